@@ -0,0 +1,131 @@
+package uint64set
+
+import (
+	"math/bits"
+)
+
+// AppendBitmapWords appends to dst the bitmap for s items in the range [lo, hi) and returns the result.
+//
+// The bitmap consists of (hi-lo+63)/64 words. Bit i of word w is set if s contains lo + w*64 + i.
+// Bits for values outside the range in the last word are always zero. lo doesn't need to be aligned to 64.
+func (s *Set) AppendBitmapWords(dst []uint64, lo, hi uint64) []uint64 {
+	if lo >= hi {
+		return dst
+	}
+	wordsCount := (hi - lo) / 64
+	if (hi-lo)%64 != 0 {
+		wordsCount++
+	}
+	dstLen := len(dst)
+	for i := uint64(0); i < wordsCount; i++ {
+		dst = append(dst, 0)
+	}
+	if s.Len() == 0 {
+		return dst
+	}
+	words := dst[dstLen:]
+	f := func(base, word uint64) bool {
+		if hi <= base || (lo > base && lo-base >= 64) {
+			// The word is outside the range.
+			return true
+		}
+		if hi-base < 64 {
+			word &= (uint64(1) << (hi - base)) - 1
+		}
+		if base < lo {
+			// The first word for unaligned lo. The shift drops bits for items smaller than lo.
+			words[0] |= word >> (lo - base)
+			return true
+		}
+		d := base - lo
+		n := d / 64
+		shift := d % 64
+		words[n] |= word << shift
+		if shift > 0 && n+1 < uint64(len(words)) {
+			words[n+1] |= word >> (64 - shift)
+		}
+		return true
+	}
+	for i := range s.buckets {
+		b32 := &s.buckets[i]
+		base32 := uint64(b32.hi) << 32
+		if hi <= base32 || (lo > base32 && lo-base32 >= 1<<32) {
+			continue
+		}
+		for j, b16 := range b32.buckets {
+			hi16 := b32.b16his[j]
+			base16 := base32 | uint64(hi16)<<16
+			if hi <= base16 || (lo > base16 && lo-base16 >= bitsPerBucket) {
+				continue
+			}
+			b16.forEachDenseWord(f, b32.hi, hi16)
+		}
+	}
+	return dst
+}
+
+// NewFromBitmap returns a set with items for the set bits in words.
+//
+// Bit i of word w corresponds to the value base + w*64 + i, so NewFromBitmap(s.AppendBitmapWords(nil, lo, hi), lo)
+// returns s items from the range [lo, hi). base doesn't need to be aligned to 64.
+// Values for the set bits in words mustn't exceed 2^64-1.
+func NewFromBitmap(words []uint64, base uint64) *Set {
+	var s Set
+	shift := base % 64
+	alignedBase := base - shift
+	wordsCount := len(words)
+	if shift > 0 {
+		// Unaligned words span an additional aligned word.
+		wordsCount++
+	}
+	getAlignedWord := func(k int) uint64 {
+		if shift == 0 {
+			return words[k]
+		}
+		var word uint64
+		if k < len(words) {
+			word = words[k] << shift
+		}
+		if k > 0 {
+			word |= words[k-1] >> (64 - shift)
+		}
+		return word
+	}
+	for k := 0; k < wordsCount; {
+		x := alignedBase + uint64(k)*64
+		wordNumStart := int(x%bitsPerBucket) / 64
+		// Process words until the end of the bucket16 containing x.
+		n := wordsPerBucket - wordNumStart
+		if n > wordsCount-k {
+			n = wordsCount - k
+		}
+		count := 0
+		for i := 0; i < n; i++ {
+			count += bits.OnesCount64(getAlignedWord(k + i))
+		}
+		if count > 0 {
+			b32 := s.getOrCreateBucket32(uint32(x >> 32))
+			b16 := b32.getOrCreateBucket16(uint16(x >> 16))
+			if count > smallPoolSize {
+				b16.makeDense()
+				for i := 0; i < n; i++ {
+					b16.bits[wordNumStart+i] = getAlignedWord(k + i)
+				}
+			} else {
+				sp := b16.smallPool[:0]
+				for i := 0; i < n; i++ {
+					word := getAlignedWord(k + i)
+					for word != 0 {
+						tzn := bits.TrailingZeros64(word)
+						word &^= uint64(1) << uint(tzn)
+						sp = append(sp, uint16((wordNumStart+i)*64+tzn))
+					}
+				}
+				b16.smallPoolLen = len(sp)
+			}
+			s.itemsCount += count
+		}
+		k += n
+	}
+	return &s
+}
@@ -0,0 +1,131 @@
+package uint64set
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestSetAppendBitmapWords(t *testing.T) {
+	f := func(a []uint64, lo, hi uint64) {
+		t.Helper()
+		var s Set
+		s.AddMulti(a)
+		prefix := []uint64{123}
+		words := s.AppendBitmapWords(prefix, lo, hi)
+		if words[0] != 123 {
+			t.Fatalf("AppendBitmapWords mustn't change the dst prefix")
+		}
+		words = words[1:]
+
+		var wordsExpected []uint64
+		if lo < hi {
+			wordsExpected = make([]uint64, (hi-lo+63)/64)
+		}
+		for _, x := range a {
+			if x >= lo && x < hi {
+				d := x - lo
+				wordsExpected[d/64] |= uint64(1) << (d % 64)
+			}
+		}
+		if len(words) != len(wordsExpected) {
+			t.Fatalf("unexpected number of words for [%d, %d); got %d; want %d", lo, hi, len(words), len(wordsExpected))
+		}
+		for i := range words {
+			if words[i] != wordsExpected[i] {
+				t.Fatalf("unexpected word #%d for [%d, %d); got %064b; want %064b", i, lo, hi, words[i], wordsExpected[i])
+			}
+		}
+	}
+	f(nil, 0, 0)
+	f(nil, 10, 5)
+	f(nil, 0, 1000)
+	f([]uint64{1, 2, 3}, 5, 5)
+	f([]uint64{0, 1, 63, 64, 127, 128, 1000}, 0, 1000)
+	f([]uint64{0, 1, 63, 64, 127, 128, 1000}, 0, 1001)
+	f([]uint64{0, 1, 63, 64, 127, 128, 1000}, 1, 129)
+	f([]uint64{0, 1, 63, 64, 127, 128, 1000}, 63, 64)
+	f([]uint64{0, 1, 63, 64, 127, 128, 1000}, 60, 70)
+	f([]uint64{1<<16 - 1, 1 << 16, 1<<32 - 1, 1 << 32}, 1<<16-3, 1<<16+5)
+	f([]uint64{1<<16 - 1, 1 << 16, 1<<32 - 1, 1 << 32}, 1<<32-100, 1<<32+100)
+	f([]uint64{1<<64 - 2, 1<<64 - 1}, 1<<64-130, 1<<64-1)
+
+	// Dense and sparse buckets
+	var a []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*3))
+	}
+	for i := 0; i < 1e3; i++ {
+		a = append(a, uint64(rand.Intn(1e7)))
+	}
+	f(a, 0, 1e5)
+	f(a, 17, 1e5+13)
+	f(a, 1<<16-31, 3<<16+65)
+	f(a, 1e6, 1e7)
+}
+
+func TestNewFromBitmap(t *testing.T) {
+	f := func(words []uint64, base uint64) {
+		t.Helper()
+		m := make(map[uint64]bool)
+		for w, word := range words {
+			for i := uint64(0); i < 64; i++ {
+				if word&(uint64(1)<<i) != 0 {
+					m[base+uint64(w)*64+i] = true
+				}
+			}
+		}
+		s := NewFromBitmap(words, base)
+		if err := expectEqual(s, m); err != nil {
+			t.Fatalf("unexpected set for base=%d: %s", base, err)
+		}
+	}
+	f(nil, 0)
+	f([]uint64{0, 0}, 123)
+	f([]uint64{1}, 0)
+	f([]uint64{1<<63 | 1, 5}, 0)
+	f([]uint64{1<<63 | 1, 5}, 7)
+	f([]uint64{1<<63 | 1, 5}, 1<<16-64)
+	f([]uint64{1<<63 | 1, 5}, 1<<16-65)
+	f([]uint64{1<<63 | 1, 5}, 1<<32-70)
+	f([]uint64{1<<63 | 1, 1<<63 | 1}, 1<<64-128)
+	f([]uint64{1<<63 | 1, 1<<62 | 1}, 1<<64-127)
+
+	// Dense words
+	words := make([]uint64, 3*wordsPerBucket)
+	for i := range words {
+		words[i] = uint64(i) * 0x9E3779B97F4A7C15
+	}
+	f(words, 0)
+	f(words, 13)
+	f(words, 5<<32-1000*64-5)
+}
+
+func TestNewFromBitmapRoundTrip(t *testing.T) {
+	f := func(a []uint64, lo, hi uint64) {
+		t.Helper()
+		var s Set
+		s.AddMulti(a)
+		words := s.AppendBitmapWords(nil, lo, hi)
+		result := NewFromBitmap(words, lo)
+		m := make(map[uint64]bool)
+		for _, x := range a {
+			if x >= lo && x < hi {
+				m[x] = true
+			}
+		}
+		if err := expectEqual(result, m); err != nil {
+			t.Fatalf("unexpected set for [%d, %d): %s", lo, hi, err)
+		}
+	}
+	var a []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*3))
+	}
+	for i := 0; i < 1e3; i++ {
+		a = append(a, uint64(rand.Intn(1e7)))
+	}
+	f(a, 0, 1e5)
+	f(a, 17, 1e5+13)
+	f(a, 1<<16-31, 3<<16+65)
+	f(a, 1e6, 1e7)
+}
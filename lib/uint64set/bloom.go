@@ -0,0 +1,145 @@
+package uint64set
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Bloom is a Bloom filter for uint64 items.
+//
+// It is obtained via Set.ToBloom and it may be serialized via MarshalBinary
+// in order to be sent to other processes as a compact probabilistic summary of the set.
+type Bloom struct {
+	hashesCount int
+	bits        []uint64
+}
+
+// The serialized Bloom filter has the following layout:
+//
+//   - 4 bytes of bloomMagic
+//   - 1 byte with bloomVersion
+//   - 1 byte with the number of hashes per item
+//   - 2 reserved zero bytes
+//   - 8 bytes with the number of 64-bit words in bits array
+//   - bits array; 8 bytes per word
+//
+// All the integers are stored in little-endian order.
+const (
+	bloomMagic      = "U64B"
+	bloomVersion    = 1
+	bloomHeaderSize = 16
+)
+
+// ToBloom returns a Bloom filter containing all the items from s.
+//
+// The filter is sized for s.Len() items, so Bloom.Has returns true for missing items with the probability
+// close to falsePositiveRate. falsePositiveRate must be in the range (0..1).
+func (s *Set) ToBloom(falsePositiveRate float64) *Bloom {
+	if !(falsePositiveRate > 0 && falsePositiveRate < 1) {
+		panic(fmt.Errorf("BUG: falsePositiveRate must be in the range (0..1); got %v", falsePositiveRate))
+	}
+	n := s.Len()
+	if n == 0 {
+		n = 1
+	}
+	// See https://en.wikipedia.org/wiki/Bloom_filter#Optimal_number_of_hash_functions
+	bitsCount := math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashesCount := int(math.Round(bitsCount / float64(n) * math.Ln2))
+	if hashesCount < 1 {
+		hashesCount = 1
+	}
+	if hashesCount > math.MaxUint8 {
+		hashesCount = math.MaxUint8
+	}
+	bf := &Bloom{
+		hashesCount: hashesCount,
+		bits:        make([]uint64, (int(bitsCount)+63)/64),
+	}
+	s.ForEach(func(part []uint64) bool {
+		for _, x := range part {
+			bf.add(x)
+		}
+		return true
+	})
+	return bf
+}
+
+// Has returns true if x may exist in the set bf has been created from.
+//
+// False is returned if x is guaranteed to be missing in the set.
+func (bf *Bloom) Has(x uint64) bool {
+	h1, h2 := getBloomHashes(x)
+	maxBits := uint64(len(bf.bits)) * 64
+	for i := 0; i < bf.hashesCount; i++ {
+		idx := (h1 + uint64(i)*h2) % maxBits
+		if bf.bits[idx/64]&(uint64(1)<<(idx%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (bf *Bloom) add(x uint64) {
+	h1, h2 := getBloomHashes(x)
+	maxBits := uint64(len(bf.bits)) * 64
+	for i := 0; i < bf.hashesCount; i++ {
+		idx := (h1 + uint64(i)*h2) % maxBits
+		bf.bits[idx/64] |= uint64(1) << (idx % 64)
+	}
+}
+
+// getBloomHashes returns a pair of hashes for x, which are used for generating hashesCount hashes
+// according to https://www.eecs.harvard.edu/~michaelm/postscripts/rsa2008.pdf
+//
+// The hashes don't depend on the CPU byte order, so the serialized filter may be used on any CPU.
+func getBloomHashes(x uint64) (uint64, uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], x)
+	h := xxhash.Sum64(buf[:])
+	return h, bits.RotateLeft64(h, 32) | 1
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (bf *Bloom) MarshalBinary() ([]byte, error) {
+	dst := make([]byte, 0, bloomHeaderSize+8*len(bf.bits))
+	dst = append(dst, bloomMagic...)
+	dst = append(dst, bloomVersion, byte(bf.hashesCount), 0, 0)
+	dst = marshalUint64(dst, uint64(len(bf.bits)))
+	for _, word := range bf.bits {
+		dst = marshalUint64(dst, word)
+	}
+	return dst, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (bf *Bloom) UnmarshalBinary(data []byte) error {
+	if len(data) < bloomHeaderSize {
+		return fmt.Errorf("cannot unmarshal bloom filter header: too short data; got %d bytes; want at least %d bytes", len(data), bloomHeaderSize)
+	}
+	if string(data[:len(bloomMagic)]) != bloomMagic {
+		return fmt.Errorf("cannot unmarshal bloom filter header: unexpected magic; got %q; want %q", data[:len(bloomMagic)], bloomMagic)
+	}
+	if version := data[4]; version != bloomVersion {
+		return fmt.Errorf("cannot unmarshal bloom filter header: unsupported version: %d; supported version: %d", version, bloomVersion)
+	}
+	hashesCount := int(data[5])
+	if hashesCount == 0 {
+		return fmt.Errorf("cannot unmarshal bloom filter header: the number of hashes cannot be zero")
+	}
+	wordsCount := binary.LittleEndian.Uint64(data[8:])
+	src := data[bloomHeaderSize:]
+	if wordsCount == 0 || wordsCount != uint64(len(src)/8) || len(src)%8 != 0 {
+		return fmt.Errorf("cannot unmarshal bloom filter: unexpected size of bits array; got %d bytes; header says %d words", len(src), wordsCount)
+	}
+	a := make([]uint64, wordsCount)
+	for i := range a {
+		a[i] = binary.LittleEndian.Uint64(src[8*i:])
+	}
+	bf.hashesCount = hashesCount
+	bf.bits = a
+	return nil
+}
@@ -0,0 +1,95 @@
+package uint64set
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestSetToBloom(t *testing.T) {
+	f := func(itemsCount int, falsePositiveRate float64) {
+		t.Helper()
+		rng := rand.New(rand.NewSource(0))
+		var s Set
+		for s.Len() < itemsCount {
+			s.Add(uint64(rng.Intn(10 * itemsCount)))
+		}
+		bf := s.ToBloom(falsePositiveRate)
+
+		// Verify the filter survives serialization.
+		data, err := bf.MarshalBinary()
+		if err != nil {
+			t.Fatalf("unexpected error in MarshalBinary: %s", err)
+		}
+		var bf2 Bloom
+		if err := bf2.UnmarshalBinary(data); err != nil {
+			t.Fatalf("unexpected error in UnmarshalBinary: %s", err)
+		}
+
+		for _, bf := range []*Bloom{bf, &bf2} {
+			s.ForEach(func(part []uint64) bool {
+				for _, x := range part {
+					if !bf.Has(x) {
+						t.Fatalf("missing item %d in the bloom filter", x)
+					}
+				}
+				return true
+			})
+
+			// Measure the false positive rate on missing items.
+			const checksCount = 1e5
+			falsePositives := 0
+			for i := 0; i < checksCount; i++ {
+				x := uint64(rng.Int63()) | 1<<63
+				if bf.Has(x) {
+					falsePositives++
+				}
+			}
+			rate := float64(falsePositives) / checksCount
+			if rate > 1.5*falsePositiveRate {
+				t.Fatalf("too high false positive rate for %d items; got %.5f; want %.5f", itemsCount, rate, falsePositiveRate)
+			}
+		}
+	}
+	f(0, 0.01)
+	f(1, 0.01)
+	f(1000, 0.1)
+	f(1e4, 0.01)
+	f(1e5, 0.001)
+	f(1e5, 0.3)
+}
+
+func TestBloomUnmarshalBinaryFailure(t *testing.T) {
+	f := func(data []byte, errExpected string) {
+		t.Helper()
+		var bf Bloom
+		err := bf.UnmarshalBinary(data)
+		if err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		if !strings.Contains(err.Error(), errExpected) {
+			t.Fatalf("unexpected error; got %q; want containing %q", err, errExpected)
+		}
+	}
+	var s Set
+	s.AddMulti([]uint64{1, 2, 3})
+	data, err := s.ToBloom(0.01).MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error in MarshalBinary: %s", err)
+	}
+
+	f(nil, "too short data")
+	f(append([]byte("FOOO"), data[4:]...), "unexpected magic")
+
+	dataBadVersion := append([]byte{}, data...)
+	dataBadVersion[4] = bloomVersion + 1
+	f(dataBadVersion, "unsupported version")
+
+	dataBadHashes := append([]byte{}, data...)
+	dataBadHashes[5] = 0
+	f(dataBadHashes, "the number of hashes cannot be zero")
+
+	f(data[:len(data)-8], "unexpected size of bits array")
+	f(data[:len(data)-1], "unexpected size of bits array")
+	f(data[:bloomHeaderSize], "unexpected size of bits array")
+}
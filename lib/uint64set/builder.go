@@ -0,0 +1,43 @@
+package uint64set
+
+// SetBuilder builds a Set with the representation chosen in advance for every region of items.
+//
+// By default a Set starts every bucket with 2^16 items as a small pool and switches it to bits array
+// when the small pool becomes full. SetBuilder allocates bits arrays for the regions hinted via HintDense,
+// so the items from these regions are added without switching the representation.
+//
+// SetBuilder methods mustn't be called from concurrent goroutines.
+type SetBuilder struct {
+	s Set
+}
+
+// HintDense marks the range [lo, hi) as densely populated.
+//
+// Bits arrays are allocated for all the buckets with 2^16 items, which intersect the range.
+// Call HintDense before adding items from the range in order to avoid switching the representation
+// of the corresponding buckets. See Set.ReserveDense for details.
+func (sb *SetBuilder) HintDense(lo, hi uint64) {
+	sb.s.ReserveDense(lo, hi)
+}
+
+// Add adds x to the set built by sb.
+func (sb *SetBuilder) Add(x uint64) {
+	sb.s.Add(x)
+}
+
+// AddMulti adds all the items from a to the set built by sb.
+//
+// AddMulti works faster if a is sorted.
+func (sb *SetBuilder) AddMulti(a []uint64) {
+	sb.s.AddMulti(a)
+}
+
+// Build returns the set with all the items added to sb.
+//
+// sb is reset after the call, so it can be used for building another set.
+func (sb *SetBuilder) Build() *Set {
+	var s Set
+	s.moveFrom(&sb.s)
+	sb.s = Set{}
+	return &s
+}
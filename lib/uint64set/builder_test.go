@@ -0,0 +1,61 @@
+package uint64set
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestSetBuilder(t *testing.T) {
+	var sb SetBuilder
+	f := func(hints [][2]uint64, a []uint64) {
+		t.Helper()
+		m := make(map[uint64]bool)
+		for _, h := range hints {
+			sb.HintDense(h[0], h[1])
+		}
+		for i, x := range a {
+			if i%2 == 0 {
+				sb.Add(x)
+			} else {
+				sb.AddMulti([]uint64{x})
+			}
+			m[x] = true
+		}
+		s := sb.Build()
+		if err := expectEqual(s, m); err != nil {
+			t.Fatalf("unexpected set: %s", err)
+		}
+
+		// Verify hinted buckets are dense, while the remaining buckets are small.
+		for i := range s.buckets {
+			b32 := &s.buckets[i]
+			for j, b16 := range b32.buckets {
+				base := uint64(b32.hi)<<32 | uint64(b32.b16his[j])<<16
+				hinted := false
+				for _, h := range hints {
+					if h[0] < base+bitsPerBucket && h[1] > base {
+						hinted = true
+					}
+				}
+				if hinted && b16.bits == nil {
+					t.Fatalf("bucket at %d must be dense", base)
+				}
+				if !hinted && b16.bits != nil && b16.getLen() <= smallPoolSize {
+					t.Fatalf("bucket at %d must be small", base)
+				}
+			}
+		}
+	}
+	f(nil, nil)
+	f(nil, []uint64{3, 2, 1, 1 << 32})
+	f([][2]uint64{{0, 10}}, []uint64{3, 2, 1, 1 << 32})
+
+	// Mixed density
+	rng := rand.New(rand.NewSource(0))
+	var a []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(rng.Intn(1e5)), 1<<32+uint64(rng.Intn(1e7)))
+	}
+	f([][2]uint64{{0, 1e5}}, a)
+	f([][2]uint64{{0, 1e5}, {1 << 40, 1<<40 + 1}}, a)
+}
@@ -0,0 +1,76 @@
+package uint64set
+
+import (
+	"context"
+	"sort"
+)
+
+// chanBatchSize is the number of items AddFromChan buffers before adding them to the set.
+const chanBatchSize = 4096
+
+// AddFromChan adds all the items read from ch to s.
+//
+// It returns after ch is closed. Items are added in sorted batches,
+// so it is usually faster than calling s.Add() for each item read from ch.
+func (s *Set) AddFromChan(ch <-chan uint64) {
+	_ = s.AddFromChanContext(context.Background(), ch)
+}
+
+// AddFromChanContext adds all the items read from ch to s until ch is closed or ctx is canceled.
+//
+// The items read from ch before ctx cancelation are added to s. ctx.Err() is returned on cancelation.
+func (s *Set) AddFromChanContext(ctx context.Context, ch <-chan uint64) error {
+	s.checkWritable()
+	s.trackedSizeBytes = 0
+	xbuf := partBufPool.Get().(*[]uint64)
+	buf := (*xbuf)[:0]
+	flush := func() {
+		sort.Sort((*uint64Sorter)(&buf))
+		s.AddMulti(buf)
+		buf = buf[:0]
+	}
+	var err error
+	done := ctx.Done()
+	if done == nil {
+		// Fast path - ctx cannot be canceled, so there is no need in select per each item.
+		for x := range ch {
+			buf = append(buf, x)
+			if len(buf) >= chanBatchSize {
+				flush()
+			}
+		}
+	} else {
+	loop:
+		for {
+			select {
+			case x, ok := <-ch:
+				if !ok {
+					break loop
+				}
+				buf = append(buf, x)
+				if len(buf) >= chanBatchSize {
+					flush()
+				}
+			case <-done:
+				err = ctx.Err()
+				break loop
+			}
+		}
+	}
+	flush()
+	*xbuf = buf
+	partBufPool.Put(xbuf)
+	return err
+}
+
+type uint64Sorter []uint64
+
+func (us *uint64Sorter) Len() int { return len(*us) }
+func (us *uint64Sorter) Less(i, j int) bool {
+	a := *us
+	return a[i] < a[j]
+}
+func (us *uint64Sorter) Swap(i, j int) {
+	a := *us
+	a[i], a[j] = a[j], a[i]
+}
@@ -0,0 +1,71 @@
+package uint64set
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+)
+
+func TestSetAddFromChan(t *testing.T) {
+	f := func(a []uint64) {
+		t.Helper()
+		m := make(map[uint64]bool)
+		ch := make(chan uint64, 100)
+		go func() {
+			for _, x := range a {
+				ch <- x
+			}
+			close(ch)
+		}()
+		var s Set
+		s.Add(123)
+		m[123] = true
+		for _, x := range a {
+			m[x] = true
+		}
+		s.AddFromChan(ch)
+		if err := expectEqual(&s, m); err != nil {
+			t.Fatalf("unexpected set after AddFromChan: %s", err)
+		}
+	}
+	f(nil)
+	f([]uint64{1})
+	f([]uint64{5, 4, 3, 1 << 16, 1 << 32, 2 << 32, 1<<64 - 1, 3})
+
+	var a []uint64
+	for i := 0; i < 3*chanBatchSize+10; i++ {
+		a = append(a, uint64(i)*3)
+	}
+	f(a)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1e4; i++ {
+		a = append(a, r.Uint64())
+	}
+	f(a)
+}
+
+func TestSetAddFromChanContext(t *testing.T) {
+	ch := make(chan uint64)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for i := 0; i < 10; i++ {
+			ch <- uint64(i)
+		}
+		cancel()
+	}()
+	var s Set
+	err := s.AddFromChanContext(ctx, ch)
+	if err != context.Canceled {
+		t.Fatalf("unexpected error; got %v; want %v", err, context.Canceled)
+	}
+	// All the items sent before cancelation must be added to s, since ch is unbuffered.
+	if n := s.Len(); n != 10 {
+		t.Fatalf("unexpected number of items; got %d; want 10", n)
+	}
+
+	// Closed channel
+	close(ch)
+	if err := s.AddFromChanContext(context.Background(), ch); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,105 @@
+package uint64set
+
+// FrozenSet is an immutable set of uint64 items.
+//
+// It is obtained via Set.Freeze. All the FrozenSet methods may be called from concurrent goroutines
+// without locks, since they never modify the FrozenSet. This makes FrozenSet suitable
+// for broadcasting a computed set to many read-only consumers.
+type FrozenSet struct {
+	s *Set
+}
+
+// Freeze returns an immutable copy of s.
+//
+// The copy is compacted, all the buckets in it are sorted and dense bits arrays are packed
+// into a single memory chunk, so the returned FrozenSet never needs lazy modifications on reads.
+// s isn't modified and it may be modified after the call without affecting the returned FrozenSet.
+func (s *Set) Freeze() *FrozenSet {
+	sc := s.Clone()
+	sc.Optimize()
+	sc.SortNow()
+	denseCount := 0
+	for i := range sc.buckets {
+		for _, b16 := range sc.buckets[i].buckets {
+			if b16.bits != nil {
+				denseCount++
+			}
+		}
+	}
+	if denseCount > 0 {
+		bitsChunk := make([][wordsPerBucket]uint64, denseCount)
+		n := 0
+		for i := range sc.buckets {
+			for _, b16 := range sc.buckets[i].buckets {
+				if b16.bits != nil {
+					bitsChunk[n] = *b16.bits
+					b16.bits = &bitsChunk[n]
+					n++
+				}
+			}
+		}
+	}
+	sc.opts = setOptions{
+		keepSorted: true,
+		readOnly:   true,
+	}
+	return &FrozenSet{
+		s: sc,
+	}
+}
+
+// Len returns the number of items in fs.
+func (fs *FrozenSet) Len() int {
+	return fs.s.Len()
+}
+
+// Has verifies whether x exists in fs.
+func (fs *FrozenSet) Has(x uint64) bool {
+	return fs.s.Has(x)
+}
+
+// ForEach calls f for all the items stored in fs in ascending order.
+//
+// Every part contains sorted items, which are bigger than the items in all the previous parts.
+// The iteration is stopped if f returns false.
+func (fs *FrozenSet) ForEach(f func(part []uint64) bool) {
+	fs.s.ForEach(f)
+}
+
+// Min returns the minimum item in fs.
+//
+// false is returned if fs is empty.
+func (fs *FrozenSet) Min() (uint64, bool) {
+	bs := fs.s.buckets
+	if len(bs) == 0 {
+		return 0, false
+	}
+	// Freeze removes empty buckets, so the first bucket contains the minimum item.
+	return bs[0].min()
+}
+
+// Max returns the maximum item in fs.
+//
+// false is returned if fs is empty.
+func (fs *FrozenSet) Max() (uint64, bool) {
+	bs := fs.s.buckets
+	if len(bs) == 0 {
+		return 0, false
+	}
+	// Freeze removes empty buckets, so the last bucket contains the maximum item.
+	return bs[len(bs)-1].max()
+}
+
+// IntersectCount returns the number of items, which exist in both fs and a.
+//
+// a mustn't be modified during the call.
+func (fs *FrozenSet) IntersectCount(a *Set) int {
+	return fs.s.intersectCount(a)
+}
+
+// Clone returns a modifiable copy of fs.
+func (fs *FrozenSet) Clone() *Set {
+	sc := fs.s.Clone()
+	sc.opts = setOptions{}
+	return sc
+}
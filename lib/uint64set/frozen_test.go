@@ -0,0 +1,167 @@
+package uint64set
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestSetFreeze(t *testing.T) {
+	f := func(a []uint64) {
+		t.Helper()
+		var s Set
+		m := make(map[uint64]bool)
+		for _, x := range a {
+			s.Add(x)
+			m[x] = true
+		}
+		// Delete some items in order to verify empty buckets are handled properly.
+		for i, x := range a {
+			if i%3 == 0 {
+				s.Del(x)
+				delete(m, x)
+			}
+		}
+		itemsExpected := s.AppendTo(nil)
+		fs := s.Freeze()
+
+		// Modify s and verify this doesn't affect fs.
+		s.Add(1 << 63)
+		s.Del(itemsExpected[len(itemsExpected)/2])
+
+		if n := fs.Len(); n != len(m) {
+			t.Fatalf("unexpected Len(); got %d; want %d", n, len(m))
+		}
+		for x := range m {
+			if !fs.Has(x) {
+				t.Fatalf("missing item %d", x)
+			}
+		}
+		if fs.Has(1 << 63) {
+			t.Fatalf("unexpected item %d", uint64(1<<63))
+		}
+		var items []uint64
+		fs.ForEach(func(part []uint64) bool {
+			items = append(items, part...)
+			return true
+		})
+		if err := checkSameItems(items, itemsExpected); err != nil {
+			t.Fatalf("unexpected items passed to ForEach: %s", err)
+		}
+		minValue, ok := fs.Min()
+		if !ok || minValue != itemsExpected[0] {
+			t.Fatalf("unexpected Min(); got %d, %v; want %d, true", minValue, ok, itemsExpected[0])
+		}
+		maxValue, ok := fs.Max()
+		if !ok || maxValue != itemsExpected[len(itemsExpected)-1] {
+			t.Fatalf("unexpected Max(); got %d, %v; want %d, true", maxValue, ok, itemsExpected[len(itemsExpected)-1])
+		}
+		if n := fs.IntersectCount(&s); n != len(m)-1 {
+			t.Fatalf("unexpected IntersectCount(); got %d; want %d", n, len(m)-1)
+		}
+
+		// Verify the clone can be modified.
+		sc := fs.Clone()
+		sc.Add(12345)
+		m[12345] = true
+		if err := expectEqual(sc, m); err != nil {
+			t.Fatalf("unexpected clone of fs: %s", err)
+		}
+		if fs.Len() != len(itemsExpected) {
+			t.Fatalf("fs mustn't change after modifying its clone")
+		}
+	}
+	f([]uint64{1, 2, 3})
+	f([]uint64{0, 1<<64 - 1, 1 << 32})
+	f([]uint64{5<<32 | 123, 1<<32 | 456, 3<<32 | 1<<20, 1<<32 | 1<<17 + 5})
+
+	// Dense buckets
+	var a []uint64
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(rng.Intn(5))<<32|uint64(rng.Intn(1<<18)))
+	}
+	f(a)
+
+	// Empty sets
+	for _, s := range []*Set{nil, {}, Empty()} {
+		fs := s.Freeze()
+		if n := fs.Len(); n != 0 {
+			t.Fatalf("unexpected Len() for empty set; got %d; want 0", n)
+		}
+		if _, ok := fs.Min(); ok {
+			t.Fatalf("Min() must return false for empty set")
+		}
+		if _, ok := fs.Max(); ok {
+			t.Fatalf("Max() must return false for empty set")
+		}
+		fs.ForEach(func(part []uint64) bool {
+			t.Fatalf("f mustn't be called for empty set")
+			return true
+		})
+	}
+}
+
+func TestFrozenSetConcurrentReads(t *testing.T) {
+	var s Set
+	for i := 0; i < 1e5; i++ {
+		// Put items in reverse order into each bucket16, so small pools aren't sorted.
+		s.Add(uint64(i%5)<<32 | uint64(1e5-i)*uint64(i%3+1))
+	}
+	itemsExpected := s.AppendTo(nil)
+	fs := s.Freeze()
+	var sa Set
+	for _, x := range itemsExpected[:1000] {
+		sa.Add(x)
+	}
+
+	const concurrency = 8
+	var wg sync.WaitGroup
+	errCh := make(chan error, concurrency)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				var items []uint64
+				fs.ForEach(func(part []uint64) bool {
+					items = append(items, part...)
+					return true
+				})
+				if err := checkSameItems(items, itemsExpected); err != nil {
+					errCh <- fmt.Errorf("unexpected items passed to ForEach: %w", err)
+					return
+				}
+				for _, x := range itemsExpected[:1000] {
+					if !fs.Has(x) {
+						errCh <- fmt.Errorf("missing item %d", x)
+						return
+					}
+				}
+				if n := fs.IntersectCount(&sa); n != 1000 {
+					errCh <- fmt.Errorf("unexpected IntersectCount(); got %d; want 1000", n)
+					return
+				}
+				if x, _ := fs.Min(); x != itemsExpected[0] {
+					errCh <- fmt.Errorf("unexpected Min(); got %d; want %d", x, itemsExpected[0])
+					return
+				}
+				if x, _ := fs.Max(); x != itemsExpected[len(itemsExpected)-1] {
+					errCh <- fmt.Errorf("unexpected Max(); got %d; want %d", x, itemsExpected[len(itemsExpected)-1])
+					return
+				}
+			}
+		}()
+	}
+	// Modify the original set concurrently with reading fs.
+	for i := 0; i < 1e4; i++ {
+		s.Add(uint64(i) << 40)
+		s.Del(itemsExpected[i])
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatal(err)
+	}
+}
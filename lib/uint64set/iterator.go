@@ -0,0 +1,235 @@
+package uint64set
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// Iterator iterates over Set items.
+//
+// Iterator is obtained via Set.Iterator or Set.ReverseIterator.
+// The set mustn't be modified while iterating over its items.
+type Iterator struct {
+	s       *Set
+	reverse bool
+
+	// i32 and i16 are the positions of the next bucket32 and bucket16 to visit
+	// counting in the iteration direction.
+	i32 int
+	i16 int
+
+	// hi64 contains the high 48 bits of the items in the current bucket16.
+	hi64 uint64
+
+	// sps contains sorted small pool items for the current bucket16.
+	sps      smallPoolSorter
+	smallPos int
+
+	// bits points to the bits array for the current bucket16 if it is dense.
+	bits *[wordsPerBucket]uint64
+
+	// wordNum is the position of the next word to visit in bits counting in the iteration direction.
+	wordNum int
+
+	// word contains the remaining bits for the current word, while wordBase contains the item for its zero bit.
+	word     uint64
+	wordBase uint64
+}
+
+// Iterator returns an iterator over s items in ascending order.
+//
+// Iterator can mutate s.
+func (s *Set) Iterator() *Iterator {
+	return s.newIterator(false)
+}
+
+// ReverseIterator returns an iterator over s items in descending order.
+//
+// ReverseIterator can mutate s.
+func (s *Set) ReverseIterator() *Iterator {
+	return s.newIterator(true)
+}
+
+// All returns a function, which calls yield for all the s items in ascending order.
+//
+// The returned function stops calling yield when it returns false. It has the signature of iter.Seq[uint64],
+// so it can be used in range-over-func loops and with iterator helpers from the standard library
+// when building with Go 1.23 or newer: for x := range s.All() {...}.
+//
+// All can mutate s. The set mustn't be modified while iterating over its items.
+func (s *Set) All() func(yield func(uint64) bool) {
+	return s.seq(false)
+}
+
+// Backward works like All, but it calls yield for all the s items in descending order.
+func (s *Set) Backward() func(yield func(uint64) bool) {
+	return s.seq(true)
+}
+
+// AddFromSeq adds all the items from seq to s.
+//
+// seq has the signature of iter.Seq[uint64], so it may be obtained from All or Backward of another set
+// or from iterator helpers of the standard library such as slices.Values when building with Go 1.23 or newer.
+// Items are added in batches, so it is usually faster than calling s.Add() for each item from seq.
+// Use AddFromSortedSeq if seq yields items in ascending order.
+//
+// s is modified while seq is running, so seq mustn't iterate over s items, e.g. s.AddFromSeq(s.All()) isn't allowed.
+func (s *Set) AddFromSeq(seq func(yield func(uint64) bool)) {
+	s.checkWritable()
+	s.trackedSizeBytes = 0
+	xbuf := partBufPool.Get().(*[]uint64)
+	buf := (*xbuf)[:0]
+	seq(func(x uint64) bool {
+		buf = append(buf, x)
+		if len(buf) >= chanBatchSize {
+			s.AddMulti(buf)
+			buf = buf[:0]
+		}
+		return true
+	})
+	s.AddMulti(buf)
+	*xbuf = buf
+	partBufPool.Put(xbuf)
+}
+
+// AddFromSortedSeq adds all the items from seq to s.
+//
+// It works faster than AddFromSeq if seq yields items in ascending order, since every bucket
+// is looked up only once then and items are added without buffering.
+// Unsorted items are added correctly too, but slower.
+//
+// s is modified while seq is running, so seq mustn't iterate over s items. See AddFromSeq.
+func (s *Set) AddFromSortedSeq(seq func(yield func(uint64) bool)) {
+	s.checkWritable()
+	s.trackedSizeBytes = 0
+	var b32 *bucket32
+	var b16 *bucket16
+	prefix := uint64(0)
+	seq(func(x uint64) bool {
+		if p := x >> 16; b16 == nil || p != prefix {
+			if hi := uint32(x >> 32); b32 == nil || b32.hi != hi {
+				b32 = s.getOrCreateBucket32(hi)
+			}
+			b16 = b32.getOrCreateBucket16(uint16(p))
+			if s.opts.alwaysDense {
+				b16.makeDense()
+			}
+			prefix = p
+		}
+		if b16.add(uint16(x)) {
+			s.itemsCount++
+		}
+		return true
+	})
+}
+
+func (s *Set) seq(reverse bool) func(yield func(uint64) bool) {
+	return func(yield func(uint64) bool) {
+		it := s.newIterator(reverse)
+		for {
+			x, ok := it.Next()
+			if !ok || !yield(x) {
+				return
+			}
+		}
+	}
+}
+
+func (s *Set) newIterator(reverse bool) *Iterator {
+	if s != nil {
+		s.sort()
+	}
+	return &Iterator{
+		s:       s,
+		reverse: reverse,
+	}
+}
+
+// Next returns the next item from the set.
+//
+// false is returned when there are no more items.
+func (it *Iterator) Next() (uint64, bool) {
+	for {
+		if x, ok := it.nextInBucket16(); ok {
+			return x, true
+		}
+		if !it.nextBucket16() {
+			return 0, false
+		}
+	}
+}
+
+// pos converts the position i counted in the iteration direction to the index in a slice with n items.
+func (it *Iterator) pos(i, n int) int {
+	if it.reverse {
+		return n - 1 - i
+	}
+	return i
+}
+
+func (it *Iterator) nextBucket16() bool {
+	if it.s == nil {
+		return false
+	}
+	buckets := it.s.buckets
+	for it.i32 < len(buckets) {
+		b32 := &buckets[it.pos(it.i32, len(buckets))]
+		if it.i16 >= len(b32.buckets) {
+			it.i32++
+			it.i16 = 0
+			continue
+		}
+		n := it.pos(it.i16, len(b32.buckets))
+		it.i16++
+		it.loadBucket16(b32.buckets[n], b32.hi, b32.b16his[n])
+		return true
+	}
+	return false
+}
+
+func (it *Iterator) loadBucket16(b *bucket16, hi uint32, hi16 uint16) {
+	it.hi64 = uint64(hi)<<32 | uint64(hi16)<<16
+	it.bits = b.bits
+	it.wordNum = 0
+	it.word = 0
+	it.smallPos = 0
+	if b.bits != nil {
+		it.sps.a = it.sps.smallPool[:0]
+		return
+	}
+	// Sort a copy of b.smallPool, since b must be readonly for iteration.
+	it.sps.smallPool = b.smallPool
+	it.sps.a = it.sps.smallPool[:b.smallPoolLen]
+	if len(it.sps.a) > 1 && !sort.IsSorted(&it.sps) {
+		sort.Sort(&it.sps)
+	}
+}
+
+func (it *Iterator) nextInBucket16() (uint64, bool) {
+	if it.bits == nil {
+		a := it.sps.a
+		if it.smallPos >= len(a) {
+			return 0, false
+		}
+		x := it.hi64 | uint64(a[it.pos(it.smallPos, len(a))])
+		it.smallPos++
+		return x, true
+	}
+	for it.word == 0 {
+		if it.wordNum >= wordsPerBucket {
+			return 0, false
+		}
+		n := it.pos(it.wordNum, wordsPerBucket)
+		it.wordNum++
+		it.word = it.bits[n]
+		it.wordBase = it.hi64 | uint64(n)*64
+	}
+	var n uint64
+	if it.reverse {
+		n = 63 - uint64(bits.LeadingZeros64(it.word))
+	} else {
+		n = uint64(bits.TrailingZeros64(it.word))
+	}
+	it.word &^= uint64(1) << n
+	return it.wordBase | n, true
+}
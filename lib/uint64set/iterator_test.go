@@ -0,0 +1,221 @@
+package uint64set
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestSetIterator(t *testing.T) {
+	f := func(a []uint64) {
+		t.Helper()
+		var s Set
+		s.AddMulti(a)
+		s.Add(a[0])
+		expected := s.AppendTo(nil)
+
+		var result []uint64
+		it := s.Iterator()
+		for {
+			x, ok := it.Next()
+			if !ok {
+				break
+			}
+			result = append(result, x)
+		}
+		if err := checkSameItems(result, expected); err != nil {
+			t.Fatalf("unexpected items from Iterator: %s", err)
+		}
+		if _, ok := it.Next(); ok {
+			t.Fatalf("Next must return false after the end of iteration")
+		}
+
+		result = result[:0]
+		it = s.ReverseIterator()
+		for {
+			x, ok := it.Next()
+			if !ok {
+				break
+			}
+			result = append(result, x)
+		}
+		for i, j := 0, len(expected)-1; i < j; i, j = i+1, j-1 {
+			expected[i], expected[j] = expected[j], expected[i]
+		}
+		if err := checkSameItems(result, expected); err != nil {
+			t.Fatalf("unexpected items from ReverseIterator: %s", err)
+		}
+	}
+	f([]uint64{0})
+	f([]uint64{1<<64 - 1})
+	f([]uint64{5, 3, 1, 1 << 16, 1<<16 + 63, 1<<16 + 64, 1 << 32, 3<<32 + 7, 1<<64 - 1})
+
+	// Dense buckets
+	var a []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*3))
+	}
+	f(a)
+
+	// Mixed small and dense buckets
+	a = a[:0]
+	for i := 0; i < 1e4; i++ {
+		a = append(a, uint64(rand.Int63n(1e6)), uint64(rand.Int63()))
+	}
+	f(a)
+
+	// Sparse buckets with deleted items
+	var s Set
+	for i := 0; i < 100; i++ {
+		s.Add(uint64(i) << 32)
+		s.Add(uint64(i) << 16)
+	}
+	for i := 0; i < 100; i += 2 {
+		s.Del(uint64(i) << 32)
+		s.Del(uint64(i) << 16)
+	}
+	f(s.AppendTo(nil))
+
+	// Verify empty and nil sets
+	var sEmpty Set
+	if _, ok := sEmpty.Iterator().Next(); ok {
+		t.Fatalf("Iterator must return no items for empty set")
+	}
+	var sNil *Set
+	if _, ok := sNil.ReverseIterator().Next(); ok {
+		t.Fatalf("ReverseIterator must return no items for nil set")
+	}
+}
+
+func TestSetAllBackward(t *testing.T) {
+	f := func(a []uint64) {
+		t.Helper()
+		var s Set
+		s.AddMulti(a)
+		expected := s.AppendTo(nil)
+
+		var result []uint64
+		s.All()(func(x uint64) bool {
+			result = append(result, x)
+			return true
+		})
+		if err := checkSameItems(result, expected); err != nil {
+			t.Fatalf("unexpected items from All: %s", err)
+		}
+
+		result = result[:0]
+		s.Backward()(func(x uint64) bool {
+			result = append(result, x)
+			return true
+		})
+		reversed := append([]uint64{}, expected...)
+		for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+			reversed[i], reversed[j] = reversed[j], reversed[i]
+		}
+		if err := checkSameItems(result, reversed); err != nil {
+			t.Fatalf("unexpected items from Backward: %s", err)
+		}
+
+		// Verify stopping the iteration
+		for _, limit := range []int{1, (len(expected) + 1) / 2} {
+			result = result[:0]
+			s.All()(func(x uint64) bool {
+				result = append(result, x)
+				return len(result) < limit
+			})
+			if err := checkSameItems(result, expected[:limit]); err != nil {
+				t.Fatalf("unexpected items from All stopped after %d items: %s", limit, err)
+			}
+			result = result[:0]
+			s.Backward()(func(x uint64) bool {
+				result = append(result, x)
+				return len(result) < limit
+			})
+			if err := checkSameItems(result, reversed[:limit]); err != nil {
+				t.Fatalf("unexpected items from Backward stopped after %d items: %s", limit, err)
+			}
+		}
+	}
+	f([]uint64{0})
+	f([]uint64{1<<64 - 1})
+	f([]uint64{5, 3, 1, 1 << 16, 1<<16 + 63, 1 << 32, 3<<32 + 7, 1<<64 - 1})
+
+	var a []uint64
+	for i := 0; i < 1e4; i++ {
+		a = append(a, uint64(rand.Int63n(1e5)), uint64(rand.Int63()))
+	}
+	f(a)
+
+	// Verify nil set
+	var sNil *Set
+	sNil.All()(func(x uint64) bool {
+		t.Fatalf("All must return no items for nil set")
+		return false
+	})
+}
+
+func TestSetAddFromSeq(t *testing.T) {
+	f := func(a []uint64) {
+		t.Helper()
+		m := make(map[uint64]bool)
+		for _, x := range a {
+			m[x] = true
+		}
+		seq := func(yield func(uint64) bool) {
+			for _, x := range a {
+				if !yield(x) {
+					return
+				}
+			}
+		}
+		var s Set
+		s.Add(a[0])
+		s.AddFromSeq(seq)
+		if err := expectEqual(&s, m); err != nil {
+			t.Fatalf("unexpected set after AddFromSeq: %s", err)
+		}
+		var sSorted Set
+		sSorted.AddFromSortedSeq(seq)
+		if err := expectEqual(&sSorted, m); err != nil {
+			t.Fatalf("unexpected set after AddFromSortedSeq for unsorted items: %s", err)
+		}
+
+		// Verify sets composed via All and Backward
+		var s2 Set
+		s2.AddFromSortedSeq(s.All())
+		if !s2.Equal(&s) {
+			t.Fatalf("unexpected set after AddFromSortedSeq(s.All())")
+		}
+		var s3 Set
+		s3.SetAlwaysDense(true)
+		s3.AddFromSeq(s.Backward())
+		if !s3.Equal(&s) {
+			t.Fatalf("unexpected set after AddFromSeq(s.Backward())")
+		}
+	}
+	f([]uint64{0})
+	f([]uint64{1<<64 - 1})
+	f([]uint64{5, 3, 1, 1, 1 << 16, 1<<16 + 63, 1 << 32, 3<<32 + 7, 1<<64 - 1})
+
+	var a []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*3))
+	}
+	f(a)
+	for i := 0; i < 1e4; i++ {
+		a = append(a, uint64(rand.Int63n(1e6)), uint64(rand.Int63()))
+	}
+	f(a)
+}
+
+func checkSameItems(a, b []uint64) error {
+	if len(a) != len(b) {
+		return fmt.Errorf("unexpected number of items; got %d; want %d", len(a), len(b))
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return fmt.Errorf("unexpected item at position %d; got %d; want %d", i, a[i], b[i])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,453 @@
+package uint64set
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"unsafe"
+)
+
+// The serialized set starts with the following header:
+//
+//   - 4 bytes of marshalMagic
+//   - 1 byte with marshalVersion
+//   - 1 byte with the format of the data following the header
+//   - 2 reserved zero bytes
+//   - 8 bytes with the number of items in the set
+//
+// All the integers are stored in little-endian order.
+// The header size is multiple of 8 bytes, so the dense bits arrays
+// of the structural format are 8-byte aligned relative to the start of the data.
+const (
+	marshalMagic      = "U64S"
+	marshalVersion    = 1
+	marshalHeaderSize = 16
+)
+
+// Supported formats of the data following the header.
+//
+// Zero format value is invalid, so zeroed data cannot be mistaken for a valid set.
+const (
+	// formatStructural mirrors the in-memory structure of the set:
+	//
+	//   - 8 bytes with the number of bucket32 items
+	//   - bucket32 items sorted by hi, each consisting of:
+	//     - 4 bytes with hi
+	//     - 4 bytes with the number of bucket16 items
+	//     - bucket16 items sorted by hi16, each consisting of:
+	//       - 2 bytes with hi16
+	//       - 2 bytes with bucket16 kind - bucket16KindSmall or bucket16KindDense
+	//       - 2 bytes with the number of small pool items
+	//       - 2 reserved zero bytes
+	//       - sorted small pool items for bucket16KindSmall, 2 bytes each, padded with zeros to multiple of 8 bytes
+	//       - bits array for bucket16KindDense; 8 bytes per word
+	formatStructural = 1
+
+	// formatRanges contains runs of consecutive items in ascending order. See MarshalRanges.
+	// Every run consists of:
+	//
+	//   - uvarint with the distance from the item following the previous run to the first item of the run;
+	//     the distance is counted from zero for the first run
+	//   - uvarint with the number of items in the run minus one
+	formatRanges = 2
+)
+
+const (
+	bucket16KindSmall = 0
+	bucket16KindDense = 1
+)
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+//
+// MarshalBinary can mutate s.
+func (s *Set) MarshalBinary() ([]byte, error) {
+	dst := make([]byte, 0, s.MarshalSize())
+	return s.marshalStructural(dst), nil
+}
+
+// MarshalSize returns the size in bytes of the data returned by MarshalBinary.
+func (s *Set) MarshalSize() int {
+	n := marshalHeaderSize + 8
+	if s == nil {
+		return n
+	}
+	for i := range s.buckets {
+		n += s.buckets[i].marshalSize()
+	}
+	return n
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+//
+// It replaces s contents with the set unmarshaled from data obtained via MarshalBinary.
+// The memory occupied by the unmarshaled set is proportional to len(data) with a big constant factor,
+// since a few bytes of data may expand into a bucket with 8KB bits array.
+// Data obtained via MarshalRanges isn't accepted, since it may contain up to 2^64 items in a few bytes.
+// Use UnmarshalRanges for such data.
+func (s *Set) UnmarshalBinary(data []byte) error {
+	s.checkWritable()
+	s.trackedSizeBytes = 0
+	format, itemsCount, tail, err := unmarshalHeader(data)
+	if err != nil {
+		return err
+	}
+	if format != formatStructural {
+		return fmt.Errorf("cannot unmarshal uint64set: unsupported format: %d; supported format: %d", format, formatStructural)
+	}
+	var a Set
+	if err := a.unmarshalStructural(tail, false); err != nil {
+		return fmt.Errorf("cannot unmarshal uint64set: %w", err)
+	}
+	if a.itemsCount != itemsCount {
+		return fmt.Errorf("cannot unmarshal uint64set: unexpected number of items; got %d; header says %d", a.itemsCount, itemsCount)
+	}
+	s.moveFrom(&a)
+	return nil
+}
+
+// PeekLen returns the number of items in the set marshaled into data via Set.MarshalBinary or Set.MarshalRanges.
+//
+// It reads only the header of data, so it works in O(1) time without unmarshaling the set.
+// The data following the header isn't validated, so UnmarshalBinary or UnmarshalRanges may still fail for data.
+func PeekLen(data []byte) (int, error) {
+	format, itemsCount, _, err := unmarshalHeader(data)
+	if err != nil {
+		return 0, err
+	}
+	if format != formatStructural && format != formatRanges {
+		return 0, fmt.Errorf("cannot unmarshal uint64set: unsupported format: %d", format)
+	}
+	return itemsCount, nil
+}
+
+// MarshalRanges returns s marshaled as a list of runs of consecutive items.
+//
+// Every run is stored as a pair of varint-encoded numbers: the distance from the previous run and the run length.
+// This is much more compact than MarshalBinary for sets consisting of a few long runs, such as sequential ids.
+// Use RangeCount in order to decide whether MarshalRanges suits s. The result may be unmarshaled
+// via UnmarshalRanges.
+//
+// MarshalRanges can mutate s.
+func (s *Set) MarshalRanges() ([]byte, error) {
+	dst := marshalHeader(nil, formatRanges, s.Len())
+	var next uint64
+	s.forEachRange(func(first, last uint64) bool {
+		dst = marshalUvarint(dst, first-next)
+		dst = marshalUvarint(dst, last-first)
+		next = last + 1
+		return true
+	})
+	return dst, nil
+}
+
+// UnmarshalRanges replaces s contents with the set unmarshaled from data obtained via MarshalRanges.
+//
+// The number of unmarshaled items is limited only by the number of items in the data header,
+// so a few bytes of data may result in huge memory usage. Verify the number of items via PeekLen
+// before unmarshaling untrusted data.
+func (s *Set) UnmarshalRanges(data []byte) error {
+	s.checkWritable()
+	s.trackedSizeBytes = 0
+	format, itemsCount, tail, err := unmarshalHeader(data)
+	if err != nil {
+		return err
+	}
+	if format != formatRanges {
+		return fmt.Errorf("cannot unmarshal uint64set ranges: unexpected format: %d; want %d", format, formatRanges)
+	}
+	var a Set
+	if err := a.unmarshalRanges(tail, itemsCount); err != nil {
+		return fmt.Errorf("cannot unmarshal uint64set ranges: %w", err)
+	}
+	if a.itemsCount != itemsCount {
+		return fmt.Errorf("cannot unmarshal uint64set ranges: unexpected number of items; got %d; header says %d", a.itemsCount, itemsCount)
+	}
+	s.moveFrom(&a)
+	return nil
+}
+
+// unmarshalRanges unmarshals s from src in formatRanges.
+//
+// maxItems limits the number of items in s, so too long runs in malformed src don't lead to huge memory allocations.
+func (s *Set) unmarshalRanges(src []byte, maxItems int) error {
+	var next uint64
+	itemsCount := uint64(0)
+	for i := 0; len(src) > 0; i++ {
+		if i > 0 && next == 0 {
+			return fmt.Errorf("unexpected data after the run ending at the maximum item")
+		}
+		distance, n := binary.Uvarint(src)
+		if n <= 0 {
+			return fmt.Errorf("cannot unmarshal the distance for run #%d", i)
+		}
+		src = src[n:]
+		length, n := binary.Uvarint(src)
+		if n <= 0 {
+			return fmt.Errorf("cannot unmarshal the length for run #%d", i)
+		}
+		src = src[n:]
+		if i > 0 && distance == 0 {
+			return fmt.Errorf("run #%d must be separated from the previous run by at least a single missing item", i)
+		}
+		first := next + distance
+		last := first + length
+		if first < next || last < first {
+			return fmt.Errorf("too big run #%d: distance=%d, length=%d", i, distance, length+1)
+		}
+		itemsCount += length + 1
+		if length >= uint64(maxItems) || itemsCount > uint64(maxItems) {
+			return fmt.Errorf("the number of items in run #%d exceeds the number of items in the header: %d", i, maxItems)
+		}
+		s.addRange(first, last)
+		next = last + 1
+	}
+	return nil
+}
+
+func marshalHeader(dst []byte, format byte, itemsCount int) []byte {
+	dst = append(dst, marshalMagic...)
+	dst = append(dst, marshalVersion, format, 0, 0)
+	return marshalUint64(dst, uint64(itemsCount))
+}
+
+func unmarshalHeader(src []byte) (byte, int, []byte, error) {
+	if len(src) < marshalHeaderSize {
+		return 0, 0, src, fmt.Errorf("cannot unmarshal uint64set header: too short data; got %d bytes; want at least %d bytes", len(src), marshalHeaderSize)
+	}
+	if string(src[:len(marshalMagic)]) != marshalMagic {
+		return 0, 0, src, fmt.Errorf("cannot unmarshal uint64set header: unexpected magic; got %q; want %q", src[:len(marshalMagic)], marshalMagic)
+	}
+	if version := src[4]; version != marshalVersion {
+		return 0, 0, src, fmt.Errorf("cannot unmarshal uint64set header: unsupported version: %d; supported version: %d", version, marshalVersion)
+	}
+	format := src[5]
+	itemsCount := binary.LittleEndian.Uint64(src[8:])
+	if itemsCount > math.MaxInt {
+		return 0, 0, src, fmt.Errorf("cannot unmarshal uint64set header: too big number of items: %d", itemsCount)
+	}
+	return format, int(itemsCount), src[marshalHeaderSize:], nil
+}
+
+func (s *Set) marshalStructural(dst []byte) []byte {
+	dst = marshalHeader(dst, formatStructural, s.Len())
+	if s == nil {
+		return marshalUint64(dst, 0)
+	}
+	s.sort()
+	bucketsCount := 0
+	for i := range s.buckets {
+		if s.buckets[i].getLen() > 0 {
+			bucketsCount++
+		}
+	}
+	dst = marshalUint64(dst, uint64(bucketsCount))
+	for i := range s.buckets {
+		b32 := &s.buckets[i]
+		if b32.getLen() > 0 {
+			dst = b32.marshal(dst)
+		}
+	}
+	return dst
+}
+
+// unmarshalStructural unmarshals s from src.
+//
+// If aliasBits is set, then dense bits arrays of s refer to src instead of copying them.
+// src must be 8-byte aligned in this case.
+func (s *Set) unmarshalStructural(src []byte, aliasBits bool) error {
+	if len(src) < 8 {
+		return fmt.Errorf("cannot unmarshal the number of bucket32 items from %d bytes; need at least 8 bytes", len(src))
+	}
+	bucketsCount := binary.LittleEndian.Uint64(src)
+	src = src[8:]
+	// Each bucket32 occupies at least 8 bytes. This prevents from too big memory allocation below.
+	if bucketsCount > uint64(len(src)/8) {
+		return fmt.Errorf("too big number of bucket32 items: %d for %d bytes of data", bucketsCount, len(src))
+	}
+	if bucketsCount == 1 {
+		s.buckets = s.scratchBuckets[:]
+	} else if bucketsCount > 1 {
+		s.buckets = make([]bucket32, bucketsCount)
+	}
+	for i := range s.buckets {
+		b32 := &s.buckets[i]
+		tail, err := b32.unmarshal(src, aliasBits)
+		if err != nil {
+			return fmt.Errorf("cannot unmarshal bucket32 #%d: %w", i, err)
+		}
+		src = tail
+		if i > 0 && b32.hi <= s.buckets[i-1].hi {
+			return fmt.Errorf("bucket32 items must be sorted by hi; got hi=%d after hi=%d", b32.hi, s.buckets[i-1].hi)
+		}
+	}
+	if len(src) > 0 {
+		return fmt.Errorf("unexpected non-empty tail left after unmarshaling bucket32 items; len(tail)=%d", len(src))
+	}
+	s.fixItemsCount()
+	return nil
+}
+
+func (b *bucket32) marshal(dst []byte) []byte {
+	bucketsCount := 0
+	for _, b16 := range b.buckets {
+		if !b16.isEmpty() {
+			bucketsCount++
+		}
+	}
+	dst = marshalUint32(dst, b.hi)
+	dst = marshalUint32(dst, uint32(bucketsCount))
+	for i, b16 := range b.buckets {
+		if !b16.isEmpty() {
+			dst = b16.marshal(dst, b.b16his[i])
+		}
+	}
+	return dst
+}
+
+func (b *bucket32) marshalSize() int {
+	n := 0
+	for _, b16 := range b.buckets {
+		n += b16.marshalSize()
+	}
+	if n == 0 {
+		// Empty buckets aren't marshaled.
+		return 0
+	}
+	return n + 8
+}
+
+func (b *bucket32) unmarshal(src []byte, aliasBits bool) ([]byte, error) {
+	if len(src) < 8 {
+		return src, fmt.Errorf("cannot unmarshal bucket32 header from %d bytes; need at least 8 bytes", len(src))
+	}
+	b.hi = binary.LittleEndian.Uint32(src)
+	bucketsCount := binary.LittleEndian.Uint32(src[4:])
+	src = src[8:]
+	// Each bucket16 occupies at least 8 bytes. This prevents from too big memory allocation below.
+	if uint64(bucketsCount) > uint64(len(src)/8) {
+		return src, fmt.Errorf("too big number of bucket16 items: %d for %d bytes of data", bucketsCount, len(src))
+	}
+	b.b16his = make([]uint16, bucketsCount)
+	b.buckets = make([]*bucket16, bucketsCount)
+	for i := range b.buckets {
+		b16 := &bucket16{}
+		hi16, tail, err := b16.unmarshal(src, aliasBits)
+		if err != nil {
+			return tail, fmt.Errorf("cannot unmarshal bucket16 #%d: %w", i, err)
+		}
+		src = tail
+		if i > 0 && hi16 <= b.b16his[i-1] {
+			return src, fmt.Errorf("bucket16 items must be sorted by hi16; got hi16=%d after hi16=%d", hi16, b.b16his[i-1])
+		}
+		b.b16his[i] = hi16
+		b.buckets[i] = b16
+	}
+	return src, nil
+}
+
+func (b *bucket16) isEmpty() bool {
+	return b.getLen() == 0
+}
+
+func (b *bucket16) marshal(dst []byte, hi16 uint16) []byte {
+	dst = marshalUint16(dst, hi16)
+	if b.bits != nil {
+		dst = marshalUint16(dst, bucket16KindDense)
+		dst = append(dst, 0, 0, 0, 0)
+		for _, word := range b.bits {
+			dst = marshalUint64(dst, word)
+		}
+		return dst
+	}
+	dst = marshalUint16(dst, bucket16KindSmall)
+	dst = marshalUint16(dst, uint16(b.smallPoolLen))
+	dst = append(dst, 0, 0)
+	xbuf := partBufPool.Get().(*[]uint64)
+	buf := b.appendTo((*xbuf)[:0], 0, 0)
+	for _, x := range buf {
+		dst = marshalUint16(dst, uint16(x))
+	}
+	for i := 0; i < getSmallPoolPaddingSize(len(buf)); i++ {
+		dst = append(dst, 0)
+	}
+	*xbuf = buf
+	partBufPool.Put(xbuf)
+	return dst
+}
+
+func (b *bucket16) marshalSize() int {
+	if b.isEmpty() {
+		return 0
+	}
+	if b.bits != nil {
+		return 8 + 8*wordsPerBucket
+	}
+	return 8 + 2*b.smallPoolLen + getSmallPoolPaddingSize(b.smallPoolLen)
+}
+
+func (b *bucket16) unmarshal(src []byte, aliasBits bool) (uint16, []byte, error) {
+	if len(src) < 8 {
+		return 0, src, fmt.Errorf("cannot unmarshal bucket16 header from %d bytes; need at least 8 bytes", len(src))
+	}
+	hi16 := binary.LittleEndian.Uint16(src)
+	kind := binary.LittleEndian.Uint16(src[2:])
+	smallPoolLen := int(binary.LittleEndian.Uint16(src[4:]))
+	src = src[8:]
+	switch kind {
+	case bucket16KindDense:
+		if len(src) < 8*wordsPerBucket {
+			return hi16, src, fmt.Errorf("cannot unmarshal bits array from %d bytes; need at least %d bytes", len(src), 8*wordsPerBucket)
+		}
+		if aliasBits {
+			b.bits = (*[wordsPerBucket]uint64)(unsafe.Pointer(&src[0]))
+			return hi16, src[8*wordsPerBucket:], nil
+		}
+		var bits [wordsPerBucket]uint64
+		for i := range bits {
+			bits[i] = binary.LittleEndian.Uint64(src[8*i:])
+		}
+		b.bits = &bits
+		return hi16, src[8*wordsPerBucket:], nil
+	case bucket16KindSmall:
+		n := 2*smallPoolLen + getSmallPoolPaddingSize(smallPoolLen)
+		if len(src) < n {
+			return hi16, src, fmt.Errorf("cannot unmarshal %d small pool items from %d bytes; need at least %d bytes", smallPoolLen, len(src), n)
+		}
+		// The data may be marshaled by the code built with bigger smallPoolSize,
+		// so add items via b.add(), which switches to bits array if needed.
+		var prev uint16
+		for i := 0; i < smallPoolLen; i++ {
+			x := binary.LittleEndian.Uint16(src[2*i:])
+			if i > 0 && x <= prev {
+				return hi16, src, fmt.Errorf("small pool items must be sorted; got %d after %d", x, prev)
+			}
+			b.add(x)
+			prev = x
+		}
+		return hi16, src[n:], nil
+	default:
+		return hi16, src, fmt.Errorf("unsupported bucket16 kind: %d", kind)
+	}
+}
+
+func getSmallPoolPaddingSize(smallPoolLen int) int {
+	return (8 - (2*smallPoolLen)%8) % 8
+}
+
+func marshalUint16(dst []byte, u uint16) []byte {
+	return append(dst, byte(u), byte(u>>8))
+}
+
+func marshalUint32(dst []byte, u uint32) []byte {
+	return append(dst, byte(u), byte(u>>8), byte(u>>16), byte(u>>24))
+}
+
+func marshalUvarint(dst []byte, u uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], u)
+	return append(dst, buf[:n]...)
+}
+
+func marshalUint64(dst []byte, u uint64) []byte {
+	return append(dst, byte(u), byte(u>>8), byte(u>>16), byte(u>>24), byte(u>>32), byte(u>>40), byte(u>>48), byte(u>>56))
+}
@@ -0,0 +1,383 @@
+package uint64set
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestMarshalUnmarshalBinary(t *testing.T) {
+	f := func(a []uint64) {
+		t.Helper()
+		var s Set
+		m := make(map[uint64]bool)
+		for _, x := range a {
+			s.Add(x)
+			m[x] = true
+		}
+		data, err := s.MarshalBinary()
+		if err != nil {
+			t.Fatalf("unexpected error in MarshalBinary: %s", err)
+		}
+		if n := s.MarshalSize(); n != len(data) {
+			t.Fatalf("unexpected MarshalSize(); got %d; want %d", n, len(data))
+		}
+		if len(data)%8 != 0 {
+			t.Fatalf("the marshaled data length must be multiple of 8; got %d", len(data))
+		}
+		var s2 Set
+		// Put some data into s2 in order to verify it is replaced by UnmarshalBinary.
+		s2.Add(1234567)
+		if err := s2.UnmarshalBinary(data); err != nil {
+			t.Fatalf("unexpected error in UnmarshalBinary: %s", err)
+		}
+		if err := expectEqual(&s2, m); err != nil {
+			t.Fatalf("unexpected set after UnmarshalBinary: %s", err)
+		}
+
+		// Verify the unmarshaled set can be modified.
+		s2.Add(1<<64 - 1)
+		s.Add(1<<64 - 1)
+		if !s.Equal(&s2) {
+			t.Fatalf("unmarshaled set must be equal to the original set after adding the same item")
+		}
+
+		// Verify the marshaled data is deterministic.
+		data2, err := s2.Clone().MarshalBinary()
+		if err != nil {
+			t.Fatalf("unexpected error in MarshalBinary: %s", err)
+		}
+		data, err = s.MarshalBinary()
+		if err != nil {
+			t.Fatalf("unexpected error in MarshalBinary: %s", err)
+		}
+		if string(data) != string(data2) {
+			t.Fatalf("marshaled data for equal sets must be equal")
+		}
+	}
+	f(nil)
+	f([]uint64{0})
+	f([]uint64{1, 2, 3})
+	f([]uint64{5, 4, 3, 1 << 16, 1 << 32, 2 << 32, 1<<64 - 2})
+
+	var a []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i))
+	}
+	f(a)
+	for i := 0; i < 1e3; i++ {
+		a = append(a, uint64(rand.Int63()))
+	}
+	f(a)
+
+	// Verify nil set
+	var sNil *Set
+	data, err := sNil.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error in MarshalBinary for nil set: %s", err)
+	}
+	if n := sNil.MarshalSize(); n != len(data) {
+		t.Fatalf("unexpected MarshalSize() for nil set; got %d; want %d", n, len(data))
+	}
+	var s Set
+	if err := s.UnmarshalBinary(data); err != nil {
+		t.Fatalf("unexpected error in UnmarshalBinary: %s", err)
+	}
+	if n := s.Len(); n != 0 {
+		t.Fatalf("unexpected number of items after unmarshaling nil set; got %d; want 0", n)
+	}
+
+	// Verify the set with deleted items
+	s = Set{}
+	for i := 0; i < 1e4; i++ {
+		s.Add(uint64(i) << 16)
+		s.Add(uint64(i))
+	}
+	for i := 0; i < 1e4; i++ {
+		s.Del(uint64(i) << 16)
+	}
+	data, err = s.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error in MarshalBinary: %s", err)
+	}
+	if n := s.MarshalSize(); n != len(data) {
+		t.Fatalf("unexpected MarshalSize() for the set with deleted items; got %d; want %d", n, len(data))
+	}
+	var s2 Set
+	if err := s2.UnmarshalBinary(data); err != nil {
+		t.Fatalf("unexpected error in UnmarshalBinary: %s", err)
+	}
+	if !s.Equal(&s2) {
+		t.Fatalf("unmarshaled set must be equal to the original set")
+	}
+}
+
+func TestUnmarshalBinaryFailure(t *testing.T) {
+	f := func(data []byte, errExpected string) {
+		t.Helper()
+		var s Set
+		err := s.UnmarshalBinary(data)
+		if err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		if !strings.Contains(err.Error(), errExpected) {
+			t.Fatalf("unexpected error; got %q; want containing %q", err, errExpected)
+		}
+	}
+	var s Set
+	for i := 0; i < 1000; i++ {
+		s.Add(uint64(i) * 123)
+	}
+	data, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error in MarshalBinary: %s", err)
+	}
+
+	f(nil, "too short data")
+	f(data[:marshalHeaderSize-1], "too short data")
+	f(append([]byte("FOOO"), data[4:]...), "unexpected magic")
+
+	dataBadVersion := append([]byte{}, data...)
+	dataBadVersion[4] = marshalVersion + 1
+	f(dataBadVersion, "unsupported version")
+
+	for _, format := range []byte{0, formatRanges + 1} {
+		dataBadFormat := append([]byte{}, data...)
+		dataBadFormat[5] = format
+		f(dataBadFormat, "unsupported format")
+	}
+
+	// Ranges aren't accepted, since a few bytes may contain huge number of items.
+	dst := marshalHeader(nil, formatRanges, 1<<62)
+	dst = marshalUvarint(dst, 0)
+	dst = marshalUvarint(dst, 1<<40)
+	f(dst, "unsupported format")
+
+	dataBadItemsCount := append([]byte{}, data...)
+	dataBadItemsCount[8]++
+	f(dataBadItemsCount, "unexpected number of items")
+
+	f(data[:marshalHeaderSize], "cannot unmarshal the number of bucket32 items")
+	f(data[:len(data)-8], "cannot unmarshal bucket32")
+	f(append(data, 0, 0, 0, 0, 0, 0, 0, 0), "unexpected non-empty tail")
+
+	dataBadKind := append([]byte{}, data...)
+	dataBadKind[marshalHeaderSize+8+8+2] = 2
+	f(dataBadKind, "unsupported bucket16 kind")
+}
+
+func TestUnmarshalBinaryBigSmallPool(t *testing.T) {
+	// Marshal the data as it could be marshaled by the code built with bigger smallPoolSize.
+	n := smallPoolSize + 10
+	data := marshalHeader(nil, formatStructural, n)
+	data = marshalUint64(data, 1)
+	data = marshalUint32(data, 123)
+	data = marshalUint32(data, 1)
+	data = marshalUint16(data, 456)
+	data = marshalUint16(data, bucket16KindSmall)
+	data = marshalUint16(data, uint16(n))
+	data = append(data, 0, 0)
+	m := make(map[uint64]bool)
+	for i := 0; i < n; i++ {
+		data = marshalUint16(data, uint16(i*3))
+		m[123<<32|456<<16|uint64(i*3)] = true
+	}
+	for i := 0; i < getSmallPoolPaddingSize(n); i++ {
+		data = append(data, 0)
+	}
+
+	var s Set
+	if err := s.UnmarshalBinary(data); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := expectEqual(&s, m); err != nil {
+		t.Fatalf("unexpected set after unmarshaling: %s", err)
+	}
+}
+
+func TestPeekLen(t *testing.T) {
+	f := func(a []uint64) {
+		t.Helper()
+		var s Set
+		s.AddMulti(a)
+		data, err := s.MarshalBinary()
+		if err != nil {
+			t.Fatalf("unexpected error in MarshalBinary: %s", err)
+		}
+		n, err := PeekLen(data)
+		if err != nil {
+			t.Fatalf("unexpected error in PeekLen: %s", err)
+		}
+		if n != s.Len() {
+			t.Fatalf("unexpected PeekLen(); got %d; want %d", n, s.Len())
+		}
+		if allocs := testing.AllocsPerRun(10, func() {
+			_, _ = PeekLen(data)
+		}); allocs != 0 {
+			t.Fatalf("unexpected number of allocations in PeekLen; got %v; want 0", allocs)
+		}
+	}
+	f(nil)
+	f([]uint64{1})
+	f([]uint64{5, 4, 3, 1 << 16, 1 << 32, 2 << 32, 1<<64 - 2})
+	var a []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*3))
+	}
+	f(a)
+}
+
+func TestPeekLenFailure(t *testing.T) {
+	f := func(data []byte, errExpected string) {
+		t.Helper()
+		_, err := PeekLen(data)
+		if err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		if !strings.Contains(err.Error(), errExpected) {
+			t.Fatalf("unexpected error; got %q; want containing %q", err, errExpected)
+		}
+	}
+	var s Set
+	s.Add(123)
+	data, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error in MarshalBinary: %s", err)
+	}
+	f(nil, "too short data")
+	f(data[:marshalHeaderSize-1], "too short data")
+	f(append([]byte("FOOO"), data[4:]...), "unexpected magic")
+
+	dataBadFormat := append([]byte{}, data...)
+	dataBadFormat[5] = formatRanges + 1
+	f(dataBadFormat, "unsupported format")
+}
+
+func TestMarshalUnmarshalRanges(t *testing.T) {
+	f := func(a []uint64) {
+		t.Helper()
+		var s Set
+		s.AddMulti(a)
+		data, err := s.MarshalRanges()
+		if err != nil {
+			t.Fatalf("unexpected error in MarshalRanges: %s", err)
+		}
+		var s2 Set
+		if err := s2.UnmarshalRanges(data); err != nil {
+			t.Fatalf("unexpected error in UnmarshalRanges: %s", err)
+		}
+		if !s2.Equal(&s) {
+			t.Fatalf("unexpected set after UnmarshalRanges")
+		}
+		// UnmarshalBinary mustn't accept ranges.
+		var s3 Set
+		s3.Add(12345)
+		if err := s3.UnmarshalBinary(data); err == nil || !strings.Contains(err.Error(), "unsupported format") {
+			t.Fatalf("expecting unsupported format error in UnmarshalBinary; got %v", err)
+		}
+		if s3.Len() != 1 || !s3.Has(12345) {
+			t.Fatalf("s3 mustn't be modified on UnmarshalBinary error")
+		}
+		n, err := PeekLen(data)
+		if err != nil {
+			t.Fatalf("unexpected error in PeekLen: %s", err)
+		}
+		if n != s.Len() {
+			t.Fatalf("unexpected PeekLen(); got %d; want %d", n, s.Len())
+		}
+	}
+	f(nil)
+	f([]uint64{0})
+	f([]uint64{1<<64 - 1})
+	f([]uint64{0, 1<<64 - 1})
+	f([]uint64{1, 2, 3, 5, 1 << 16, 1 << 32, 1<<64 - 2, 1<<64 - 1})
+	var a []uint64
+	for i := 0; i < 1e4; i++ {
+		a = append(a, uint64(rand.Int63()), uint64(rand.Intn(1e5)))
+	}
+	f(a)
+
+	// Highly contiguous set
+	var s Set
+	for i := 0; i < 10; i++ {
+		s.addRange(uint64(i)<<30, uint64(i)<<30+1e6)
+	}
+	f(s.AppendTo(nil))
+	dataRanges, err := s.MarshalRanges()
+	if err != nil {
+		t.Fatalf("unexpected error in MarshalRanges: %s", err)
+	}
+	dataBinary, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error in MarshalBinary: %s", err)
+	}
+	if len(dataRanges) > 100 || 1000*len(dataRanges) > len(dataBinary) {
+		t.Fatalf("too big data returned from MarshalRanges: %d bytes vs %d bytes returned from MarshalBinary", len(dataRanges), len(dataBinary))
+	}
+}
+
+func TestUnmarshalRangesFailure(t *testing.T) {
+	f := func(data []byte, errExpected string) {
+		t.Helper()
+		var s Set
+		s.Add(123)
+		err := s.UnmarshalRanges(data)
+		if err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		if !strings.Contains(err.Error(), errExpected) {
+			t.Fatalf("unexpected error; got %q; want containing %q", err, errExpected)
+		}
+		if s.Len() != 1 || !s.Has(123) {
+			t.Fatalf("s mustn't be modified on error")
+		}
+	}
+	var s Set
+	s.AddMulti([]uint64{1, 2, 3, 10, 11, 1 << 40})
+	data, err := s.MarshalRanges()
+	if err != nil {
+		t.Fatalf("unexpected error in MarshalRanges: %s", err)
+	}
+	dataBinary, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error in MarshalBinary: %s", err)
+	}
+
+	f(nil, "too short data")
+	f(dataBinary, "unexpected format")
+	f(data[:len(data)-1], "cannot unmarshal the length for run #2")
+
+	dataBadItemsCount := append([]byte{}, data...)
+	dataBadItemsCount[8]--
+	f(dataBadItemsCount, "exceeds the number of items in the header")
+	dataBadItemsCount[8] += 2
+	f(dataBadItemsCount, "unexpected number of items")
+
+	// Adjacent runs
+	dst := marshalHeader(nil, formatRanges, 2)
+	dst = marshalUvarint(dst, 1)
+	dst = marshalUvarint(dst, 0)
+	dst = marshalUvarint(dst, 0)
+	dst = marshalUvarint(dst, 0)
+	f(dst, "must be separated from the previous run")
+
+	// Too long run
+	dst = marshalHeader(nil, formatRanges, 10)
+	dst = marshalUvarint(dst, 0)
+	dst = marshalUvarint(dst, 1<<40)
+	f(dst, "exceeds the number of items in the header")
+
+	// Overflowing run
+	dst = marshalHeader(nil, formatRanges, 10)
+	dst = marshalUvarint(dst, 1<<64-1)
+	dst = marshalUvarint(dst, 1)
+	f(dst, "too big run #0")
+
+	// Data after the maximum item
+	dst = marshalHeader(nil, formatRanges, 10)
+	dst = marshalUvarint(dst, 1<<64-1)
+	dst = marshalUvarint(dst, 0)
+	dst = marshalUvarint(dst, 1)
+	dst = marshalUvarint(dst, 0)
+	f(dst, "unexpected data after the run ending at the maximum item")
+}
@@ -0,0 +1,46 @@
+package uint64set
+
+import (
+	"sync"
+)
+
+// GetSet returns an empty set from the pool.
+//
+// Return the set to the pool via PutSet when it is no longer needed in order to reduce memory allocations.
+// The returned set may contain empty buckets with bits arrays left from the previous use, so adding items
+// with the same upper 48 bits to it doesn't allocate new bits arrays.
+func GetSet() *Set {
+	v := setPool.Get()
+	if v == nil {
+		return &Set{}
+	}
+	return v.(*Set)
+}
+
+// PutSet returns s to the pool, so it could be re-used via GetSet.
+//
+// s keeps its bits arrays in emptied buckets for re-use by the next GetSet caller.
+// s mustn't be used after returning it to the pool.
+//
+// The memory is re-used only if it is exclusively owned by s. If s may share memory with other sets,
+// e.g. after passing s to UnionMayOwn or passing another set to s.UnionMayOwn, then all the s memory
+// is released instead, so other sets aren't affected.
+func PutSet(s *Set) {
+	s.checkWritable()
+	if s.sharedMemory {
+		s.reset()
+	} else {
+		for i := range s.buckets {
+			s.buckets[i].clear(true)
+		}
+		s.removeEmptyBuckets()
+		s.itemsCount = 0
+	}
+	s.opts = setOptions{}
+	s.trackedSizeBytes = 0
+	s.bucketsSorted = false
+	s.hint = 0
+	setPool.Put(s)
+}
+
+var setPool sync.Pool
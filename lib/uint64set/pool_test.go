@@ -0,0 +1,112 @@
+package uint64set
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestGetPutSet(t *testing.T) {
+	f := func(seed uint64) error {
+		for i := 0; i < 100; i++ {
+			s := GetSet()
+			if n := s.Len(); n != 0 {
+				return fmt.Errorf("GetSet must return an empty set; got %d items", n)
+			}
+			if a := s.AppendTo(nil); len(a) != 0 {
+				return fmt.Errorf("GetSet must return a set without items; got %d items", len(a))
+			}
+			m := make(map[uint64]bool)
+			for j := 0; j < 1000; j++ {
+				x := seed<<32 | uint64(i*j)
+				s.Add(x)
+				m[x] = true
+			}
+			// Make some buckets dense.
+			for j := 0; j < 10000; j++ {
+				x := seed<<48 | uint64(j)
+				s.Add(x)
+				m[x] = true
+			}
+			if err := expectEqual(s, m); err != nil {
+				return fmt.Errorf("unexpected set obtained via GetSet: %w", err)
+			}
+			PutSet(s)
+		}
+		return nil
+	}
+
+	const concurrency = 4
+	ch := make(chan error, concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func(seed uint64) {
+			ch <- f(seed)
+		}(uint64(i + 1))
+	}
+	for i := 0; i < concurrency; i++ {
+		if err := <-ch; err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// Sets unrelated to the pool must work properly after re-using pooled buckets.
+	var s Set
+	m := make(map[uint64]bool)
+	for i := 0; i < 1e5; i++ {
+		x := uint64(i * 3)
+		s.Add(x)
+		m[x] = true
+	}
+	if err := expectEqual(&s, m); err != nil {
+		t.Fatalf("unexpected set: %s", err)
+	}
+
+	expectPanic(t, func() { PutSet(Empty()) })
+}
+
+func TestPutSetSharedMemory(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		// dst owns the memory of a after UnionMayOwn, so PutSet(a) mustn't re-use it.
+		a := GetSet()
+		for j := 0; j < 1000; j++ {
+			a.Add(uint64(j))
+		}
+		var dst Set
+		dst.UnionMayOwn(a)
+		PutSet(a)
+
+		// s shares the memory with b after s.UnionMayOwn(b), so PutSet(s) mustn't re-use it.
+		s := GetSet()
+		s.Add(1 << 40)
+		b := &Set{}
+		for j := 0; j < 1000; j++ {
+			b.Add(1<<32 + uint64(j))
+		}
+		s.UnionMayOwn(b)
+		PutSet(s)
+
+		var sets []*Set
+		for j := 0; j < 3; j++ {
+			sNew := GetSet()
+			for k := 0; k < 2000; k++ {
+				sNew.Add(uint64(k))
+				sNew.Add(1<<32 + uint64(k))
+			}
+			sets = append(sets, sNew)
+		}
+		m := make(map[uint64]bool)
+		mb := make(map[uint64]bool)
+		for j := 0; j < 1000; j++ {
+			m[uint64(j)] = true
+			mb[1<<32+uint64(j)] = true
+		}
+		if err := expectEqual(&dst, m); err != nil {
+			t.Fatalf("the set owning pooled memory mustn't change: %s", err)
+		}
+		if err := expectEqual(b, mb); err != nil {
+			t.Fatalf("the set sharing memory with pooled set mustn't change: %s", err)
+		}
+		for _, sNew := range sets {
+			PutSet(sNew)
+		}
+	}
+}
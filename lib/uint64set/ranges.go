@@ -0,0 +1,287 @@
+package uint64set
+
+import (
+	"math/bits"
+)
+
+// ForEachRun calls f for every run of consecutive items in s in ascending order.
+//
+// start is the first item of the run, while length is the number of items in the run.
+// Runs spanning multiple internal buckets are passed to f as a single run.
+// The iteration is stopped if f returns false.
+//
+// ForEachRun can mutate s.
+func (s *Set) ForEachRun(f func(start uint64, length int) bool) {
+	s.forEachRange(func(first, last uint64) bool {
+		return f(first, int(last-first+1))
+	})
+}
+
+// IsContiguous returns the first and the last items of s if s contains all the items between them.
+//
+// ok is set to false if s is empty or if it contains gaps. A set with a single item is contiguous with lo == hi.
+//
+// IsContiguous can mutate s.
+func (s *Set) IsContiguous() (lo, hi uint64, ok bool) {
+	runs := 0
+	s.forEachRange(func(first, last uint64) bool {
+		runs++
+		lo = first
+		hi = last
+		return runs == 1
+	})
+	if runs != 1 {
+		return 0, 0, false
+	}
+	return lo, hi, true
+}
+
+// RangeCount returns the number of maximal runs of consecutive items in s.
+//
+// It returns 0 for empty s and 1 for s containing all the items between its minimum and maximum items.
+// RangeCount much smaller than s.Len() means that s can be stored compactly as a list of runs.
+// Runs spanning multiple internal buckets are counted once.
+//
+// RangeCount can mutate s.
+func (s *Set) RangeCount() int {
+	n := 0
+	s.forEachRange(func(first, last uint64) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// MaxGap returns the start and the length of the largest range of missing items between the minimum and the maximum items of s.
+//
+// Only gaps between s items are taken into account, i.e. missing items below the minimum item
+// and above the maximum item are ignored. The lowest gap is returned if there are multiple gaps with the maximum length.
+// gapLen is zero if s contains all the items between its minimum and maximum items.
+// ok is set to false if s contains less than two items.
+//
+// MaxGap can mutate s.
+func (s *Set) MaxGap() (gapStart, gapLen uint64, ok bool) {
+	if s.Len() < 2 {
+		return 0, 0, false
+	}
+	var lastPrev uint64
+	runs := 0
+	s.forEachRange(func(first, last uint64) bool {
+		if runs > 0 {
+			if n := first - lastPrev - 1; n > gapLen {
+				gapStart = lastPrev + 1
+				gapLen = n
+			}
+		}
+		lastPrev = last
+		runs++
+		return true
+	})
+	return gapStart, gapLen, true
+}
+
+// AppendMissingInRange appends items from the range [lo, hi), which are missing in s, to dst and returns the result.
+//
+// The appended items are sorted. Beware that the number of appended items may be huge
+// if s is sparse over the range. Use ForEachMissingInRange in this case.
+//
+// AppendMissingInRange can mutate s.
+func (s *Set) AppendMissingInRange(dst []uint64, lo, hi uint64) []uint64 {
+	s.ForEachMissingInRange(lo, hi, func(lo, hi uint64) bool {
+		for x := lo; x < hi; x++ {
+			dst = append(dst, x)
+		}
+		return true
+	})
+	return dst
+}
+
+// ForEachMissingInRange calls f for every range [lo, hi) of consecutive items missing in s
+// inside the range [lo, hi) in ascending order.
+//
+// The iteration is stopped if f returns false.
+//
+// ForEachMissingInRange can mutate s.
+func (s *Set) ForEachMissingInRange(lo, hi uint64, f func(lo, hi uint64) bool) {
+	if lo >= hi {
+		return
+	}
+	// next is the first item, which may be missing in s.
+	next := lo
+	done := false
+	s.forEachRange(func(first, last uint64) bool {
+		if last < next {
+			return true
+		}
+		if first >= hi {
+			return false
+		}
+		if first > next && !f(next, first) {
+			done = true
+			return false
+		}
+		if last >= hi-1 {
+			done = true
+			return false
+		}
+		next = last + 1
+		return true
+	})
+	if !done && next < hi {
+		f(next, hi)
+	}
+}
+
+// forEachRange calls f for every range [first, last] of consecutive items in s in ascending order.
+//
+// The iteration is stopped if f returns false.
+//
+// forEachRange can mutate s.
+func (s *Set) forEachRange(f func(first, last uint64) bool) {
+	if s.Len() == 0 {
+		return
+	}
+	s.sort()
+	rw := rangeWalker{
+		f: f,
+	}
+	for i := range s.buckets {
+		if !s.buckets[i].forEachRange(&rw) {
+			return
+		}
+	}
+	rw.flush()
+}
+
+// rangeWalker merges adjacent ranges of items passed to add in ascending order
+// and passes the merged ranges to f.
+type rangeWalker struct {
+	f func(first, last uint64) bool
+
+	// first and last are the bounds of the pending range if ok is set.
+	first uint64
+	last  uint64
+	ok    bool
+}
+
+func (rw *rangeWalker) add(first, last uint64) bool {
+	if rw.ok && rw.last+1 == first {
+		rw.last = last
+		return true
+	}
+	if rw.ok && !rw.f(rw.first, rw.last) {
+		return false
+	}
+	rw.first = first
+	rw.last = last
+	rw.ok = true
+	return true
+}
+
+func (rw *rangeWalker) flush() {
+	if rw.ok {
+		rw.ok = false
+		_ = rw.f(rw.first, rw.last)
+	}
+}
+
+func (b *bucket32) forEachRange(rw *rangeWalker) bool {
+	for i, b16 := range b.buckets {
+		if !b16.forEachRange(rw, b.hi, b.b16his[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bucket16) forEachRange(rw *rangeWalker, hi uint32, hi16 uint16) bool {
+	if b.bits == nil {
+		xbuf := partBufPool.Get().(*[]uint64)
+		buf := b.appendTo((*xbuf)[:0], hi, hi16)
+		ok := true
+		for _, x := range buf {
+			if !rw.add(x, x) {
+				ok = false
+				break
+			}
+		}
+		*xbuf = buf
+		partBufPool.Put(xbuf)
+		return ok
+	}
+	hi64 := uint64(hi)<<32 | uint64(hi16)<<16
+	for wordNum, word := range b.bits {
+		base := hi64 | uint64(wordNum*64)
+		for word != 0 {
+			// Locate the run of set bits starting at the lowest set bit in word.
+			start := uint(bits.TrailingZeros64(word))
+			n := uint(bits.TrailingZeros64(^(word >> start)))
+			if n > 64-start {
+				n = 64 - start
+			}
+			if !rw.add(base+uint64(start), base+uint64(start+n-1)) {
+				return false
+			}
+			if start+n >= 64 {
+				break
+			}
+			word &^= (uint64(1) << (start + n)) - 1
+		}
+	}
+	return true
+}
+
+// maxUnmarshalRangeItems is the maximum number of items, which may be unmarshaled from ranges.
+//
+// This protects from excessive memory usage when unmarshaling untrusted data, since a range
+// occupying a few bytes may contain up to 2^64 items.
+const maxUnmarshalRangeItems = 1 << 30
+
+// addRange adds all the items in the range [first, last] to s.
+func (s *Set) addRange(first, last uint64) {
+	s.checkWritable()
+	if first > last {
+		return
+	}
+	s.trackedSizeBytes = 0
+	var b32 *bucket32
+	x := first
+	for {
+		hi32 := uint32(x >> 32)
+		if b32 == nil || b32.hi != hi32 {
+			b32 = s.getOrCreateBucket32(hi32)
+		}
+		base16 := x &^ (bitsPerBucket - 1)
+		end := base16 + (bitsPerBucket - 1)
+		if end > last {
+			end = last
+		}
+		b16 := b32.getOrCreateBucket16(uint16(x >> 16))
+		s.itemsCount += b16.addRange(int(x-base16), int(end-base16)+1)
+		if end == last {
+			return
+		}
+		x = end + 1
+	}
+}
+
+// addRange adds items in the range [lo, hi) to b and returns the number of added items.
+func (b *bucket16) addRange(lo, hi int) int {
+	count := 0
+	if b.bits == nil && b.smallPoolLen+hi-lo <= smallPoolSize {
+		for x := lo; x < hi; x++ {
+			if b.addToSmallPool(uint16(x)) {
+				count++
+			}
+		}
+		return count
+	}
+	b.makeDense()
+	bb := b.bits
+	for wordNum := lo / 64; wordNum < (hi+63)/64; wordNum++ {
+		mask := getRangeMask(wordNum, lo, hi)
+		count += bits.OnesCount64(mask &^ bb[wordNum])
+		bb[wordNum] |= mask
+	}
+	return count
+}
@@ -0,0 +1,256 @@
+package uint64set
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestSetForEachRun(t *testing.T) {
+	f := func(a []uint64) {
+		t.Helper()
+		var s Set
+		s.AddMulti(a)
+
+		// Calculate the expected runs from the sorted items.
+		var starts []uint64
+		var lengths []int
+		for _, x := range s.AppendTo(nil) {
+			if n := len(starts); n > 0 && starts[n-1]+uint64(lengths[n-1]) == x {
+				lengths[n-1]++
+				continue
+			}
+			starts = append(starts, x)
+			lengths = append(lengths, 1)
+		}
+
+		i := 0
+		s.ForEachRun(func(start uint64, length int) bool {
+			if i >= len(starts) {
+				t.Fatalf("unexpected run #%d: start=%d, length=%d", i, start, length)
+			}
+			if start != starts[i] || length != lengths[i] {
+				t.Fatalf("unexpected run #%d; got start=%d, length=%d; want start=%d, length=%d", i, start, length, starts[i], lengths[i])
+			}
+			i++
+			return true
+		})
+		if i != len(starts) {
+			t.Fatalf("unexpected number of runs; got %d; want %d", i, len(starts))
+		}
+
+		// Verify the iteration stops when f returns false
+		calls := 0
+		s.ForEachRun(func(start uint64, length int) bool {
+			calls++
+			return false
+		})
+		if len(starts) > 0 && calls != 1 {
+			t.Fatalf("unexpected number of calls; got %d; want 1", calls)
+		}
+	}
+	f(nil)
+	f([]uint64{0})
+	f([]uint64{1<<64 - 1})
+	f([]uint64{1<<64 - 2, 1<<64 - 1})
+	f([]uint64{1, 2, 3, 5, 6, 10})
+	f([]uint64{63, 64, 127, 128, 129})
+
+	// Runs spanning bucket boundaries
+	var a []uint64
+	for i := 0; i < 3*bitsPerBucket; i++ {
+		a = append(a, 1<<32-bitsPerBucket+uint64(i))
+	}
+	f(a)
+
+	// Small runs in sparse buckets
+	a = a[:0]
+	for i := 0; i < 100; i++ {
+		x := uint64(i) << 16
+		a = append(a, x+1<<16-2, x+1<<16-1, x+5<<32)
+	}
+	f(a)
+
+	// Random runs
+	rng := rand.New(rand.NewSource(0))
+	a = a[:0]
+	for i := 0; i < 1e3; i++ {
+		start := uint64(rng.Intn(1e7))
+		for j := 0; j < rng.Intn(200); j++ {
+			a = append(a, start+uint64(j))
+		}
+	}
+	f(a)
+}
+
+func TestSetIsContiguous(t *testing.T) {
+	f := func(a []uint64, loExpected, hiExpected uint64, okExpected bool) {
+		t.Helper()
+		var s Set
+		s.AddMulti(a)
+		lo, hi, ok := s.IsContiguous()
+		if ok != okExpected {
+			t.Fatalf("unexpected ok; got %v; want %v", ok, okExpected)
+		}
+		if lo != loExpected || hi != hiExpected {
+			t.Fatalf("unexpected range; got [%d, %d]; want [%d, %d]", lo, hi, loExpected, hiExpected)
+		}
+	}
+	f(nil, 0, 0, false)
+	f([]uint64{5}, 5, 5, true)
+	f([]uint64{1<<64 - 1}, 1<<64-1, 1<<64-1, true)
+	f([]uint64{3, 1, 2}, 1, 3, true)
+	f([]uint64{1, 3}, 0, 0, false)
+	f([]uint64{1 << 32, 2 << 32}, 0, 0, false)
+
+	var a []uint64
+	for i := 0; i < 3*bitsPerBucket; i++ {
+		a = append(a, 1<<32-100+uint64(i))
+	}
+	f(a, 1<<32-100, 1<<32-100+3*bitsPerBucket-1, true)
+	a = append(a, 1<<33)
+	f(a, 0, 0, false)
+}
+
+func TestSetRangeCount(t *testing.T) {
+	f := func(a []uint64, nExpected int) {
+		t.Helper()
+		var s Set
+		s.AddMulti(a)
+		if n := s.RangeCount(); n != nExpected {
+			t.Fatalf("unexpected RangeCount(); got %d; want %d", n, nExpected)
+		}
+	}
+	f(nil, 0)
+	f([]uint64{5}, 1)
+	f([]uint64{3, 1, 2}, 1)
+	f([]uint64{1, 3, 5, 6, 7}, 3)
+	f([]uint64{0, 1<<64 - 1}, 2)
+	f([]uint64{1 << 32, 2 << 32, 2<<32 + 1}, 2)
+
+	// Runs crossing bucket bounds in dense buckets
+	var a []uint64
+	for i := 0; i < 3*bitsPerBucket; i++ {
+		a = append(a, 1<<32-100+uint64(i))
+	}
+	f(a, 1)
+
+	// Runs of known lengths in dense buckets
+	a = a[:0]
+	runs := 0
+	for x := uint64(0); x < 4*bitsPerBucket; x += 100 {
+		for i := uint64(0); i < 1+x%63; i++ {
+			a = append(a, x+i)
+		}
+		runs++
+	}
+	f(a, runs)
+
+	// Every other item
+	a = a[:0]
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(2*i))
+	}
+	f(a, 1e5)
+
+	var sNil *Set
+	if n := sNil.RangeCount(); n != 0 {
+		t.Fatalf("unexpected RangeCount() for nil set; got %d; want 0", n)
+	}
+}
+
+func TestSetMaxGap(t *testing.T) {
+	f := func(a []uint64, gapStartExpected, gapLenExpected uint64, okExpected bool) {
+		t.Helper()
+		var s Set
+		s.AddMulti(a)
+		gapStart, gapLen, ok := s.MaxGap()
+		if ok != okExpected {
+			t.Fatalf("unexpected ok; got %v; want %v", ok, okExpected)
+		}
+		if gapStart != gapStartExpected || gapLen != gapLenExpected {
+			t.Fatalf("unexpected gap; got start=%d, len=%d; want start=%d, len=%d", gapStart, gapLen, gapStartExpected, gapLenExpected)
+		}
+	}
+	f(nil, 0, 0, false)
+	f([]uint64{5}, 0, 0, false)
+	f([]uint64{5, 6, 7}, 0, 0, true)
+	f([]uint64{5, 7}, 6, 1, true)
+	f([]uint64{1, 3, 10, 12, 19}, 4, 6, true)
+	f([]uint64{0, 1<<64 - 1}, 1, 1<<64-2, true)
+	f([]uint64{1, 1 << 32, 1<<32 + 5, 3 << 32}, 1<<32+6, 2<<32-6, true)
+
+	var a []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i))
+	}
+	a = append(a, 1e5+1000, 1e5+1001, 1e5+3000)
+	f(a, 1e5+1002, 1998, true)
+}
+
+func TestSetAppendMissingInRange(t *testing.T) {
+	f := func(a []uint64, lo, hi uint64) {
+		t.Helper()
+		var s Set
+		s.AddMulti(a)
+		var expected []uint64
+		for x := lo; x < hi; x++ {
+			if !s.Has(x) {
+				expected = append(expected, x)
+			}
+		}
+		result := s.AppendMissingInRange(nil, lo, hi)
+		if err := checkSameItems(result, expected); err != nil {
+			t.Fatalf("unexpected missing items in the range [%d, %d): %s", lo, hi, err)
+		}
+
+		// Verify the iteration stops when f returns false
+		calls := 0
+		s.ForEachMissingInRange(lo, hi, func(lo, hi uint64) bool {
+			calls++
+			return false
+		})
+		if len(expected) > 0 && calls != 1 {
+			t.Fatalf("unexpected number of calls; got %d; want 1", calls)
+		}
+	}
+	f(nil, 0, 0)
+	f(nil, 10, 5)
+	f(nil, 0, 10)
+	f([]uint64{1, 2, 3}, 0, 10)
+	f([]uint64{1, 2, 3}, 1, 4)
+	f([]uint64{1, 2, 3}, 2, 3)
+	f([]uint64{1, 5, 6, 9}, 2, 9)
+	f([]uint64{1, 5, 6, 9}, 5, 100)
+	f([]uint64{1<<64 - 3, 1<<64 - 1}, 1<<64-10, 1<<64-1)
+	f([]uint64{1<<32 - 2, 1 << 32, 1<<32 + 1}, 1<<32-5, 1<<32+5)
+
+	var a []uint64
+	for i := 0; i < 1e5; i++ {
+		if i%1000 != 0 {
+			a = append(a, uint64(i))
+		}
+	}
+	f(a, 0, 2e5)
+	f(a, 5e4, 5e4+10)
+	f(a, 500, 999)
+	f(a, 999, 1000)
+}
+
+func TestSetForEachMissingInRangeHugeGap(t *testing.T) {
+	var s Set
+	s.AddMulti([]uint64{10, 1<<64 - 10})
+	var ranges [][2]uint64
+	s.ForEachMissingInRange(0, 1<<64-1, func(lo, hi uint64) bool {
+		ranges = append(ranges, [2]uint64{lo, hi})
+		return true
+	})
+	expected := [][2]uint64{{0, 10}, {11, 1<<64 - 10}, {1<<64 - 9, 1<<64 - 1}}
+	if len(ranges) != len(expected) {
+		t.Fatalf("unexpected number of ranges; got %d; want %d", len(ranges), len(expected))
+	}
+	for i := range ranges {
+		if ranges[i] != expected[i] {
+			t.Fatalf("unexpected range #%d; got %v; want %v", i, ranges[i], expected[i])
+		}
+	}
+}
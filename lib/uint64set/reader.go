@@ -0,0 +1,123 @@
+package uint64set
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// readerBatchSize is the number of items AddFromReader and WriteValuesTo process at once.
+const readerBatchSize = 4096
+
+// AddFromReader adds all the items read from r to s.
+//
+// r must contain a stream of 8-byte little-endian uint64 items. The stream is read until io.EOF,
+// which is treated as clean termination. Items are added in batches via AddMulti, so AddFromReader
+// doesn't need to decode the whole stream into memory before adding items to s.
+//
+// It returns the number of items read from r including duplicates. An error is returned
+// if r returns an error other than io.EOF or if the stream ends with a partial item.
+// The items read before the error are added to s.
+func (s *Set) AddFromReader(r io.Reader) (int, error) {
+	s.checkWritable()
+	s.trackedSizeBytes = 0
+	buf := make([]byte, 8*readerBatchSize)
+	xa := partBufPool.Get().(*[]uint64)
+	a := *xa
+	n := 0
+	var err error
+	for {
+		bytesRead, errRead := io.ReadFull(r, buf)
+		a = a[:0]
+		for i := 0; i+8 <= bytesRead; i += 8 {
+			a = append(a, binary.LittleEndian.Uint64(buf[i:]))
+		}
+		s.AddMulti(a)
+		n += len(a)
+		if errRead == nil {
+			continue
+		}
+		if errRead == io.ErrUnexpectedEOF && bytesRead%8 != 0 {
+			err = fmt.Errorf("cannot read uint64 item #%d: unexpected end of stream after %d bytes", n, bytesRead%8)
+		} else if errRead != io.EOF && errRead != io.ErrUnexpectedEOF {
+			err = fmt.Errorf("cannot read uint64 items after reading %d items: %w", n, errRead)
+		}
+		break
+	}
+	*xa = a
+	partBufPool.Put(xa)
+	return n, err
+}
+
+// WriteValuesTo writes all the items from s to w in ascending order.
+//
+// Every item is written as 8-byte little-endian uint64, so the written data may be read
+// by AddFromReader or by tools expecting a flat array of raw uint64 values. This is different
+// from MarshalBinary, which stores the internal structure of s. Items are written in chunks
+// via a reusable buffer, so WriteValuesTo doesn't need to build the whole array in memory.
+//
+// It returns the number of bytes written to w. s isn't modified.
+func (s *Set) WriteValuesTo(w io.Writer) (int64, error) {
+	buf := make([]byte, 0, 8*readerBatchSize)
+	var n int64
+	var err error
+	flush := func() bool {
+		if len(buf) == 0 {
+			return true
+		}
+		var m int
+		m, err = w.Write(buf)
+		n += int64(m)
+		buf = buf[:0]
+		if err != nil {
+			err = fmt.Errorf("cannot write uint64 items after writing %d bytes: %w", n, err)
+			return false
+		}
+		return true
+	}
+	bs := s.getSortedBuckets()
+	for i := range bs {
+		ok := bs[i].forEach(func(part []uint64) bool {
+			for _, x := range part {
+				if len(buf) == cap(buf) && !flush() {
+					return false
+				}
+				buf = marshalUint64(buf, x)
+			}
+			return true
+		})
+		if !ok {
+			return n, err
+		}
+	}
+	flush()
+	return n, err
+}
+
+// StreamingUnion returns the union of sets read from readers.
+//
+// Every reader must contain a single set serialized via MarshalBinary. The sets are read and merged
+// into the result one by one, so the peak memory usage is limited by the result plus a single serialized
+// and a single decoded set instead of all the sets. This allows merging many serialized sets,
+// which don't fit memory at once, e.g. during index compaction.
+//
+// An error is returned if any of readers returns an error or contains invalid data.
+// The partially merged result is discarded in this case.
+func StreamingUnion(readers ...io.Reader) (*Set, error) {
+	var dst Set
+	var buf bytes.Buffer
+	for i, r := range readers {
+		buf.Reset()
+		if _, err := buf.ReadFrom(r); err != nil {
+			return nil, fmt.Errorf("cannot read set #%d: %w", i, err)
+		}
+		var a Set
+		if err := a.UnmarshalBinary(buf.Bytes()); err != nil {
+			return nil, fmt.Errorf("cannot decode set #%d: %w", i, err)
+		}
+		// a isn't used after the call, so its buckets may be moved to dst.
+		dst.UnionMayOwn(&a)
+	}
+	return &dst, nil
+}
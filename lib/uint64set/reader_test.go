@@ -0,0 +1,277 @@
+package uint64set
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestSetAddFromReader(t *testing.T) {
+	f := func(a []uint64) {
+		t.Helper()
+		var s Set
+		s.Add(123)
+		m := map[uint64]bool{
+			123: true,
+		}
+		var data []byte
+		for _, x := range a {
+			data = marshalUint64(data, x)
+			m[x] = true
+		}
+		n, err := s.AddFromReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if n != len(a) {
+			t.Fatalf("unexpected number of items read; got %d; want %d", n, len(a))
+		}
+		if err := expectEqual(&s, m); err != nil {
+			t.Fatalf("unexpected set: %s", err)
+		}
+
+		// Read data in small chunks.
+		var s2 Set
+		s2.Add(123)
+		n, err = s2.AddFromReader(&chunkedReader{data: data})
+		if err != nil {
+			t.Fatalf("unexpected error for chunked reader: %s", err)
+		}
+		if n != len(a) {
+			t.Fatalf("unexpected number of items read from chunked reader; got %d; want %d", n, len(a))
+		}
+		if err := expectEqual(&s2, m); err != nil {
+			t.Fatalf("unexpected set for chunked reader: %s", err)
+		}
+	}
+	f(nil)
+	f([]uint64{1})
+	f([]uint64{1<<64 - 1, 0, 1 << 32, 123, 1})
+
+	// Multiple batches
+	var a []uint64
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 3*readerBatchSize+5; i++ {
+		a = append(a, uint64(rng.Intn(5))<<32|uint64(rng.Intn(1e6)))
+	}
+	f(a)
+}
+
+func TestSetAddFromReaderFailure(t *testing.T) {
+	// Partial item at the end of stream
+	var data []byte
+	for i := 0; i < readerBatchSize+1; i++ {
+		data = marshalUint64(data, uint64(i))
+	}
+	data = append(data, 1, 2, 3)
+	var s Set
+	n, err := s.AddFromReader(bytes.NewReader(data))
+	if err == nil {
+		t.Fatalf("expecting non-nil error for partial item")
+	}
+	if n != readerBatchSize+1 {
+		t.Fatalf("unexpected number of items read; got %d; want %d", n, readerBatchSize+1)
+	}
+	if s.Len() != readerBatchSize+1 {
+		t.Fatalf("the items read before the error must be added; got %d items; want %d", s.Len(), readerBatchSize+1)
+	}
+
+	// Reader error
+	errReader := errors.New("some error")
+	r := io.MultiReader(bytes.NewReader(data[:80]), &errorReader{err: errReader})
+	var s2 Set
+	n, err = s2.AddFromReader(r)
+	if !errors.Is(err, errReader) {
+		t.Fatalf("unexpected error; got %v; want %v", err, errReader)
+	}
+	if n != 10 || s2.Len() != 10 {
+		t.Fatalf("unexpected number of items read; got %d; want 10", n)
+	}
+}
+
+// chunkedReader returns data in chunks of unaligned size.
+type chunkedReader struct {
+	data []byte
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	if len(cr.data) == 0 {
+		return 0, io.EOF
+	}
+	n := 13
+	if n > len(cr.data) {
+		n = len(cr.data)
+	}
+	n = copy(p, cr.data[:n])
+	cr.data = cr.data[n:]
+	return n, nil
+}
+
+type errorReader struct {
+	err error
+}
+
+func (er *errorReader) Read(p []byte) (int, error) {
+	return 0, er.err
+}
+
+func TestSetWriteValuesTo(t *testing.T) {
+	f := func(a []uint64) {
+		t.Helper()
+		var s Set
+		for _, x := range a {
+			s.Add(x)
+		}
+		var bb bytes.Buffer
+		n, err := s.WriteValuesTo(&bb)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if n != int64(8*s.Len()) || n != int64(bb.Len()) {
+			t.Fatalf("unexpected number of bytes written; got %d; want %d", n, 8*s.Len())
+		}
+		var data []byte
+		for _, x := range s.AppendTo(nil) {
+			data = marshalUint64(data, x)
+		}
+		if !bytes.Equal(bb.Bytes(), data) {
+			t.Fatalf("unexpected data written")
+		}
+
+		// Read the data back
+		var s2 Set
+		itemsCount, err := s2.AddFromReader(&bb)
+		if err != nil {
+			t.Fatalf("unexpected error in AddFromReader: %s", err)
+		}
+		if itemsCount != s.Len() {
+			t.Fatalf("unexpected number of items read; got %d; want %d", itemsCount, s.Len())
+		}
+		if !s2.Equal(&s) {
+			t.Fatalf("the set read via AddFromReader must be equal to the original set")
+		}
+	}
+	f(nil)
+	f([]uint64{1})
+	f([]uint64{1<<64 - 1, 0, 5 << 32, 1 << 32, 123, 1})
+
+	// Multiple chunks
+	var a []uint64
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(rng.Intn(5))<<32|uint64(rng.Intn(1e6)))
+	}
+	f(a)
+
+	// Writer error
+	var s Set
+	for _, x := range a {
+		s.Add(x)
+	}
+	errWriter := errors.New("some error")
+	fw := &failingWriter{
+		maxLen: 8 * readerBatchSize,
+		err:    errWriter,
+	}
+	n, err := s.WriteValuesTo(fw)
+	if !errors.Is(err, errWriter) {
+		t.Fatalf("unexpected error; got %v; want %v", err, errWriter)
+	}
+	if n != 8*readerBatchSize {
+		t.Fatalf("unexpected number of bytes written; got %d; want %d", n, 8*readerBatchSize)
+	}
+}
+
+// failingWriter returns err after writing maxLen bytes.
+type failingWriter struct {
+	maxLen int
+	err    error
+	n      int
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	if fw.n+len(p) > fw.maxLen {
+		n := fw.maxLen - fw.n
+		fw.n = fw.maxLen
+		return n, fw.err
+	}
+	fw.n += len(p)
+	return len(p), nil
+}
+
+func TestStreamingUnion(t *testing.T) {
+	f := func(aa [][]uint64) {
+		t.Helper()
+		var readers []io.Reader
+		m := make(map[uint64]bool)
+		for _, a := range aa {
+			var s Set
+			s.AddMulti(a)
+			for _, x := range a {
+				m[x] = true
+			}
+			data, err := s.MarshalBinary()
+			if err != nil {
+				t.Fatalf("cannot marshal set: %s", err)
+			}
+			readers = append(readers, &chunkedReader{data: data})
+		}
+		result, err := StreamingUnion(readers...)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := expectEqual(result, m); err != nil {
+			t.Fatalf("unexpected result: %s", err)
+		}
+		// Verify the result can be modified.
+		result.Add(1<<64 - 1)
+		if !result.Has(1<<64 - 1) {
+			t.Fatalf("missing item added to the result")
+		}
+	}
+	f(nil)
+	f([][]uint64{nil})
+	f([][]uint64{{1, 2, 3}})
+	f([][]uint64{{1, 2, 3}, nil, {2, 3, 4, 1 << 40}, {1 << 32}})
+
+	// Mixed small and dense buckets
+	var aa [][]uint64
+	for i := 0; i < 10; i++ {
+		var a []uint64
+		for j := 0; j < 1e4; j++ {
+			a = append(a, uint64(rand.Intn(1e5)), uint64(rand.Int63()))
+		}
+		aa = append(aa, a)
+	}
+	f(aa)
+}
+
+func TestStreamingUnionFailure(t *testing.T) {
+	var s Set
+	s.AddMulti([]uint64{1, 2, 3})
+	data, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatalf("cannot marshal set: %s", err)
+	}
+
+	// Reader error
+	errReader := errors.New("some error")
+	result, err := StreamingUnion(bytes.NewReader(data), &errorReader{err: errReader})
+	if !errors.Is(err, errReader) {
+		t.Fatalf("unexpected error; got %v; want %v", err, errReader)
+	}
+	if result != nil {
+		t.Fatalf("the partial result must be discarded on error")
+	}
+
+	// Invalid data
+	result, err = StreamingUnion(bytes.NewReader(data), bytes.NewReader(data[:len(data)-1]))
+	if err == nil {
+		t.Fatalf("expecting non-nil error for invalid data")
+	}
+	if result != nil {
+		t.Fatalf("the partial result must be discarded on invalid data")
+	}
+}
@@ -0,0 +1,77 @@
+package uint64set
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// NewReadOnlyFromBytes returns a read-only set for the data obtained via Set.MarshalBinary.
+//
+// Dense bits arrays of the returned set refer to data instead of being copied to the heap,
+// so data may point to a memory-mapped file. data must be 8-byte aligned and it mustn't be modified
+// or unmapped while the returned set is in use.
+//
+// The returned set supports all the read-only methods and it may be passed as an argument
+// to methods such as Union, Intersect or Subtract. Methods modifying the returned set
+// such as Add, Del or Union panic. Use Clone for obtaining a modifiable copy of the set.
+func NewReadOnlyFromBytes(data []byte) (*Set, error) {
+	format, itemsCount, tail, err := unmarshalHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if format != formatStructural {
+		return nil, fmt.Errorf("cannot create read-only uint64set: unsupported format: %d; supported format: %d", format, formatStructural)
+	}
+	if uintptr(unsafe.Pointer(&data[0]))%8 != 0 {
+		return nil, fmt.Errorf("cannot create read-only uint64set: data must be 8-byte aligned")
+	}
+	var s Set
+	// Dense bits arrays are stored in little-endian order, so they can be referred directly only on little-endian CPUs.
+	if err := s.unmarshalStructural(tail, isLittleEndian()); err != nil {
+		return nil, fmt.Errorf("cannot create read-only uint64set: %w", err)
+	}
+	if s.itemsCount != itemsCount {
+		return nil, fmt.Errorf("cannot create read-only uint64set: unexpected number of items; got %d; header says %d", s.itemsCount, itemsCount)
+	}
+	s.opts.readOnly = true
+	return &s, nil
+}
+
+// emptySet is returned by Empty.
+var emptySet = &Set{
+	opts: setOptions{
+		readOnly: true,
+	},
+}
+
+// Empty returns a shared read-only empty set.
+//
+// It may be returned from hot paths instead of allocating a new empty set.
+// The returned set is shared among all the callers, so it mustn't be modified -
+// methods modifying it such as Add, Union or SetKeepSorted panic.
+// Use Clone for obtaining a modifiable empty set.
+func Empty() *Set {
+	return emptySet
+}
+
+// IsReadOnly returns true if s cannot be modified. See NewReadOnlyFromBytes and Empty.
+func (s *Set) IsReadOnly() bool {
+	return s != nil && s.opts.readOnly
+}
+
+// checkWritable must be called by every method modifying s.
+//
+// It panics if s is read-only.
+func (s *Set) checkWritable() {
+	if s == nil {
+		return
+	}
+	if s.opts.readOnly {
+		panic(fmt.Errorf("BUG: cannot modify read-only uint64set"))
+	}
+}
+
+func isLittleEndian() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}
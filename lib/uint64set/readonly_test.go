@@ -0,0 +1,225 @@
+package uint64set
+
+import (
+	"math/rand"
+	"testing"
+	"unsafe"
+)
+
+func TestNewReadOnlyFromBytes(t *testing.T) {
+	f := func(a []uint64) {
+		t.Helper()
+		var s Set
+		m := make(map[uint64]bool)
+		for _, x := range a {
+			s.Add(x)
+			m[x] = true
+		}
+		data, err := s.MarshalBinary()
+		if err != nil {
+			t.Fatalf("unexpected error in MarshalBinary: %s", err)
+		}
+		data = newAlignedBytes(data)
+		sr, err := NewReadOnlyFromBytes(data)
+		if err != nil {
+			t.Fatalf("unexpected error in NewReadOnlyFromBytes: %s", err)
+		}
+		if !sr.IsReadOnly() {
+			t.Fatalf("the set must be read-only")
+		}
+		if err := expectEqual(sr, m); err != nil {
+			t.Fatalf("unexpected read-only set: %s", err)
+		}
+		for _, x := range a {
+			if !sr.Has(x) {
+				t.Fatalf("missing item %d in the read-only set", x)
+			}
+		}
+
+		// Verify the read-only set can be passed to methods modifying other sets.
+		var s2 Set
+		s2.UnionMayOwn(sr)
+		if err := expectEqual(&s2, m); err != nil {
+			t.Fatalf("unexpected set after the union with read-only set: %s", err)
+		}
+		s2.AddMulti([]uint64{0, 3, 1<<64 - 1})
+		s3 := s.Clone()
+		s3.Intersect(sr)
+		if !s3.Equal(&s) {
+			t.Fatalf("unexpected set after the intersection with read-only set")
+		}
+		s3.Subtract(sr)
+		if n := s3.Len(); n != 0 {
+			t.Fatalf("unexpected number of items after subtracting read-only set; got %d; want 0", n)
+		}
+		if err := expectEqual(sr, m); err != nil {
+			t.Fatalf("the read-only set mustn't change: %s", err)
+		}
+
+		// Verify the clone of read-only set can be modified.
+		sc := sr.Clone()
+		if sc.IsReadOnly() {
+			t.Fatalf("the clone of read-only set mustn't be read-only")
+		}
+		sc.Add(1<<64 - 1)
+		sc.Del(1<<64 - 1)
+		if !sc.Equal(sr) {
+			t.Fatalf("the clone must be equal to the read-only set")
+		}
+
+		expectPanic(t, func() { sr.Add(123) })
+		expectPanic(t, func() { sr.AddWithByteLimit(123, 1<<20) })
+		expectPanic(t, func() { sr.AddMulti([]uint64{1, 2}) })
+		expectPanic(t, func() { sr.AddFromSeq(s.All()) })
+		expectPanic(t, func() { sr.AddFromSortedSeq(s.All()) })
+		expectPanic(t, func() { sr.Del(123) })
+		expectPanic(t, func() { sr.Apply([]uint64{1}, []uint64{2}) })
+		expectPanic(t, func() { sr.Union(&s) })
+		expectPanic(t, func() { sr.UnionWithCallback(&s, nil, func(x uint64) {}) })
+		expectPanic(t, func() { sr.Intersect(&s) })
+		expectPanic(t, func() { sr.Subtract(&s) })
+		expectPanic(t, func() { sr.Swap(&s) })
+		expectPanic(t, func() { sr.Optimize() })
+		expectPanic(t, func() { sr.DropSparsePrefixes(10) })
+		expectPanic(t, func() { sr.DrainMin(1) })
+		expectPanic(t, func() { s.CloneInto(sr) })
+		expectPanic(t, func() { _ = sr.UnmarshalBinary(data) })
+	}
+	f(nil)
+	f([]uint64{1, 2, 3, 1 << 32, 1<<64 - 2})
+
+	var a []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*3))
+	}
+	for i := 0; i < 1e3; i++ {
+		a = append(a, uint64(rand.Int63()))
+	}
+	f(a)
+}
+
+func TestNewReadOnlyFromBytesNoCopy(t *testing.T) {
+	if !isLittleEndian() {
+		t.Skip("dense bits arrays are copied on big-endian CPUs")
+	}
+	var s Set
+	for i := 0; i < bitsPerBucket; i++ {
+		s.Add(uint64(i))
+	}
+	data, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error in MarshalBinary: %s", err)
+	}
+	data = newAlignedBytes(data)
+	sr, err := NewReadOnlyFromBytes(data)
+	if err != nil {
+		t.Fatalf("unexpected error in NewReadOnlyFromBytes: %s", err)
+	}
+	// Clear the first bits word in data and verify the set reflects the change.
+	off := marshalHeaderSize + 8 + 8 + 8
+	for i := 0; i < 8; i++ {
+		data[off+i] = 0
+	}
+	if sr.Has(0) {
+		t.Fatalf("the read-only set must refer to data")
+	}
+	if !sr.Has(64) {
+		t.Fatalf("missing item 64 in the read-only set")
+	}
+}
+
+func TestNewReadOnlyFromBytesFailure(t *testing.T) {
+	f := func(data []byte) {
+		t.Helper()
+		if _, err := NewReadOnlyFromBytes(data); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+	var s Set
+	s.Add(123)
+	data, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error in MarshalBinary: %s", err)
+	}
+	data = newAlignedBytes(data)
+
+	f(nil)
+	f(data[:len(data)-1])
+
+	// Unaligned data
+	buf := newAlignedBytes(append([]byte{0}, data...))
+	f(buf[1:])
+
+	dataBadFormat := newAlignedBytes(data)
+	dataBadFormat[5] = 0
+	f(dataBadFormat)
+}
+
+func TestEmpty(t *testing.T) {
+	s := Empty()
+	if s != Empty() {
+		t.Fatalf("Empty must return the same set on every call")
+	}
+	if n := s.Len(); n != 0 {
+		t.Fatalf("unexpected Empty().Len(); got %d; want 0", n)
+	}
+	if !s.IsReadOnly() {
+		t.Fatalf("Empty must return read-only set")
+	}
+	if n := testing.AllocsPerRun(100, func() {
+		_ = Empty().Has(123)
+	}); n != 0 {
+		t.Fatalf("unexpected number of allocations; got %v; want 0", n)
+	}
+
+	// The empty set may be passed to methods modifying other sets.
+	var a Set
+	a.Add(123)
+	a.Union(s)
+	a.Subtract(s)
+	if n := a.Len(); n != 1 {
+		t.Fatalf("unexpected number of items; got %d; want 1", n)
+	}
+	a.Intersect(s)
+	if n := a.Len(); n != 0 {
+		t.Fatalf("unexpected number of items after intersection with the empty set; got %d; want 0", n)
+	}
+
+	sc := s.Clone()
+	if sc.IsReadOnly() {
+		t.Fatalf("the clone of the empty set mustn't be read-only")
+	}
+	sc.Add(123)
+	if n := Empty().Len(); n != 0 {
+		t.Fatalf("the empty set mustn't change after modifying its clone; got %d items", n)
+	}
+
+	expectPanic(t, func() { s.Add(123) })
+	expectPanic(t, func() { s.AddMulti([]uint64{1, 2}) })
+	expectPanic(t, func() { s.Del(123) })
+	expectPanic(t, func() { s.Union(sc) })
+	expectPanic(t, func() { s.Intersect(sc) })
+	expectPanic(t, func() { s.SetKeepSorted(true) })
+	expectPanic(t, func() { s.SetStickyDense(true) })
+	expectPanic(t, func() { s.SetMaxLen(10) })
+}
+
+func newAlignedBytes(src []byte) []byte {
+	if len(src) == 0 {
+		return nil
+	}
+	buf := make([]uint64, (len(src)+7)/8)
+	dst := (*[1 << 30]byte)(unsafe.Pointer(&buf[0]))[:len(src):len(src)]
+	copy(dst, src)
+	return dst
+}
+
+func expectPanic(t *testing.T, f func()) {
+	t.Helper()
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("expecting panic")
+		}
+	}()
+	f()
+}
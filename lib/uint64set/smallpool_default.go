@@ -0,0 +1,17 @@
+//go:build !uint64set_smallpool_small && !uint64set_smallpool_large
+// +build !uint64set_smallpool_small,!uint64set_smallpool_large
+
+package uint64set
+
+// smallPoolSize is the maximum number of items in bucket16 before switching to bits array.
+//
+// Bigger smallPoolSize reduces memory usage for sparse buckets, since bits array occupies 8KB,
+// at the cost of slower operations on such buckets.
+//
+// smallPoolSize may be tuned at build time with the following tags:
+//
+//   - uint64set_smallpool_small - for memory-constrained workloads with mostly tiny buckets.
+//   - uint64set_smallpool_large - for workloads with many sparse, but not tiny buckets.
+//
+// The default value results in 128-byte bucket16 struct.
+const smallPoolSize = 56
@@ -0,0 +1,7 @@
+//go:build uint64set_smallpool_large && !uint64set_smallpool_small
+// +build uint64set_smallpool_large,!uint64set_smallpool_small
+
+package uint64set
+
+// smallPoolSize results in 256-byte bucket16 struct. See smallpool_default.go for details.
+const smallPoolSize = 120
@@ -0,0 +1,323 @@
+package uint64set
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"unsafe"
+)
+
+// ExportPopulationByPrefix returns the number of items in s grouped by the top prefixBits bits of items.
+//
+// The map key is the prefix, i.e. the item value shifted right by 64-prefixBits bits.
+// Only prefixes with non-zero number of items are returned.
+//
+// prefixBits must be in the range [1..48]. This allows counting items per the whole bucket
+// with 2^16 items without the need to inspect every item, since all the items
+// in such a bucket share the same prefix.
+func (s *Set) ExportPopulationByPrefix(prefixBits uint) map[uint64]int {
+	if prefixBits < 1 || prefixBits > 48 {
+		panic(fmt.Errorf("BUG: prefixBits must be in the range [1..48]; got %d", prefixBits))
+	}
+	m := make(map[uint64]int)
+	if s == nil {
+		return m
+	}
+	shift := 64 - prefixBits
+	for i := range s.buckets {
+		b32 := &s.buckets[i]
+		for j, b16 := range b32.buckets {
+			n := b16.getLen()
+			if n == 0 {
+				continue
+			}
+			base := uint64(b32.hi)<<32 | uint64(b32.b16his[j])<<16
+			m[base>>shift] += n
+		}
+	}
+	return m
+}
+
+// HottestPrefix returns the upper 32 bits of items shared by the biggest number of items in s.
+//
+// count is the number of items in s with the upper 32 bits hi. The smallest hi is returned
+// if multiple prefixes have the same number of items. ok is false for empty s.
+// Unlike ExportPopulationByPrefix, HottestPrefix doesn't allocate memory.
+func (s *Set) HottestPrefix() (hi uint32, count int, ok bool) {
+	if s == nil {
+		return 0, 0, false
+	}
+	for i := range s.buckets {
+		b32 := &s.buckets[i]
+		n := b32.getLen()
+		if n == 0 {
+			continue
+		}
+		if !ok || n > count || (n == count && b32.hi < hi) {
+			hi = b32.hi
+			count = n
+			ok = true
+		}
+	}
+	return hi, count, ok
+}
+
+// NearUpgradeCount returns the number of non-empty buckets with up to 2^16 items, which store items
+// in the small pool and which will be switched to bits array after adding margin or less new items.
+//
+// This helps tuning the small pool size - see smallpool_*.go files.
+func (s *Set) NearUpgradeCount(margin int) int {
+	if s == nil {
+		return 0
+	}
+	n := 0
+	for i := range s.buckets {
+		for _, b16 := range s.buckets[i].buckets {
+			if b16.bits == nil && b16.smallPoolLen > 0 && smallPoolSize-b16.smallPoolLen < margin {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// DensePopulation returns the number of items in s stored in bits arrays and in small pools.
+//
+// dense + sparse always equals s.Len(). Unlike NearUpgradeCount, it counts items instead of buckets,
+// so it shows the share of items, which benefit from the dense representation.
+// This helps deciding whether tuning the small pool size or SetAlwaysDense mode suits the data in s.
+func (s *Set) DensePopulation() (dense, sparse int) {
+	if s == nil {
+		return 0, 0
+	}
+	for i := range s.buckets {
+		for _, b16 := range s.buckets[i].buckets {
+			if b16.bits != nil {
+				dense += b16.getLen()
+			} else {
+				sparse += b16.smallPoolLen
+			}
+		}
+	}
+	return dense, sparse
+}
+
+// Fragmentation returns the share of memory occupied by s, which can be reclaimed by Optimize.
+//
+// It is calculated as (SizeBytes() - optimizedSizeBytes) / SizeBytes(), where optimizedSizeBytes
+// is the SizeBytes() value after Optimize call. The reclaimable memory consists of empty buckets,
+// bits arrays for buckets with up to smallPoolSize items and the unused capacity of bucket lists.
+// The returned value is in the range [0..1), where 0 means s is already lean. s isn't modified.
+func (s *Set) Fragmentation() float64 {
+	n := s.SizeBytes()
+	if n == 0 {
+		return 0
+	}
+	return float64(n-s.optimizedSizeBytes()) / float64(n)
+}
+
+// optimizedSizeBytes returns s.SizeBytes() value after s.Optimize call without modifying s.
+func (s *Set) optimizedSizeBytes() uint64 {
+	if s == nil {
+		return 0
+	}
+	n := uint64(unsafe.Sizeof(*s))
+	if !s.hasScratchBuckets() {
+		n += getBuckets32SizeBytes(cap(s.buckets))
+	}
+	buckets32Count := 0
+	for i := range s.buckets {
+		size := s.buckets[i].optimizedSizeBytes(s.opts.alwaysDense)
+		if size > 0 {
+			buckets32Count++
+		}
+		n += size
+	}
+	if buckets32Count == cap(s.buckets) || s.hasScratchBuckets() {
+		// Optimize keeps s.buckets as is.
+		return n
+	}
+	n -= getBuckets32SizeBytes(cap(s.buckets))
+	if buckets32Count > 1 {
+		n += getBuckets32SizeBytes(buckets32Count)
+	}
+	return n
+}
+
+// optimizedSizeBytes returns b.sizeBytes() value after b.shrink call without modifying b.
+//
+// 0 is returned if b becomes empty after b.shrink call.
+func (b *bucket32) optimizedSizeBytes(alwaysDense bool) uint64 {
+	n := uint64(0)
+	for _, b16 := range b.buckets {
+		itemsCount := b16.getLen()
+		if itemsCount == 0 {
+			continue
+		}
+		n += getBucket32ListsSizeBytes(1, 1)
+		n += getBucket16SizeBytes(b16.bits != nil && (alwaysDense || itemsCount > smallPoolSize))
+	}
+	return n
+}
+
+// ApproxUnionCount returns an estimate for the number of unique items in the union of sets.
+//
+// It samples buckets with 2^16 items by hashing their upper bits, calculates the exact number of unique items
+// in the sampled buckets and extrapolates it to all the buckets. The sampling rate is chosen so that about
+// sampleBuckets buckets are sampled from the set with the biggest number of buckets. Only the sampled buckets
+// are looked up in other sets and merged, so this is much faster than the exact union for big sets.
+// The exact number is returned if sampleBuckets isn't smaller than the number of buckets in every set.
+//
+// The relative error of the estimate is proportional to 1/sqrt(sampleBuckets) multiplied by the coefficient
+// of variation of the number of unique items per bucket. For instance, sampleBuckets=100 gives about 10% error
+// for buckets with similar density and bigger error for sets mixing sparse and dense buckets.
+// The same buckets are sampled on every call, so the result is deterministic. The sets aren't modified.
+func ApproxUnionCount(sets []*Set, sampleBuckets int) int {
+	if sampleBuckets <= 0 {
+		panic(fmt.Errorf("BUG: sampleBuckets must be positive; got %d", sampleBuckets))
+	}
+	maxBucketsCount := 0
+	for _, s := range sets {
+		if n := s.bucket16sCount(); n > maxBucketsCount {
+			maxBucketsCount = n
+		}
+	}
+	if maxBucketsCount == 0 {
+		return 0
+	}
+	rate := 1.0
+	threshold := uint64(1<<64 - 1)
+	if sampleBuckets < maxBucketsCount {
+		rate = float64(sampleBuckets) / float64(maxBucketsCount)
+		threshold = uint64(rate * (1 << 64))
+	}
+
+	// Calculate the exact number of unique items in the sampled buckets.
+	// Every sampled bucket is merged with the buckets for the same prefix from the remaining sets
+	// when it is met in the first set containing it.
+	var bitsBuf [wordsPerBucket]uint64
+	n := 0
+	for i, s := range sets {
+		if s.Len() == 0 {
+			continue
+		}
+		for j := range s.buckets {
+			b32 := &s.buckets[j]
+			for k, b16 := range b32.buckets {
+				if b16.isZero() {
+					continue
+				}
+				hi16 := b32.b16his[k]
+				prefix := uint64(b32.hi)<<16 | uint64(hi16)
+				if prefix*prefixHashMultiplier > threshold {
+					continue
+				}
+				if hasNonZeroBucket16(sets[:i], b32.hi, hi16) {
+					// The bucket has been already counted.
+					continue
+				}
+				others := sets[i+1:]
+				if !hasNonZeroBucket16(others, b32.hi, hi16) {
+					n += b16.getLen()
+					continue
+				}
+				bitsBuf = [wordsPerBucket]uint64{}
+				b16.orTo(&bitsBuf)
+				for _, a := range others {
+					if a16 := a.getNonZeroBucket16(b32.hi, hi16); a16 != nil {
+						a16.orTo(&bitsBuf)
+					}
+				}
+				for _, word := range bitsBuf {
+					n += bits.OnesCount64(word)
+				}
+			}
+		}
+	}
+	if rate == 1 {
+		return n
+	}
+	return int(float64(n) / rate)
+}
+
+// prefixHashMultiplier is used for hashing bucket prefixes in ApproxUnionCount.
+//
+// This is the golden ratio multiplier, which evenly spreads subsequent prefixes over uint64 range.
+const prefixHashMultiplier = 0x9e3779b97f4a7c15
+
+// hasNonZeroBucket16 returns true if at least a single set from sets has items with the given upper 48 bits.
+func hasNonZeroBucket16(sets []*Set, hi32 uint32, hi16 uint16) bool {
+	for _, s := range sets {
+		if s.getNonZeroBucket16(hi32, hi16) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// getNonZeroBucket16 returns non-empty bucket16 for items with the given upper 48 bits in s.
+//
+// nil is returned if s has no such items.
+func (s *Set) getNonZeroBucket16(hi32 uint32, hi16 uint16) *bucket16 {
+	if s.Len() == 0 {
+		return nil
+	}
+	b32 := s.getBucket32(hi32)
+	if b32 == nil {
+		return nil
+	}
+	b16 := b32.getBucket16(hi16)
+	if b16 == nil || b16.isZero() {
+		return nil
+	}
+	return b16
+}
+
+// Similarity contains similarity coefficients for a pair of sets.
+//
+// See Set.Similarities.
+type Similarity struct {
+	// IntersectionLen is the number of items, which exist in both sets.
+	IntersectionLen int
+
+	// UnionLen is the number of items, which exist in at least one of the sets.
+	UnionLen int
+
+	// Jaccard is |s ∩ a| / |s ∪ a|.
+	Jaccard float64
+
+	// Dice is 2*|s ∩ a| / (|s| + |a|).
+	Dice float64
+
+	// Overlap is |s ∩ a| / min(|s|, |a|).
+	Overlap float64
+
+	// Cosine is |s ∩ a| / sqrt(|s| * |a|).
+	Cosine float64
+}
+
+// Similarities returns similarity coefficients for s and a.
+//
+// All the coefficients are derived from a single intersection pass, so this is faster
+// than computing every coefficient via a separate call such as OverlapFraction. Coefficients are set to zero
+// if their denominator is zero. Neither s nor a is modified.
+func (s *Set) Similarities(a *Set) Similarity {
+	sn := s.Len()
+	an := a.Len()
+	n := s.intersectCount(a)
+	var sim Similarity
+	sim.IntersectionLen = n
+	sim.UnionLen = sn + an - n
+	if n == 0 {
+		return sim
+	}
+	minLen := sn
+	if an < minLen {
+		minLen = an
+	}
+	sim.Jaccard = float64(n) / float64(sim.UnionLen)
+	sim.Dice = 2 * float64(n) / float64(sn+an)
+	sim.Overlap = float64(n) / float64(minLen)
+	sim.Cosine = float64(n) / math.Sqrt(float64(sn)*float64(an))
+	return sim
+}
@@ -0,0 +1,412 @@
+package uint64set
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestSetExportPopulationByPrefix(t *testing.T) {
+	f := func(a []uint64, prefixBits uint) {
+		t.Helper()
+		var s Set
+		m := make(map[uint64]bool)
+		for _, x := range a {
+			s.Add(x)
+			m[x] = true
+		}
+		resultExpected := make(map[uint64]int)
+		for x := range m {
+			resultExpected[x>>(64-prefixBits)]++
+		}
+		result := s.ExportPopulationByPrefix(prefixBits)
+		if !reflect.DeepEqual(result, resultExpected) {
+			t.Fatalf("unexpected result for prefixBits=%d\ngot\n%v\nwant\n%v", prefixBits, result, resultExpected)
+		}
+	}
+	rng := rand.New(rand.NewSource(0))
+	var a []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(rng.Intn(1e3))<<40|uint64(rng.Intn(1e7)))
+	}
+	for _, prefixBits := range []uint{1, 8, 16, 24, 32, 40, 47, 48} {
+		f(nil, prefixBits)
+		f([]uint64{0, 1<<64 - 1}, prefixBits)
+		f(a, prefixBits)
+	}
+
+	// Verify deleted items aren't counted
+	var s Set
+	s.Add(1 << 20)
+	s.Del(1 << 20)
+	s.Add(1 << 40)
+	result := s.ExportPopulationByPrefix(32)
+	resultExpected := map[uint64]int{
+		1 << 8: 1,
+	}
+	if !reflect.DeepEqual(result, resultExpected) {
+		t.Fatalf("unexpected result after deleting items; got %v; want %v", result, resultExpected)
+	}
+
+	// Verify nil set
+	var sNil *Set
+	if n := len(sNil.ExportPopulationByPrefix(16)); n != 0 {
+		t.Fatalf("unexpected number of prefixes for nil set; got %d; want 0", n)
+	}
+
+	// Verify invalid prefixBits
+	for _, prefixBits := range []uint{0, 49, 64} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Fatalf("expecting panic for prefixBits=%d", prefixBits)
+				}
+			}()
+			s.ExportPopulationByPrefix(prefixBits)
+		}()
+	}
+}
+
+func TestSetHottestPrefix(t *testing.T) {
+	f := func(a []uint64) {
+		t.Helper()
+		var s Set
+		s.AddMulti(a)
+		var hiExpected uint32
+		countExpected := 0
+		okExpected := false
+		for prefix, n := range s.ExportPopulationByPrefix(32) {
+			hi := uint32(prefix)
+			if !okExpected || n > countExpected || (n == countExpected && hi < hiExpected) {
+				hiExpected = hi
+				countExpected = n
+				okExpected = true
+			}
+		}
+		hi, count, ok := s.HottestPrefix()
+		if hi != hiExpected || count != countExpected || ok != okExpected {
+			t.Fatalf("unexpected HottestPrefix(); got %d, %d, %v; want %d, %d, %v", hi, count, ok, hiExpected, countExpected, okExpected)
+		}
+	}
+	f(nil)
+	f([]uint64{123})
+	f([]uint64{1<<64 - 1})
+	f([]uint64{1, 2, 1 << 32, 5 << 32, 5<<32 + 1, 5<<32 + 2})
+
+	// Prefixes with the same number of items
+	f([]uint64{7 << 32, 3 << 32, 5 << 32})
+
+	rng := rand.New(rand.NewSource(0))
+	var a []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(rng.Intn(10))<<32|uint64(rng.Intn(1e7)))
+	}
+	f(a)
+
+	// Deleted items mustn't be counted
+	var s Set
+	s.AddMulti([]uint64{1, 2, 3, 1 << 32, 1<<32 + 1})
+	s.DelMulti([]uint64{1, 2, 3})
+	hi, count, ok := s.HottestPrefix()
+	if hi != 1 || count != 2 || !ok {
+		t.Fatalf("unexpected HottestPrefix() after deleting items; got %d, %d, %v; want 1, 2, true", hi, count, ok)
+	}
+	s.DelMulti([]uint64{1 << 32, 1<<32 + 1})
+	if _, _, ok := s.HottestPrefix(); ok {
+		t.Fatalf("HottestPrefix() must return false for set with deleted items")
+	}
+
+	// nil set
+	var sNil *Set
+	if _, _, ok := sNil.HottestPrefix(); ok {
+		t.Fatalf("HottestPrefix() must return false for nil set")
+	}
+}
+
+func TestSetNearUpgradeCount(t *testing.T) {
+	var s Set
+	// Create buckets with the given number of items.
+	for i, n := range []int{1, smallPoolSize / 2, smallPoolSize - 2, smallPoolSize - 1, smallPoolSize, smallPoolSize + 1} {
+		for j := 0; j < n; j++ {
+			s.Add(uint64(i)<<16 | uint64(j))
+		}
+	}
+	f := func(margin, resultExpected int) {
+		t.Helper()
+		if result := s.NearUpgradeCount(margin); result != resultExpected {
+			t.Fatalf("unexpected NearUpgradeCount(%d); got %d; want %d", margin, result, resultExpected)
+		}
+	}
+	f(0, 0)
+	f(1, 1)
+	f(2, 2)
+	f(3, 3)
+	f(smallPoolSize-smallPoolSize/2+1, 4)
+	f(smallPoolSize+1, 5)
+
+	var sNil *Set
+	if n := sNil.NearUpgradeCount(10); n != 0 {
+		t.Fatalf("unexpected NearUpgradeCount for nil set; got %d; want 0", n)
+	}
+}
+
+func TestSetDensePopulation(t *testing.T) {
+	f := func(s *Set, denseExpected, sparseExpected int) {
+		t.Helper()
+		dense, sparse := s.DensePopulation()
+		if dense != denseExpected || sparse != sparseExpected {
+			t.Fatalf("unexpected DensePopulation(); got dense=%d, sparse=%d; want dense=%d, sparse=%d", dense, sparse, denseExpected, sparseExpected)
+		}
+		if dense+sparse != s.Len() {
+			t.Fatalf("dense+sparse must equal s.Len(); got %d; want %d", dense+sparse, s.Len())
+		}
+	}
+	var s Set
+	f(&s, 0, 0)
+	s.Add(1)
+	s.Add(1 << 40)
+	f(&s, 0, 2)
+
+	// Switch a bucket to bits array.
+	for i := 0; i <= smallPoolSize; i++ {
+		s.Add(1<<32 | uint64(i))
+	}
+	f(&s, smallPoolSize+1, 2)
+
+	// Deleted items aren't counted.
+	s.Del(1<<32 | 5)
+	s.Del(1 << 40)
+	f(&s, smallPoolSize, 1)
+
+	// alwaysDense mode
+	var sd Set
+	sd.SetAlwaysDense(true)
+	sd.AddMulti([]uint64{1, 2, 1 << 32})
+	f(&sd, 3, 0)
+
+	var sNil *Set
+	f(sNil, 0, 0)
+}
+
+func TestSetFragmentation(t *testing.T) {
+	f := func(name string, s *Set) float64 {
+		t.Helper()
+		fragmentation := s.Fragmentation()
+		if fragmentation < 0 || fragmentation >= 1 {
+			t.Fatalf("%s: fragmentation must be in the range [0..1); got %v", name, fragmentation)
+		}
+		sizeBefore := s.SizeBytes()
+
+		// Verify the fragmentation matches the memory reclaimed by Optimize.
+		s.Optimize()
+		sizeAfter := s.SizeBytes()
+		fragmentationExpected := 0.0
+		if sizeBefore > 0 {
+			fragmentationExpected = float64(sizeBefore-sizeAfter) / float64(sizeBefore)
+		}
+		if fragmentation != fragmentationExpected {
+			t.Fatalf("%s: unexpected fragmentation; got %v; want %v", name, fragmentation, fragmentationExpected)
+		}
+		if n := s.Fragmentation(); n != 0 {
+			t.Fatalf("%s: unexpected fragmentation after Optimize; got %v; want 0", name, n)
+		}
+		return fragmentation
+	}
+
+	var sNil *Set
+	if n := sNil.Fragmentation(); n != 0 {
+		t.Fatalf("unexpected fragmentation for nil set; got %v; want 0", n)
+	}
+	f("empty", &Set{})
+
+	// Freshly built sets are lean.
+	var s Set
+	s.Add(123)
+	if n := f("single-item", &s); n > 0.05 {
+		t.Fatalf("too big fragmentation for the set with a single item; got %v; want up to 0.05", n)
+	}
+	s = Set{}
+	for i := 0; i < 1e6; i++ {
+		s.Add(uint64(i))
+	}
+	if n := f("fresh-dense", &s); n > 0.01 {
+		t.Fatalf("too big fragmentation for freshly built dense set; got %v; want up to 0.01", n)
+	}
+
+	// Heavily churned sets are fragmented.
+	s = Set{}
+	for i := 0; i < 1e6; i++ {
+		s.Add(uint64(i))
+	}
+	for i := 0; i < 1e6; i++ {
+		if i%1e4 != 0 {
+			s.Del(uint64(i))
+		}
+	}
+	if n := f("churned-dense", &s); n < 0.9 {
+		t.Fatalf("too small fragmentation for heavily churned set; got %v; want at least 0.9", n)
+	}
+	s = Set{}
+	for i := 0; i < 100; i++ {
+		s.Add(uint64(i) << 32)
+		s.Add(uint64(i)<<32 | 1<<16)
+	}
+	for i := 0; i < 100; i++ {
+		s.Del(uint64(i) << 32)
+		if i > 0 {
+			s.Del(uint64(i)<<32 | 1<<16)
+		}
+	}
+	if n := f("churned-sparse", &s); n < 0.5 {
+		t.Fatalf("too small fragmentation for heavily churned sparse set; got %v; want at least 0.5", n)
+	}
+}
+
+func TestApproxUnionCount(t *testing.T) {
+	f := func(sets []*Set, sampleBuckets int, maxRelativeError float64) {
+		t.Helper()
+		var su Set
+		for _, s := range sets {
+			su.Union(s)
+		}
+		nExpected := su.Len()
+		n := ApproxUnionCount(sets, sampleBuckets)
+		if maxRelativeError == 0 {
+			if n != nExpected {
+				t.Fatalf("unexpected exact union count for sampleBuckets=%d; got %d; want %d", sampleBuckets, n, nExpected)
+			}
+			return
+		}
+		relativeError := math.Abs(float64(n-nExpected)) / float64(nExpected)
+		if relativeError > maxRelativeError {
+			t.Fatalf("too big relative error for sampleBuckets=%d: %.3f; got %d; want %d", sampleBuckets, relativeError, n, nExpected)
+		}
+	}
+	f(nil, 1, 0)
+	f([]*Set{nil, {}}, 10, 0)
+
+	rng := rand.New(rand.NewSource(0))
+	var sets []*Set
+	for i := 0; i < 20; i++ {
+		var s Set
+		for j := 0; j < 2e4; j++ {
+			s.Add(uint64(rng.Intn(1e8)))
+		}
+		// Sets with deleted items
+		for j := 0; j < 100; j++ {
+			s.Del(uint64(rng.Intn(1e8)))
+		}
+		sets = append(sets, &s)
+	}
+	f(sets, 100, 0.1)
+	f(sets, 500, 0.05)
+	f(sets, 1e6, 0)
+
+	// Dense buckets partially shared between sets
+	var denseSets []*Set
+	for i := 0; i < 10; i++ {
+		var s Set
+		for j := 0; j < 1e5; j++ {
+			s.Add(uint64(rng.Intn(1e3))<<32 | uint64(i*1e5+j))
+		}
+		denseSets = append(denseSets, &s)
+	}
+	f(denseSets, 100, 0.1)
+	f(denseSets, 1e6, 0)
+
+	// Mixed sparse and dense buckets
+	sets = append(sets, denseSets...)
+	f(sets, 1e6, 0)
+
+	// Buckets missing in the biggest set must be counted too.
+	var sBig, sSmall Set
+	for i := 0; i < 1e3; i++ {
+		sBig.Add(uint64(i) << 16)
+		sSmall.Add(uint64(i)<<16 | 1<<40)
+	}
+	f([]*Set{&sSmall, &sBig}, 1e3, 0)
+	f([]*Set{&sBig, &sSmall, &sBig}, 100, 0.1)
+
+	// Verify that sets aren't modified
+	var origs []*Set
+	for _, s := range sets {
+		origs = append(origs, s.Clone())
+	}
+	_ = ApproxUnionCount(sets, 10)
+	for i, s := range sets {
+		if !s.Equal(origs[i]) {
+			t.Fatalf("set #%d has been modified", i)
+		}
+	}
+
+	expectPanic(t, func() { ApproxUnionCount(sets, 0) })
+}
+
+func TestSetSimilarities(t *testing.T) {
+	f := func(a, b []uint64) {
+		t.Helper()
+		var sa, sb Set
+		sa.AddMulti(a)
+		sb.AddMulti(b)
+		ma := make(map[uint64]bool)
+		for _, x := range a {
+			ma[x] = true
+		}
+		mb := make(map[uint64]bool)
+		for _, x := range b {
+			mb[x] = true
+		}
+		intersectionLen := 0
+		for x := range ma {
+			if mb[x] {
+				intersectionLen++
+			}
+		}
+		unionLen := len(ma) + len(mb) - intersectionLen
+		var expected Similarity
+		expected.IntersectionLen = intersectionLen
+		expected.UnionLen = unionLen
+		if intersectionLen > 0 {
+			minLen := len(ma)
+			if len(mb) < minLen {
+				minLen = len(mb)
+			}
+			expected.Jaccard = float64(intersectionLen) / float64(unionLen)
+			expected.Dice = 2 * float64(intersectionLen) / float64(len(ma)+len(mb))
+			expected.Overlap = float64(intersectionLen) / float64(minLen)
+			expected.Cosine = float64(intersectionLen) / math.Sqrt(float64(len(ma))*float64(len(mb)))
+		}
+		if sim := sa.Similarities(&sb); sim != expected {
+			t.Fatalf("unexpected sa.Similarities(sb); got %+v; want %+v", sim, expected)
+		}
+		if sim := sb.Similarities(&sa); sim != expected {
+			t.Fatalf("unexpected sb.Similarities(sa); got %+v; want %+v", sim, expected)
+		}
+		if sa.Len() != len(ma) || sb.Len() != len(mb) {
+			t.Fatalf("Similarities mustn't modify the sets")
+		}
+	}
+	f(nil, nil)
+	f([]uint64{1, 2}, nil)
+	f([]uint64{1, 2}, []uint64{3, 4})
+	f([]uint64{1, 2}, []uint64{1, 2})
+	f([]uint64{1, 2}, []uint64{1, 2, 3, 4})
+	f([]uint64{1, 2, 1 << 32}, []uint64{1, 3, 1 << 32, 2 << 32})
+
+	// Dense and sparse buckets
+	var a, b []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*2))
+		b = append(b, uint64(i*3))
+	}
+	f(a, b)
+	f(a, b[:100])
+	f(a[:10], b)
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 1000; i++ {
+		a = append(a, uint64(rng.Int63()))
+		b = append(b, uint64(rng.Intn(1e7)))
+	}
+	f(a, b)
+}
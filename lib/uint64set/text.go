@@ -0,0 +1,81 @@
+package uint64set
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MarshalText implements encoding.TextMarshaler.
+//
+// It returns comma-separated sorted items of s, where runs of consecutive items are collapsed into
+// inclusive ranges, e.g. `1-5,9,20`. Empty string is returned for empty set.
+//
+// MarshalText can mutate s.
+func (s *Set) MarshalText() ([]byte, error) {
+	var dst []byte
+	s.forEachRange(func(first, last uint64) bool {
+		if len(dst) > 0 {
+			dst = append(dst, ',')
+		}
+		dst = strconv.AppendUint(dst, first, 10)
+		if last > first {
+			dst = append(dst, '-')
+			dst = strconv.AppendUint(dst, last, 10)
+		}
+		return true
+	})
+	return dst, nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+//
+// It replaces s contents with the items from data in the format returned by MarshalText.
+// Items and ranges may be listed in arbitrary order and they may overlap.
+// Whitespace around items and ranges is ignored. An error is returned if the ranges contain
+// more than 2^30 items in total.
+func (s *Set) UnmarshalText(data []byte) error {
+	s.checkWritable()
+	s.trackedSizeBytes = 0
+	var a Set
+	if str := strings.TrimSpace(string(data)); len(str) > 0 {
+		itemsCount := uint64(0)
+		for _, token := range strings.Split(str, ",") {
+			token = strings.TrimSpace(token)
+			first, last, err := parseTextRange(token)
+			if err != nil {
+				return fmt.Errorf("cannot unmarshal uint64set from %q: %w", data, err)
+			}
+			if last-first >= maxUnmarshalRangeItems-itemsCount {
+				return fmt.Errorf("cannot unmarshal uint64set from %q: too many items in ranges; cannot exceed %d items", data, maxUnmarshalRangeItems)
+			}
+			itemsCount += last - first + 1
+			a.addRange(first, last)
+		}
+	}
+	s.moveFrom(&a)
+	return nil
+}
+
+func parseTextRange(token string) (uint64, uint64, error) {
+	n := strings.IndexByte(token, '-')
+	if n < 0 {
+		x, err := strconv.ParseUint(token, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("cannot parse item %q: %w", token, err)
+		}
+		return x, x, nil
+	}
+	first, err := strconv.ParseUint(token[:n], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot parse the start of range %q: %w", token, err)
+	}
+	last, err := strconv.ParseUint(token[n+1:], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot parse the end of range %q: %w", token, err)
+	}
+	if first > last {
+		return 0, 0, fmt.Errorf("the start of range %q cannot exceed its end", token)
+	}
+	return first, last, nil
+}
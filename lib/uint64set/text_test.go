@@ -0,0 +1,110 @@
+package uint64set
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestMarshalUnmarshalText(t *testing.T) {
+	f := func(a []uint64, textExpected string) {
+		t.Helper()
+		var s Set
+		s.AddMulti(a)
+		data, err := s.MarshalText()
+		if err != nil {
+			t.Fatalf("unexpected error in MarshalText: %s", err)
+		}
+		// Skip the text check for non-empty sets with empty textExpected.
+		if textExpected != "" || len(a) == 0 {
+			if string(data) != textExpected {
+				t.Fatalf("unexpected text; got %q; want %q", data, textExpected)
+			}
+		}
+		var s2 Set
+		// Put some data into s2 in order to verify it is replaced by UnmarshalText.
+		s2.Add(1234567)
+		if err := s2.UnmarshalText(data); err != nil {
+			t.Fatalf("unexpected error in UnmarshalText: %s", err)
+		}
+		if !s2.Equal(&s) {
+			t.Fatalf("unexpected set after UnmarshalText(%q); got %d items; want %d items", data, s2.Len(), s.Len())
+		}
+	}
+	f(nil, "")
+	f([]uint64{0}, "0")
+	f([]uint64{9, 1, 2, 3, 4, 5, 20}, "1-5,9,20")
+	f([]uint64{1<<64 - 2, 1<<64 - 1}, "18446744073709551614-18446744073709551615")
+	f([]uint64{1<<32 - 1, 1 << 32}, "4294967295-4294967296")
+
+	var a []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i))
+	}
+	f(a, "0-99999")
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 1e3; i++ {
+		a = append(a, uint64(rng.Int63()))
+	}
+	f(a, "")
+}
+
+func TestUnmarshalText(t *testing.T) {
+	f := func(text string, a []uint64) {
+		t.Helper()
+		var s Set
+		if err := s.UnmarshalText([]byte(text)); err != nil {
+			t.Fatalf("unexpected error in UnmarshalText(%q): %s", text, err)
+		}
+		m := make(map[uint64]bool)
+		for _, x := range a {
+			m[x] = true
+		}
+		if err := expectEqual(&s, m); err != nil {
+			t.Fatalf("unexpected set after UnmarshalText(%q): %s", text, err)
+		}
+	}
+	f("", nil)
+	f("  ", nil)
+	f(" 5 ", []uint64{5})
+	f("3-5, 1,4", []uint64{1, 3, 4, 5})
+	f("7-7", []uint64{7})
+	f("65530-65540", []uint64{65530, 65531, 65532, 65533, 65534, 65535, 65536, 65537, 65538, 65539, 65540})
+
+	var a []uint64
+	for i := 0; i < 3e5; i++ {
+		a = append(a, 1<<32-1e5+uint64(i))
+	}
+	f("4294867296-4295167295", a)
+}
+
+func TestUnmarshalTextFailure(t *testing.T) {
+	f := func(text, errExpected string) {
+		t.Helper()
+		var s Set
+		s.Add(123)
+		err := s.UnmarshalText([]byte(text))
+		if err == nil {
+			t.Fatalf("expecting non-nil error for %q", text)
+		}
+		if !strings.Contains(err.Error(), errExpected) {
+			t.Fatalf("unexpected error; got %q; want containing %q", err, errExpected)
+		}
+		if !s.Has(123) || s.Len() != 1 {
+			t.Fatalf("the set mustn't change on error")
+		}
+	}
+	f("foo", "cannot parse item")
+	f("1,,2", "cannot parse item")
+	f("1,", "cannot parse item")
+	f("-1", "cannot parse the start of range")
+	f("1-", "cannot parse the end of range")
+	f("1-2-3", "cannot parse the end of range")
+	f("5-3", "cannot exceed its end")
+	f("18446744073709551616", "cannot parse item")
+
+	// Too many items
+	f("0-18446744073709551615", "too many items")
+	f("5-1073741829", "too many items")
+	f("1-536870912,536870913-1073741824,0", "too many items")
+}
@@ -6,6 +6,8 @@ import (
 	"sync"
 	"sync/atomic"
 	"unsafe"
+
+	"github.com/cespare/xxhash/v2"
 )
 
 // Set is a fast set for uint64.
@@ -14,15 +16,57 @@ import (
 // such as MetricIDs generated by lib/storage.
 //
 // It is unsafe calling Set methods from concurrent goroutines.
+// The exception is read-only methods in keepSorted mode - see SetKeepSorted.
 type Set struct {
 	itemsCount int
 	buckets    bucket32Sorter
 
+	// opts contains s settings, which are preserved when s items are replaced.
+	opts setOptions
+
+	// trackedSizeBytes is SizeBytes() value maintained incrementally by AddWithByteLimit.
+	// Zero means the value is unknown. It is reset by other methods, which may change SizeBytes().
+	trackedSizeBytes uint64
+
+	// bucketsSorted is set if buckets are known to be sorted by hi outside keepSorted mode.
+	// This allows looking up buckets via binary search. It is reset when a bucket is appended
+	// to the end of buckets. See addBucket32.
+	bucketsSorted bool
+
+	// sharedMemory is set if s may share buckets or bits arrays with other sets after UnionMayOwn.
+	// Such memory mustn't be re-used by PutSet and CloneInto.
+	sharedMemory bool
+
+	// hint may contain bucket index for the last Add or Del operation.
+	//
+	// It speeds up the operations, which are clustered by high 32 bits of items.
+	// It is verified before use, so it may be stale after the buckets are removed or re-ordered.
+	// Has doesn't update hint, since this may trash performance when many concurrent goroutines
+	// call Has from many CPU cores.
+	hint uint32
+
 	// Most likely the buckets contains only a single item, so put it here for performance reasons
 	// in order to improve memory locality.
 	scratchBuckets [1]bucket32
 }
 
+type setOptions struct {
+	// keepSorted indicates whether buckets must be kept sorted by hi on every modification.
+	keepSorted bool
+
+	// maxLen is the maximum number of items Add may add to the set. Zero means no limit.
+	maxLen int
+
+	// stickyDense indicates whether emptied bucket16 items keep their bits arrays. See SetStickyDense.
+	stickyDense bool
+
+	// readOnly indicates whether the set is backed by external read-only memory. See NewReadOnlyFromBytes.
+	readOnly bool
+
+	// alwaysDense indicates whether bucket16 items must be switched to bits arrays on the first added item. See SetAlwaysDense.
+	alwaysDense bool
+}
+
 type bucket32Sorter []bucket32
 
 func (s *bucket32Sorter) Len() int { return len(*s) }
@@ -36,13 +80,23 @@ func (s *bucket32Sorter) Swap(i, j int) {
 }
 
 // Clone returns an independent copy of s.
+//
+// The copy of read-only set can be modified.
 func (s *Set) Clone() *Set {
 	if s == nil || s.itemsCount == 0 {
 		// Return an empty set, so data could be added into it later.
-		return &Set{}
+		var dst Set
+		if s != nil {
+			dst.opts = s.opts
+			dst.opts.readOnly = false
+		}
+		return &dst
 	}
 	var dst Set
+	dst.opts = s.opts
+	dst.opts.readOnly = false
 	dst.itemsCount = s.itemsCount
+	dst.bucketsSorted = s.bucketsSorted
 	if len(s.buckets) == 1 {
 		dst.buckets = dst.scratchBuckets[:]
 	} else {
@@ -54,6 +108,170 @@ func (s *Set) Clone() *Set {
 	return &dst
 }
 
+// CloneInto makes dst an independent copy of s.
+//
+// It reuses dst memory, including dense bits arrays, when possible.
+// This reduces memory allocations when cloning sets into the same dst repeatedly.
+// dst memory isn't re-used if dst may share it with other sets after UnionMayOwn.
+func (s *Set) CloneInto(dst *Set) {
+	if s == dst {
+		return
+	}
+	dst.checkWritable()
+	dst.trackedSizeBytes = 0
+	n := 0
+	if s != nil {
+		n = len(s.buckets)
+	}
+	if n == 0 || dst.sharedMemory {
+		// Do not re-use dst memory shared with other sets.
+		dst.reset()
+	}
+	if n == 0 {
+		return
+	}
+	bs := dst.buckets
+	if cap(bs) < n {
+		if n == 1 {
+			// Do not reuse stale scratch bucket, since it may share memory with other sets.
+			dst.scratchBuckets[0] = bucket32{}
+			bs = dst.scratchBuckets[:]
+		} else {
+			bsNew := make([]bucket32, n)
+			copy(bsNew, bs)
+			bs = bsNew
+		}
+	}
+	for i := n; i < len(bs); i++ {
+		// Release memory occupied by the unused buckets.
+		bs[i] = bucket32{}
+	}
+	bs = bs[:n]
+	for i := range s.buckets {
+		s.buckets[i].copyToReuse(&bs[i])
+	}
+	dst.buckets = bs
+	dst.itemsCount = s.itemsCount
+	dst.bucketsSorted = s.bucketsSorted
+	if dst.opts.keepSorted {
+		dst.sort()
+	}
+	if dst.opts.alwaysDense {
+		dst.makeDense()
+	}
+}
+
+// SetKeepSorted enables or disables keepSorted mode for s.
+//
+// In keepSorted mode s maintains the internal buckets in sorted order on every modification,
+// so AppendTo, ForEach and other read-only methods don't mutate s and may be called
+// from concurrent goroutines under a read lock. ForEach passes items in ascending order in this mode.
+//
+// This mode slows down adding items with new high 32 bits to s, since the corresponding bucket
+// must be inserted in the middle of the sorted buckets. On the other hand, Has and Del stay fast for sets
+// with many distinct high 32 bits after any modification, since the buckets are always looked up via binary search.
+// Outside this mode the buckets are sorted for binary search by Add, so modifications such as Union
+// switch lookups to linear search until the next Add.
+func (s *Set) SetKeepSorted(keepSorted bool) {
+	s.checkWritable()
+	s.opts.keepSorted = keepSorted
+	if keepSorted {
+		s.sort()
+	}
+}
+
+// SetStickyDense enables or disables stickyDense mode for s.
+//
+// In stickyDense mode buckets switched to bits arrays keep the arrays after all their items are deleted
+// by methods such as ReplaceRange or Intersect, so the arrays are re-used when items are added to the buckets again.
+// Del and DelMulti always keep bits arrays.
+//
+// This mode reduces memory allocations and GC pressure for workloads, which repeatedly add and delete items
+// with the same high bits, at the cost of higher memory usage, since every such bucket occupies 8KiB
+// even if it is empty.
+func (s *Set) SetStickyDense(stickyDense bool) {
+	s.checkWritable()
+	s.opts.stickyDense = stickyDense
+}
+
+// SetAlwaysDense enables or disables alwaysDense mode for s.
+//
+// In alwaysDense mode Add and AddMulti switch buckets to bits arrays on the first added item
+// instead of storing items in small pools first. Existing buckets are switched to bits arrays
+// when the mode is enabled. Buckets added by Union, UnionRange, ReplaceRange, CloneInto and Unmarshal* calls
+// are switched to bits arrays too, while Optimize and ShrinkBucket keep bits arrays in this mode.
+//
+// This mode speeds up adding items to buckets, which become densely populated anyway, since it saves
+// the conversion from small pool to bits array. It may significantly increase memory usage for sparse buckets,
+// since every bucket occupies 8KiB in this mode. Use ReserveDense if only a known range of items is dense.
+func (s *Set) SetAlwaysDense(alwaysDense bool) {
+	s.checkWritable()
+	s.trackedSizeBytes = 0
+	s.opts.alwaysDense = alwaysDense
+	if alwaysDense {
+		s.makeDense()
+	}
+}
+
+// makeDense switches all the s buckets to bits arrays.
+func (s *Set) makeDense() {
+	for i := range s.buckets {
+		for _, b16 := range s.buckets[i].buckets {
+			b16.makeDense()
+		}
+	}
+}
+
+// Swap swaps the items between s and a.
+//
+// Both s and a are modified. Settings such as keepSorted mode stay with their sets.
+// Swap takes O(1) time, except of the case when the items from unsorted set are moved
+// to the set in keepSorted mode, since the buckets must be sorted then.
+//
+// Swap doesn't provide any locking, so concurrent access to s and a must be synchronized by the caller.
+func (s *Set) Swap(a *Set) {
+	s.checkWritable()
+	a.checkWritable()
+	if s == a {
+		return
+	}
+	var tmp Set
+	tmp.moveFrom(s)
+	s.moveFrom(a)
+	a.moveFrom(&tmp)
+}
+
+// reset removes all the items from s while preserving s settings.
+func (s *Set) reset() {
+	opts := s.opts
+	*s = Set{}
+	s.opts = opts
+}
+
+// moveFrom moves all the items from a to s while preserving s settings.
+//
+// a cannot be used after the call.
+func (s *Set) moveFrom(a *Set) {
+	s.itemsCount = a.itemsCount
+	if len(a.buckets) == 1 && &a.buckets[0] == &a.scratchBuckets[0] {
+		s.scratchBuckets = a.scratchBuckets
+		s.buckets = s.scratchBuckets[:]
+	} else {
+		// Drop the previous scratch bucket, since it may share memory with other sets after Swap.
+		s.scratchBuckets[0] = bucket32{}
+		s.buckets = a.buckets
+	}
+	s.sharedMemory = a.sharedMemory
+	s.trackedSizeBytes = a.trackedSizeBytes
+	s.bucketsSorted = a.bucketsSorted
+	if s.opts.keepSorted {
+		s.sort()
+	}
+	if s.opts.alwaysDense {
+		s.makeDense()
+	}
+}
+
 func (s *Set) fixItemsCount() {
 	n := 0
 	for i := range s.buckets {
@@ -73,17 +291,47 @@ func (s *Set) cloneShallow() *Set {
 }
 
 // SizeBytes returns an estimate size of s in RAM.
+//
+// The estimate includes the unused capacity retained by s after deleting items.
 func (s *Set) SizeBytes() uint64 {
 	if s == nil {
 		return 0
 	}
 	n := uint64(unsafe.Sizeof(*s))
+	if !s.hasScratchBuckets() {
+		// s.scratchBuckets is already counted in unsafe.Sizeof(*s).
+		n += getBuckets32SizeBytes(cap(s.buckets))
+	}
 	for i := range s.buckets {
 		n += s.buckets[i].sizeBytes()
 	}
 	return n
 }
 
+// getBuckets32SizeBytes returns the size of Set.buckets with the given capacity.
+func getBuckets32SizeBytes(capacity int) uint64 {
+	return uint64(capacity) * uint64(unsafe.Sizeof(bucket32{}))
+}
+
+// getBucket32ListsSizeBytes returns the size of bucket32.b16his and bucket32.buckets with the given capacities.
+func getBucket32ListsSizeBytes(hisCap, bucketsCap int) uint64 {
+	return uint64(hisCap)*uint64(unsafe.Sizeof(uint16(0))) + uint64(bucketsCap)*uint64(unsafe.Sizeof((*bucket16)(nil)))
+}
+
+// getBucket16SizeBytes returns the size of bucket16 with or without bits array.
+func getBucket16SizeBytes(dense bool) uint64 {
+	n := unsafe.Sizeof(bucket16{})
+	if dense {
+		n += unsafe.Sizeof([wordsPerBucket]uint64{})
+	}
+	return uint64(n)
+}
+
+// hasScratchBuckets returns true if s.buckets points to s.scratchBuckets.
+func (s *Set) hasScratchBuckets() bool {
+	return cap(s.buckets) > 0 && &s.buckets[:1][0] == &s.scratchBuckets[0]
+}
+
 // Len returns the number of distinct uint64 values in s.
 func (s *Set) Len() int {
 	if s == nil {
@@ -92,42 +340,233 @@ func (s *Set) Len() int {
 	return s.itemsCount
 }
 
+// IsEmpty returns true if s has no items.
+func (s *Set) IsEmpty() bool {
+	return s.Len() == 0
+}
+
+// IsSingleton returns the only item in s if s contains exactly one item.
+//
+// Otherwise false is returned.
+func (s *Set) IsSingleton() (uint64, bool) {
+	if s.Len() != 1 {
+		return 0, false
+	}
+	for i := range s.buckets {
+		if x, ok := s.buckets[i].min(); ok {
+			return x, true
+		}
+	}
+	return 0, false
+}
+
+// SetMaxLen limits the number of items, which can be added to s via Add, by maxLen.
+//
+// Add ignores new items when s contains maxLen or more items. Bulk methods such as AddMulti and Union ignore the limit.
+// Zero or negative maxLen removes the limit.
+func (s *Set) SetMaxLen(maxLen int) {
+	s.checkWritable()
+	if maxLen < 0 {
+		maxLen = 0
+	}
+	s.opts.maxLen = maxLen
+}
+
+// AddWithLimit adds x to s if s contains less than maxLen items.
+//
+// It returns whether x has been added to s and whether s contains at least maxLen items after the call.
+// Existing items are always accepted, i.e. false is returned for added when x already exists in s.
+//
+// The limit set via SetMaxLen is respected too.
+func (s *Set) AddWithLimit(x uint64, maxLen int) (added, atLimit bool) {
+	if s.opts.maxLen > 0 && s.opts.maxLen < maxLen {
+		maxLen = s.opts.maxLen
+	}
+	n := s.itemsCount
+	if n >= maxLen {
+		return false, true
+	}
+	s.Add(x)
+	return s.itemsCount > n, s.itemsCount >= maxLen
+}
+
+// AddWithByteLimit adds x to s if this doesn't make s.SizeBytes() bigger than maxBytes.
+//
+// It returns whether x has been added to s and whether x has been rejected because of the limit.
+// Existing items are always accepted, i.e. false is returned for both values when x already exists in s.
+// The limit set via SetMaxLen is respected too.
+//
+// The size of s is tracked incrementally between subsequent AddWithByteLimit calls, so they don't
+// need to visit all the buckets in s. The size is recalculated via SizeBytes after s is modified
+// by other methods. This allows limiting the memory occupied by sets built from untrusted input.
+func (s *Set) AddWithByteLimit(x uint64, maxBytes uint64) (added, atLimit bool) {
+	s.checkWritable()
+	if s.trackedSizeBytes == 0 {
+		s.trackedSizeBytes = s.SizeBytes()
+	}
+	if s.Has(x) {
+		return false, false
+	}
+	if s.opts.maxLen > 0 && s.itemsCount >= s.opts.maxLen {
+		return false, true
+	}
+
+	// Calculate the size of s after adding x.
+	hi32 := uint32(x >> 32)
+	lo32 := uint32(x)
+	sizeNew := s.trackedSizeBytes
+	bucketsCap := 0
+	hisCap := 0
+	refsCap := 0
+	b32 := s.getBucket32(hi32)
+	if b32 == nil {
+		bs := s.buckets
+		if len(bs) == 0 || len(bs) == cap(bs) {
+			// s.buckets is switched to s.scratchBuckets or it is re-allocated.
+			if !s.hasScratchBuckets() {
+				sizeNew -= getBuckets32SizeBytes(cap(bs))
+			}
+			if len(bs) > 0 {
+				bucketsCap = getGrownCap(len(bs))
+				sizeNew += getBuckets32SizeBytes(bucketsCap)
+			}
+		}
+		// The new bucket32 gets lists with a single item.
+		sizeNew += getBucket32ListsSizeBytes(1, 1) + getBucket16SizeBytes(s.opts.alwaysDense)
+	} else if b16 := b32.getBucket16(uint16(lo32 >> 16)); b16 == nil {
+		hisCap = cap(b32.b16his)
+		if len(b32.b16his) == hisCap {
+			hisCap = getGrownCap(hisCap)
+		}
+		refsCap = cap(b32.buckets)
+		if len(b32.buckets) == refsCap {
+			refsCap = getGrownCap(refsCap)
+		}
+		sizeNew += getBucket32ListsSizeBytes(hisCap, refsCap) + getBucket16SizeBytes(s.opts.alwaysDense)
+		sizeNew -= getBucket32ListsSizeBytes(cap(b32.b16his), cap(b32.buckets))
+	} else if b16.bits == nil && b16.smallPoolLen >= smallPoolSize {
+		// The small pool is switched to bits array.
+		sizeNew += getBucket16SizeBytes(true) - getBucket16SizeBytes(false)
+	}
+	if sizeNew > maxBytes {
+		return false, true
+	}
+
+	// Grow lists to the capacity used in the calculations above and add x.
+	if b32 == nil {
+		if bucketsCap > 0 {
+			s.growBuckets(bucketsCap - len(s.buckets))
+		}
+		b32 = s.createBucket32(hi32)
+		b32.b16his = make([]uint16, 0, 1)
+		b32.buckets = make([]*bucket16, 0, 1)
+	} else {
+		if hisCap > cap(b32.b16his) {
+			his := make([]uint16, len(b32.b16his), hisCap)
+			copy(his, b32.b16his)
+			b32.b16his = his
+		}
+		if refsCap > cap(b32.buckets) {
+			bs := make([]*bucket16, len(b32.buckets), refsCap)
+			copy(bs, b32.buckets)
+			b32.buckets = bs
+		}
+	}
+	_ = b32.add(lo32, s.opts.alwaysDense)
+	s.itemsCount++
+	s.trackedSizeBytes = sizeNew
+	return true, false
+}
+
+// getGrownCap returns the capacity for the list with n items, which needs room for a new item.
+func getGrownCap(n int) int {
+	if n < 256 {
+		return 2*n + 1
+	}
+	return n + n/4
+}
+
 // Add adds x to s.
+//
+// x is ignored if s already contains the maximum number of items set via SetMaxLen.
 func (s *Set) Add(x uint64) {
+	s.checkWritable()
+	if s.opts.maxLen > 0 && s.itemsCount >= s.opts.maxLen {
+		if !s.Has(x) {
+			return
+		}
+	}
+	if len(s.buckets) > maxLinearSearchBuckets32 && !s.opts.keepSorted && !s.bucketsSorted {
+		// Sort buckets, so they are looked up via binary search. createBucket32 keeps them sorted.
+		s.sort()
+		s.bucketsSorted = true
+	}
 	hi32 := uint32(x >> 32)
 	lo32 := uint32(x)
 	bs := s.buckets
-	if len(bs) > 0 && bs[0].hi == hi32 {
+	if n := s.hint; n < uint32(len(bs)) && bs[n].hi == hi32 {
 		// Manually inline bucket32.add for performance reasons.
 		hi16 := uint16(lo32 >> 16)
 		lo16 := uint16(lo32)
-		b32 := &bs[0]
+		b32 := &bs[n]
 		his := b32.b16his
 		if n := b32.getHint(); n < uint32(len(his)) && his[n] == hi16 {
 			bs := b32.buckets
 			if n < uint32(len(bs)) && bs[n].add(lo16) {
 				s.itemsCount++
+				s.trackedSizeBytes = 0
 			}
 			return
 		}
-		if b32.addSlow(hi16, lo16) {
+		if b32.addSlow(hi16, lo16, s.opts.alwaysDense) {
 			s.itemsCount++
+			s.trackedSizeBytes = 0
 		}
 		return
 	}
-	for i := range bs {
-		b32 := &bs[i]
-		if b32.hi == hi32 {
-			if b32.add(lo32) {
-				s.itemsCount++
-			}
-			return
+	if n := s.searchBucket32(hi32); n >= 0 {
+		s.hint = uint32(n)
+		if bs[n].add(lo32, s.opts.alwaysDense) {
+			s.itemsCount++
+			s.trackedSizeBytes = 0
 		}
+		return
 	}
-	b32 := s.addBucket32()
-	b32.hi = hi32
-	_ = b32.add(lo32)
+	b32 := s.createBucket32(hi32)
+	_ = b32.add(lo32, s.opts.alwaysDense)
 	s.itemsCount++
+	s.trackedSizeBytes = 0
+}
+
+// ReserveDense pre-allocates dense bits arrays for all the buckets with 2^16 items, which intersect the range [lo, hi).
+//
+// Subsequent additions of items from the range to s are performed via bit setting without any memory allocations.
+// This is useful when the range is expected to be densely populated.
+//
+// ReserveDense allocates 8KB of memory per every 2^16 values in the range,
+// so it may over-allocate memory for the range containing only a few items.
+func (s *Set) ReserveDense(lo, hi uint64) {
+	s.checkWritable()
+	if lo >= hi {
+		return
+	}
+	s.trackedSizeBytes = 0
+	var b32 *bucket32
+	x := lo &^ (bitsPerBucket - 1)
+	for {
+		hi32 := uint32(x >> 32)
+		if b32 == nil || b32.hi != hi32 {
+			b32 = s.getOrCreateBucket32(hi32)
+		}
+		b16 := b32.getOrCreateBucket16(uint16(x >> 16))
+		b16.makeDense()
+		xNext := x + bitsPerBucket
+		if xNext < x || xNext >= hi {
+			// The end of the range or uint64 overflow.
+			return
+		}
+		x = xNext
+	}
 }
 
 // AddMulti adds all the items from a to s.
@@ -136,9 +575,11 @@ func (s *Set) Add(x uint64) {
 //
 // The caller is responsible for splitting a into items with clustered values.
 func (s *Set) AddMulti(a []uint64) {
+	s.checkWritable()
 	if len(a) == 0 {
 		return
 	}
+	s.trackedSizeBytes = 0
 	hiPrev := uint32(a[0] >> 32)
 	i := 0
 	for j, x := range a {
@@ -147,128 +588,616 @@ func (s *Set) AddMulti(a []uint64) {
 			continue
 		}
 		b32 := s.getOrCreateBucket32(hiPrev)
-		s.itemsCount += b32.addMulti(a[i:j])
+		s.itemsCount += b32.addMulti(a[i:j], s.opts.alwaysDense)
 		hiPrev = hi
 		i = j
 	}
 	b32 := s.getOrCreateBucket32(hiPrev)
-	s.itemsCount += b32.addMulti(a[i:])
+	s.itemsCount += b32.addMulti(a[i:], s.opts.alwaysDense)
 }
 
-func (s *Set) getOrCreateBucket32(hi uint32) *bucket32 {
-	bs := s.buckets
-	for i := range bs {
-		if bs[i].hi == hi {
-			return &bs[i]
+// AddSortedSlices adds all the items from slices to s.
+//
+// Every slice must be sorted in ascending order. Slices are merged in global ascending order
+// of buckets with 2^16 items, so every bucket is looked up only once and the lookup cursor moves forward only.
+// Buckets receiving more than smallPoolSize items are switched to bits arrays in advance.
+// This is faster than calling AddMulti for every slice separately when slices contain interleaved items.
+// Unsorted slices are added correctly too, but the merge becomes slower for them.
+//
+// slices aren't modified.
+func (s *Set) AddSortedSlices(slices ...[]uint64) {
+	s.checkWritable()
+	s.trackedSizeBytes = 0
+	// Copy slice headers, since they are advanced during the merge.
+	heads := make([][]uint64, 0, len(slices))
+	for _, a := range slices {
+		if len(a) > 0 {
+			heads = append(heads, a)
 		}
 	}
-	b32 := s.addBucket32()
-	b32.hi = hi
-	return b32
-}
+	ends := make([]int, len(heads))
+	var b32 *bucket32
+	for len(heads) > 0 {
+		// Find the smallest bucket16 prefix among the heads.
+		prefix := heads[0][0] >> 16
+		for _, a := range heads[1:] {
+			if p := a[0] >> 16; p < prefix {
+				prefix = p
+			}
+		}
+		n := 0
+		for i, a := range heads {
+			j := 0
+			for j < len(a) && a[j]>>16 == prefix {
+				j++
+			}
+			ends[i] = j
+			n += j
+		}
 
-func (s *Set) addBucket32() *bucket32 {
-	if len(s.buckets) == 0 {
-		s.buckets = s.scratchBuckets[:]
-	} else {
-		s.buckets = append(s.buckets, bucket32{})
+		if hi := uint32(prefix >> 16); b32 == nil || b32.hi != hi {
+			b32 = s.getOrCreateBucket32(hi)
+		}
+		b16 := b32.getOrCreateBucket16(uint16(prefix))
+		prevLen := -1
+		if b16.bits == nil && (s.opts.alwaysDense || n > smallPoolSize) {
+			prevLen = b16.smallPoolLen
+			b16.makeDense()
+		}
+		count := 0
+		dst := heads[:0]
+		for i, a := range heads {
+			count += b16.addMulti(a[:ends[i]])
+			if a = a[ends[i]:]; len(a) > 0 {
+				dst = append(dst, a)
+			}
+		}
+		heads = dst
+		s.itemsCount += count
+		if prevLen >= 0 && prevLen+count <= smallPoolSize && !s.opts.alwaysDense {
+			// The slices contained duplicate items, so b16 fits the small pool.
+			b16.makeSmallIfPossible()
+		}
 	}
-	return &s.buckets[len(s.buckets)-1]
 }
 
-// Has verifies whether x exists in s.
-func (s *Set) Has(x uint64) bool {
-	if s == nil {
-		return false
+// DelMulti deletes all the items in a from s.
+//
+// It works faster than calling Del for every item in a if a items are grouped by their high bits,
+// e.g. if a is sorted.
+// In the same way as Del, DelMulti leaves empty buckets in s.
+func (s *Set) DelMulti(a []uint64) {
+	s.checkWritable()
+	if len(a) == 0 || s.Len() == 0 {
+		return
 	}
-	hi32 := uint32(x >> 32)
-	lo32 := uint32(x)
-	bs := s.buckets
-	for i := range bs {
-		b32 := &bs[i]
-		if b32.hi == hi32 {
-			return b32.has(lo32)
+	hiPrev := uint32(a[0] >> 32)
+	i := 0
+	for j, x := range a {
+		hi := uint32(x >> 32)
+		if hi == hiPrev {
+			continue
 		}
+		if b32 := s.getBucket32(hiPrev); b32 != nil {
+			s.itemsCount -= b32.delMulti(a[i:j])
+		}
+		hiPrev = hi
+		i = j
+	}
+	if b32 := s.getBucket32(hiPrev); b32 != nil {
+		s.itemsCount -= b32.delMulti(a[i:])
 	}
-	return false
 }
 
-// Del deletes x from s.
-func (s *Set) Del(x uint64) {
-	hi := uint32(x >> 32)
-	lo := uint32(x)
-	bs := s.buckets
-	if len(bs) > 0 && bs[0].hi == hi {
-		if bs[0].del(lo) {
-			s.itemsCount--
+// Apply adds all the items from adds to s and then deletes all the items in dels from s.
+//
+// Items from dels are deleted after adding items from adds, so items contained in both adds and dels
+// are missing in s after the call. If adds is sorted, then the bucket found for adds is reused for dels
+// with the same upper 32 bits instead of looking it up again.
+// Otherwise Apply works the same as AddMulti(adds) followed by DelMulti(dels).
+// In the same way as Del, Apply leaves empty buckets in s.
+func (s *Set) Apply(adds, dels []uint64) {
+	s.checkWritable()
+	s.trackedSizeBytes = 0
+	for k := 1; k < len(adds); k++ {
+		if adds[k]>>32 < adds[k-1]>>32 {
+			// Slow path - adds must be applied in full before dels, since they aren't grouped by buckets.
+			s.AddMulti(adds)
+			s.DelMulti(dels)
+			return
 		}
-		return
 	}
-	for i := range bs {
-		b32 := &bs[i]
-		if b32.hi == hi {
-			if b32.del(lo) {
-				s.itemsCount--
+	i := 0
+	for len(dels) > 0 {
+		hi := uint32(dels[0] >> 32)
+		j := 1
+		for j < len(dels) && uint32(dels[j]>>32) == hi {
+			j++
+		}
+		// Add items from the buckets up to hi, so they are deleted after the addition.
+		var b32 *bucket32
+		for i < len(adds) && uint32(adds[i]>>32) <= hi {
+			hiAdd := uint32(adds[i] >> 32)
+			k := i + 1
+			for k < len(adds) && uint32(adds[k]>>32) == hiAdd {
+				k++
 			}
-			return
+			b32 = s.getOrCreateBucket32(hiAdd)
+			s.itemsCount += b32.addMulti(adds[i:k], s.opts.alwaysDense)
+			i = k
+		}
+		if b32 == nil || b32.hi != hi {
+			b32 = s.getBucket32(hi)
 		}
+		if b32 != nil {
+			s.itemsCount -= b32.delMulti(dels[:j])
+		}
+		dels = dels[j:]
 	}
+	s.AddMulti(adds[i:])
 }
 
-// AppendTo appends all the items from the set to dst and returns the result.
-//
-// The returned items are sorted.
-//
-// AppendTo can mutate s.
-func (s *Set) AppendTo(dst []uint64) []uint64 {
-	if s == nil {
-		return dst
-	}
-
-	// pre-allocate memory for dst
-	dstLen := len(dst)
-	if n := s.Len() - cap(dst) + dstLen; n > 0 {
-		dst = append(dst[:cap(dst)], make([]uint64, n)...)
-		dst = dst[:dstLen]
-	}
-	s.sort()
-	for i := range s.buckets {
-		dst = s.buckets[i].appendTo(dst)
+func (s *Set) getOrCreateBucket32(hi uint32) *bucket32 {
+	if n := s.searchBucket32(hi); n >= 0 {
+		s.hint = uint32(n)
+		return &s.buckets[n]
 	}
-	return dst
+	return s.createBucket32(hi)
 }
 
-func (s *Set) sort() {
-	// sort s.buckets if it isn't sorted yet
-	if !sort.IsSorted(&s.buckets) {
-		sort.Sort(&s.buckets)
+// maxLinearSearchBuckets32 is the maximum number of buckets in s, which are searched linearly.
+//
+// Bigger number of sorted buckets is searched via binary search. BenchmarkAddManyPrefixes shows
+// that it is faster than the linear search only for big number of buckets.
+// Add sorts buckets when their number exceeds this value.
+const maxLinearSearchBuckets32 = 64
+
+func (s *Set) getBucket32(hi uint32) *bucket32 {
+	n := s.searchBucket32(hi)
+	if n < 0 {
+		return nil
 	}
+	return &s.buckets[n]
 }
 
-// Union adds all the items from a to s.
-func (s *Set) Union(a *Set) {
-	s.union(a, false)
+// searchBucket32 returns the index of the bucket with the given hi in s.buckets.
+//
+// -1 is returned if s has no such bucket.
+func (s *Set) searchBucket32(hi uint32) int {
+	bs := s.buckets
+	if n := s.hint; n < uint32(len(bs)) && bs[n].hi == hi {
+		// Fast path - use the bucket from the previous operation.
+		return int(n)
+	}
+	if len(bs) > maxLinearSearchBuckets32 && (s.opts.keepSorted || s.bucketsSorted) {
+		return binarySearchBucket32(bs, hi)
+	}
+	for i := range bs {
+		if bs[i].hi == hi {
+			return i
+		}
+	}
+	return -1
 }
 
-// UnionMayOwn adds all the items from a to s.
+// binarySearchBucket32 returns the index of the bucket with the given hi in bs sorted by hi.
 //
-// It may own a if s is empty. This means that `a` cannot be used
+// -1 is returned if bs has no such bucket.
+func binarySearchBucket32(bs []bucket32, hi uint32) int {
+	i, j := 0, len(bs)
+	for i < j {
+		h := int(uint(i+j) >> 1)
+		if bs[h].hi < hi {
+			i = h + 1
+		} else {
+			j = h
+		}
+	}
+	if i < len(bs) && bs[i].hi == hi {
+		return i
+	}
+	return -1
+}
+
+// createBucket32 adds new bucket32 with the given hi to s.
+//
+// The bucket is inserted at the sorted position in keepSorted mode or if s buckets are known to be sorted.
+func (s *Set) createBucket32(hi uint32) *bucket32 {
+	b32 := s.appendBucket32()
+	b32.hi = hi
+	bs := s.buckets
+	n := len(bs) - 1
+	if !s.opts.keepSorted && !s.bucketsSorted {
+		s.hint = uint32(n)
+		return b32
+	}
+	pos := sort.Search(n, func(i int) bool {
+		return bs[i].hi > hi
+	})
+	s.hint = uint32(pos)
+	if pos == n {
+		return b32
+	}
+	b := bs[n]
+	copy(bs[pos+1:], bs[pos:n])
+	bs[pos] = b
+	return &bs[pos]
+}
+
+// growBuckets makes sure s.buckets has enough capacity for adding n buckets without reallocation.
+func (s *Set) growBuckets(n int) {
+	bs := s.buckets
+	if cap(bs)-len(bs) >= n {
+		return
+	}
+	bsNew := make([]bucket32, len(bs), len(bs)+n)
+	copy(bsNew, bs)
+	s.buckets = bsNew
+}
+
+// getMissingBuckets32Count returns the number of buckets in a with hi missing in b.
+//
+// Both a and b must be sorted by hi.
+func getMissingBuckets32Count(b, a []bucket32) int {
+	n := 0
+	i := 0
+	for j := range a {
+		for i < len(b) && b[i].hi < a[j].hi {
+			i++
+		}
+		if i >= len(b) || b[i].hi != a[j].hi {
+			n++
+		}
+	}
+	return n
+}
+
+// addBucket32 appends new bucket32 to s.
+//
+// The appended bucket may violate the order of buckets, so s.bucketsSorted is reset.
+// Use createBucket32 for preserving the order.
+func (s *Set) addBucket32() *bucket32 {
+	s.bucketsSorted = false
+	return s.appendBucket32()
+}
+
+func (s *Set) appendBucket32() *bucket32 {
+	if len(s.buckets) == 0 {
+		// Clear s.scratchBuckets, since it may contain stale data after removing buckets from s.
+		s.scratchBuckets[0] = bucket32{}
+		s.buckets = s.scratchBuckets[:]
+	} else {
+		s.buckets = append(s.buckets, bucket32{})
+	}
+	return &s.buckets[len(s.buckets)-1]
+}
+
+// Has verifies whether x exists in s.
+func (s *Set) Has(x uint64) bool {
+	if s == nil {
+		return false
+	}
+	b32 := s.getBucket32(uint32(x >> 32))
+	return b32 != nil && b32.has(uint32(x))
+}
+
+// ContainsAll returns true if s contains all the items from xs.
+//
+// It is optimized for the case when xs contains a few items, while s is big.
+// It returns true for empty xs.
+//
+// The lookup is faster if items with the same high 32 bits are adjacent in xs.
+func (s *Set) ContainsAll(xs []uint64) bool {
+	if len(xs) == 0 {
+		return true
+	}
+	if s.Len() == 0 {
+		return false
+	}
+	hiPrev := uint32(xs[0] >> 32)
+	b32 := s.getBucket32(hiPrev)
+	for _, x := range xs {
+		if hi := uint32(x >> 32); hi != hiPrev {
+			b32 = s.getBucket32(hi)
+			hiPrev = hi
+		}
+		if b32 == nil || !b32.has(uint32(x)) {
+			return false
+		}
+	}
+	return true
+}
+
+// UnionCountWithSorted returns the number of unique items in the union of s and sorted.
+//
+// sorted must contain items sorted in ascending order. Duplicate items in sorted are counted once.
+// s isn't modified.
+func (s *Set) UnionCountWithSorted(sorted []uint64) int {
+	n := s.Len()
+	for i, x := range sorted {
+		if i > 0 && x == sorted[i-1] {
+			continue
+		}
+		if !s.Has(x) {
+			n++
+		}
+	}
+	return n
+}
+
+// Del deletes x from s.
+func (s *Set) Del(x uint64) {
+	s.checkWritable()
+	hi := uint32(x >> 32)
+	lo := uint32(x)
+	n := s.searchBucket32(hi)
+	if n < 0 {
+		return
+	}
+	s.hint = uint32(n)
+	if s.buckets[n].del(lo) {
+		s.itemsCount--
+	}
+}
+
+// AppendTo appends all the items from the set to dst and returns the result.
+//
+// The returned items are sorted.
+//
+// AppendTo can mutate s.
+func (s *Set) AppendTo(dst []uint64) []uint64 {
+	if s == nil {
+		return dst
+	}
+
+	// pre-allocate memory for dst
+	dstLen := len(dst)
+	if n := s.Len() - cap(dst) + dstLen; n > 0 {
+		dst = append(dst[:cap(dst)], make([]uint64, n)...)
+		dst = dst[:dstLen]
+	}
+	s.sort()
+	for i := range s.buckets {
+		dst = s.buckets[i].appendTo(dst)
+	}
+	return dst
+}
+
+// ToSortedSlice returns a new slice with all the items from the set in ascending order.
+//
+// Unlike AppendTo(nil), which may over-allocate when appending to dst, it allocates the slice
+// with the capacity equal to s.Len() exactly once, so cap(result) == len(result) == s.Len().
+// nil is returned for an empty set.
+//
+// ToSortedSlice can mutate s.
+func (s *Set) ToSortedSlice() []uint64 {
+	n := s.Len()
+	if n == 0 {
+		return nil
+	}
+	dst := make([]uint64, 0, n)
+	s.sort()
+	for i := range s.buckets {
+		dst = s.buckets[i].appendTo(dst)
+	}
+	return dst
+}
+
+// AppendAllTo appends all the items from sets to dst and returns the result.
+//
+// Items from every set are appended as a sorted block, while blocks follow in the order of sets.
+// The returned items aren't sorted globally across sets and they may contain duplicates
+// if the same item exists in multiple sets.
+//
+// AppendAllTo can mutate sets.
+func AppendAllTo(dst []uint64, sets ...*Set) []uint64 {
+	// pre-allocate memory for dst
+	n := 0
+	for _, s := range sets {
+		n += s.Len()
+	}
+	dstLen := len(dst)
+	if n := n - cap(dst) + dstLen; n > 0 {
+		dst = append(dst[:cap(dst)], make([]uint64, n)...)
+		dst = dst[:dstLen]
+	}
+	for _, s := range sets {
+		dst = s.AppendTo(dst)
+	}
+	return dst
+}
+
+// AppendMergedTo appends the sorted union of items from s and sorted to dst and returns the result.
+//
+// sorted must contain items in ascending order. Duplicate items are appended to dst only once.
+//
+// AppendMergedTo can mutate s.
+func (s *Set) AppendMergedTo(dst, sorted []uint64) []uint64 {
+	if s.Len() == 0 && len(sorted) == 0 {
+		return dst
+	}
+	var prev uint64
+	hasPrev := false
+	appendItem := func(x uint64) {
+		if hasPrev && x == prev {
+			return
+		}
+		dst = append(dst, x)
+		prev = x
+		hasPrev = true
+	}
+	if s != nil {
+		s.sort()
+	}
+	i := 0
+	s.ForEach(func(part []uint64) bool {
+		for _, x := range part {
+			for i < len(sorted) && sorted[i] < x {
+				appendItem(sorted[i])
+				i++
+			}
+			appendItem(x)
+		}
+		return true
+	})
+	for _, x := range sorted[i:] {
+		appendItem(x)
+	}
+	return dst
+}
+
+// AppendMissingTo appends items from s, which are missing in a, to dst and returns the result.
+//
+// The appended items are sorted.
+//
+// AppendMissingTo can mutate s.
+func (s *Set) AppendMissingTo(dst []uint64, a *Set) []uint64 {
+	if s.Len() == 0 {
+		return dst
+	}
+	s.sort()
+	for i := range s.buckets {
+		b32 := &s.buckets[i]
+		var a32 *bucket32
+		if a != nil {
+			a32 = a.getBucket32(b32.hi)
+		}
+		dst = b32.appendMissingTo(dst, a32)
+	}
+	return dst
+}
+
+func (s *Set) sort() {
+	// sort s.buckets if it isn't sorted yet
+	if !sort.IsSorted(&s.buckets) {
+		sort.Sort(&s.buckets)
+	}
+}
+
+// SortNow sorts s internal structures, so subsequent calls to AppendTo, ForEach
+// and other methods, which need sorted items, don't pay the sorting cost.
+//
+// This allows controlling the moment when the sorting cost is paid, e.g. after adding many items
+// and before serving read-only requests. Subsequent modifications of s may break the sorted order again.
+// See also SetKeepSorted.
+func (s *Set) SortNow() {
+	s.checkWritable()
+	if s == nil {
+		return
+	}
+	s.sort()
+	for i := range s.buckets {
+		for _, b16 := range s.buckets[i].buckets {
+			b16.sortSmallPool()
+		}
+	}
+}
+
+// Union adds all the items from a to s.
+func (s *Set) Union(a *Set) {
+	s.union(a, false, false)
+}
+
+// UnionWithCallback adds all the items from a to s and reports the kind of every a item via callbacks.
+//
+// onNew is called for items missing in s before the call, while onExisting is called for items,
+// which already exist in s. This allows maintaining external counters such as reference counts
+// for s items without a separate pass over a. The callbacks are called in arbitrary order of items.
+// nil callbacks are skipped. UnionWithCallback works like Union if both callbacks are nil.
+// The callbacks mustn't modify s and a.
+func (s *Set) UnionWithCallback(a *Set, onExisting, onNew func(x uint64)) {
+	s.checkWritable()
+	if onExisting == nil && onNew == nil {
+		s.Union(a)
+		return
+	}
+	if a.Len() == 0 {
+		return
+	}
+	s.trackedSizeBytes = 0
+	alwaysDense := s.opts.alwaysDense
+	for i := range a.buckets {
+		b32 := &a.buckets[i]
+		if b32.getLen() == 0 {
+			continue
+		}
+		dst := s.getOrCreateBucket32(b32.hi)
+		b32.forEach(func(part []uint64) bool {
+			for _, x := range part {
+				if dst.add(uint32(x), alwaysDense) {
+					s.itemsCount++
+					if onNew != nil {
+						onNew(x)
+					}
+				} else if onExisting != nil {
+					onExisting(x)
+				}
+			}
+			return true
+		})
+	}
+}
+
+// UnionMayOwn adds all the items from a to s.
+//
+// It may own a if s is empty. This means that `a` cannot be used
 // after the call to UnionMayOwn.
 func (s *Set) UnionMayOwn(a *Set) {
-	s.union(a, true)
+	s.union(a, true, false)
+}
+
+// UnionMayOwnN returns a new set containing items from all the sets.
+//
+// It may own any of the sets and their buckets in order to reduce memory allocations:
+// the biggest set becomes the base for the result, while buckets from other sets are moved
+// to the result instead of being copied when possible. This means that none of the sets
+// can be used after the call to UnionMayOwnN.
+func UnionMayOwnN(sets ...*Set) *Set {
+	var base *Set
+	for _, a := range sets {
+		if a.Len() > base.Len() {
+			base = a
+		}
+	}
+	var dst Set
+	if base == nil {
+		return &dst
+	}
+	dst.union(base, true, true)
+	for _, a := range sets {
+		if a != base {
+			dst.union(a, true, true)
+		}
+	}
+	return &dst
 }
 
-func (s *Set) union(a *Set, mayOwn bool) {
+// union adds a items to s.
+//
+// If mayOwn is set, then s may own a items if s is empty, and it may share a buckets with bits arrays.
+// If mayOwnBuckets is set, then a buckets missing in s may be moved to s instead of copying them.
+func (s *Set) union(a *Set, mayOwn, mayOwnBuckets bool) {
+	s.checkWritable()
+	if a != nil && a.opts.readOnly {
+		// a items are backed by read-only memory, so they cannot be owned by s.
+		mayOwn = false
+		mayOwnBuckets = false
+	}
 	if a.Len() == 0 {
 		// Fast path - nothing to union.
 		return
 	}
+	s.trackedSizeBytes = 0
+	if mayOwn {
+		s.sharedMemory = true
+		a.sharedMemory = true
+	}
 	if s.Len() == 0 {
 		// Fast path - copy `a` to `s`.
 		if !mayOwn {
 			a = a.Clone()
 		}
-		*s = *a
+		s.moveFrom(a)
 		return
 	}
 	// Make shallow copy of `a`, since it can be modified by a.sort().
@@ -277,6 +1206,7 @@ func (s *Set) union(a *Set, mayOwn bool) {
 	}
 	a.sort()
 	s.sort()
+	s.growBuckets(getMissingBuckets32Count(s.buckets, a.buckets))
 	i := 0
 	j := 0
 	sBucketsLen := len(s.buckets)
@@ -286,71 +1216,991 @@ func (s *Set) union(a *Set, mayOwn bool) {
 		}
 		if i >= sBucketsLen {
 			for j < len(a.buckets) {
-				b32 := s.addBucket32()
-				a.buckets[j].copyTo(b32)
+				s.itemsCount += s.addBucket32From(&a.buckets[j], mayOwnBuckets)
 				j++
 			}
 			break
 		}
 		for j < len(a.buckets) && a.buckets[j].hi < s.buckets[i].hi {
-			b32 := s.addBucket32()
-			a.buckets[j].copyTo(b32)
+			s.itemsCount += s.addBucket32From(&a.buckets[j], mayOwnBuckets)
 			j++
 		}
 		if j >= len(a.buckets) {
 			break
 		}
 		if s.buckets[i].hi == a.buckets[j].hi {
-			s.buckets[i].union(&a.buckets[j], mayOwn)
+			s.itemsCount += s.buckets[i].union(&a.buckets[j], mayOwn)
 			i++
 			j++
 		}
 	}
-	s.fixItemsCount()
+	if s.opts.keepSorted {
+		// Restore buckets order, which could be violated by the merge above.
+		s.sort()
+	}
+	if s.opts.alwaysDense {
+		// Switch the buckets copied from a to bits arrays.
+		s.makeDense()
+	}
 }
 
-// Intersect removes all the items missing in a from s.
-func (s *Set) Intersect(a *Set) {
-	if s.Len() == 0 || a.Len() == 0 {
-		// Fast path - the result is empty.
-		*s = Set{}
+// addBucket32From adds a copy of a to s and returns the number of items in a.
+//
+// a is moved to s instead of copying if mayOwn is set.
+func (s *Set) addBucket32From(a *bucket32, mayOwn bool) int {
+	b32 := s.addBucket32()
+	if mayOwn {
+		b32.hi = a.hi
+		b32.b16his = a.b16his
+		b32.buckets = a.buckets
+		*a = bucket32{}
+	} else {
+		a.copyTo(b32)
+	}
+	return b32.getLen()
+}
+
+// UnionSmart adds all the items from a to s.
+//
+// It works like Union, but it chooses the cheaper strategy depending on the sizes of s and a:
+// if a is much smaller than s, then a items are added to s one-by-one instead of merging all the s buckets
+// with a buckets. If s is much smaller than a, then s items are added to a copy of a, which replaces s contents.
+// This makes the performance of UnionSmart insensitive to the order of its operands. a isn't modified.
+func (s *Set) UnionSmart(a *Set) {
+	s.checkWritable()
+	s.trackedSizeBytes = 0
+	if n := a.Len(); n > 0 && n < s.bucket16sCount()/4 {
+		s.addFrom(a)
 		return
 	}
-	// Make shallow copy of `a`, since it can be modified by a.sort().
-	a = a.cloneShallow()
-	a.sort()
-	s.sort()
-	i := 0
-	j := 0
-	for {
-		for i < len(s.buckets) && j < len(a.buckets) && s.buckets[i].hi < a.buckets[j].hi {
-			s.buckets[i] = bucket32{}
-			i++
-		}
-		if i >= len(s.buckets) {
-			break
+	if n := s.Len(); n > 0 && n < a.bucket16sCount()/4 {
+		c := a.Clone()
+		c.opts = s.opts
+		c.addFrom(s)
+		s.moveFrom(c)
+		return
+	}
+	s.Union(a)
+}
+
+// addFrom adds a items to s one-by-one.
+func (s *Set) addFrom(a *Set) {
+	a.ForEach(func(part []uint64) bool {
+		s.AddMulti(part)
+		return true
+	})
+}
+
+func (s *Set) bucket16sCount() int {
+	if s == nil {
+		return 0
+	}
+	n := 0
+	for i := range s.buckets {
+		n += len(s.buckets[i].buckets)
+	}
+	return n
+}
+
+// UnionRange adds all the items from a in the range [lo, hi) to s.
+//
+// Dense buckets from a are merged into s with bitwise ops. a buckets outside the range aren't visited,
+// since the first bucket in the range is located via binary search. This requires sorting a copy of bucket headers
+// if a buckets aren't sorted yet, e.g. outside keepSorted mode. a isn't modified.
+func (s *Set) UnionRange(a *Set, lo, hi uint64) {
+	s.checkWritable()
+	if a.Len() == 0 || lo >= hi {
+		// Fast path - nothing to union.
+		return
+	}
+	s.trackedSizeBytes = 0
+	// Skip a buckets below lo via binary search over sorted buckets.
+	bs := a.getSortedBuckets()
+	hi32 := uint32(lo >> 32)
+	iStart := sort.Search(len(bs), func(i int) bool {
+		return bs[i].hi >= hi32
+	})
+	for i := iStart; i < len(bs); i++ {
+		b32 := &bs[i]
+		base := uint64(b32.hi) << 32
+		if hi <= base {
+			break
+		}
+		jStart := 0
+		if lo > base {
+			jStart = b32.firstBucket16Index(uint16((lo - base) >> 16))
+		}
+		var dst *bucket32
+		for j := jStart; j < len(b32.buckets); j++ {
+			b16 := b32.buckets[j]
+			base16 := base | uint64(b32.b16his[j])<<16
+			if hi <= base16 {
+				break
+			}
+			loLocal := 0
+			if lo > base16 {
+				if lo-base16 >= bitsPerBucket {
+					continue
+				}
+				loLocal = int(lo - base16)
+			}
+			hiLocal := bitsPerBucket
+			if hi-base16 < bitsPerBucket {
+				hiLocal = int(hi - base16)
+			}
+			if b16.isZero() {
+				continue
+			}
+			if dst == nil {
+				dst = s.getOrCreateBucket32(b32.hi)
+			}
+			s.itemsCount += dst.unionRange16(b32.b16his[j], b16, loLocal, hiLocal, s.opts.alwaysDense)
+		}
+	}
+}
+
+// UnionAbove adds all the items from a, which are bigger than watermark, to s.
+//
+// This is the fast path for merging monotonically increasing items such as time-ordered ids,
+// since a buckets below the watermark aren't visited.
+func (s *Set) UnionAbove(a *Set, watermark uint64) {
+	s.checkWritable()
+	if watermark == 1<<64-1 {
+		return
+	}
+	s.UnionRange(a, watermark+1, 1<<64-1)
+	// The range passed to UnionRange cannot contain the maximum uint64 value.
+	if a.Has(1<<64 - 1) {
+		s.AddMulti([]uint64{1<<64 - 1})
+	}
+}
+
+// CloneRange returns a new set with s items in the range [lo, hi).
+//
+// s isn't modified. Buckets outside the range aren't visited, while dense buckets crossing
+// the range bounds are copied with bitwise ops, so CloneRange is fast for a narrow range over a big set.
+// The returned set inherits s settings except of read-only mode.
+func (s *Set) CloneRange(lo, hi uint64) *Set {
+	var dst Set
+	if s == nil {
+		return &dst
+	}
+	dst.opts = s.opts
+	dst.opts.readOnly = false
+	dst.UnionRange(s, lo, hi)
+	return &dst
+}
+
+// AddShifted adds x+delta to s for every item x in s.
+//
+// This is equivalent to the union of s with a copy of s, where every item is shifted by delta.
+// Items, for which x+delta overflows uint64, are skipped, i.e. the shifted values never wrap around.
+// AddShifted copies all the items from s into a temporary slice, so it needs 8 bytes per item in s.
+func (s *Set) AddShifted(delta uint64) {
+	s.checkWritable()
+	if delta == 0 || s.Len() == 0 {
+		return
+	}
+	a := s.AppendTo(nil)
+	// a is sorted, so the items overflowing after the shift are located at the end of a.
+	n := sort.Search(len(a), func(i int) bool {
+		return a[i] > 1<<64-1-delta
+	})
+	a = a[:n]
+	for i := range a {
+		a[i] += delta
+	}
+	s.AddMulti(a)
+}
+
+// ReplaceRange replaces s items in the range [lo, hi) with a items from this range.
+//
+// s items outside the range are left untouched.
+func (s *Set) ReplaceRange(a *Set, lo, hi uint64) {
+	s.checkWritable()
+	if lo >= hi || s == a {
+		return
+	}
+	s.trackedSizeBytes = 0
+	if a.Len() == 0 {
+		// Fast path - just delete the range.
+		s.delRange(lo, hi)
+		return
+	}
+	// Visit s and a buckets intersecting the range in a single merge pass over sorted buckets.
+	// Make shallow copy of `a`, since it can be modified by a.sort().
+	a = a.cloneShallow()
+	a.sort()
+	s.sort()
+	var bsNew []bucket32
+	addMissing := func(a32 *bucket32) {
+		var b32 bucket32
+		b32.hi = a32.hi
+		if n := b32.replaceRange(uint64(a32.hi)<<32, lo, hi, a32, false, s.opts.alwaysDense); n > 0 {
+			s.itemsCount += n
+			bsNew = append(bsNew, b32)
+		}
+	}
+	abs := a.buckets
+	j := 0
+	for i := range s.buckets {
+		b32 := &s.buckets[i]
+		base := uint64(b32.hi) << 32
+		if hi <= base || (lo > base && lo-base >= 1<<32) {
+			continue
+		}
+		for j < len(abs) && abs[j].hi < b32.hi {
+			addMissing(&abs[j])
+			j++
+		}
+		var a32 *bucket32
+		if j < len(abs) && abs[j].hi == b32.hi {
+			a32 = &abs[j]
+			j++
+		}
+		s.itemsCount += b32.replaceRange(base, lo, hi, a32, s.opts.stickyDense, s.opts.alwaysDense)
+	}
+	for ; j < len(abs); j++ {
+		addMissing(&abs[j])
+	}
+	s.removeEmptyBuckets()
+	for i := range bsNew {
+		*s.createBucket32(bsNew[i].hi) = bsNew[i]
+	}
+}
+
+// delRange removes all the items in the range [lo, hi) from s.
+func (s *Set) delRange(lo, hi uint64) {
+	s.checkWritable()
+	if s.Len() == 0 || lo >= hi {
+		// Fast path - nothing to delete.
+		return
+	}
+	s.trackedSizeBytes = 0
+	for i := range s.buckets {
+		b32 := &s.buckets[i]
+		base := uint64(b32.hi) << 32
+		if hi <= base || (lo > base && lo-base >= 1<<32) {
+			continue
+		}
+		if lo <= base && hi-base >= 1<<32 && !s.opts.stickyDense {
+			// Drop the whole bucket32 at once.
+			s.itemsCount -= b32.getLen()
+			*b32 = bucket32{}
+			continue
+		}
+		s.itemsCount -= b32.delRange(base, lo, hi, s.opts.stickyDense)
+	}
+	s.removeEmptyBuckets()
+}
+
+// ShrinkBucket reclaims memory for the bucket containing items with the given upper 32 bits.
+//
+// It removes empty bucket16 items, converts sparse bits arrays to small pools and trims
+// the capacity of the bucket lists. Other buckets in s aren't visited, so ShrinkBucket is cheap
+// after deleting many items with the same upper 32 bits. Bits arrays are kept in alwaysDense mode.
+// false is returned if s has no bucket for hi.
+func (s *Set) ShrinkBucket(hi uint32) bool {
+	s.checkWritable()
+	s.trackedSizeBytes = 0
+	b32 := s.getBucket32(hi)
+	if b32 == nil {
+		return false
+	}
+	b32.shrink(s.opts.alwaysDense)
+	if len(b32.buckets) == 0 {
+		s.removeEmptyBuckets()
+	}
+	return true
+}
+
+// Optimize makes s as lean as possible in a single pass.
+//
+// It removes empty buckets, converts sparse bits arrays to small pools, trims the capacity
+// of the bucket lists and resets stale lookup hints for all the buckets in s.
+// Bits arrays are kept in alwaysDense mode. This is the same as calling ShrinkBucket for every bucket in s.
+//
+// Optimize is useful for sets with long lifetime after many items are deleted from them.
+func (s *Set) Optimize() {
+	s.checkWritable()
+	s.trackedSizeBytes = 0
+	for i := range s.buckets {
+		b32 := &s.buckets[i]
+		b32.shrink(s.opts.alwaysDense)
+		b32.resetHint()
+	}
+	s.removeEmptyBuckets()
+	if len(s.buckets) == cap(s.buckets) || s.hasScratchBuckets() {
+		return
+	}
+	switch len(s.buckets) {
+	case 0:
+		s.buckets = nil
+	case 1:
+		s.scratchBuckets[0] = s.buckets[0]
+		s.buckets = s.scratchBuckets[:]
+	default:
+		bs := make([]bucket32, len(s.buckets))
+		copy(bs, s.buckets)
+		s.buckets = bs
+	}
+}
+
+// TruncateBelow removes all the items smaller than x from s.
+//
+// Buckets containing only items smaller than x are dropped at once,
+// so the cost doesn't depend on the number of removed items there.
+func (s *Set) TruncateBelow(x uint64) {
+	s.delRange(0, x)
+}
+
+// TruncateAbove removes all the items bigger than or equal to x from s.
+//
+// Buckets containing only items bigger than or equal to x are dropped at once,
+// so the cost doesn't depend on the number of removed items there.
+func (s *Set) TruncateAbove(x uint64) {
+	s.delRange(x, 1<<64-1)
+	s.Del(1<<64 - 1)
+}
+
+// DropSparsePrefixes removes all the items with the upper 32 bits shared by less than minCount items in s.
+//
+// Such buckets are dropped at once, so the cost doesn't depend on the number of removed items.
+// This is a coarse filter for removing noise prefixes. The number of removed items is returned.
+func (s *Set) DropSparsePrefixes(minCount int) int {
+	s.checkWritable()
+	s.trackedSizeBytes = 0
+	dropped := 0
+	for i := range s.buckets {
+		b32 := &s.buckets[i]
+		if n := b32.getLen(); n < minCount {
+			dropped += n
+			b32.clear(s.opts.stickyDense)
+		}
+	}
+	s.itemsCount -= dropped
+	s.removeEmptyBuckets()
+	return dropped
+}
+
+// Intersect removes all the items missing in a from s.
+func (s *Set) Intersect(a *Set) {
+	s.checkWritable()
+	s.trackedSizeBytes = 0
+	if s.Len() == 0 || a.Len() == 0 {
+		// Fast path - the result is empty.
+		if s.opts.stickyDense {
+			for i := range s.buckets {
+				s.buckets[i].clear(true)
+			}
+			s.removeEmptyBuckets()
+			s.itemsCount = 0
+			return
+		}
+		s.reset()
+		return
+	}
+	// Make shallow copy of `a`, since it can be modified by a.sort().
+	a = a.cloneShallow()
+	a.sort()
+	s.sort()
+	i := 0
+	j := 0
+	for {
+		for i < len(s.buckets) && j < len(a.buckets) && s.buckets[i].hi < a.buckets[j].hi {
+			s.buckets[i].clear(s.opts.stickyDense)
+			i++
+		}
+		if i >= len(s.buckets) {
+			break
+		}
+		for j < len(a.buckets) && a.buckets[j].hi < s.buckets[i].hi {
+			j++
+		}
+		if j >= len(a.buckets) {
+			for i < len(s.buckets) {
+				s.buckets[i].clear(s.opts.stickyDense)
+				i++
+			}
+			break
+		}
+		if s.buckets[i].hi == a.buckets[j].hi {
+			s.buckets[i].intersect(&a.buckets[j], s.opts.stickyDense)
+			i++
+			j++
+		}
+	}
+	s.removeEmptyBuckets()
+	s.fixItemsCount()
+}
+
+// removeEmptyBuckets removes bucket32 items without bucket16 items from s.
+//
+// The order of the remaining buckets is preserved.
+func (s *Set) removeEmptyBuckets() {
+	bs := s.buckets[:0]
+	for i := range s.buckets {
+		if len(s.buckets[i].buckets) > 0 {
+			bs = append(bs, s.buckets[i])
+		}
+	}
+	for i := len(bs); i < len(s.buckets); i++ {
+		s.buckets[i] = bucket32{}
+	}
+	s.buckets = bs
+}
+
+// ForEachIntersection calls f for all the items, which exist in both s and a.
+//
+// Each call to f contains part with sorted items from a single bucket with 2^16 items.
+// The order of parts is arbitrary. Neither s nor a is modified.
+// The iteration is stopped if f returns false.
+func (s *Set) ForEachIntersection(a *Set, f func(part []uint64) bool) {
+	if s.Len() == 0 || a.Len() == 0 {
+		return
+	}
+	xbuf := partBufPool.Get().(*[]uint64)
+	buf := *xbuf
+	for i := range s.buckets {
+		b32 := &s.buckets[i]
+		a32 := a.getBucket32(b32.hi)
+		if a32 == nil {
+			continue
+		}
+		for j, b16 := range b32.buckets {
+			hi16 := b32.b16his[j]
+			a16 := a32.getBucket16(hi16)
+			if a16 == nil {
+				continue
+			}
+			buf = b16.appendIntersectionTo(buf[:0], b32.hi, hi16, a16)
+			if len(buf) > 0 && !f(buf) {
+				*xbuf = buf
+				partBufPool.Put(xbuf)
+				return
+			}
+		}
+	}
+	*xbuf = buf
+	partBufPool.Put(xbuf)
+}
+
+// OverlapFraction returns the share of the smaller set items, which exist in the bigger set.
+//
+// The result is |s ∩ a| / min(|s|, |a|) in the range [0, 1]. It equals to 1 if the smaller set
+// is fully contained in the bigger set. Zero is returned if s or a is empty.
+// Neither s nor a is modified.
+func (s *Set) OverlapFraction(a *Set) float64 {
+	n := s.Len()
+	if an := a.Len(); an < n {
+		n = an
+	}
+	if n == 0 {
+		return 0
+	}
+	return float64(s.intersectCount(a)) / float64(n)
+}
+
+// IntersectClone returns a new set containing the items, which exist in both s and a.
+//
+// It works like s.Clone().Intersect(a), but without copying s items missing in a.
+// Neither s nor a is modified.
+func (s *Set) IntersectClone(a *Set) *Set {
+	var dst Set
+	if s != nil {
+		dst.opts = s.opts
+		dst.opts.readOnly = false
+	}
+	if s.Len() == 0 || a.Len() == 0 {
+		return &dst
+	}
+	d16 := &bucket16{}
+	for i := range s.buckets {
+		b32 := &s.buckets[i]
+		a32 := a.getBucket32(b32.hi)
+		if a32 == nil {
+			continue
+		}
+		var d32 *bucket32
+		for j, b16 := range b32.buckets {
+			hi16 := b32.b16his[j]
+			a16 := a32.getBucket16(hi16)
+			if a16 == nil {
+				continue
+			}
+			n := b16.intersectTo(d16, a16)
+			if n == 0 {
+				// Re-use d16 for the next bucket16.
+				continue
+			}
+			if d32 == nil {
+				d32 = dst.addBucket32()
+				d32.hi = b32.hi
+			}
+			d32.b16his = append(d32.b16his, hi16)
+			d32.buckets = append(d32.buckets, d16)
+			dst.itemsCount += n
+			d16 = &bucket16{}
+		}
+	}
+	return &dst
+}
+
+// TakeMin returns a new set with k smallest items from s.
+//
+// All the items from s are returned if k >= s.Len(). Buckets from s are visited in ascending order
+// until k items are collected, so the cost doesn't depend on the number of items above the k-th item.
+// Dense buckets are copied word by word, while the result buckets with a few items are stored
+// in small pools. s isn't modified.
+func (s *Set) TakeMin(k int) *Set {
+	if k >= s.Len() {
+		return s.Clone()
+	}
+	var dst Set
+	dst.opts = s.opts
+	dst.opts.readOnly = false
+	if k <= 0 {
+		return &dst
+	}
+	bs := s.getSortedBuckets()
+	for i := range bs {
+		b32 := &bs[i]
+		var d32 *bucket32
+		for j, b16 := range b32.buckets {
+			d16 := &bucket16{}
+			n := b16.takeMinTo(d16, k-dst.itemsCount)
+			if n == 0 {
+				continue
+			}
+			if d32 == nil {
+				d32 = dst.addBucket32()
+				d32.hi = b32.hi
+			}
+			d32.b16his = append(d32.b16his, b32.b16his[j])
+			d32.buckets = append(d32.buckets, d16)
+			dst.itemsCount += n
+			if dst.itemsCount >= k {
+				return &dst
+			}
+		}
+	}
+	return &dst
+}
+
+// DrainMin removes k smallest items from s and returns them in a new set.
+//
+// s keeps the remaining items, so it shrinks by k items. All the items are moved from s
+// to the returned set if k >= s.Len(). Buckets emptied in s are removed, so the memory occupied
+// by drained items is released. This allows processing a big set in bounded chunks.
+func (s *Set) DrainMin(k int) *Set {
+	s.checkWritable()
+	if k >= s.Len() {
+		var dst Set
+		if s != nil {
+			dst.opts = s.opts
+			dst.moveFrom(s)
+			s.reset()
+		}
+		return &dst
+	}
+	s.trackedSizeBytes = 0
+	dst := s.TakeMin(k)
+	if dst.Len() == 0 {
+		return dst
+	}
+	// dst buckets are sorted, so the last bucket contains the maximum drained item.
+	// It is smaller than the maximum item in s, so maxItem+1 cannot overflow.
+	maxItem, _ := dst.buckets[len(dst.buckets)-1].max()
+	s.delRange(0, maxItem+1)
+	return dst
+}
+
+// SubtractCount returns the number of items in s, which are missing in a.
+//
+// It works like s.Clone().Subtract(a).Len(), but without creating the resulting set.
+// Neither s nor a is modified.
+func (s *Set) SubtractCount(a *Set) int {
+	return s.Len() - s.intersectCount(a)
+}
+
+// SelectInBucket returns the k-th smallest item among the items with the given upper 32 bits hi.
+//
+// k is 0-based. It skips bucket16 items by their lengths and selects the item by counting bits
+// inside the found bits word, so it doesn't visit other buckets in s.
+// false is returned if s has no items with upper 32 bits hi or if it has less than k+1 such items.
+func (s *Set) SelectInBucket(hi uint32, k int) (uint64, bool) {
+	if s == nil || k < 0 {
+		return 0, false
+	}
+	b32 := s.getBucket32(hi)
+	if b32 == nil {
+		return 0, false
+	}
+	return b32.nth(k)
+}
+
+// RangeStatus returns the number of s items in the range [lo, hi) and whether all the items from the range are in s.
+//
+// full is set to true if present equals to hi-lo. The empty range with lo >= hi has present=0 and full=true.
+// Both values are calculated in a single pass over s buckets intersecting the range. s isn't modified.
+func (s *Set) RangeStatus(lo, hi uint64) (present int, full bool) {
+	if lo >= hi {
+		return 0, true
+	}
+	if s.Len() == 0 {
+		return 0, false
+	}
+	for i := range s.buckets {
+		b32 := &s.buckets[i]
+		base := uint64(b32.hi) << 32
+		if hi <= base || (lo > base && lo-base >= 1<<32) {
+			continue
+		}
+		jStart := 0
+		if lo > base {
+			jStart = b32.firstBucket16Index(uint16((lo - base) >> 16))
+		}
+		for j := jStart; j < len(b32.buckets); j++ {
+			base16 := base | uint64(b32.b16his[j])<<16
+			if hi <= base16 {
+				break
+			}
+			loLocal := 0
+			if lo > base16 {
+				loLocal = int(lo - base16)
+			}
+			hiLocal := bitsPerBucket
+			if hi-base16 < bitsPerBucket {
+				hiLocal = int(hi - base16)
+			}
+			present += b32.buckets[j].countRange(loLocal, hiLocal)
+		}
+	}
+	return present, uint64(present) == hi-lo
+}
+
+// AbsentCount returns the number of values in the range [lo, hi), which are missing in s.
+//
+// The result is returned as uint64, since it doesn't fit int for ranges with more than 2^63 values.
+// Zero is returned for the empty range with lo >= hi. s isn't modified.
+func (s *Set) AbsentCount(lo, hi uint64) uint64 {
+	if lo >= hi {
+		return 0
+	}
+	present, _ := s.RangeStatus(lo, hi)
+	return hi - lo - uint64(present)
+}
+
+// CountRanges returns the number of s items in every range [bounds[i], bounds[i+1]).
+//
+// bounds must be sorted in ascending order. The returned slice contains len(bounds)-1 items.
+// It is much faster than counting items in every range separately, since s buckets are visited only once.
+// s isn't modified.
+func (s *Set) CountRanges(bounds []uint64) []int {
+	if len(bounds) < 2 {
+		return nil
+	}
+	counts := make([]int, len(bounds)-1)
+	k := 0
+	for _, b32 := range s.getSortedBuckets() {
+		for j, b16 := range b32.buckets {
+			base := uint64(b32.hi)<<32 | uint64(b32.b16his[j])<<16
+			last := base + bitsPerBucket - 1
+			for k < len(counts) && bounds[k+1] <= base {
+				k++
+			}
+			if k >= len(counts) {
+				return counts
+			}
+			for i := k; i < len(counts) && bounds[i] <= last; i++ {
+				lo, hi := bounds[i], bounds[i+1]
+				if lo >= hi {
+					continue
+				}
+				loLocal := 0
+				if lo > base {
+					loLocal = int(lo - base)
+				}
+				hiLocal := bitsPerBucket
+				if hi <= last {
+					hiLocal = int(hi - base)
+				}
+				counts[i] += b16.countRange(loLocal, hiLocal)
+			}
+		}
+	}
+	return counts
+}
+
+// PairwiseIntersectCounts returns a symmetric matrix with the number of common items for every pair of sets.
+//
+// The entry [i][j] contains the number of items, which exist in both sets[i] and sets[j],
+// while the entry [i][i] contains sets[i].Len(). Nil sets are treated as empty sets.
+// It is faster than calling Similarities for every pair of sets, since it groups buckets
+// from all the sets by their upper 48 bits and intersects only the buckets, which share the same upper bits.
+// The sets aren't modified.
+func PairwiseIntersectCounts(sets []*Set) [][]int {
+	counts := make([][]int, len(sets))
+	countsBuf := make([]int, len(sets)*len(sets))
+	for i := range counts {
+		counts[i] = countsBuf[i*len(sets) : (i+1)*len(sets)]
+	}
+	for i, s := range sets {
+		counts[i][i] = s.Len()
+	}
+	pbs := getSortedPrefixBuckets16(sets)
+	for len(pbs) > 0 {
+		n := 1
+		for n < len(pbs) && pbs[n].prefix == pbs[0].prefix {
+			n++
+		}
+		group := pbs[:n]
+		pbs = pbs[n:]
+		for i := range group {
+			for j := i + 1; j < len(group); j++ {
+				c := group[i].b16.intersectCount(group[j].b16)
+				counts[group[i].setIdx][group[j].setIdx] += c
+				counts[group[j].setIdx][group[i].setIdx] += c
+			}
+		}
+	}
+	return counts
+}
+
+// prefixBucket16 contains bucket16 from the set with setIdx index and prefix upper bits.
+type prefixBucket16 struct {
+	prefix uint64
+	setIdx int
+	b16    *bucket16
+}
+
+// getSortedPrefixBuckets16 returns all the bucket16 items from sets sorted by prefix.
+func getSortedPrefixBuckets16(sets []*Set) prefixBucket16Sorter {
+	bucketsCount := 0
+	for _, s := range sets {
+		if s.Len() == 0 {
+			continue
+		}
+		for j := range s.buckets {
+			bucketsCount += len(s.buckets[j].buckets)
+		}
+	}
+	pbs := make(prefixBucket16Sorter, 0, bucketsCount)
+	for i, s := range sets {
+		if s.Len() == 0 {
+			continue
+		}
+		for j := range s.buckets {
+			b32 := &s.buckets[j]
+			for k, b16 := range b32.buckets {
+				pbs = append(pbs, prefixBucket16{
+					prefix: uint64(b32.hi)<<16 | uint64(b32.b16his[k]),
+					setIdx: i,
+					b16:    b16,
+				})
+			}
+		}
+	}
+	sort.Sort(&pbs)
+	return pbs
+}
+
+type prefixBucket16Sorter []prefixBucket16
+
+func (pbs *prefixBucket16Sorter) Len() int { return len(*pbs) }
+func (pbs *prefixBucket16Sorter) Less(i, j int) bool {
+	a := *pbs
+	return a[i].prefix < a[j].prefix
+}
+func (pbs *prefixBucket16Sorter) Swap(i, j int) {
+	a := *pbs
+	a[i], a[j] = a[j], a[i]
+}
+
+// intersectCount returns the number of items, which exist in both s and a.
+func (s *Set) intersectCount(a *Set) int {
+	if s.Len() == 0 || a.Len() == 0 {
+		return 0
+	}
+	n := 0
+	for i := range s.buckets {
+		b32 := &s.buckets[i]
+		a32 := a.getBucket32(b32.hi)
+		if a32 == nil {
+			continue
+		}
+		for j, b16 := range b32.buckets {
+			if a16 := a32.getBucket16(b32.b16his[j]); a16 != nil {
+				n += b16.intersectCount(a16)
+			}
+		}
+	}
+	return n
+}
+
+// ForEachUnion calls f for all the items, which exist in s or a, in ascending order.
+//
+// It works like s.Clone().Union(a).ForEachSorted(f), but without creating the union set.
+// Every part contains sorted items, which are bigger than the items in all the previous parts.
+// Neither s nor a is modified. The iteration is stopped if f returns false.
+func (s *Set) ForEachUnion(a *Set, f func(part []uint64) bool) {
+	sbs := s.getSortedBuckets()
+	abs := a.getSortedBuckets()
+	i := 0
+	j := 0
+	for i < len(sbs) || j < len(abs) {
+		var ok bool
+		switch {
+		case j >= len(abs) || i < len(sbs) && sbs[i].hi < abs[j].hi:
+			ok = sbs[i].forEach(f)
+			i++
+		case i >= len(sbs) || abs[j].hi < sbs[i].hi:
+			ok = abs[j].forEach(f)
+			j++
+		default:
+			ok = sbs[i].forEachUnion(&abs[j], f)
+			i++
+			j++
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// SharesBucket returns true if s and a contain buckets for items with the same upper 32 bits.
+//
+// It is much faster than checking for common items, since it doesn't look inside the buckets.
+// false means s and a have no common items, while true means s and a may have common items.
+// Neither s nor a is modified.
+func (s *Set) SharesBucket(a *Set) bool {
+	sbs := s.getSortedBuckets()
+	abs := a.getSortedBuckets()
+	i := 0
+	j := 0
+	for i < len(sbs) && j < len(abs) {
+		switch {
+		case sbs[i].hi < abs[j].hi:
+			i++
+		case sbs[i].hi > abs[j].hi:
+			j++
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// getSortedBuckets returns s buckets sorted by hi without modifying s.
+func (s *Set) getSortedBuckets() []bucket32 {
+	if s.Len() == 0 {
+		return nil
+	}
+	if s.opts.keepSorted || s.bucketsSorted || sort.IsSorted(&s.buckets) {
+		return s.buckets
+	}
+	sc := s.cloneShallow()
+	sc.sort()
+	return sc.buckets
+}
+
+// ConcatDisjoint returns a new set containing items from all the sets.
+//
+// It is optimized for sets partitioned by the upper 32 bits of items, i.e. when every 2^32 range of items
+// is stored in at most a single set. Buckets for such sets are copied to the result without any merging.
+// Buckets for the ranges stored in multiple sets are merged via union, so the result is always correct,
+// but the merge is slower. The sets aren't modified.
+func ConcatDisjoint(sets ...*Set) *Set {
+	var dst Set
+	bucketsCount := 0
+	for _, a := range sets {
+		if a.Len() > 0 {
+			bucketsCount += len(a.buckets)
+		}
+	}
+	if bucketsCount > 1 {
+		dst.buckets = make([]bucket32, 0, bucketsCount)
+	}
+	for _, a := range sets {
+		if a.Len() == 0 {
+			continue
+		}
+		for i := range a.buckets {
+			a.buckets[i].copyTo(dst.addBucket32())
+		}
+		dst.itemsCount += a.itemsCount
+	}
+	dst.sort()
+
+	// Merge buckets with the same hi.
+	bs := dst.buckets
+	n := 0
+	for i := 1; i < len(bs); i++ {
+		if bs[i].hi != bs[n].hi {
+			n++
+			if n != i {
+				bs[n] = bs[i]
+			}
+			continue
+		}
+		dst.itemsCount -= bs[i].getLen()
+		dst.itemsCount += bs[n].union(&bs[i], true)
+	}
+	if len(bs) > 0 {
+		for i := n + 1; i < len(bs); i++ {
+			bs[i] = bucket32{}
 		}
-		for j < len(a.buckets) && a.buckets[j].hi < s.buckets[i].hi {
-			j++
+		dst.buckets = bs[:n+1]
+	}
+	return &dst
+}
+
+// SymmetricDifferenceN returns a new set with items, which exist in an odd number of sets.
+//
+// The sets aren't modified.
+func SymmetricDifferenceN(sets ...*Set) *Set {
+	var dst Set
+	var dst32 *bucket32
+	var bb [wordsPerBucket]uint64
+	pbs := getSortedPrefixBuckets16(sets)
+	for len(pbs) > 0 {
+		n := 1
+		for n < len(pbs) && pbs[n].prefix == pbs[0].prefix {
+			n++
 		}
-		if j >= len(a.buckets) {
-			for i < len(s.buckets) {
-				s.buckets[i] = bucket32{}
-				i++
+		group := pbs[:n]
+		pbs = pbs[n:]
+		var b16 bucket16
+		if n == 1 {
+			group[0].b16.copyTo(&b16)
+		} else {
+			// Toggle the items from all the sets in the scratch bits array, so the result
+			// occupies the bits array only if it doesn't fit the small pool.
+			for _, pb := range group {
+				pb.b16.xorTo(&bb)
 			}
-			break
+			b16.initFromBits(&bb)
+			bb = [wordsPerBucket]uint64{}
 		}
-		if s.buckets[i].hi == a.buckets[j].hi {
-			s.buckets[i].intersect(&a.buckets[j])
-			i++
-			j++
+		if b16.isEmpty() {
+			continue
 		}
+		prefix := group[0].prefix
+		if hi := uint32(prefix >> 16); dst32 == nil || dst32.hi != hi {
+			// Prefixes are visited in ascending order, so new buckets are appended in sorted order.
+			dst32 = dst.appendBucket32()
+			dst32.hi = hi
+		}
+		*dst32.addBucket16(uint16(prefix)) = b16
+		dst.itemsCount += b16.getLen()
 	}
-	s.fixItemsCount()
+	dst.bucketsSorted = true
+	return &dst
 }
 
 // Subtract removes from s all the shared items between s and a.
 func (s *Set) Subtract(a *Set) {
+	s.checkWritable()
 	if s.Len() == 0 || a.Len() == 0 {
 		// Fast path - nothing to subtract.
 		return
@@ -363,6 +2213,28 @@ func (s *Set) Subtract(a *Set) {
 	})
 }
 
+// SubtractDelta removes from s all the shared items between s and a
+// and returns a new set with the removed items.
+func (s *Set) SubtractDelta(a *Set) *Set {
+	s.checkWritable()
+	var removed Set
+	if s.Len() == 0 || a.Len() == 0 {
+		// Fast path - nothing to subtract.
+		return &removed
+	}
+	a.ForEach(func(part []uint64) bool {
+		for _, x := range part {
+			n := s.itemsCount
+			s.Del(x)
+			if s.itemsCount < n {
+				removed.Add(x)
+			}
+		}
+		return true
+	})
+	return &removed
+}
+
 // Equal returns true if s contains the same items as a.
 func (s *Set) Equal(a *Set) bool {
 	if s.Len() != a.Len() {
@@ -381,6 +2253,46 @@ func (s *Set) Equal(a *Set) bool {
 	return equal
 }
 
+// FirstDiff returns the smallest item x, which exists only in s or only in a.
+//
+// inS is set to true if x exists in s and is missing in a, while it is set to false if x exists in a
+// and is missing in s. equal is set to true if s and a contain the same items; x and inS are
+// meaningless in this case. Nil sets are treated as empty sets.
+//
+// FirstDiff walks s and a in ascending order and stops at the first mismatch, so it is cheap
+// for nearly equal sets with early differences. It is useful for reporting actionable errors in tests.
+// Neither s nor a is modified.
+func (s *Set) FirstDiff(a *Set) (x uint64, inS bool, equal bool) {
+	if s == a {
+		return 0, false, true
+	}
+	sbs := s.getSortedBuckets()
+	abs := a.getSortedBuckets()
+	i := 0
+	j := 0
+	for i < len(sbs) || j < len(abs) {
+		switch {
+		case j == len(abs) || (i < len(sbs) && sbs[i].hi < abs[j].hi):
+			if x, ok := sbs[i].min(); ok {
+				return x, true, false
+			}
+			i++
+		case i == len(sbs) || sbs[i].hi > abs[j].hi:
+			if x, ok := abs[j].min(); ok {
+				return x, false, false
+			}
+			j++
+		default:
+			if x, inS, ok := sbs[i].firstDiff(&abs[j]); ok {
+				return x, inS, false
+			}
+			i++
+			j++
+		}
+	}
+	return 0, false, true
+}
+
 // ForEach calls f for all the items stored in s.
 //
 // Each call to f contains part with arbitrary part of items stored in the set.
@@ -396,6 +2308,170 @@ func (s *Set) ForEach(f func(part []uint64) bool) {
 	}
 }
 
+// ForEachMutable calls f for every item stored in s at the moment of the call.
+//
+// Unlike ForEach, it doesn't iterate over the live contents of s. It copies all the items via AppendTo
+// at entry and then calls f for each copied item in ascending order, passing s to it. This allows f
+// to Add and Del items in s freely while iterating, e.g. for growing s based on its own contents.
+// Items added by f aren't visited in the current pass, while items deleted by f are still visited
+// if they were in s at entry. The iteration is stopped if f returns false.
+//
+// The copy takes 8 bytes per item in s, so prefer ForEach when f doesn't modify s.
+func (s *Set) ForEachMutable(f func(x uint64, s *Set) bool) {
+	if s.Len() == 0 {
+		return
+	}
+	a := s.AppendTo(nil)
+	for _, x := range a {
+		if !f(x, s) {
+			return
+		}
+	}
+}
+
+// ForEachSorted calls f for all the items stored in s in ascending order.
+//
+// Unlike ForEach, it guarantees that every part contains sorted items, which are bigger
+// than the items in all the previous parts, i.e. the concatenation of parts is sorted.
+// The iteration is stopped if f returns false.
+//
+// ForEachSorted can mutate s.
+func (s *Set) ForEachSorted(f func(part []uint64) bool) {
+	if s == nil {
+		return
+	}
+	s.sort()
+	s.ForEach(f)
+}
+
+// ForEachBucket16 calls f for every bucket with 2^16 items in s in ascending order of base.
+//
+// base is the lowest possible item in the bucket, i.e. the item with all the lower 16 bits cleared,
+// while part contains sorted items from the bucket. Empty buckets are skipped.
+// The iteration is stopped if f returns false.
+//
+// ForEachBucket16 can mutate s.
+func (s *Set) ForEachBucket16(f func(base uint64, part []uint64) bool) {
+	if s == nil {
+		return
+	}
+	s.sort()
+	for i := range s.buckets {
+		if !s.buckets[i].forEachBucket16(f) {
+			return
+		}
+	}
+}
+
+// ForEachUnordered calls f for all the items stored in s.
+//
+// It works like ForEach, but items inside each part are passed in arbitrary order.
+// This allows skipping the sorting of sparse buckets, so it is faster than ForEach
+// for consumers not depending on the order of items.
+// The iteration is stopped if f returns false.
+func (s *Set) ForEachUnordered(f func(part []uint64) bool) {
+	if s == nil {
+		return
+	}
+	for i := range s.buckets {
+		if !s.buckets[i].forEachUnordered(f) {
+			return
+		}
+	}
+}
+
+// CountIf returns the number of items in s for which f returns true.
+//
+// f is called for every item in s in arbitrary order, so CountIf takes O(s.Len()) time.
+// It doesn't allocate memory for the matching items.
+func (s *Set) CountIf(f func(x uint64) bool) int {
+	n := 0
+	s.ForEachUnordered(func(part []uint64) bool {
+		for _, x := range part {
+			if f(x) {
+				n++
+			}
+		}
+		return true
+	})
+	return n
+}
+
+// ForEachIndexed calls f for all the items stored in s in ascending order.
+//
+// index is the 0-based position of x among the items in s.
+// The iteration is stopped if f returns false.
+//
+// ForEachIndexed can mutate s.
+func (s *Set) ForEachIndexed(f func(index int, x uint64) bool) {
+	if s == nil {
+		return
+	}
+	s.sort()
+	index := 0
+	s.ForEach(func(part []uint64) bool {
+		for _, x := range part {
+			if !f(index, x) {
+				return false
+			}
+			index++
+		}
+		return true
+	})
+}
+
+// ForEachDenseWord calls f for every non-zero 64-bit word of the bitmap representing s items.
+//
+// base is the item for the lowest bit of word, i.e. base is a multiple of 64,
+// while every set bit n of word stands for the item base+n.
+// Small buckets are converted into words before calling f.
+// Words are passed in ascending order of base within every 2^32 range of items,
+// while the ranges are visited in arbitrary order.
+// The iteration is stopped if f returns false.
+//
+// ForEachDenseWord exposes the internal bitmap layout for performance-critical code.
+// The layout of words (64-bit words aligned to 64 items) is stable, while the order
+// and the batching of calls may change in the future.
+func (s *Set) ForEachDenseWord(f func(base, word uint64) bool) {
+	if s == nil {
+		return
+	}
+	for i := range s.buckets {
+		if !s.buckets[i].forEachDenseWord(f) {
+			return
+		}
+	}
+}
+
+// Checksum returns a hash of s items.
+//
+// The hash depends only on the items in s, so equal sets have equal checksums
+// regardless of the order of item additions and the internal representation.
+//
+// Checksum can mutate s.
+func (s *Set) Checksum() uint64 {
+	var d xxhash.Digest
+	d.Reset()
+	if s == nil {
+		return d.Sum64()
+	}
+	s.sort()
+	var buf [1024]byte
+	b := buf[:0]
+	s.ForEach(func(part []uint64) bool {
+		for _, x := range part {
+			if len(b) == len(buf) {
+				_, _ = d.Write(b)
+				b = buf[:0]
+			}
+			b = marshalUint64(b, x)
+		}
+		return true
+	})
+	_, _ = d.Write(b)
+	return d.Sum64()
+}
+
 type bucket32 struct {
 	hi uint32
 
@@ -420,7 +2496,80 @@ func (b *bucket32) getLen() int {
 	return n
 }
 
-func (b *bucket32) union(a *bucket32, mayOwn bool) {
+// min returns the minimum item in b.
+//
+// false is returned if b is empty.
+func (b *bucket32) min() (uint64, bool) {
+	for i, b16 := range b.buckets {
+		if lo, ok := b16.min(); ok {
+			return uint64(b.hi)<<32 | uint64(b.b16his[i])<<16 | uint64(lo), true
+		}
+	}
+	return 0, false
+}
+
+// max returns the maximum item in b.
+//
+// false is returned if b is empty.
+func (b *bucket32) max() (uint64, bool) {
+	for i := len(b.buckets) - 1; i >= 0; i-- {
+		if lo, ok := b.buckets[i].max(); ok {
+			return uint64(b.hi)<<32 | uint64(b.b16his[i])<<16 | uint64(lo), true
+		}
+	}
+	return 0, false
+}
+
+// firstDiff returns the smallest item x, which exists only in b or only in a.
+//
+// inB is set to true if x exists in b. false ok is returned if b and a contain the same items.
+// b and a must have the same hi.
+func (b *bucket32) firstDiff(a *bucket32) (x uint64, inB, ok bool) {
+	base := uint64(b.hi) << 32
+	i := 0
+	j := 0
+	for i < len(b.buckets) || j < len(a.buckets) {
+		switch {
+		case j == len(a.buckets) || (i < len(b.buckets) && b.b16his[i] < a.b16his[j]):
+			if lo, ok := b.buckets[i].min(); ok {
+				return base | uint64(b.b16his[i])<<16 | uint64(lo), true, true
+			}
+			i++
+		case i == len(b.buckets) || b.b16his[i] > a.b16his[j]:
+			if lo, ok := a.buckets[j].min(); ok {
+				return base | uint64(a.b16his[j])<<16 | uint64(lo), false, true
+			}
+			j++
+		default:
+			if lo, inB, ok := b.buckets[i].firstDiff(a.buckets[j]); ok {
+				return base | uint64(b.b16his[i])<<16 | uint64(lo), inB, true
+			}
+			i++
+			j++
+		}
+	}
+	return 0, false, false
+}
+
+// nth returns the k-th smallest item in b.
+//
+// false is returned if b contains less than k+1 items.
+func (b *bucket32) nth(k int) (uint64, bool) {
+	for i, b16 := range b.buckets {
+		n := b16.getLen()
+		if k >= n {
+			k -= n
+			continue
+		}
+		lo, _ := b16.nth(k)
+		return uint64(b.hi)<<32 | uint64(b.b16his[i])<<16 | uint64(lo), true
+	}
+	return 0, false
+}
+
+// union adds a items to b and returns the number of added items.
+func (b *bucket32) union(a *bucket32, mayOwn bool) int {
+	count := 0
 	i := 0
 	j := 0
 	bBucketsLen := len(b.buckets)
@@ -436,6 +2585,7 @@ func (b *bucket32) union(a *bucket32, mayOwn bool) {
 				} else {
 					a.buckets[j].copyTo(b16)
 				}
+				count += b16.getLen()
 				j++
 			}
 			break
@@ -447,13 +2597,14 @@ func (b *bucket32) union(a *bucket32, mayOwn bool) {
 			} else {
 				a.buckets[j].copyTo(b16)
 			}
+			count += b16.getLen()
 			j++
 		}
 		if j >= len(a.b16his) {
 			break
 		}
 		if b.b16his[i] == a.b16his[j] {
-			b.buckets[i].union(a.buckets[j])
+			count += b.buckets[i].union(a.buckets[j])
 			i++
 			j++
 		}
@@ -461,7 +2612,40 @@ func (b *bucket32) union(a *bucket32, mayOwn bool) {
 	// Restore buckets order, which could be violated during the merge above.
 	if !sort.IsSorted(b) {
 		sort.Sort(b)
+		b.resetHint()
+	}
+	return count
+}
+
+// unionRange16 adds items from a in the range [lo, hi) to the bucket16 with the given hi16.
+//
+// lo and hi are offsets inside the bucket16. It returns the number of added items.
+func (b *bucket32) unionRange16(hi16 uint16, a *bucket16, lo, hi int, alwaysDense bool) int {
+	his := b.b16his
+	n := binarySearch16(his, hi16)
+	if n < 0 || n >= len(his) || his[n] != hi16 {
+		b16 := b.addBucketAtPos(hi16, n)
+		if lo == 0 && hi == bitsPerBucket {
+			// Fast path - copy the whole bucket.
+			a.copyTo(b16)
+			if alwaysDense {
+				b16.makeDense()
+			}
+			return b16.getLen()
+		}
+		if alwaysDense || a.bits != nil && a.countRange(lo, hi) > smallPoolSize {
+			// Allocate bits array only if the items from the range do not fit the small pool.
+			var bits [wordsPerBucket]uint64
+			b16.bits = &bits
+		}
+		count := b16.unionRange(a, lo, hi)
+		if count == 0 {
+			// Do not leave empty bucket, which could hold big bits array.
+			b.removeBucketAtPos(n)
+		}
+		return count
 	}
+	return b.buckets[n].unionRange(a, lo, hi)
 }
 
 // This is for sort.Interface used in bucket32.union
@@ -474,12 +2658,41 @@ func (b *bucket32) Swap(i, j int) {
 	buckets[i], buckets[j] = buckets[j], buckets[i]
 }
 
-func (b *bucket32) intersect(a *bucket32) {
+// clear removes all the items from b.
+//
+// b16 items with bits arrays are kept if keepBits is set.
+func (b *bucket32) clear(keepBits bool) {
+	if !keepBits {
+		*b = bucket32{}
+		return
+	}
+	b16his := b.b16his[:0]
+	bs := b.buckets[:0]
+	for i, b16 := range b.buckets {
+		if b16.bits == nil {
+			continue
+		}
+		b16.clear(true)
+		b16his = append(b16his, b.b16his[i])
+		bs = append(bs, b16)
+	}
+	for i := len(bs); i < len(b.buckets); i++ {
+		b.buckets[i] = nil
+	}
+	b.resetHint()
+	b.b16his = b16his
+	b.buckets = bs
+}
+
+// intersect removes b items missing in a.
+//
+// If stickyDense is set, then b16 items with bits arrays are kept even if all their items are removed.
+func (b *bucket32) intersect(a *bucket32, stickyDense bool) {
 	i := 0
 	j := 0
 	for {
 		for i < len(b.b16his) && j < len(a.b16his) && b.b16his[i] < a.b16his[j] {
-			*b.buckets[i] = bucket16{}
+			b.buckets[i].clear(stickyDense)
 			i++
 		}
 		if i >= len(b.b16his) {
@@ -490,7 +2703,7 @@ func (b *bucket32) intersect(a *bucket32) {
 		}
 		if j >= len(a.b16his) {
 			for i < len(b.b16his) {
-				*b.buckets[i] = bucket16{}
+				b.buckets[i].clear(stickyDense)
 				i++
 			}
 			break
@@ -500,50 +2713,135 @@ func (b *bucket32) intersect(a *bucket32) {
 			i++
 			j++
 		}
-	}
-	// Remove zero buckets
-	b16his := b.b16his[:0]
-	bs := b.buckets[:0]
-	for i, b16 := range b.buckets {
-		if b16.isZero() {
-			continue
+	}
+	// Remove zero buckets
+	b16his := b.b16his[:0]
+	bs := b.buckets[:0]
+	for i, b16 := range b.buckets {
+		if b16.isZero() {
+			continue
+		}
+		b16his = append(b16his, b.b16his[i])
+		bs = append(bs, b16)
+	}
+	for i := len(bs); i < len(b.buckets); i++ {
+		b.buckets[i] = nil
+	}
+	b.resetHint()
+	b.b16his = b16his
+	b.buckets = bs
+}
+
+func (b *bucket32) forEach(f func(part []uint64) bool) bool {
+	xbuf := partBufPool.Get().(*[]uint64)
+	buf := *xbuf
+	ok := true
+	for i, b16 := range b.buckets {
+		hi16 := b.b16his[i]
+		buf = b16.appendTo(buf[:0], b.hi, hi16)
+		if !f(buf) {
+			ok = false
+			break
+		}
+	}
+	*xbuf = buf
+	partBufPool.Put(xbuf)
+	return ok
+}
+
+func (b *bucket32) forEachBucket16(f func(base uint64, part []uint64) bool) bool {
+	xbuf := partBufPool.Get().(*[]uint64)
+	buf := *xbuf
+	ok := true
+	for i, b16 := range b.buckets {
+		hi16 := b.b16his[i]
+		buf = b16.appendTo(buf[:0], b.hi, hi16)
+		if len(buf) == 0 {
+			continue
+		}
+		if !f(uint64(b.hi)<<32|uint64(hi16)<<16, buf) {
+			ok = false
+			break
+		}
+	}
+	*xbuf = buf
+	partBufPool.Put(xbuf)
+	return ok
+}
+
+func (b *bucket32) forEachUnion(a *bucket32, f func(part []uint64) bool) bool {
+	xbuf := partBufPool.Get().(*[]uint64)
+	buf := *xbuf
+	ok := true
+	i := 0
+	j := 0
+	for i < len(b.b16his) || j < len(a.b16his) {
+		switch {
+		case j >= len(a.b16his) || i < len(b.b16his) && b.b16his[i] < a.b16his[j]:
+			buf = b.buckets[i].appendTo(buf[:0], b.hi, b.b16his[i])
+			i++
+		case i >= len(b.b16his) || a.b16his[j] < b.b16his[i]:
+			buf = a.buckets[j].appendTo(buf[:0], a.hi, a.b16his[j])
+			j++
+		default:
+			buf = b.buckets[i].appendUnionTo(buf[:0], b.hi, b.b16his[i], a.buckets[j])
+			i++
+			j++
+		}
+		if !f(buf) {
+			ok = false
+			break
 		}
-		b16his = append(b16his, b.b16his[i])
-		bs = append(bs, b16)
-	}
-	for i := len(bs); i < len(b.buckets); i++ {
-		b.buckets[i] = nil
 	}
-	b.hint = 0
-	b.b16his = b16his
-	b.buckets = bs
+	*xbuf = buf
+	partBufPool.Put(xbuf)
+	return ok
 }
 
-func (b *bucket32) forEach(f func(part []uint64) bool) bool {
+func (b *bucket32) forEachUnordered(f func(part []uint64) bool) bool {
 	xbuf := partBufPool.Get().(*[]uint64)
 	buf := *xbuf
+	ok := true
 	for i, b16 := range b.buckets {
 		hi16 := b.b16his[i]
-		buf = b16.appendTo(buf[:0], b.hi, hi16)
+		buf = b16.appendToUnordered(buf[:0], b.hi, hi16)
 		if !f(buf) {
-			return false
+			ok = false
+			break
 		}
 	}
 	*xbuf = buf
 	partBufPool.Put(xbuf)
+	return ok
+}
+
+func (b *bucket32) forEachDenseWord(f func(base, word uint64) bool) bool {
+	for i, b16 := range b.buckets {
+		if !b16.forEachDenseWord(f, b.hi, b.b16his[i]) {
+			return false
+		}
+	}
 	return true
 }
 
+// partBufPool contains buffers for holding items from a single bucket16.
+//
+// The buffers start with the capacity enough for a small pool and grow on demand
+// up to the number of items in the biggest visited bucket16, so iterating over sparse sets
+// doesn't allocate buffers for the maximum possible number of items in bucket16.
 var partBufPool = &sync.Pool{
 	New: func() interface{} {
-		buf := make([]uint64, 0, bitsPerBucket)
+		buf := make([]uint64, 0, smallPoolSize)
 		return &buf
 	},
 }
 
+// sizeBytes returns the size of memory referenced by b.
+//
+// The size of b itself isn't included, since it is stored in Set.buckets.
+// The whole capacity of b.b16his and b.buckets is counted, since it is retained in RAM.
 func (b *bucket32) sizeBytes() uint64 {
-	n := uint64(unsafe.Sizeof(*b))
-	n += 2 * uint64(len(b.b16his))
+	n := getBucket32ListsSizeBytes(cap(b.b16his), cap(b.buckets))
 	for _, b16 := range b.buckets {
 		n += b16.sizeBytes()
 	}
@@ -565,6 +2863,32 @@ func (b *bucket32) copyTo(dst *bucket32) {
 	}
 }
 
+// copyToReuse copies b to dst while reusing dst memory.
+func (b *bucket32) copyToReuse(dst *bucket32) {
+	dst.hi = b.hi
+	dst.resetHint()
+	dst.b16his = append(dst.b16his[:0], b.b16his...)
+	bs := dst.buckets
+	n := len(b.buckets)
+	if cap(bs) < n {
+		bsNew := make([]*bucket16, n)
+		copy(bsNew, bs)
+		bs = bsNew
+	}
+	for i := n; i < len(bs); i++ {
+		// Release memory occupied by the unused buckets.
+		bs[i] = nil
+	}
+	bs = bs[:n]
+	for i, b16 := range b.buckets {
+		if bs[i] == nil {
+			bs[i] = &bucket16{}
+		}
+		b16.copyToReuse(bs[i])
+	}
+	dst.buckets = bs
+}
+
 func (b *bucket32) getHint() uint32 {
 	return atomic.LoadUint32(&b.hint)
 }
@@ -573,7 +2897,16 @@ func (b *bucket32) setHint(n int) {
 	atomic.StoreUint32(&b.hint, uint32(n))
 }
 
-func (b *bucket32) add(x uint32) bool {
+// resetHint must be called after b.buckets are re-ordered or rebuilt,
+// so the hint doesn't point to unrelated bucket16.
+func (b *bucket32) resetHint() {
+	b.setHint(0)
+}
+
+// add adds x to b.
+//
+// If alwaysDense is set, then the created bucket16 is switched to bits array.
+func (b *bucket32) add(x uint32, alwaysDense bool) bool {
 	hi := uint16(x >> 16)
 	lo := uint16(x)
 	his := b.b16his
@@ -582,10 +2915,13 @@ func (b *bucket32) add(x uint32) bool {
 		bs := b.buckets
 		return n < uint32(len(bs)) && bs[n].add(lo)
 	}
-	return b.addSlow(hi, lo)
+	return b.addSlow(hi, lo, alwaysDense)
 }
 
-func (b *bucket32) addMulti(a []uint64) int {
+// addMulti adds items from a with the same upper 32 bits to b.
+//
+// If alwaysDense is set, then bucket16 items for a are switched to bits arrays.
+func (b *bucket32) addMulti(a []uint64, alwaysDense bool) int {
 	if len(a) == 0 {
 		return 0
 	}
@@ -598,15 +2934,58 @@ func (b *bucket32) addMulti(a []uint64) int {
 			continue
 		}
 		b16 := b.getOrCreateBucket16(hiPrev)
+		if alwaysDense {
+			b16.makeDense()
+		}
 		count += b16.addMulti(a[i:j])
 		hiPrev = hi
 		i = j
 	}
 	b16 := b.getOrCreateBucket16(hiPrev)
+	if alwaysDense {
+		b16.makeDense()
+	}
 	count += b16.addMulti(a[i:])
 	return count
 }
 
+func (b *bucket32) delMulti(a []uint64) int {
+	count := 0
+	hiPrev := uint16(a[0] >> 16)
+	i := 0
+	for j, x := range a {
+		hi := uint16(x >> 16)
+		if hi == hiPrev {
+			continue
+		}
+		if b16 := b.getBucket16(hiPrev); b16 != nil {
+			count += b16.delMulti(a[i:j])
+		}
+		hiPrev = hi
+		i = j
+	}
+	if b16 := b.getBucket16(hiPrev); b16 != nil {
+		count += b16.delMulti(a[i:])
+	}
+	return count
+}
+
+func (b *bucket32) getBucket16(hi uint16) *bucket16 {
+	his := b.b16his
+	n := binarySearch16(his, hi)
+	if n < 0 || n >= len(his) || his[n] != hi {
+		return nil
+	}
+	return b.buckets[n]
+}
+
+// firstBucket16Index returns the index of the first bucket16 item in b with the upper bits not less than hi.
+//
+// len(b.buckets) is returned if there are no such items.
+func (b *bucket32) firstBucket16Index(hi uint16) int {
+	return binarySearch16(b.b16his, hi)
+}
+
 func (b *bucket32) getOrCreateBucket16(hi uint16) *bucket16 {
 	his := b.b16his
 	bs := b.buckets
@@ -617,12 +2996,16 @@ func (b *bucket32) getOrCreateBucket16(hi uint16) *bucket16 {
 	return bs[n]
 }
 
-func (b *bucket32) addSlow(hi, lo uint16) bool {
+func (b *bucket32) addSlow(hi, lo uint16, alwaysDense bool) bool {
 	his := b.b16his
 	n := binarySearch16(his, hi)
 	if n < 0 || n >= len(his) || his[n] != hi {
 		b16 := b.addBucketAtPos(hi, n)
+		if alwaysDense {
+			b16.makeDense()
+		}
 		b16.add(lo)
+		b.setHint(n)
 		return true
 	}
 	b.setHint(n)
@@ -649,9 +3032,223 @@ func (b *bucket32) addBucketAtPos(hi uint16, pos int) *bucket16 {
 	b.buckets = append(b.buckets[:pos+1], b.buckets[pos:]...)
 	b16 := &bucket16{}
 	b.buckets[pos] = b16
+	if n := int(b.getHint()); n >= pos {
+		// Move the hint together with the bucket it points to.
+		b.setHint(n + 1)
+	}
 	return b16
 }
 
+func (b *bucket32) removeBucketAtPos(pos int) {
+	if n := int(b.getHint()); n > pos {
+		// Move the hint together with the bucket it points to.
+		b.setHint(n - 1)
+	}
+	b.b16his = append(b.b16his[:pos], b.b16his[pos+1:]...)
+	bs := b.buckets
+	copy(bs[pos:], bs[pos+1:])
+	bs[len(bs)-1] = nil
+	b.buckets = bs[:len(bs)-1]
+}
+
+// compact removes empty bucket16 items from b and converts sparse dense items to small pool.
+//
+// Bits arrays are kept if alwaysDense is set.
+func (b *bucket32) compact(alwaysDense bool) {
+	for j := len(b.buckets) - 1; j >= 0; j-- {
+		b16 := b.buckets[j]
+		if b16.isEmpty() {
+			b.removeBucketAtPos(j)
+			continue
+		}
+		if !alwaysDense {
+			b16.makeSmallIfPossible()
+		}
+	}
+}
+
+// shrink compacts b and trims the capacity of its bucket lists.
+func (b *bucket32) shrink(alwaysDense bool) {
+	b.compact(alwaysDense)
+	if len(b.buckets) == 0 {
+		return
+	}
+	if cap(b.b16his) > len(b.b16his) {
+		b16his := make([]uint16, len(b.b16his))
+		copy(b16his, b.b16his)
+		b.b16his = b16his
+	}
+	if cap(b.buckets) > len(b.buckets) {
+		bs := make([]*bucket16, len(b.buckets))
+		copy(bs, b.buckets)
+		b.buckets = bs
+	}
+}
+
+// replaceRange replaces b items in the range [lo, hi) with a items from this range, where base is the item for b start.
+//
+// a may be nil. It returns the change in the number of b items. New bucket16 items are switched
+// to bits arrays if alwaysDense is set.
+func (b *bucket32) replaceRange(base, lo, hi uint64, a *bucket32, stickyDense, alwaysDense bool) int {
+	var ahis []uint16
+	var abs []*bucket16
+	if a != nil {
+		ahis = a.b16his
+		abs = a.buckets
+	}
+	bhis := b.b16his
+	bbs := b.buckets
+	count := 0
+	his := make([]uint16, 0, len(bhis)+len(ahis))
+	bs := make([]*bucket16, 0, len(bbs)+len(abs))
+	i := 0
+	j := 0
+	for i < len(bhis) || j < len(ahis) {
+		switch {
+		case j >= len(ahis) || i < len(bhis) && bhis[i] < ahis[j]:
+			// The bucket16 is missing in a, so delete the range from it.
+			hi16 := bhis[i]
+			b16 := bbs[i]
+			i++
+			loLocal, hiLocal, ok := getLocalRange(base|uint64(hi16)<<16, lo, hi)
+			if ok {
+				if loLocal == 0 && hiLocal == bitsPerBucket && !(stickyDense && b16.bits != nil) {
+					// Drop the whole bucket16 without clearing its items.
+					count -= b16.getLen()
+					continue
+				}
+				count -= b16.delRange(loLocal, hiLocal)
+				if b16.isEmpty() && !(stickyDense && b16.bits != nil) {
+					continue
+				}
+			}
+			his = append(his, hi16)
+			bs = append(bs, b16)
+		case i >= len(bhis) || ahis[j] < bhis[i]:
+			// The bucket16 is missing in b, so add a items from the range to the new bucket16.
+			hi16 := ahis[j]
+			a16 := abs[j]
+			j++
+			loLocal, hiLocal, ok := getLocalRange(base|uint64(hi16)<<16, lo, hi)
+			if !ok {
+				continue
+			}
+			b16 := &bucket16{}
+			if loLocal == 0 && hiLocal == bitsPerBucket {
+				a16.copyTo(b16)
+				if alwaysDense {
+					b16.makeDense()
+				}
+				count += b16.getLen()
+			} else {
+				if alwaysDense || a16.bits != nil && a16.countRange(loLocal, hiLocal) > smallPoolSize {
+					var bits [wordsPerBucket]uint64
+					b16.bits = &bits
+				}
+				count += b16.unionRange(a16, loLocal, hiLocal)
+			}
+			if !b16.isEmpty() {
+				his = append(his, hi16)
+				bs = append(bs, b16)
+			}
+		default:
+			// The bucket16 exists in both b and a, so replace the range in place.
+			hi16 := bhis[i]
+			b16 := bbs[i]
+			a16 := abs[j]
+			i++
+			j++
+			if loLocal, hiLocal, ok := getLocalRange(base|uint64(hi16)<<16, lo, hi); ok {
+				count -= b16.delRange(loLocal, hiLocal)
+				count += b16.unionRange(a16, loLocal, hiLocal)
+				if b16.isEmpty() && !(stickyDense && b16.bits != nil) {
+					continue
+				}
+			}
+			his = append(his, hi16)
+			bs = append(bs, b16)
+		}
+	}
+	b.resetHint()
+	b.b16his = his
+	b.buckets = bs
+	return count
+}
+
+// getLocalRange returns the range [lo, hi) as offsets inside the bucket16 starting at base16.
+//
+// false is returned if the range doesn't intersect the bucket16.
+func getLocalRange(base16, lo, hi uint64) (int, int, bool) {
+	if hi <= base16 || (lo > base16 && lo-base16 >= bitsPerBucket) {
+		return 0, 0, false
+	}
+	loLocal := 0
+	if lo > base16 {
+		loLocal = int(lo - base16)
+	}
+	hiLocal := bitsPerBucket
+	if hi-base16 < bitsPerBucket {
+		hiLocal = int(hi - base16)
+	}
+	return loLocal, hiLocal, true
+}
+
+// delRange removes items in the range [lo, hi) from b, where base is the item for b start.
+//
+// It returns the number of removed items.
+// If stickyDense is set, then b16 items with bits arrays are kept even if all their items are removed.
+func (b *bucket32) delRange(base, lo, hi uint64, stickyDense bool) int {
+	count := 0
+	hint := int(b.getHint())
+	b.resetHint()
+	his := b.b16his[:0]
+	bs := b.buckets[:0]
+	for j, b16 := range b.buckets {
+		if j == hint {
+			// Move the hint together with the bucket it points to.
+			// The hint points to the next preserved bucket if the bucket is deleted.
+			b.setHint(len(bs))
+		}
+		hi16 := b.b16his[j]
+		base16 := base | uint64(hi16)<<16
+		if hi <= base16 || (lo > base16 && lo-base16 >= bitsPerBucket) {
+			his = append(his, hi16)
+			bs = append(bs, b16)
+			continue
+		}
+		loLocal := 0
+		if lo > base16 {
+			loLocal = int(lo - base16)
+		}
+		hiLocal := bitsPerBucket
+		if hi-base16 < bitsPerBucket {
+			hiLocal = int(hi - base16)
+		}
+		if stickyDense && b16.bits != nil {
+			count += b16.delRange(loLocal, hiLocal)
+			his = append(his, hi16)
+			bs = append(bs, b16)
+			continue
+		}
+		if loLocal == 0 && hiLocal == bitsPerBucket {
+			// Drop the whole bucket16 without clearing its items.
+			count += b16.getLen()
+			continue
+		}
+		count += b16.delRange(loLocal, hiLocal)
+		if !b16.isEmpty() {
+			his = append(his, hi16)
+			bs = append(bs, b16)
+		}
+	}
+	for j := len(bs); j < len(b.buckets); j++ {
+		b.buckets[j] = nil
+	}
+	b.b16his = his
+	b.buckets = bs
+	return count
+}
+
 func (b *bucket32) has(x uint32) bool {
 	hi := uint16(x >> 16)
 	lo := uint16(x)
@@ -697,6 +3294,21 @@ func (b *bucket32) appendTo(dst []uint64) []uint64 {
 	return dst
 }
 
+// appendMissingTo appends sorted items from b, which are missing in a, to dst.
+//
+// a may be nil.
+func (b *bucket32) appendMissingTo(dst []uint64, a *bucket32) []uint64 {
+	for i, b16 := range b.buckets {
+		hi16 := b.b16his[i]
+		var a16 *bucket16
+		if a != nil {
+			a16 = a.getBucket16(hi16)
+		}
+		dst = b16.appendMissingTo(dst, b.hi, hi16, a16)
+	}
+	return dst
+}
+
 const (
 	bitsPerBucket  = 1 << 16
 	wordsPerBucket = bitsPerBucket / 64
@@ -708,7 +3320,16 @@ type bucket16 struct {
 	smallPoolLen int
 }
 
-const smallPoolSize = 56
+// clear removes all the items from b.
+//
+// The bits array is kept if keepBits is set.
+func (b *bucket16) clear(keepBits bool) {
+	if keepBits && b.bits != nil {
+		*b.bits = [wordsPerBucket]uint64{}
+		return
+	}
+	*b = bucket16{}
+}
 
 func (b *bucket16) isZero() bool {
 	return b.bits == nil && b.smallPoolLen == 0
@@ -724,33 +3345,279 @@ func (b *bucket16) getLen() int {
 			n += bits.OnesCount64(x)
 		}
 	}
-	return n
+	return n
+}
+
+// min returns the minimum item in b.
+//
+// false is returned if b is empty.
+func (b *bucket16) min() (uint16, bool) {
+	if b.bits == nil {
+		if b.smallPoolLen == 0 {
+			return 0, false
+		}
+		sp := b.smallPool[:b.smallPoolLen]
+		x := sp[0]
+		for _, v := range sp[1:] {
+			if v < x {
+				x = v
+			}
+		}
+		return x, true
+	}
+	for wordNum, word := range b.bits {
+		if word != 0 {
+			return uint16(wordNum*64 + bits.TrailingZeros64(word)), true
+		}
+	}
+	return 0, false
+}
+
+// appendSortedItems appends up to maxItems smallest items from b to dst in ascending order.
+//
+// It doesn't modify b, so it is safe to use for buckets shared with read-only sets.
+func (b *bucket16) appendSortedItems(dst []uint16, maxItems int) []uint16 {
+	dstLen := len(dst)
+	if b.bits == nil {
+		dst = append(dst, b.smallPool[:b.smallPoolLen]...)
+		a := dst[dstLen:]
+		// Use insertion sort, since the small pool is short.
+		for i := 1; i < len(a); i++ {
+			for j := i; j > 0 && a[j] < a[j-1]; j-- {
+				a[j], a[j-1] = a[j-1], a[j]
+			}
+		}
+		if len(a) > maxItems {
+			dst = dst[:dstLen+maxItems]
+		}
+		return dst
+	}
+	for wordNum, word := range b.bits {
+		for word != 0 {
+			if len(dst)-dstLen >= maxItems {
+				return dst
+			}
+			tzn := bits.TrailingZeros64(word)
+			word &^= uint64(1) << uint(tzn)
+			dst = append(dst, uint16(wordNum*64+tzn))
+		}
+	}
+	return dst
+}
+
+// takeMinTo puts up to k smallest items from b to dst and returns the number of items put to dst.
+//
+// dst must be empty. It is switched to bits array only if it gets more than smallPoolSize items.
+func (b *bucket16) takeMinTo(dst *bucket16, k int) int {
+	if n := b.getLen(); k > n {
+		k = n
+	}
+	if k <= smallPoolSize {
+		sp := b.appendSortedItems(dst.smallPool[:0], k)
+		dst.smallPoolLen = len(sp)
+		return len(sp)
+	}
+
+	// b is dense, since it contains more than smallPoolSize items.
+	var dstBits [wordsPerBucket]uint64
+	remaining := k
+	for wordNum, word := range b.bits {
+		n := bits.OnesCount64(word)
+		if n < remaining {
+			dstBits[wordNum] = word
+			remaining -= n
+			continue
+		}
+		// Take the lowest remaining bits from the boundary word.
+		var result uint64
+		for ; remaining > 0; remaining-- {
+			lowest := word & -word
+			result |= lowest
+			word ^= lowest
+		}
+		dstBits[wordNum] = result
+		break
+	}
+	dst.bits = &dstBits
+	return k
+}
+
+// firstDiff returns the smallest item x, which exists only in b or only in a.
+//
+// inB is set to true if x exists in b. false ok is returned if b and a contain the same items.
+func (b *bucket16) firstDiff(a *bucket16) (x uint16, inB, ok bool) {
+	if b.bits != nil && a.bits != nil {
+		// Fast path - use bitwise ops.
+		ab := a.bits
+		bb := b.bits
+		for wordNum, bx := range bb {
+			d := bx ^ ab[wordNum]
+			if d == 0 {
+				continue
+			}
+			tzn := bits.TrailingZeros64(d)
+			return uint16(wordNum*64 + tzn), bx&(uint64(1)<<uint(tzn)) != 0, true
+		}
+		return 0, false, false
+	}
+
+	// At least one of the buckets is a small pool, so the first mismatch is located
+	// among the first smallPoolSize+1 items of both buckets.
+	var bbuf, abuf [smallPoolSize + 1]uint16
+	bs := b.appendSortedItems(bbuf[:0], len(bbuf))
+	as := a.appendSortedItems(abuf[:0], len(abuf))
+	for i := 0; i < len(bs) && i < len(as); i++ {
+		if bs[i] != as[i] {
+			if bs[i] < as[i] {
+				return bs[i], true, true
+			}
+			return as[i], false, true
+		}
+	}
+	if len(bs) > len(as) {
+		return bs[len(as)], true, true
+	}
+	if len(as) > len(bs) {
+		return as[len(bs)], false, true
+	}
+	return 0, false, false
+}
+
+// nth returns the k-th smallest item in b.
+//
+// false is returned if b contains less than k+1 items.
+func (b *bucket16) nth(k int) (uint16, bool) {
+	if b.bits == nil {
+		if k >= b.smallPoolLen {
+			return 0, false
+		}
+		var buf [smallPoolSize]uint16
+		sp := b.appendSortedItems(buf[:0], k+1)
+		return sp[k], true
+	}
+	for wordNum, word := range b.bits {
+		n := bits.OnesCount64(word)
+		if k >= n {
+			k -= n
+			continue
+		}
+		for ; k > 0; k-- {
+			// Clear the lowest set bit.
+			word &= word - 1
+		}
+		return uint16(wordNum*64 + bits.TrailingZeros64(word)), true
+	}
+	return 0, false
+}
+
+// max returns the maximum item in b.
+//
+// false is returned if b is empty.
+func (b *bucket16) max() (uint16, bool) {
+	if b.bits == nil {
+		if b.smallPoolLen == 0 {
+			return 0, false
+		}
+		sp := b.smallPool[:b.smallPoolLen]
+		x := sp[0]
+		for _, v := range sp[1:] {
+			if v > x {
+				x = v
+			}
+		}
+		return x, true
+	}
+	for wordNum := len(b.bits) - 1; wordNum >= 0; wordNum-- {
+		if word := b.bits[wordNum]; word != 0 {
+			return uint16(wordNum*64 + 63 - bits.LeadingZeros64(word)), true
+		}
+	}
+	return 0, false
+}
+
+// union adds a items to b and returns the number of added items.
+func (b *bucket16) union(a *bucket16) int {
+	count := 0
+	if a.bits != nil && b.bits != nil {
+		// Fast path - use bitwise ops.
+		ab := a.bits
+		bb := b.bits
+		_ = bb[len(ab)-1]
+		for i, ax := range ab {
+			bx := bb[i]
+			count += bits.OnesCount64(ax &^ bx)
+			bx |= ax
+			bb[i] = bx
+		}
+		return count
+	}
+	if a.bits != nil {
+		// Fast path - start from the copy of a bits and add b items to it.
+		bits := *a.bits
+		count = a.getLen()
+		for _, v := range b.smallPool[:b.smallPoolLen] {
+			wordNum, bitMask := getWordNumBitMask(v)
+			if bits[wordNum]&bitMask != 0 {
+				count--
+			}
+			bits[wordNum] |= bitMask
+		}
+		b.bits = &bits
+		b.smallPoolLen = 0
+		return count
+	}
+
+	// Slow path
+	for _, v := range a.smallPool[:a.smallPoolLen] {
+		if b.add(v) {
+			count++
+		}
+	}
+	return count
 }
 
-func (b *bucket16) union(a *bucket16) {
+// unionRange adds items from a in the range [lo, hi) to b and returns the number of added items.
+//
+// lo and hi are offsets inside the bucket.
+func (b *bucket16) unionRange(a *bucket16, lo, hi int) int {
+	count := 0
 	if a.bits != nil && b.bits != nil {
 		// Fast path - use bitwise ops.
 		ab := a.bits
 		bb := b.bits
-		_ = bb[len(ab)-1]
-		for i, ax := range ab {
-			bx := bb[i]
-			bx |= ax
-			bb[i] = bx
+		for wordNum := lo / 64; wordNum < (hi+63)/64; wordNum++ {
+			ax := ab[wordNum] & getRangeMask(wordNum, lo, hi)
+			if ax == 0 {
+				continue
+			}
+			bx := bb[wordNum]
+			count += bits.OnesCount64(ax &^ bx)
+			bb[wordNum] = bx | ax
 		}
-		return
+		return count
 	}
 
-	// Slow path
-	xbuf := partBufPool.Get().(*[]uint64)
-	buf := *xbuf
-	buf = a.appendTo(buf[:0], 0, 0)
-	for _, x := range buf {
-		x16 := uint16(x)
-		b.add(x16)
+	// Slow path - add items one by one, so b stays in the small pool if they fit it.
+	if a.bits != nil {
+		ab := a.bits
+		for wordNum := lo / 64; wordNum < (hi+63)/64; wordNum++ {
+			word := ab[wordNum] & getRangeMask(wordNum, lo, hi)
+			for word != 0 {
+				tzn := bits.TrailingZeros64(word)
+				word &^= uint64(1) << uint(tzn)
+				if b.add(uint16(wordNum*64 + tzn)) {
+					count++
+				}
+			}
+		}
+		return count
 	}
-	*xbuf = buf
-	partBufPool.Put(xbuf)
+	for _, v := range a.smallPool[:a.smallPoolLen] {
+		if int(v) >= lo && int(v) < hi && b.add(v) {
+			count++
+		}
+	}
+	return count
 }
 
 func (b *bucket16) intersect(a *bucket16) {
@@ -782,11 +3649,7 @@ func (b *bucket16) intersect(a *bucket16) {
 }
 
 func (b *bucket16) sizeBytes() uint64 {
-	n := unsafe.Sizeof(*b)
-	if b.bits != nil {
-		n += unsafe.Sizeof(*b.bits)
-	}
-	return uint64(n)
+	return getBucket16SizeBytes(b.bits != nil)
 }
 
 func (b *bucket16) copyTo(dst *bucket16) {
@@ -800,6 +3663,20 @@ func (b *bucket16) copyTo(dst *bucket16) {
 	dst.smallPoolLen = b.smallPoolLen
 }
 
+// copyToReuse copies b to dst while reusing dst.bits if it is already allocated.
+func (b *bucket16) copyToReuse(dst *bucket16) {
+	if b.bits == nil {
+		dst.bits = nil
+	} else if dst.bits == nil {
+		bits := *b.bits
+		dst.bits = &bits
+	} else {
+		copy(dst.bits[:], b.bits[:])
+	}
+	dst.smallPool = b.smallPool
+	dst.smallPoolLen = b.smallPoolLen
+}
+
 func (b *bucket16) add(x uint16) bool {
 	bits := b.bits
 	if bits == nil {
@@ -850,14 +3727,106 @@ func (b *bucket16) addToSmallPool(x uint16) bool {
 		b.smallPoolLen++
 		return true
 	}
+	b.makeDense()
+	b.add(x)
+	return true
+}
+
+// orTo sets b items in bb.
+func (b *bucket16) orTo(bb *[wordsPerBucket]uint64) {
+	if b.bits != nil {
+		for wordNum, word := range b.bits {
+			bb[wordNum] |= word
+		}
+		return
+	}
+	for _, v := range b.smallPool[:b.smallPoolLen] {
+		wordNum, bitMask := getWordNumBitMask(v)
+		bb[wordNum] |= bitMask
+	}
+}
+
+// xorTo toggles b items in bb.
+func (b *bucket16) xorTo(bb *[wordsPerBucket]uint64) {
+	if b.bits != nil {
+		for wordNum, word := range b.bits {
+			bb[wordNum] ^= word
+		}
+		return
+	}
+	for _, v := range b.smallPool[:b.smallPoolLen] {
+		wordNum, bitMask := getWordNumBitMask(v)
+		bb[wordNum] ^= bitMask
+	}
+}
+
+// initFromBits initializes b with the items from bb.
+//
+// The items are stored in the small pool if they fit it. Otherwise bb is copied to b.
+func (b *bucket16) initFromBits(bb *[wordsPerBucket]uint64) {
+	n := 0
+	for _, word := range bb {
+		n += bits.OnesCount64(word)
+	}
+	if n > smallPoolSize {
+		bitsCopy := *bb
+		b.bits = &bitsCopy
+		b.smallPoolLen = 0
+		return
+	}
+	b.bits = nil
 	b.smallPoolLen = 0
+	for wordNum, word := range bb {
+		for word != 0 {
+			tzn := bits.TrailingZeros64(word)
+			word &^= uint64(1) << uint(tzn)
+			b.smallPool[b.smallPoolLen] = uint16(wordNum*64 + tzn)
+			b.smallPoolLen++
+		}
+	}
+}
+
+// makeSmallIfPossible converts dense b to small pool representation if b items fit the small pool.
+func (b *bucket16) makeSmallIfPossible() {
+	if b.bits == nil || b.getLen() > smallPoolSize {
+		return
+	}
+	n := 0
+	for wordNum, word := range b.bits {
+		for word != 0 {
+			tzn := bits.TrailingZeros64(word)
+			word &^= uint64(1) << uint(tzn)
+			b.smallPool[n] = uint16(wordNum*64 + tzn)
+			n++
+		}
+	}
+	b.bits = nil
+	b.smallPoolLen = n
+}
+
+// sortSmallPool sorts b.smallPool in place.
+func (b *bucket16) sortSmallPool() {
+	a := b.smallPool[:b.smallPoolLen]
+	// Use insertion sort, since the small pool is short.
+	for i := 1; i < len(a); i++ {
+		for j := i; j > 0 && a[j] < a[j-1]; j-- {
+			a[j], a[j-1] = a[j-1], a[j]
+		}
+	}
+}
+
+// makeDense converts b to dense representation with bits array.
+func (b *bucket16) makeDense() {
+	if b.bits != nil {
+		return
+	}
 	var bits [wordsPerBucket]uint64
-	b.bits = &bits
-	for _, v := range sp[:] {
-		b.add(v)
+	for _, v := range b.smallPool[:b.smallPoolLen] {
+		wordNum, bitMask := getWordNumBitMask(v)
+		bits[wordNum] |= bitMask
 	}
-	b.add(x)
-	return true
+	b.bits = &bits
+	b.smallPoolLen = 0
 }
 
 func (b *bucket16) has(x uint16) bool {
@@ -888,6 +3857,79 @@ func (b *bucket16) del(x uint16) bool {
 	return ok
 }
 
+// countRange returns the number of b items in the range [lo, hi).
+func (b *bucket16) countRange(lo, hi int) int {
+	count := 0
+	if b.bits != nil {
+		bb := b.bits
+		for wordNum := lo / 64; wordNum < (hi+63)/64; wordNum++ {
+			count += bits.OnesCount64(bb[wordNum] & getRangeMask(wordNum, lo, hi))
+		}
+		return count
+	}
+	for _, v := range b.smallPool[:b.smallPoolLen] {
+		if int(v) >= lo && int(v) < hi {
+			count++
+		}
+	}
+	return count
+}
+
+// delRange removes items in the range [lo, hi) from b and returns the number of removed items.
+func (b *bucket16) delRange(lo, hi int) int {
+	count := 0
+	if b.bits != nil {
+		bb := b.bits
+		for wordNum := lo / 64; wordNum < (hi+63)/64; wordNum++ {
+			x := bb[wordNum]
+			mask := getRangeMask(wordNum, lo, hi)
+			count += bits.OnesCount64(x & mask)
+			bb[wordNum] = x &^ mask
+		}
+		return count
+	}
+	sp := b.smallPool[:b.smallPoolLen]
+	dst := sp[:0]
+	for _, v := range sp {
+		if int(v) >= lo && int(v) < hi {
+			count++
+			continue
+		}
+		dst = append(dst, v)
+	}
+	b.smallPoolLen = len(dst)
+	return count
+}
+
+func (b *bucket16) delMulti(a []uint64) int {
+	count := 0
+	if b.bits == nil {
+		for _, x := range a {
+			if b.delFromSmallPool(uint16(x)) {
+				count++
+			}
+		}
+		return count
+	}
+	// Clear the bits for consecutive items from the same word at once.
+	bb := b.bits
+	wordNumPrev, mask := getWordNumBitMask(uint16(a[0]))
+	for _, x := range a[1:] {
+		wordNum, bitMask := getWordNumBitMask(uint16(x))
+		if wordNum == wordNumPrev {
+			mask |= bitMask
+			continue
+		}
+		count += bits.OnesCount64(bb[wordNumPrev] & mask)
+		bb[wordNumPrev] &^= mask
+		wordNumPrev = wordNum
+		mask = bitMask
+	}
+	count += bits.OnesCount64(bb[wordNumPrev] & mask)
+	bb[wordNumPrev] &^= mask
+	return count
+}
+
 func (b *bucket16) delFromSmallPool(x uint16) bool {
 	sp := b.smallPool[:]
 	for i, v := range sp[:b.smallPoolLen] {
@@ -920,11 +3962,26 @@ func (b *bucket16) appendTo(dst []uint64, hi uint32, hi16 uint16) []uint64 {
 		return dst
 	}
 	var wordNum uint64
+	sized := false
 	for _, word := range b.bits {
 		if word == 0 {
 			wordNum++
 			continue
 		}
+		if !sized && cap(dst)-len(dst) < 64 {
+			// dst runs out of capacity, so grow it to the exact size needed for the remaining b items
+			// in order to avoid multiple re-allocations. This is the case for partBufPool buffers.
+			n := 0
+			for _, w := range b.bits[wordNum:] {
+				n += bits.OnesCount64(w)
+			}
+			if cap(dst)-len(dst) < n {
+				dstNew := make([]uint64, len(dst), len(dst)+n)
+				copy(dstNew, dst)
+				dst = dstNew
+			}
+			sized = true
+		}
 		x64 := hi64 | (wordNum * 64)
 		for {
 			tzn := uint64(bits.TrailingZeros64(word))
@@ -940,6 +3997,241 @@ func (b *bucket16) appendTo(dst []uint64, hi uint32, hi16 uint16) []uint64 {
 	return dst
 }
 
+// appendToUnordered appends items from b to dst without sorting the small pool.
+func (b *bucket16) appendToUnordered(dst []uint64, hi uint32, hi16 uint16) []uint64 {
+	if b.bits != nil {
+		return b.appendTo(dst, hi, hi16)
+	}
+	hi64 := uint64(hi)<<32 | uint64(hi16)<<16
+	for _, v := range b.smallPool[:b.smallPoolLen] {
+		x := hi64 | uint64(v)
+		dst = append(dst, x)
+	}
+	return dst
+}
+
+// appendMissingTo appends sorted items from b, which are missing in a, to dst.
+//
+// a may be nil.
+func (b *bucket16) appendMissingTo(dst []uint64, hi uint32, hi16 uint16, a *bucket16) []uint64 {
+	if a == nil {
+		return b.appendTo(dst, hi, hi16)
+	}
+	if a.bits != nil && b.bits != nil {
+		// Fast path - use bitwise ops.
+		hi64 := uint64(hi)<<32 | uint64(hi16)<<16
+		ab := a.bits
+		for wordNum, word := range b.bits {
+			dst = appendWordItems(dst, hi64|uint64(wordNum*64), word&^ab[wordNum])
+		}
+		return dst
+	}
+
+	// Slow path
+	dstLen := len(dst)
+	dst = b.appendTo(dst, hi, hi16)
+	tail := dst[dstLen:]
+	dst = dst[:dstLen]
+	for _, x := range tail {
+		if !a.has(uint16(x)) {
+			dst = append(dst, x)
+		}
+	}
+	return dst
+}
+
+// appendUnionTo appends sorted items, which exist in b or a, to dst.
+func (b *bucket16) appendUnionTo(dst []uint64, hi uint32, hi16 uint16, a *bucket16) []uint64 {
+	hi64 := uint64(hi)<<32 | uint64(hi16)<<16
+	if a.bits != nil && b.bits != nil {
+		// Fast path - use bitwise ops.
+		ab := a.bits
+		for wordNum, word := range b.bits {
+			dst = appendWordItems(dst, hi64|uint64(wordNum*64), word|ab[wordNum])
+		}
+		return dst
+	}
+	if a.bits != nil || b.bits != nil {
+		// Put small pool items into the copy of bits array.
+		if b.bits == nil {
+			a, b = b, a
+		}
+		bits := *b.bits
+		for _, v := range a.smallPool[:a.smallPoolLen] {
+			wordNum, bitMask := getWordNumBitMask(v)
+			bits[wordNum] |= bitMask
+		}
+		for wordNum, word := range bits {
+			dst = appendWordItems(dst, hi64|uint64(wordNum*64), word)
+		}
+		return dst
+	}
+
+	// Merge sorted small pool items.
+	dstLen := len(dst)
+	dst = b.appendTo(dst, hi, hi16)
+	dst = a.appendTo(dst, hi, hi16)
+	bItems := dst[dstLen : dstLen+b.smallPoolLen]
+	aItems := dst[dstLen+b.smallPoolLen:]
+	var buf [2 * smallPoolSize]uint64
+	merged := buf[:0]
+	for len(bItems) > 0 && len(aItems) > 0 {
+		switch {
+		case bItems[0] < aItems[0]:
+			merged = append(merged, bItems[0])
+			bItems = bItems[1:]
+		case aItems[0] < bItems[0]:
+			merged = append(merged, aItems[0])
+			aItems = aItems[1:]
+		default:
+			merged = append(merged, bItems[0])
+			bItems = bItems[1:]
+			aItems = aItems[1:]
+		}
+	}
+	merged = append(merged, bItems...)
+	merged = append(merged, aItems...)
+	return append(dst[:dstLen], merged...)
+}
+
+// appendIntersectionTo appends sorted items, which exist in both b and a, to dst.
+func (b *bucket16) appendIntersectionTo(dst []uint64, hi uint32, hi16 uint16, a *bucket16) []uint64 {
+	if a.bits != nil && b.bits != nil {
+		// Fast path - use bitwise ops.
+		hi64 := uint64(hi)<<32 | uint64(hi16)<<16
+		ab := a.bits
+		for wordNum, word := range b.bits {
+			dst = appendWordItems(dst, hi64|uint64(wordNum*64), word&ab[wordNum])
+		}
+		return dst
+	}
+
+	// Slow path - iterate over the smaller bucket and check items in the bigger bucket.
+	if b.bits != nil {
+		a, b = b, a
+	}
+	dstLen := len(dst)
+	dst = b.appendTo(dst, hi, hi16)
+	tail := dst[dstLen:]
+	dst = dst[:dstLen]
+	for _, x := range tail {
+		if a.has(uint16(x)) {
+			dst = append(dst, x)
+		}
+	}
+	return dst
+}
+
+func (b *bucket16) forEachDenseWord(f func(base, word uint64) bool, hi uint32, hi16 uint16) bool {
+	hi64 := uint64(hi)<<32 | uint64(hi16)<<16
+	if b.bits != nil {
+		for wordNum, word := range b.bits {
+			if word != 0 && !f(hi64|uint64(wordNum*64), word) {
+				return false
+			}
+		}
+		return true
+	}
+	xbuf := partBufPool.Get().(*[]uint64)
+	buf := b.appendTo((*xbuf)[:0], hi, hi16)
+	ok := true
+	for i := 0; i < len(buf); {
+		base := buf[i] &^ 63
+		var word uint64
+		for i < len(buf) && buf[i]&^63 == base {
+			word |= uint64(1) << (buf[i] & 63)
+			i++
+		}
+		if !f(base, word) {
+			ok = false
+			break
+		}
+	}
+	*xbuf = buf
+	partBufPool.Put(xbuf)
+	return ok
+}
+
+// intersectTo puts the items, which exist in both b and a, to the empty dst and returns the number of these items.
+func (b *bucket16) intersectTo(dst, a *bucket16) int {
+	if a.bits != nil && b.bits != nil {
+		// Fast path - use bitwise ops.
+		n := b.intersectCount(a)
+		if n == 0 {
+			return 0
+		}
+		ab := a.bits
+		if n > smallPoolSize {
+			var bits [wordsPerBucket]uint64
+			for wordNum, word := range b.bits {
+				bits[wordNum] = word & ab[wordNum]
+			}
+			dst.bits = &bits
+			return n
+		}
+		sp := dst.smallPool[:0]
+		for wordNum, word := range b.bits {
+			word &= ab[wordNum]
+			for word != 0 {
+				tzn := bits.TrailingZeros64(word)
+				word &^= uint64(1) << uint(tzn)
+				sp = append(sp, uint16(wordNum*64+tzn))
+			}
+		}
+		dst.smallPoolLen = len(sp)
+		return n
+	}
+
+	// Slow path - check small pool items in the other bucket.
+	// The number of these items cannot exceed smallPoolSize.
+	if b.bits != nil {
+		a, b = b, a
+	}
+	n := 0
+	for _, v := range b.smallPool[:b.smallPoolLen] {
+		if a.has(v) {
+			dst.smallPool[n] = v
+			n++
+		}
+	}
+	dst.smallPoolLen = n
+	return n
+}
+
+// intersectCount returns the number of items, which exist in both b and a.
+func (b *bucket16) intersectCount(a *bucket16) int {
+	n := 0
+	if a.bits != nil && b.bits != nil {
+		// Fast path - use bitwise ops.
+		ab := a.bits
+		for wordNum, word := range b.bits {
+			n += bits.OnesCount64(word & ab[wordNum])
+		}
+		return n
+	}
+	if b.bits != nil {
+		a, b = b, a
+	}
+	for _, v := range b.smallPool[:b.smallPoolLen] {
+		if a.has(v) {
+			n++
+		}
+	}
+	return n
+}
+
+// appendWordItems appends items for set bits in word to dst.
+//
+// base is the item for the lowest bit in word.
+func appendWordItems(dst []uint64, base, word uint64) []uint64 {
+	for word != 0 {
+		tzn := uint64(bits.TrailingZeros64(word))
+		word &^= uint64(1) << tzn
+		dst = append(dst, base|tzn)
+	}
+	return dst
+}
+
 var smallPoolSorterPool = &sync.Pool{
 	New: func() interface{} {
 		return &smallPoolSorter{}
@@ -967,6 +4259,20 @@ func getWordNumBitMask(x uint16) (uint16, uint64) {
 	return wordNum, bitMask
 }
 
+// getRangeMask returns a mask for bits of the word with the given wordNum,
+// which belong to the range [lo, hi) of bucket16 offsets.
+func getRangeMask(wordNum, lo, hi int) uint64 {
+	mask := ^uint64(0)
+	start := wordNum * 64
+	if lo > start {
+		mask <<= uint(lo - start)
+	}
+	if end := start + 64; hi < end {
+		mask &= ^uint64(0) >> uint(end-hi)
+	}
+	return mask
+}
+
 func binarySearch16(u16 []uint16, x uint16) int {
 	// The code has been adapted from sort.Search.
 	n := len(u16)
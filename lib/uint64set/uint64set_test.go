@@ -7,6 +7,7 @@ import (
 	"sort"
 	"testing"
 	"time"
+	"unsafe"
 )
 
 func TestSetOps(t *testing.T) {
@@ -177,6 +178,17 @@ func TestSetOps(t *testing.T) {
 	}
 	f(a, b)
 
+	// Dense and sparse buckets with the same high bits
+	a = a[:0]
+	b = b[:0]
+	for i := 0; i < 1e4; i++ {
+		a = append(a, uint64(i*3))
+		if i%100 == 0 {
+			b = append(b, uint64(i*2))
+		}
+	}
+	f(a, b)
+
 	rng := rand.New(rand.NewSource(0))
 	for i := 0; i < 10; i++ {
 		a = nil
@@ -757,3 +769,3897 @@ func TestAddMulti(t *testing.T) {
 	}
 	f(a)
 }
+
+func TestSetForEachUnordered(t *testing.T) {
+	f := func(a []uint64) {
+		t.Helper()
+		var s Set
+		m := make(map[uint64]bool)
+		for _, x := range a {
+			s.Add(x)
+			m[x] = true
+		}
+		s.ForEachUnordered(func(part []uint64) bool {
+			for _, x := range part {
+				if !m[x] {
+					t.Fatalf("unexpected item %d passed to ForEachUnordered", x)
+				}
+				delete(m, x)
+			}
+			return true
+		})
+		if len(m) != 0 {
+			t.Fatalf("ForEachUnordered didn't visit %d items; items: %v", len(m), m)
+		}
+
+		// Verify fast stop
+		calls := 0
+		s.ForEachUnordered(func(part []uint64) bool {
+			calls++
+			return false
+		})
+		if len(a) > 0 && calls != 1 {
+			t.Fatalf("unexpected number of ForEachUnordered callback calls; got %d; want 1", calls)
+		}
+	}
+	f(nil)
+	f([]uint64{1})
+	f([]uint64{5, 3, 1, 4, 2})
+	f([]uint64{30, 20, 10, 1 << 16, 1 << 32, 2 << 32, 1<<32 + 1})
+
+	var a []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*7))
+	}
+	f(a)
+
+	// Verify ForEachUnordered on nil set.
+	var sNil *Set
+	sNil.ForEachUnordered(func(part []uint64) bool {
+		t.Fatalf("callback shouldn't be called on nil set")
+		return true
+	})
+}
+
+func TestSetContainsAll(t *testing.T) {
+	var s Set
+	for i := 0; i < 1e5; i++ {
+		s.Add(uint64(i * 3))
+		s.Add(1<<32 + uint64(i))
+	}
+	f := func(xs []uint64, resultExpected bool) {
+		t.Helper()
+		result := s.ContainsAll(xs)
+		if result != resultExpected {
+			t.Fatalf("unexpected s.ContainsAll(%v); got %v; want %v", xs, result, resultExpected)
+		}
+	}
+	f(nil, true)
+	f([]uint64{0}, true)
+	f([]uint64{1}, false)
+	f([]uint64{0, 3, 6, 1 << 32, 1<<32 + 1}, true)
+	f([]uint64{1 << 32, 0, 1<<32 + 5, 30}, true)
+	f([]uint64{0, 3, 6, 1<<32 + 1e5}, false)
+	f([]uint64{0, 2 << 32}, false)
+	f([]uint64{3 * (1e5 - 1), 3 * 1e5}, false)
+
+	// Verify nil set
+	var sNil *Set
+	if !sNil.ContainsAll(nil) {
+		t.Fatalf("nil set must contain empty xs")
+	}
+	if sNil.ContainsAll([]uint64{1}) {
+		t.Fatalf("nil set mustn't contain any items")
+	}
+}
+
+func TestSetUnionRange(t *testing.T) {
+	f := func(a, b []uint64, lo, hi uint64) {
+		t.Helper()
+		var sa, sb Set
+		m := make(map[uint64]bool)
+		for _, x := range a {
+			sa.Add(x)
+			m[x] = true
+		}
+		for _, x := range b {
+			sb.Add(x)
+			if x >= lo && x < hi {
+				m[x] = true
+			}
+		}
+		sbOrig := sb.Clone()
+		sa.UnionRange(&sb, lo, hi)
+		if err := expectEqual(&sa, m); err != nil {
+			t.Fatalf("invalid sa.UnionRange(sb, %d, %d): %s", lo, hi, err)
+		}
+		if !sbOrig.Equal(&sb) {
+			t.Fatalf("sb mustn't change after sa.UnionRange(sb, %d, %d)", lo, hi)
+		}
+	}
+	f(nil, nil, 0, 10)
+	f([]uint64{1, 2}, nil, 0, 10)
+	f(nil, []uint64{1, 2, 3, 10}, 2, 10)
+	f([]uint64{1}, []uint64{1, 2, 3}, 0, 1<<64-1)
+	f([]uint64{1}, []uint64{1, 2, 3}, 2, 2)
+	f([]uint64{1}, []uint64{1, 2, 3}, 3, 2)
+	f([]uint64{1}, []uint64{1, 1 << 16, 1 << 32, 2 << 32}, 1<<16, 2<<32)
+	f([]uint64{1<<64 - 1}, []uint64{1<<64 - 2, 1<<64 - 1}, 1<<64-10, 1<<64-1)
+
+	// Dense buckets
+	var a, b []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*2))
+		b = append(b, uint64(i*3))
+	}
+	f(a, b, 0, 1<<64-1)
+	f(a, b, 100, 1e5)
+	f(a, b, 65, 127)
+	f(a, b, 1<<16+3, 1<<17-5)
+	f(nil, b, 1<<16+3, 1<<17-5)
+	f(nil, b, 1<<16, 1<<17)
+	f(nil, b, 2e5+1, 2e5+2)
+	f(nil, b, 1, 3)
+	f(a[:10], b, 10, 1e5)
+
+	// Random items
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 10; i++ {
+		a = nil
+		b = nil
+		for j := 0; j < 1000; j++ {
+			a = append(a, uint64(rng.Intn(1e6)))
+			b = append(b, uint64(rng.Intn(1e6)))
+		}
+		lo := uint64(rng.Intn(1e6))
+		hi := lo + uint64(rng.Intn(1e6))
+		f(a, b, lo, hi)
+	}
+
+	// Small ranges from dense buckets must be stored in the small pool
+	var sa Set
+	for i := 0; i < 1e5; i++ {
+		sa.Add(uint64(i * 3))
+	}
+	var sb Set
+	sb.UnionRange(&sa, 1<<16+3, 1<<16+30)
+	if n := sb.Len(); n != 9 {
+		t.Fatalf("unexpected number of items after UnionRange; got %d; want 9", n)
+	}
+	if sb.buckets[0].buckets[0].bits != nil {
+		t.Fatalf("UnionRange mustn't allocate bits array for items fitting the small pool")
+	}
+	sb.UnionRange(&sa, 1<<16+100, 1<<16+200)
+	if sb.buckets[0].buckets[0].bits != nil {
+		t.Fatalf("UnionRange mustn't allocate bits array for items fitting the small pool")
+	}
+}
+
+func TestSetAddSortedSlices(t *testing.T) {
+	f := func(slices [][]uint64) {
+		t.Helper()
+		var s Set
+		s.Add(1 << 40)
+		m := map[uint64]bool{
+			1 << 40: true,
+		}
+		var slicesOrig [][]uint64
+		for _, a := range slices {
+			for _, x := range a {
+				m[x] = true
+			}
+			slicesOrig = append(slicesOrig, append([]uint64{}, a...))
+		}
+		s.AddSortedSlices(slices...)
+		if err := expectEqual(&s, m); err != nil {
+			t.Fatalf("unexpected set: %s", err)
+		}
+		for i, a := range slices {
+			if err := checkSameItems(a, slicesOrig[i]); err != nil {
+				t.Fatalf("slice #%d mustn't change: %s", i, err)
+			}
+		}
+		for i := range s.buckets {
+			for j, b16 := range s.buckets[i].buckets {
+				if b16.bits != nil && b16.getLen() <= smallPoolSize {
+					t.Fatalf("bucket16 #%d with %d items must be stored in small pool", j, b16.getLen())
+				}
+			}
+		}
+	}
+	f(nil)
+	f([][]uint64{nil, {}})
+	f([][]uint64{{1, 2, 3}})
+	f([][]uint64{{1, 3, 5}, {2, 4, 6}, nil, {0, 1<<64 - 1}})
+	f([][]uint64{{1, 1 << 16, 1 << 32, 5 << 32}, {2, 1<<16 + 1, 3 << 32}, {1 << 32}})
+
+	// Duplicate items mustn't switch buckets to bits arrays.
+	var a []uint64
+	for i := 0; i < smallPoolSize-1; i++ {
+		a = append(a, uint64(i*3))
+	}
+	f([][]uint64{a, a, a})
+
+	// Interleaved dense slices
+	rng := rand.New(rand.NewSource(0))
+	var slices [][]uint64
+	for i := 0; i < 10; i++ {
+		x := uint64(rng.Intn(1e5))
+		var a []uint64
+		for j := 0; j < 1e4; j++ {
+			a = append(a, x)
+			x += uint64(1 + rng.Intn(1e3))
+		}
+		slices = append(slices, a)
+	}
+	f(slices)
+
+	// Unsorted slices must be added correctly.
+	f([][]uint64{{5 << 32, 1, 3 << 32, 2}, {1 << 16, 0, 1<<64 - 1, 1 << 17}})
+
+	// alwaysDense mode
+	var s Set
+	s.SetAlwaysDense(true)
+	s.AddSortedSlices([]uint64{1, 5}, []uint64{3})
+	if n := s.Len(); n != 3 {
+		t.Fatalf("unexpected number of items; got %d; want 3", n)
+	}
+	if s.buckets[0].buckets[0].bits == nil {
+		t.Fatalf("bucket16 must be switched to bits array in alwaysDense mode")
+	}
+}
+
+func TestSetCloneRangeManyBuckets(t *testing.T) {
+	f := func(keepSorted bool) {
+		t.Helper()
+		var s Set
+		s.SetKeepSorted(keepSorted)
+		// Add buckets in descending order, so they aren't sorted outside keepSorted mode.
+		var a []uint64
+		for i := 1e4; i >= 0; i-- {
+			a = append(a, uint64(i)<<32|1<<16|uint64(i), uint64(i)<<32|1<<31)
+		}
+		s.AddMulti(a)
+		if !keepSorted && sort.IsSorted(&s.buckets) {
+			t.Fatalf("buckets mustn't be sorted")
+		}
+		sOrig := s.Clone()
+		for _, lr := range [][2]uint64{
+			{0, 1},
+			{5000 << 32, 5000<<32 + 1<<16 + 5001},
+			{5000<<32 + 1<<16 + 5000, 5002<<32 + 1<<31},
+			{1e4<<32 + 1<<31, 1<<64 - 1},
+			{1e4<<32 + 1<<31 + 1, 1<<64 - 1},
+		} {
+			lo, hi := lr[0], lr[1]
+			result := s.CloneRange(lo, hi)
+			m := make(map[uint64]bool)
+			for _, x := range a {
+				if x >= lo && x < hi {
+					m[x] = true
+				}
+			}
+			if err := expectEqual(result, m); err != nil {
+				t.Fatalf("unexpected result for CloneRange(%d, %d): %s", lo, hi, err)
+			}
+			if len(result.buckets) > 3 {
+				t.Fatalf("too many buckets in the result for CloneRange(%d, %d); got %d; want up to 3", lo, hi, len(result.buckets))
+			}
+		}
+		if !s.Equal(sOrig) {
+			t.Fatalf("s mustn't be modified by CloneRange")
+		}
+	}
+	f(false)
+	f(true)
+}
+
+func TestSetCloneRange(t *testing.T) {
+	var s Set
+	for i := 0; i < 1e4; i++ {
+		s.Add(uint64(rand.Intn(3e5)))
+		s.Add(1<<32 | uint64(rand.Intn(1e3)))
+		s.Add(uint64(rand.Int63()))
+	}
+	for i := 0; i < 1e5; i++ {
+		s.Add(2<<32 | uint64(i))
+	}
+	s.Add(1<<64 - 1)
+	sOrig := s.Clone()
+	f := func(lo, hi uint64) {
+		t.Helper()
+		result := s.CloneRange(lo, hi)
+		if !s.Equal(sOrig) {
+			t.Fatalf("s mustn't be modified by CloneRange(%d, %d)", lo, hi)
+		}
+		m := make(map[uint64]bool)
+		s.ForEach(func(part []uint64) bool {
+			for _, x := range part {
+				if x >= lo && x < hi {
+					m[x] = true
+				}
+			}
+			return true
+		})
+		if err := expectEqual(result, m); err != nil {
+			t.Fatalf("unexpected result for CloneRange(%d, %d): %s", lo, hi, err)
+		}
+		if hi > lo && hi-lo <= 3e5 {
+			// Compare to the intersection with the set containing all the items in the range.
+			expected := s.Clone()
+			expected.Intersect(createRangeSet(lo, int(hi-lo)))
+			if !result.Equal(expected) {
+				t.Fatalf("CloneRange(%d, %d) must be equal to the intersection with the range", lo, hi)
+			}
+		}
+		// The result must be independent of s.
+		result.Add(lo)
+		result.Del(lo + 1)
+		if !s.Equal(sOrig) {
+			t.Fatalf("s mustn't be modified after modifying the result of CloneRange(%d, %d)", lo, hi)
+		}
+	}
+	f(0, 0)
+	f(10, 5)
+	f(0, 1)
+	f(0, 3e5)
+	f(123, 1<<16+7)
+	f(1<<16, 2<<16)
+	f(1<<32, 1<<32+500)
+	f(2<<32+100, 2<<32+1e5+10)
+	f(0, 3<<32)
+	f(1<<40, 1<<64-1)
+	f(0, 1<<64-1)
+
+	// The result inherits s settings.
+	var sk Set
+	sk.SetKeepSorted(true)
+	sk.AddMulti([]uint64{3 << 32, 1 << 32, 2 << 32})
+	if result := sk.CloneRange(0, 1<<40); !result.opts.keepSorted {
+		t.Fatalf("CloneRange result must inherit keepSorted mode")
+	}
+
+	var sNil *Set
+	if n := sNil.CloneRange(0, 100).Len(); n != 0 {
+		t.Fatalf("unexpected CloneRange length for nil set; got %d; want 0", n)
+	}
+}
+
+func TestSetUnionAbove(t *testing.T) {
+	f := func(a, b []uint64, watermark uint64) {
+		t.Helper()
+		var sa, sb Set
+		m := make(map[uint64]bool)
+		for _, x := range a {
+			sa.Add(x)
+			m[x] = true
+		}
+		for _, x := range b {
+			sb.Add(x)
+			if x > watermark {
+				m[x] = true
+			}
+		}
+		sbOrig := sb.Clone()
+		sa.UnionAbove(&sb, watermark)
+		if err := expectEqual(&sa, m); err != nil {
+			t.Fatalf("invalid sa.UnionAbove(sb, %d): %s", watermark, err)
+		}
+		if !sbOrig.Equal(&sb) {
+			t.Fatalf("sb mustn't change after sa.UnionAbove(sb, %d)", watermark)
+		}
+	}
+	f(nil, nil, 0)
+	f([]uint64{1, 2}, nil, 0)
+	f(nil, []uint64{0, 1, 2, 3}, 0)
+	f([]uint64{1}, []uint64{1, 2, 3}, 2)
+	f([]uint64{5}, []uint64{1, 2, 3}, 3)
+	f(nil, []uint64{1, 1 << 16, 1 << 32, 2 << 32}, 1<<32-1)
+	f(nil, []uint64{1, 1 << 16, 1 << 32, 2 << 32}, 1<<32)
+	f([]uint64{3}, []uint64{1<<64 - 2, 1<<64 - 1}, 1<<64-3)
+	f([]uint64{3}, []uint64{1<<64 - 2, 1<<64 - 1}, 1<<64-2)
+	f([]uint64{3}, []uint64{1<<64 - 2, 1<<64 - 1}, 1<<64-1)
+
+	// Watermark falls in the middle of bucket16 and bucket32 items
+	var a, b []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*7))
+		b = append(b, uint64(i*3), 5<<32|uint64(i*5))
+	}
+	f(a, b, 1<<16+12345)
+	f(a, b, 5<<32+1<<17+100)
+	f(a[:10], b, 2<<32)
+	f(nil, b, 1e5)
+
+	// Items added before watermark mustn't be counted again
+	var sa, sb Set
+	sa.AddMulti([]uint64{1, 2, 1e6})
+	sb.AddMulti([]uint64{1, 2, 3, 1e6, 1e6 + 1})
+	sa.UnionAbove(&sb, 2)
+	if n := sa.Len(); n != 5 {
+		t.Fatalf("unexpected number of items; got %d; want 5", n)
+	}
+}
+
+func TestSetAddShifted(t *testing.T) {
+	f := func(a []uint64, delta uint64) {
+		t.Helper()
+		var s Set
+		m := make(map[uint64]bool)
+		for _, x := range a {
+			s.Add(x)
+			m[x] = true
+		}
+		for _, x := range a {
+			if x <= 1<<64-1-delta {
+				m[x+delta] = true
+			}
+		}
+		s.AddShifted(delta)
+		if err := expectEqual(&s, m); err != nil {
+			t.Fatalf("invalid s.AddShifted(%d): %s", delta, err)
+		}
+	}
+	f(nil, 1)
+	f([]uint64{1, 2, 3}, 0)
+	f([]uint64{1, 2, 3}, 1)
+	f([]uint64{1, 2, 3}, 10)
+	f([]uint64{1<<16 - 1, 1<<32 - 1}, 1)
+	f([]uint64{0, 1 << 40}, 1<<32+5)
+
+	// Overflowing items must be skipped
+	f([]uint64{1, 1<<64 - 2, 1<<64 - 1}, 1)
+	f([]uint64{1, 1<<64 - 2, 1<<64 - 1}, 2)
+	f([]uint64{5, 1<<64 - 100}, 1<<64-1)
+	f([]uint64{0, 1<<63 - 1, 1 << 63}, 1<<63)
+
+	// Dense buckets
+	var a []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*3))
+	}
+	f(a, 1)
+	f(a, 64)
+	f(a, 1<<16)
+	f(a, 1<<64-2e5)
+}
+
+func TestSetCloneInto(t *testing.T) {
+	f := func(a, b []uint64) {
+		t.Helper()
+		var sa, dst Set
+		m := make(map[uint64]bool)
+		for _, x := range a {
+			sa.Add(x)
+			m[x] = true
+		}
+		for _, x := range b {
+			dst.Add(x)
+		}
+		sa.CloneInto(&dst)
+		if err := expectEqual(&dst, m); err != nil {
+			t.Fatalf("unexpected dst after CloneInto: %s", err)
+		}
+
+		// Verify dst is independent of sa.
+		for _, x := range a {
+			dst.Del(x)
+		}
+		dst.Add(1<<64 - 1)
+		if err := expectEqual(&sa, m); err != nil {
+			t.Fatalf("sa mustn't change after modifying dst: %s", err)
+		}
+		for _, x := range a {
+			dst.Add(x)
+		}
+		dst.Del(1<<64 - 1)
+		if !dst.Equal(&sa) {
+			t.Fatalf("dst must be equal to sa after restoring the deleted items")
+		}
+		sa.Add(1<<64 - 1)
+		if dst.Has(1<<64 - 1) {
+			t.Fatalf("dst mustn't change after modifying sa")
+		}
+	}
+	f(nil, nil)
+	f([]uint64{1}, nil)
+	f(nil, []uint64{1})
+	f([]uint64{1, 2, 3}, []uint64{4, 5})
+	f([]uint64{1, 1 << 16, 1 << 32, 2 << 32}, []uint64{4, 5})
+	f([]uint64{4, 5}, []uint64{1, 1 << 16, 1 << 32, 2 << 32})
+
+	var dense, denseOther, sparse []uint64
+	for i := 0; i < 1e5; i++ {
+		dense = append(dense, uint64(i))
+		denseOther = append(denseOther, 1<<32+uint64(i)*3)
+		sparse = append(sparse, uint64(i)*1e6)
+	}
+	f(dense, denseOther)
+	f(denseOther, dense)
+	f(dense, sparse)
+	f(sparse, dense)
+	f(sparse[:10], dense)
+	f(dense[:10], dense)
+
+	// Verify CloneInto from nil set
+	var sNil *Set
+	var dst Set
+	dst.Add(123)
+	sNil.CloneInto(&dst)
+	if n := dst.Len(); n != 0 {
+		t.Fatalf("unexpected dst.Len() after CloneInto from nil set; got %d; want 0", n)
+	}
+	dst.Add(123)
+	if n := dst.Len(); n != 1 {
+		t.Fatalf("unexpected dst.Len() after adding an item; got %d; want 1", n)
+	}
+
+	// Verify CloneInto itself
+	dst.CloneInto(&dst)
+	if n := dst.Len(); n != 1 {
+		t.Fatalf("unexpected dst.Len() after CloneInto itself; got %d; want 1", n)
+	}
+}
+
+func TestSetKeepSorted(t *testing.T) {
+	checkSorted := func(s *Set, op string) {
+		t.Helper()
+		if !sort.IsSorted(&s.buckets) {
+			t.Fatalf("buckets must be sorted after %s", op)
+		}
+	}
+	rng := rand.New(rand.NewSource(0))
+	genItems := func(n int) []uint64 {
+		a := make([]uint64, n)
+		for i := range a {
+			a[i] = uint64(rng.Intn(50))<<32 | uint64(rng.Intn(1e5))
+		}
+		return a
+	}
+
+	var s Set
+	for _, x := range genItems(1000) {
+		s.Add(x)
+	}
+	s.SetKeepSorted(true)
+	checkSorted(&s, "SetKeepSorted")
+	m := make(map[uint64]bool)
+	for _, x := range s.AppendTo(nil) {
+		m[x] = true
+	}
+	for i := 0; i < 10; i++ {
+		for _, x := range genItems(100) {
+			s.Add(x)
+			m[x] = true
+		}
+		checkSorted(&s, "Add")
+
+		a := genItems(100)
+		s.AddMulti(a)
+		for _, x := range a {
+			m[x] = true
+		}
+		checkSorted(&s, "AddMulti")
+
+		var sa Set
+		for _, x := range genItems(1000) {
+			sa.Add(x)
+			m[x] = true
+		}
+		s.Union(&sa)
+		checkSorted(&s, "Union")
+
+		var sb Set
+		for _, x := range genItems(100) {
+			sb.Add(x)
+			if m[x] {
+				delete(m, x)
+			}
+		}
+		s.Subtract(&sb)
+		checkSorted(&s, "Subtract")
+
+		if err := expectEqual(&s, m); err != nil {
+			t.Fatalf("unexpected set contents in keepSorted mode: %s", err)
+		}
+		sCopy := s.Clone()
+		checkSorted(sCopy, "Clone")
+		sCopy.Add(1<<64 - 1)
+		sCopy.Add(0)
+		checkSorted(sCopy, "Add to Clone")
+	}
+
+	var sc Set
+	for _, x := range genItems(1e4) {
+		sc.Add(x)
+	}
+	s.Intersect(&sc)
+	checkSorted(&s, "Intersect")
+	for _, x := range genItems(100) {
+		s.Add(x)
+	}
+	checkSorted(&s, "Add after Intersect")
+
+	// Verify Union into empty set preserves keepSorted mode
+	var se Set
+	se.SetKeepSorted(true)
+	se.Union(&sc)
+	checkSorted(&se, "Union into empty set")
+	se.Add(1<<64 - 1)
+	se.Add(0)
+	checkSorted(&se, "Add after Union into empty set")
+
+	// Verify concurrent reads in keepSorted mode
+	itemsExpected := s.AppendTo(nil)
+	ch := make(chan error, 4)
+	for i := 0; i < cap(ch); i++ {
+		go func() {
+			var err error
+			for j := 0; j < 10; j++ {
+				items := s.AppendTo(nil)
+				if !reflect.DeepEqual(items, itemsExpected) {
+					err = fmt.Errorf("unexpected items returned from AppendTo")
+				}
+				var prev uint64
+				s.ForEach(func(part []uint64) bool {
+					for _, x := range part {
+						if x < prev {
+							err = fmt.Errorf("ForEach must return items in ascending order in keepSorted mode; got %d after %d", x, prev)
+							return false
+						}
+						prev = x
+					}
+					return true
+				})
+			}
+			ch <- err
+		}()
+	}
+	for i := 0; i < cap(ch); i++ {
+		if err := <-ch; err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+}
+
+func TestSetManyBuckets(t *testing.T) {
+	// Buckets are looked up via binary search if their number exceeds maxLinearSearchBuckets32.
+	f := func(keepSorted bool) {
+		t.Helper()
+		rng := rand.New(rand.NewSource(0))
+		genItem := func() uint64 {
+			return uint64(rng.Intn(10*maxLinearSearchBuckets32))<<32 | uint64(rng.Intn(1e3))
+		}
+		checkHas := func(s *Set, m map[uint64]bool, op string) {
+			t.Helper()
+			for i := 0; i < 1e3; i++ {
+				x := genItem()
+				if s.Has(x) != m[x] {
+					t.Fatalf("unexpected Has(%d) result after %s; got %v; want %v", x, op, !m[x], m[x])
+				}
+			}
+			if err := expectEqual(s, m); err != nil {
+				t.Fatalf("unexpected set contents after %s: %s", op, err)
+			}
+		}
+		var s Set
+		s.SetKeepSorted(keepSorted)
+		m := make(map[uint64]bool)
+		for i := 0; i < 1e5; i++ {
+			x := genItem()
+			switch rng.Intn(4) {
+			case 0:
+				s.Del(x)
+				delete(m, x)
+			case 1:
+				if s.Has(x) != m[x] {
+					t.Fatalf("unexpected Has(%d) result; got %v; want %v", x, !m[x], m[x])
+				}
+			default:
+				s.Add(x)
+				m[x] = true
+			}
+		}
+		if !sort.IsSorted(&s.buckets) {
+			t.Fatalf("buckets must be sorted")
+		}
+		if len(s.buckets) <= maxLinearSearchBuckets32 {
+			t.Fatalf("too small number of buckets; got %d; want more than %d", len(s.buckets), maxLinearSearchBuckets32)
+		}
+		checkHas(&s, m, "Add and Del")
+		if !keepSorted && !s.bucketsSorted {
+			t.Fatalf("Add and Del must preserve the known order of buckets")
+		}
+
+		// Clone and Swap must move the known order of buckets together with buckets.
+		if sc := s.Clone(); sc.bucketsSorted != s.bucketsSorted {
+			t.Fatalf("Clone must preserve the known order of buckets")
+		}
+		bucketsSorted := s.bucketsSorted
+		var sw Set
+		sw.Swap(&s)
+		if sw.bucketsSorted != bucketsSorted || s.bucketsSorted {
+			t.Fatalf("Swap must move the known order of buckets")
+		}
+		s.Swap(&sw)
+		checkHas(&s, m, "Swap")
+
+		// Verify lookups after modifications, which may break the order of buckets outside keepSorted mode.
+		var sa Set
+		for i := 0; i < 1e4; i++ {
+			x := genItem() + 1<<40
+			sa.Add(x)
+			m[x] = true
+		}
+		s.Union(&sa)
+		checkHas(&s, m, "Union")
+		s.Add(0)
+		m[0] = true
+		checkHas(&s, m, "Add after Union")
+
+		a := make([]uint64, 1e3)
+		for i := range a {
+			a[i] = genItem() + 1<<41
+			m[a[i]] = true
+		}
+		s.AddMulti(a)
+		checkHas(&s, m, "AddMulti")
+
+		var sb Set
+		for i := 0; i < 1e4; i++ {
+			x := genItem()
+			sb.Add(x)
+			delete(m, x)
+		}
+		s.Subtract(&sb)
+		checkHas(&s, m, "Subtract")
+
+		s.TruncateAbove(1 << 41)
+		for x := range m {
+			if x >= 1<<41 {
+				delete(m, x)
+			}
+		}
+		checkHas(&s, m, "TruncateAbove")
+		for i := 0; i < 1e3; i++ {
+			x := genItem() + 1<<42
+			s.Add(x)
+			m[x] = true
+		}
+		checkHas(&s, m, "Add after TruncateAbove")
+	}
+	f(false)
+	f(true)
+}
+
+func TestSetHint(t *testing.T) {
+	// The hint must be verified before use, since buckets may be removed or re-ordered after it is set.
+	rng := rand.New(rand.NewSource(0))
+	var s Set
+	m := make(map[uint64]bool)
+	f := func(op string, mutate func()) {
+		t.Helper()
+		mutate()
+		// Run clustered operations for random prefixes.
+		for i := 0; i < 100; i++ {
+			hi := uint64(rng.Intn(8)) << 32
+			for j := 0; j < 10; j++ {
+				x := hi | uint64(rng.Intn(100))
+				if rng.Intn(3) == 0 {
+					s.Del(x)
+					delete(m, x)
+				} else {
+					s.Add(x)
+					m[x] = true
+				}
+				if s.Has(x) != m[x] {
+					t.Fatalf("unexpected Has(%d) result after %s; got %v; want %v", x, op, !m[x], m[x])
+				}
+			}
+		}
+		if err := expectEqual(&s, m); err != nil {
+			t.Fatalf("unexpected set contents after %s: %s", op, err)
+		}
+	}
+	f("Add", func() {})
+	f("TruncateBelow", func() {
+		s.TruncateBelow(4 << 32)
+		for x := range m {
+			if x < 4<<32 {
+				delete(m, x)
+			}
+		}
+	})
+	f("AppendTo", func() {
+		// AppendTo sorts the buckets.
+		_ = s.AppendTo(nil)
+	})
+	f("Optimize", func() {
+		s.Optimize()
+	})
+	f("Swap", func() {
+		var a Set
+		a.Add(7 << 32)
+		a.Add(1 << 32)
+		s.Swap(&a)
+		m = map[uint64]bool{
+			7 << 32: true,
+			1 << 32: true,
+		}
+	})
+	f("Union", func() {
+		var a Set
+		for i := 0; i < 8; i++ {
+			x := uint64(7-i)<<32 | 1000
+			a.Add(x)
+			m[x] = true
+		}
+		s.Union(&a)
+	})
+}
+
+func TestSetIsEmptyIsSingleton(t *testing.T) {
+	f := func(a []uint64) {
+		t.Helper()
+		var s Set
+		for _, x := range a {
+			s.Add(x)
+		}
+		isEmpty := s.IsEmpty()
+		isEmptyExpected := s.Len() == 0
+		if isEmpty != isEmptyExpected {
+			t.Fatalf("unexpected IsEmpty() for %v; got %v; want %v", a, isEmpty, isEmptyExpected)
+		}
+		x, ok := s.IsSingleton()
+		okExpected := s.Len() == 1
+		if ok != okExpected {
+			t.Fatalf("unexpected IsSingleton() for %v; got %v; want %v", a, ok, okExpected)
+		}
+		if ok && x != a[0] {
+			t.Fatalf("unexpected item returned from IsSingleton() for %v; got %d; want %d", a, x, a[0])
+		}
+	}
+	f(nil)
+	f([]uint64{0})
+	f([]uint64{123})
+	f([]uint64{1<<64 - 1})
+	f([]uint64{1<<32 + 1<<16 + 5, 1<<32 + 1<<16 + 5})
+	f([]uint64{1, 2})
+	f([]uint64{1, 1 << 32})
+
+	// Verify singleton after deleting items from a dense bucket
+	var s Set
+	for i := 0; i < 1e4; i++ {
+		s.Add(uint64(i))
+	}
+	for i := 0; i < 1e4; i++ {
+		if i != 4321 {
+			s.Del(uint64(i))
+		}
+	}
+	if s.IsEmpty() {
+		t.Fatalf("the set mustn't be empty")
+	}
+	x, ok := s.IsSingleton()
+	if !ok {
+		t.Fatalf("the set must be singleton")
+	}
+	if x != 4321 {
+		t.Fatalf("unexpected singleton item; got %d; want %d", x, 4321)
+	}
+	s.Del(4321)
+	if !s.IsEmpty() {
+		t.Fatalf("the set must be empty")
+	}
+
+	// Verify nil set
+	var sNil *Set
+	if !sNil.IsEmpty() {
+		t.Fatalf("nil set must be empty")
+	}
+	if _, ok := sNil.IsSingleton(); ok {
+		t.Fatalf("nil set mustn't be singleton")
+	}
+}
+
+func TestSetAppendMergedTo(t *testing.T) {
+	f := func(a, sorted []uint64) {
+		t.Helper()
+		var s Set
+		for _, x := range a {
+			s.Add(x)
+		}
+		m := make(map[uint64]bool)
+		var resultExpected []uint64
+		for _, x := range append(append([]uint64{}, a...), sorted...) {
+			if !m[x] {
+				resultExpected = append(resultExpected, x)
+				m[x] = true
+			}
+		}
+		sort.Slice(resultExpected, func(i, j int) bool { return resultExpected[i] < resultExpected[j] })
+		prefix := []uint64{7, 3, 5}
+		result := s.AppendMergedTo(append([]uint64{}, prefix...), sorted)
+		resultExpected = append(prefix, resultExpected...)
+		if !reflect.DeepEqual(result, resultExpected) {
+			t.Fatalf("unexpected result for a=%v, sorted=%v\ngot\n%v\nwant\n%v", a, sorted, result, resultExpected)
+		}
+	}
+	f(nil, nil)
+	f([]uint64{1}, nil)
+	f(nil, []uint64{1})
+	f(nil, []uint64{1, 1, 2, 2, 2, 3})
+	f([]uint64{7, 3, 5}, []uint64{7})
+	f([]uint64{2, 4, 6}, []uint64{1, 2, 3, 3, 4, 5, 7})
+	f([]uint64{1 << 32, 1, 2 << 32}, []uint64{0, 1, 1 << 16, 1 << 32, 3 << 32})
+
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 10; i++ {
+		var a, sorted []uint64
+		for j := 0; j < 1000; j++ {
+			a = append(a, uint64(rng.Intn(1e6)))
+			sorted = append(sorted, uint64(rng.Intn(1e6)))
+		}
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		f(a, sorted)
+	}
+
+	// Verify nil set
+	var sNil *Set
+	result := sNil.AppendMergedTo(nil, []uint64{1, 2, 2})
+	if !reflect.DeepEqual(result, []uint64{1, 2}) {
+		t.Fatalf("unexpected result for nil set; got %v; want %v", result, []uint64{1, 2})
+	}
+}
+
+func TestSetSwap(t *testing.T) {
+	f := func(a, b []uint64) {
+		t.Helper()
+		var sa, sb Set
+		ma := make(map[uint64]bool)
+		mb := make(map[uint64]bool)
+		for _, x := range a {
+			sa.Add(x)
+			ma[x] = true
+		}
+		for _, x := range b {
+			sb.Add(x)
+			mb[x] = true
+		}
+		sa.Swap(&sb)
+		if err := expectEqual(&sa, mb); err != nil {
+			t.Fatalf("unexpected sa after Swap: %s", err)
+		}
+		if err := expectEqual(&sb, ma); err != nil {
+			t.Fatalf("unexpected sb after Swap: %s", err)
+		}
+
+		// Verify the swapped sets are independent.
+		sa.Add(1<<64 - 1)
+		if sb.Has(1<<64-1) && !ma[1<<64-1] {
+			t.Fatalf("sb mustn't change after modifying sa")
+		}
+		sb.Add(1<<63 - 1)
+		if sa.Has(1<<63-1) && !mb[1<<63-1] {
+			t.Fatalf("sa mustn't change after modifying sb")
+		}
+
+		// Swap back
+		sb.Swap(&sa)
+		sa.Del(1<<63 - 1)
+		sb.Del(1<<64 - 1)
+		if err := expectEqual(&sa, ma); err != nil {
+			t.Fatalf("unexpected sa after the second Swap: %s", err)
+		}
+		if err := expectEqual(&sb, mb); err != nil {
+			t.Fatalf("unexpected sb after the second Swap: %s", err)
+		}
+	}
+	f(nil, nil)
+	f([]uint64{1}, nil)
+	f(nil, []uint64{1})
+	f([]uint64{1, 2}, []uint64{3})
+	f([]uint64{1, 1 << 32}, []uint64{3})
+	f([]uint64{1, 1 << 32}, []uint64{3, 2 << 32, 3 << 32})
+
+	// Verify keepSorted mode stays with the set
+	var sa, sb Set
+	sa.SetKeepSorted(true)
+	for _, x := range []uint64{3 << 32, 1 << 32, 2 << 32} {
+		sb.Add(x)
+	}
+	sa.Swap(&sb)
+	if !sa.opts.keepSorted || sb.opts.keepSorted {
+		t.Fatalf("keepSorted mode must stay with the set after Swap")
+	}
+	if !sort.IsSorted(&sa.buckets) {
+		t.Fatalf("buckets must be sorted after Swap into the set in keepSorted mode")
+	}
+
+	// Verify Swap with itself
+	sa.Swap(&sa)
+	if n := sa.Len(); n != 3 {
+		t.Fatalf("unexpected sa.Len() after Swap with itself; got %d; want 3", n)
+	}
+}
+
+func TestSetSwapCloneInto(t *testing.T) {
+	// Swap with an empty set mustn't leave memory shared between the sets.
+	var sa, sb Set
+	for i := 0; i < 10; i++ {
+		sa.Add(uint64(i))
+	}
+	sa.Swap(&sb)
+	var src Set
+	for i := 1000; i < 1010; i++ {
+		src.Add(uint64(i))
+	}
+	src.CloneInto(&sa)
+	mb := make(map[uint64]bool)
+	for i := 0; i < 10; i++ {
+		mb[uint64(i)] = true
+	}
+	if err := expectEqual(&sb, mb); err != nil {
+		t.Fatalf("unexpected items in sb after sa.Swap(sb) and CloneInto(sa): %s", err)
+	}
+	if !sa.Equal(&src) {
+		t.Fatalf("unexpected items in sa after CloneInto(sa)")
+	}
+
+	// The same for a swap with an empty set in the opposite direction.
+	var sc Set
+	sc.Swap(&sa)
+	var src2 Set
+	for i := 2000; i < 2010; i++ {
+		src2.Add(uint64(i))
+	}
+	src2.CloneInto(&sa)
+	if !sc.Equal(&src) {
+		t.Fatalf("unexpected items in sc after sc.Swap(sa) and CloneInto(sa)")
+	}
+	if !sa.Equal(&src2) {
+		t.Fatalf("unexpected items in sa after CloneInto(sa)")
+	}
+}
+
+func TestSetReserveDense(t *testing.T) {
+	f := func(a []uint64, lo, hi uint64, denseBucketsExpected int) {
+		t.Helper()
+		var s Set
+		m := make(map[uint64]bool)
+		for _, x := range a {
+			s.Add(x)
+			m[x] = true
+		}
+		s.ReserveDense(lo, hi)
+		if err := expectEqual(&s, m); err != nil {
+			t.Fatalf("unexpected set after ReserveDense(%d, %d): %s", lo, hi, err)
+		}
+		denseBuckets := 0
+		for i := range s.buckets {
+			for _, b16 := range s.buckets[i].buckets {
+				if b16.bits != nil {
+					denseBuckets++
+				}
+			}
+		}
+		if denseBuckets != denseBucketsExpected {
+			t.Fatalf("unexpected number of dense buckets after ReserveDense(%d, %d); got %d; want %d", lo, hi, denseBuckets, denseBucketsExpected)
+		}
+
+		// Verify adding items to the reserved range.
+		for x := lo; x < hi && x < lo+1000; x++ {
+			s.Add(x)
+			m[x] = true
+		}
+		if err := expectEqual(&s, m); err != nil {
+			t.Fatalf("unexpected set after adding items to the reserved range [%d, %d): %s", lo, hi, err)
+		}
+	}
+	f(nil, 0, 0, 0)
+	f(nil, 10, 5, 0)
+	f(nil, 0, 1, 1)
+	f(nil, 0, 1<<16, 1)
+	f(nil, 0, 1<<16+1, 2)
+	f(nil, 1<<16-1, 1<<16+1, 2)
+	f(nil, 1<<32-1, 1<<32+1, 2)
+	f(nil, 1<<64-1<<16, 1<<64-1, 1)
+	f([]uint64{1, 2, 3, 1 << 20}, 0, 1<<16, 1)
+	f([]uint64{1, 2, 3, 1 << 20}, 0, 1<<24, 1<<8)
+}
+
+func TestSetForEachIndexed(t *testing.T) {
+	f := func(a []uint64) {
+		t.Helper()
+		var s Set
+		for _, x := range a {
+			s.Add(x)
+		}
+		itemsExpected := s.Clone().AppendTo(nil)
+		var items []uint64
+		s.ForEachIndexed(func(index int, x uint64) bool {
+			if index != len(items) {
+				t.Fatalf("unexpected index for item %d; got %d; want %d", x, index, len(items))
+			}
+			items = append(items, x)
+			return true
+		})
+		if !reflect.DeepEqual(items, itemsExpected) {
+			t.Fatalf("unexpected items\ngot\n%v\nwant\n%v", items, itemsExpected)
+		}
+
+		// Verify early stop
+		for _, stopIndex := range []int{0, len(a) / 2} {
+			lastIndex := -1
+			s.ForEachIndexed(func(index int, x uint64) bool {
+				lastIndex = index
+				return index < stopIndex
+			})
+			if len(itemsExpected) > 0 && lastIndex != stopIndex {
+				t.Fatalf("unexpected last index after stop at %d; got %d", stopIndex, lastIndex)
+			}
+		}
+	}
+	f(nil)
+	f([]uint64{1})
+	f([]uint64{3, 2, 1})
+	f([]uint64{2 << 32, 1<<32 + 5, 1 << 16, 1<<32 + 1, 0})
+
+	rng := rand.New(rand.NewSource(0))
+	var a []uint64
+	for i := 0; i < 1e4; i++ {
+		a = append(a, uint64(rng.Intn(10))<<32|uint64(rng.Intn(1e6)))
+	}
+	f(a)
+
+	// Verify nil set
+	var sNil *Set
+	sNil.ForEachIndexed(func(index int, x uint64) bool {
+		t.Fatalf("callback shouldn't be called on nil set")
+		return true
+	})
+}
+
+func TestSetChecksum(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 100; i++ {
+		var a []uint64
+		itemsCount := rng.Intn(1e4)
+		for j := 0; j < itemsCount; j++ {
+			a = append(a, uint64(rng.Intn(10))<<32|uint64(rng.Intn(1e5)))
+		}
+
+		// Build sets with the same items and distinct internal representation.
+		var s1, s2 Set
+		for _, x := range a {
+			s1.Add(x)
+		}
+		for j := len(a) - 1; j >= 0; j-- {
+			s2.Add(a[j])
+		}
+		for j := 0; j < 1e3; j++ {
+			x := uint64(rng.Intn(10))<<32 | uint64(rng.Intn(1e5))
+			if !s1.Has(x) {
+				s2.Add(x)
+				s2.Del(x)
+			}
+		}
+		if !s1.Equal(&s2) {
+			t.Fatalf("s1 must be equal to s2")
+		}
+		h1 := s1.Checksum()
+		h2 := s2.Checksum()
+		if h1 != h2 {
+			t.Fatalf("equal sets must have equal checksums; got %d vs %d", h1, h2)
+		}
+
+		// Verify checksum changes after set modification.
+		x := uint64(rng.Intn(10))<<32 | uint64(rng.Intn(1e5))
+		if s2.Has(x) {
+			s2.Del(x)
+		} else {
+			s2.Add(x)
+		}
+		if h := s2.Checksum(); h == h1 {
+			t.Fatalf("checksum must change after modifying the set")
+		}
+	}
+
+	// Verify nil and empty sets
+	var sNil *Set
+	var sEmpty Set
+	if sNil.Checksum() != sEmpty.Checksum() {
+		t.Fatalf("nil set and empty set must have equal checksums")
+	}
+	sEmpty.Add(0)
+	if sNil.Checksum() == sEmpty.Checksum() {
+		t.Fatalf("nil set and non-empty set must have distinct checksums")
+	}
+}
+
+func TestSetAppendMissingTo(t *testing.T) {
+	f := func(a, b []uint64) {
+		t.Helper()
+		var sa, sb Set
+		for _, x := range a {
+			sa.Add(x)
+		}
+		for _, x := range b {
+			sb.Add(x)
+		}
+		sDiff := sa.Clone()
+		sDiff.Subtract(&sb)
+		resultExpected := sDiff.AppendTo(nil)
+		result := sa.AppendMissingTo(nil, &sb)
+		if !reflect.DeepEqual(result, resultExpected) {
+			t.Fatalf("unexpected result\ngot\n%v\nwant\n%v", result, resultExpected)
+		}
+	}
+	f(nil, nil)
+	f([]uint64{1}, nil)
+	f(nil, []uint64{1})
+	f([]uint64{1, 2, 3}, []uint64{2})
+	f([]uint64{1, 1 << 16, 1 << 32, 2 << 32}, []uint64{1 << 16, 3 << 32})
+
+	var a, b []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*2))
+		b = append(b, uint64(i*3))
+	}
+	f(a, b)
+	f(b, a)
+	f(a, b[:10])
+	f(a[:10], b)
+
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 10; i++ {
+		a = nil
+		b = nil
+		for j := 0; j < 1000; j++ {
+			a = append(a, uint64(rng.Intn(1e6)))
+			b = append(b, uint64(rng.Intn(1e6)))
+		}
+		f(a, b)
+	}
+
+	// Verify nil sets
+	var sNil *Set
+	var s Set
+	s.Add(123)
+	result := s.AppendMissingTo(nil, sNil)
+	if !reflect.DeepEqual(result, []uint64{123}) {
+		t.Fatalf("unexpected result for nil a; got %v; want %v", result, []uint64{123})
+	}
+	if result := sNil.AppendMissingTo(nil, &s); result != nil {
+		t.Fatalf("unexpected result for nil s; got %v; want nil", result)
+	}
+}
+
+func TestSetForEachIntersection(t *testing.T) {
+	f := func(a, b []uint64) {
+		t.Helper()
+		var sa, sb Set
+		for _, x := range a {
+			sa.Add(x)
+		}
+		for _, x := range b {
+			sb.Add(x)
+		}
+		saOrig := sa.Clone()
+		sbOrig := sb.Clone()
+		sIntersect := sa.Clone()
+		sIntersect.Intersect(&sb)
+		resultExpected := sIntersect.AppendTo(nil)
+		var result []uint64
+		sa.ForEachIntersection(&sb, func(part []uint64) bool {
+			if !sort.SliceIsSorted(part, func(i, j int) bool { return part[i] < part[j] }) {
+				t.Fatalf("part must be sorted; got %v", part)
+			}
+			result = append(result, part...)
+			return true
+		})
+		sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+		if !reflect.DeepEqual(result, resultExpected) {
+			t.Fatalf("unexpected result\ngot\n%v\nwant\n%v", result, resultExpected)
+		}
+		if !saOrig.Equal(&sa) || !sbOrig.Equal(&sb) {
+			t.Fatalf("ForEachIntersection mustn't modify the sets")
+		}
+
+		// Verify early stop
+		calls := 0
+		sa.ForEachIntersection(&sb, func(part []uint64) bool {
+			calls++
+			return false
+		})
+		if len(resultExpected) > 0 && calls != 1 {
+			t.Fatalf("unexpected number of callback calls; got %d; want 1", calls)
+		}
+	}
+	f(nil, nil)
+	f([]uint64{1}, nil)
+	f(nil, []uint64{1})
+	f([]uint64{1, 2, 3}, []uint64{3, 2})
+	f([]uint64{1, 1 << 16, 1 << 32, 2 << 32}, []uint64{1 << 16, 2 << 32, 3 << 32})
+
+	var a, b []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*2))
+		b = append(b, uint64(i*3))
+	}
+	f(a, b)
+	f(a, b[:10])
+	f(a[:10], b)
+
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 10; i++ {
+		a = nil
+		b = nil
+		for j := 0; j < 1000; j++ {
+			a = append(a, uint64(rng.Intn(1e5)))
+			b = append(b, uint64(rng.Intn(1e5)))
+		}
+		f(a, b)
+	}
+}
+
+func TestSetAddWithLimit(t *testing.T) {
+	var s Set
+	for i := 0; i < 10; i++ {
+		added, atLimit := s.AddWithLimit(uint64(i)<<20, 5)
+		if added != (i < 5) {
+			t.Fatalf("unexpected added for item #%d; got %v; want %v", i, added, i < 5)
+		}
+		if atLimit != (i >= 4) {
+			t.Fatalf("unexpected atLimit for item #%d; got %v; want %v", i, atLimit, i >= 4)
+		}
+	}
+	if n := s.Len(); n != 5 {
+		t.Fatalf("unexpected s.Len(); got %d; want 5", n)
+	}
+	// Existing items are accepted at the limit.
+	if added, atLimit := s.AddWithLimit(3<<20, 5); added || !atLimit {
+		t.Fatalf("unexpected result for existing item; got added=%v, atLimit=%v; want added=false, atLimit=true", added, atLimit)
+	}
+
+	// Verify SetMaxLen
+	var s2 Set
+	s2.SetMaxLen(3)
+	for i := 0; i < 10; i++ {
+		s2.Add(uint64(i))
+		s2.Add(uint64(i % 2))
+	}
+	m := map[uint64]bool{0: true, 1: true, 2: true}
+	if err := expectEqual(&s2, m); err != nil {
+		t.Fatalf("unexpected set with max len: %s", err)
+	}
+	if added, atLimit := s2.AddWithLimit(100, 10); added || !atLimit {
+		t.Fatalf("unexpected result for the set at SetMaxLen limit; got added=%v, atLimit=%v; want added=false, atLimit=true", added, atLimit)
+	}
+
+	// The limit must be preserved by Clone and reset.
+	s3 := s2.Clone()
+	s3.Add(100)
+	if s3.Has(100) {
+		t.Fatalf("the cloned set mustn't exceed the max len")
+	}
+	s3.reset()
+	for i := 0; i < 20; i++ {
+		s3.Add(uint64(i))
+	}
+	if n := s3.Len(); n != 3 {
+		t.Fatalf("unexpected number of items in the reset set; got %d; want 3", n)
+	}
+
+	// Remove the limit
+	s2.SetMaxLen(0)
+	s2.Add(100)
+	if !s2.Has(100) {
+		t.Fatalf("missing item after removing the max len")
+	}
+}
+
+func TestSetAddWithByteLimit(t *testing.T) {
+	f := func(maxBytes uint64, keepSorted, alwaysDense bool) {
+		t.Helper()
+		r := rand.New(rand.NewSource(int64(maxBytes)))
+		var s Set
+		if keepSorted {
+			s.SetKeepSorted(true)
+		}
+		if alwaysDense {
+			s.SetAlwaysDense(true)
+		}
+		m := make(map[uint64]bool)
+		rejected := 0
+		for i := 0; i < 20000; i++ {
+			x := uint64(r.Intn(1e6))
+			switch r.Intn(4) {
+			case 0:
+				x = r.Uint64()
+			case 1:
+				x <<= 20
+			}
+			if i%1000 == 999 {
+				// Del doesn't change s.SizeBytes(), so it must preserve the tracked size.
+				trackedSizeBytes := s.trackedSizeBytes
+				s.Del(x)
+				delete(m, x)
+				if s.trackedSizeBytes != trackedSizeBytes {
+					t.Fatalf("unexpected tracked size after Del; got %d; want %d", s.trackedSizeBytes, trackedSizeBytes)
+				}
+				continue
+			}
+			added, atLimit := s.AddWithByteLimit(x, maxBytes)
+			if added == atLimit && (added || !m[x]) {
+				t.Fatalf("unexpected result for item #%d: added=%v, atLimit=%v", i, added, atLimit)
+			}
+			if added {
+				if m[x] {
+					t.Fatalf("item %d has been added twice", x)
+				}
+				m[x] = true
+			}
+			if atLimit {
+				rejected++
+			}
+			if n := s.SizeBytes(); n > maxBytes {
+				t.Fatalf("too big s.SizeBytes() after adding item #%d; got %d; mustn't exceed %d", i, n, maxBytes)
+			}
+			if s.trackedSizeBytes != s.SizeBytes() {
+				t.Fatalf("unexpected tracked size after adding item #%d; got %d; want %d", i, s.trackedSizeBytes, s.SizeBytes())
+			}
+		}
+		if rejected == 0 {
+			t.Fatalf("expecting rejected items for maxBytes=%d", maxBytes)
+		}
+		if err := expectEqual(&s, m); err != nil {
+			t.Fatalf("unexpected items: %s", err)
+		}
+	}
+	for _, maxBytes := range []uint64{1e3, 1e4, 1e5, 1e6} {
+		f(maxBytes, false, false)
+		f(maxBytes, true, false)
+	}
+	f(1e5, false, true)
+	f(1e6, true, true)
+
+	// Verify SetMaxLen
+	var s Set
+	s.SetMaxLen(2)
+	for i := 0; i < 3; i++ {
+		added, atLimit := s.AddWithByteLimit(uint64(i)<<40, 1e9)
+		if added != (i < 2) || atLimit != (i >= 2) {
+			t.Fatalf("unexpected result for item #%d at SetMaxLen limit; got added=%v, atLimit=%v", i, added, atLimit)
+		}
+	}
+	// Existing items are accepted.
+	if added, atLimit := s.AddWithByteLimit(1<<40, 0); added || atLimit {
+		t.Fatalf("unexpected result for existing item; got added=%v, atLimit=%v; want added=false, atLimit=false", added, atLimit)
+	}
+
+	// Other modifications must invalidate the tracked size.
+	var sa Set
+	sa.AddWithByteLimit(1, 1e9)
+	for _, x := range []uint64{1, 1 << 16, 1 << 32} {
+		sa.Add(x)
+		if sa.trackedSizeBytes != 0 && sa.trackedSizeBytes != sa.SizeBytes() {
+			t.Fatalf("unexpected tracked size after Add(%d); got %d; want %d", x, sa.trackedSizeBytes, sa.SizeBytes())
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		sa.AddWithByteLimit(uint64(i), 1e9)
+	}
+	sa.Swap(&s)
+	for _, x := range []*Set{&s, &sa} {
+		if x.trackedSizeBytes != 0 && x.trackedSizeBytes != x.SizeBytes() {
+			t.Fatalf("unexpected tracked size after Swap; got %d; want %d", x.trackedSizeBytes, x.SizeBytes())
+		}
+	}
+	sa.Union(&s)
+	if sa.trackedSizeBytes != 0 {
+		t.Fatalf("Union must reset the tracked size; got %d", sa.trackedSizeBytes)
+	}
+}
+
+func TestSetForEachDenseWord(t *testing.T) {
+	f := func(a []uint64) {
+		t.Helper()
+		var s Set
+		s.AddMulti(a)
+		m := make(map[uint64]bool)
+		for _, x := range a {
+			m[x] = true
+		}
+		var s2 Set
+		s.ForEachDenseWord(func(base, word uint64) bool {
+			if base%64 != 0 {
+				t.Fatalf("base must be multiple of 64; got %d", base)
+			}
+			if word == 0 {
+				t.Fatalf("word mustn't be zero")
+			}
+			for n := uint64(0); n < 64; n++ {
+				if word&(uint64(1)<<n) != 0 {
+					s2.Add(base + n)
+				}
+			}
+			return true
+		})
+		if err := expectEqual(&s2, m); err != nil {
+			t.Fatalf("unexpected items from ForEachDenseWord: %s", err)
+		}
+
+		// Verify the iteration stops when f returns false
+		calls := 0
+		s.ForEachDenseWord(func(base, word uint64) bool {
+			calls++
+			return false
+		})
+		if len(a) > 0 && calls != 1 {
+			t.Fatalf("unexpected number of calls; got %d; want 1", calls)
+		}
+	}
+	f(nil)
+	f([]uint64{0})
+	f([]uint64{1, 60, 63, 64, 127, 128, 1 << 16, 1<<32 + 1, 1<<64 - 1})
+
+	var a []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*7))
+	}
+	for i := 0; i < 1e3; i++ {
+		a = append(a, uint64(rand.Int63()))
+	}
+	f(a)
+}
+
+func TestSetReplaceRange(t *testing.T) {
+	f := func(a, b []uint64, lo, hi uint64) {
+		t.Helper()
+		var sa, sb Set
+		m := make(map[uint64]bool)
+		for _, x := range a {
+			sa.Add(x)
+			if x < lo || x >= hi {
+				m[x] = true
+			}
+		}
+		for _, x := range b {
+			sb.Add(x)
+			if x >= lo && x < hi {
+				m[x] = true
+			}
+		}
+		sbOrig := sb.Clone()
+		sa.ReplaceRange(&sb, lo, hi)
+		if err := expectEqual(&sa, m); err != nil {
+			t.Fatalf("invalid sa.ReplaceRange(sb, %d, %d): %s", lo, hi, err)
+		}
+		if !sbOrig.Equal(&sb) {
+			t.Fatalf("sb mustn't change after sa.ReplaceRange(sb, %d, %d)", lo, hi)
+		}
+	}
+	f(nil, nil, 0, 10)
+	f([]uint64{1, 2, 10}, nil, 0, 10)
+	f([]uint64{1, 2, 10}, nil, 3, 2)
+	f(nil, []uint64{1, 2, 3, 10}, 2, 10)
+	f([]uint64{1, 5}, []uint64{1, 2, 3}, 0, 1<<64-1)
+	f([]uint64{1, 1 << 16, 1 << 32, 2 << 32, 3 << 32}, []uint64{5, 1<<32 + 1}, 1<<16, 2<<32+1)
+	f([]uint64{1<<64 - 2, 1<<64 - 1}, []uint64{1<<64 - 3}, 1<<64-10, 1<<64-1)
+
+	// Disjoint windows
+	f([]uint64{1, 2, 3}, []uint64{100, 200}, 50, 150)
+	f([]uint64{100, 200}, []uint64{1, 2, 3}, 50, 150)
+
+	// Dense buckets
+	var a, b []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*2))
+		b = append(b, uint64(i*3))
+	}
+	f(a, b, 0, 1<<64-1)
+	f(a, b, 100, 1e5)
+	f(a, b, 65, 127)
+	f(a, b, 1<<16, 1<<17)
+	f(a, b, 1<<16+3, 1<<17-5)
+	f(a, nil, 1<<16, 1<<17)
+	f(a[:10], b, 10, 1e5)
+
+	// Random items
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 10; i++ {
+		a = nil
+		b = nil
+		for j := 0; j < 1000; j++ {
+			a = append(a, uint64(rng.Intn(1e6)))
+			b = append(b, uint64(rng.Intn(1e6)))
+		}
+		lo := uint64(rng.Intn(1e6))
+		hi := lo + uint64(rng.Intn(1e6))
+		f(a, b, lo, hi)
+	}
+
+	// Random items spanning multiple bucket32 items
+	for i := 0; i < 10; i++ {
+		a = nil
+		b = nil
+		for j := 0; j < 1000; j++ {
+			a = append(a, uint64(rng.Intn(5))<<32|uint64(rng.Intn(1e6)))
+			b = append(b, uint64(rng.Intn(5))<<32|uint64(rng.Intn(1e6)))
+		}
+		lo := uint64(rng.Intn(2))<<32 | uint64(rng.Intn(1e6))
+		hi := lo + uint64(rng.Intn(3))<<32 + uint64(rng.Intn(1e6))
+		f(a, b, lo, hi)
+	}
+}
+
+func TestSymmetricDifferenceN(t *testing.T) {
+	f := func(sets []*Set) {
+		t.Helper()
+		origs := make([]*Set, len(sets))
+		m := make(map[uint64]bool)
+		for i, s := range sets {
+			origs[i] = s.Clone()
+			s.ForEach(func(part []uint64) bool {
+				for _, x := range part {
+					if m[x] {
+						delete(m, x)
+					} else {
+						m[x] = true
+					}
+				}
+				return true
+			})
+		}
+		result := SymmetricDifferenceN(sets...)
+		if !sort.IsSorted(&result.buckets) {
+			t.Fatalf("result buckets must be sorted")
+		}
+		if err := expectEqual(result, m); err != nil {
+			t.Fatalf("unexpected result: %s", err)
+		}
+		for i, s := range sets {
+			if !s.Equal(origs[i]) {
+				t.Fatalf("the set #%d mustn't change", i)
+			}
+		}
+	}
+	newSet := func(a ...uint64) *Set {
+		var s Set
+		s.AddMulti(a)
+		return &s
+	}
+	f(nil)
+	f([]*Set{nil, newSet()})
+	f([]*Set{newSet(1, 2, 3)})
+	f([]*Set{newSet(1, 2, 3), newSet(2, 3, 4)})
+	f([]*Set{newSet(1, 2, 3), newSet(2, 3, 4), newSet(3, 4, 5)})
+	f([]*Set{newSet(1, 1<<16, 1<<32), newSet(1, 1<<16, 1<<32)})
+
+	// Random sets with dense and sparse buckets
+	rng := rand.New(rand.NewSource(0))
+	for n := 1; n < 6; n++ {
+		var sets []*Set
+		for i := 0; i < n; i++ {
+			var s Set
+			for j := 0; j < 1e4; j++ {
+				s.Add(uint64(rng.Intn(3e4)))
+				s.Add(uint64(rng.Intn(3)<<32 | rng.Intn(1e6)))
+			}
+			sets = append(sets, &s)
+		}
+		f(sets)
+	}
+
+	// Sparse results from dense buckets must be stored in small pools
+	var sa, sb Set
+	for i := 0; i < 1e4; i++ {
+		sa.Add(uint64(i))
+		sb.Add(uint64(i))
+	}
+	sa.Add(1e4)
+	sa.Add(1e4 + 5)
+	d := SymmetricDifferenceN(&sa, &sb, newSet(1<<20, 1<<21))
+	if err := expectEqual(d, map[uint64]bool{1e4: true, 1e4 + 5: true, 1 << 20: true, 1 << 21: true}); err != nil {
+		t.Fatalf("unexpected SymmetricDifferenceN result: %s", err)
+	}
+	for i := range d.buckets {
+		for _, b16 := range d.buckets[i].buckets {
+			if b16.bits != nil {
+				t.Fatalf("SymmetricDifferenceN mustn't allocate bits arrays for items fitting the small pool")
+			}
+		}
+	}
+}
+
+func TestSetOverlapFraction(t *testing.T) {
+	f := func(a, b []uint64) {
+		t.Helper()
+		var sa, sb Set
+		sa.AddMulti(a)
+		sb.AddMulti(b)
+		intersection := sa.Clone()
+		intersection.Intersect(&sb)
+		n := sa.Len()
+		if sb.Len() < n {
+			n = sb.Len()
+		}
+		expected := 0.0
+		if n > 0 {
+			expected = float64(intersection.Len()) / float64(n)
+		}
+		if fraction := sa.OverlapFraction(&sb); fraction != expected {
+			t.Fatalf("unexpected sa.OverlapFraction(sb); got %v; want %v", fraction, expected)
+		}
+		if fraction := sb.OverlapFraction(&sa); fraction != expected {
+			t.Fatalf("unexpected sb.OverlapFraction(sa); got %v; want %v", fraction, expected)
+		}
+	}
+	f(nil, nil)
+	f([]uint64{1, 2}, nil)
+	f([]uint64{1, 2}, []uint64{3, 4})
+	f([]uint64{1, 2}, []uint64{1, 2, 3, 4})
+	f([]uint64{1, 2, 1 << 32}, []uint64{1, 3, 1 << 32, 2 << 32})
+
+	// Dense and sparse buckets
+	var a, b []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*2))
+		b = append(b, uint64(i*3))
+	}
+	f(a, b)
+	f(a, b[:100])
+	f(a[:10], b)
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 1000; i++ {
+		a = append(a, uint64(rng.Int63()))
+		b = append(b, uint64(rng.Intn(1e7)))
+	}
+	f(a, b)
+
+	// Verify the smaller set contained in the bigger set
+	var sa, sb Set
+	sa.AddMulti(a)
+	sb.AddMulti(a[:1000])
+	if fraction := sa.OverlapFraction(&sb); fraction != 1 {
+		t.Fatalf("unexpected OverlapFraction for contained set; got %v; want 1", fraction)
+	}
+}
+
+func TestSetSubtractDelta(t *testing.T) {
+	f := func(a, b []uint64) {
+		t.Helper()
+		var sa, sb Set
+		sa.AddMulti(a)
+		sb.AddMulti(b)
+		expectedRemoved := sa.Clone()
+		expectedRemoved.Intersect(&sb)
+		expected := sa.Clone()
+		expected.Subtract(&sb)
+		sbOrig := sb.Clone()
+
+		removed := sa.SubtractDelta(&sb)
+		if !removed.Equal(expectedRemoved) {
+			t.Fatalf("unexpected removed items; got %d items; want %d items", removed.Len(), expectedRemoved.Len())
+		}
+		if !sa.Equal(expected) {
+			t.Fatalf("unexpected set after SubtractDelta; got %d items; want %d items", sa.Len(), expected.Len())
+		}
+		if !sb.Equal(sbOrig) {
+			t.Fatalf("sb mustn't change after SubtractDelta")
+		}
+	}
+	f(nil, nil)
+	f([]uint64{1, 2}, nil)
+	f(nil, []uint64{1, 2})
+	f([]uint64{1, 2}, []uint64{3, 4})
+	f([]uint64{1, 2, 3, 1 << 32}, []uint64{2, 3, 4, 1 << 32, 2 << 32})
+
+	var a, b []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*2))
+		b = append(b, uint64(i*3))
+	}
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 1000; i++ {
+		x := uint64(rng.Int63())
+		a = append(a, x)
+		if i%2 == 0 {
+			b = append(b, x)
+		}
+	}
+	f(a, b)
+	f(b, a)
+}
+
+func TestSetDelMulti(t *testing.T) {
+	f := func(a, b []uint64) {
+		t.Helper()
+		var s Set
+		m := make(map[uint64]bool)
+		for _, x := range a {
+			s.Add(x)
+			m[x] = true
+		}
+		for _, x := range b {
+			delete(m, x)
+		}
+		s.DelMulti(b)
+		if err := expectEqual(&s, m); err != nil {
+			t.Fatalf("unexpected set after DelMulti: %s", err)
+		}
+	}
+	f(nil, nil)
+	f([]uint64{1, 2, 3}, nil)
+	f(nil, []uint64{1, 2, 3})
+	f([]uint64{1, 2, 3}, []uint64{3, 2, 3, 4})
+	f([]uint64{1, 1 << 16, 1 << 32, 2 << 32}, []uint64{1 << 32, 1, 5 << 32, 1 << 16})
+
+	// Dense buckets
+	var a, b []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*2))
+		b = append(b, uint64(i*3))
+	}
+	f(a, b)
+	f(a, a)
+	f(a, a[:100])
+
+	// Unsorted items with duplicates
+	rng := rand.New(rand.NewSource(0))
+	a = a[:0]
+	b = b[:0]
+	for i := 0; i < 1e4; i++ {
+		x := uint64(rng.Intn(1e6))
+		a = append(a, x, uint64(rng.Int63()))
+		b = append(b, x, uint64(rng.Intn(1e6)), x)
+	}
+	f(a, b)
+}
+
+func TestSetStickyDense(t *testing.T) {
+	f := func(stickyDense bool, clear func(s *Set)) {
+		t.Helper()
+		var s Set
+		s.SetStickyDense(stickyDense)
+		a := make([]uint64, 0, 2*bitsPerBucket)
+		for i := 0; i < bitsPerBucket; i++ {
+			a = append(a, 1<<32|uint64(i), 2<<32|uint64(i))
+		}
+		s.AddMulti(a)
+		s.Add(3)
+		var bitsOrig []*[wordsPerBucket]uint64
+		for i := range s.buckets {
+			for _, b16 := range s.buckets[i].buckets {
+				if b16.bits != nil {
+					bitsOrig = append(bitsOrig, b16.bits)
+				}
+			}
+		}
+		if len(bitsOrig) != 2 {
+			t.Fatalf("unexpected number of dense buckets; got %d; want 2", len(bitsOrig))
+		}
+
+		clear(&s)
+		if n := s.Len(); n != 0 {
+			t.Fatalf("unexpected number of items after clearing the set; got %d; want 0", n)
+		}
+		s.AddMulti(a)
+		m := make(map[uint64]bool)
+		for _, x := range a {
+			m[x] = true
+		}
+		if err := expectEqual(&s, m); err != nil {
+			t.Fatalf("unexpected set after adding items again: %s", err)
+		}
+		reused := 0
+		for i := range s.buckets {
+			for _, b16 := range s.buckets[i].buckets {
+				for _, bits := range bitsOrig {
+					if b16.bits == bits {
+						reused++
+					}
+				}
+			}
+		}
+		if stickyDense && reused != len(bitsOrig) {
+			t.Fatalf("unexpected number of reused bits arrays in stickyDense mode; got %d; want %d", reused, len(bitsOrig))
+		}
+		if !stickyDense && reused != 0 {
+			t.Fatalf("unexpected number of reused bits arrays; got %d; want 0", reused)
+		}
+	}
+	for _, stickyDense := range []bool{false, true} {
+		f(stickyDense, func(s *Set) {
+			s.ReplaceRange(nil, 0, 1<<64-1)
+		})
+		f(stickyDense, func(s *Set) {
+			var a Set
+			a.Add(123 << 32)
+			s.Intersect(&a)
+		})
+		f(stickyDense, func(s *Set) {
+			var a Set
+			s.Intersect(&a)
+		})
+	}
+}
+
+func TestSetToSortedSlice(t *testing.T) {
+	f := func(a []uint64) {
+		t.Helper()
+		var s Set
+		s.AddMulti(a)
+		result := s.ToSortedSlice()
+		if len(result) != s.Len() || cap(result) != s.Len() {
+			t.Fatalf("unexpected result size; got len=%d, cap=%d; want %d", len(result), cap(result), s.Len())
+		}
+		if err := checkSameItems(result, s.AppendTo(nil)); err != nil {
+			t.Fatalf("unexpected items: %s", err)
+		}
+	}
+	f([]uint64{1})
+	f([]uint64{3, 2, 1, 1 << 16, 1 << 32, 1<<64 - 1})
+
+	// Dense buckets
+	var a []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*3))
+	}
+	f(a)
+
+	// Mixed small and dense buckets
+	a = a[:0]
+	for i := 0; i < 1e4; i++ {
+		a = append(a, uint64(rand.Int63n(1e6)), uint64(rand.Int63()))
+	}
+	f(a)
+
+	// Verify empty and nil sets
+	var s Set
+	if result := s.ToSortedSlice(); result != nil {
+		t.Fatalf("expecting nil result for empty set; got %d", result)
+	}
+	var sNil *Set
+	if result := sNil.ToSortedSlice(); result != nil {
+		t.Fatalf("expecting nil result for nil set; got %d", result)
+	}
+}
+
+func TestAppendAllTo(t *testing.T) {
+	f := func(dst []uint64, sets ...*Set) {
+		t.Helper()
+		expected := append([]uint64{}, dst...)
+		for _, s := range sets {
+			expected = s.AppendTo(expected)
+		}
+		result := AppendAllTo(dst, sets...)
+		if err := checkSameItems(result, expected); err != nil {
+			t.Fatalf("unexpected result: %s", err)
+		}
+	}
+	newSet := func(a ...uint64) *Set {
+		var s Set
+		s.AddMulti(a)
+		return &s
+	}
+	f(nil)
+	f([]uint64{1, 2})
+	f(nil, nil, newSet())
+	f([]uint64{7}, newSet(3, 1, 2))
+	f([]uint64{7}, newSet(3, 1, 2), nil, newSet(2, 1<<32, 0))
+
+	var a []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*3))
+	}
+	f(make([]uint64, 10, 20), newSet(a...), newSet(a[:1000]...), newSet(1<<64-1, 5))
+}
+
+func TestSetUnionWithCallback(t *testing.T) {
+	f := func(a, b []uint64) {
+		t.Helper()
+		var sa, sb Set
+		sa.AddMulti(a)
+		sb.AddMulti(b)
+		sbOrig := sb.Clone()
+		expected := sa.Clone()
+		expected.Union(&sb)
+
+		var existing, added []uint64
+		sa.UnionWithCallback(&sb, func(x uint64) {
+			existing = append(existing, x)
+		}, func(x uint64) {
+			added = append(added, x)
+		})
+		if !sa.Equal(expected) {
+			t.Fatalf("unexpected union result")
+		}
+		if !sb.Equal(sbOrig) {
+			t.Fatalf("a mustn't be modified")
+		}
+		sort.Slice(existing, func(i, j int) bool { return existing[i] < existing[j] })
+		sort.Slice(added, func(i, j int) bool { return added[i] < added[j] })
+		var existingExpected, addedExpected []uint64
+		m := make(map[uint64]bool)
+		for _, x := range a {
+			m[x] = true
+		}
+		for _, x := range sb.AppendTo(nil) {
+			if m[x] {
+				existingExpected = append(existingExpected, x)
+			} else {
+				addedExpected = append(addedExpected, x)
+			}
+		}
+		if err := checkSameItems(existing, existingExpected); err != nil {
+			t.Fatalf("unexpected items passed to onExisting: %s", err)
+		}
+		if err := checkSameItems(added, addedExpected); err != nil {
+			t.Fatalf("unexpected items passed to onNew: %s", err)
+		}
+
+		// Verify nil callbacks
+		for _, onExisting := range []func(x uint64){nil, func(x uint64) {}} {
+			var sc Set
+			sc.AddMulti(a)
+			n := 0
+			sc.UnionWithCallback(&sb, onExisting, func(x uint64) { n++ })
+			if !sc.Equal(expected) {
+				t.Fatalf("unexpected union result with nil onExisting")
+			}
+			if n != len(addedExpected) {
+				t.Fatalf("unexpected number of onNew calls; got %d; want %d", n, len(addedExpected))
+			}
+			var sd Set
+			sd.AddMulti(a)
+			sd.UnionWithCallback(&sb, nil, nil)
+			if !sd.Equal(expected) {
+				t.Fatalf("unexpected union result with nil callbacks")
+			}
+		}
+	}
+	f(nil, nil)
+	f([]uint64{1, 2, 3}, nil)
+	f(nil, []uint64{1, 2, 3})
+	f([]uint64{1, 2, 3, 1 << 32}, []uint64{2, 3, 4, 1 << 33, 1<<64 - 1})
+
+	var a, b []uint64
+	for i := 0; i < 1e4; i++ {
+		a = append(a, uint64(rand.Intn(1e5)), uint64(rand.Intn(10))<<32|uint64(rand.Intn(1e3)))
+		b = append(b, uint64(rand.Intn(1e5)), uint64(rand.Intn(10))<<32|uint64(rand.Intn(1e3)))
+	}
+	f(a, b)
+
+	// Verify union with itself
+	var s Set
+	s.AddMulti(a)
+	n := 0
+	s.UnionWithCallback(&s, func(x uint64) { n++ }, func(x uint64) {
+		t.Fatalf("unexpected new item %d in union with itself", x)
+	})
+	if n != s.Len() {
+		t.Fatalf("unexpected number of onExisting calls for union with itself; got %d; want %d", n, s.Len())
+	}
+}
+
+func TestSetUnionSmart(t *testing.T) {
+	f := func(a, b []uint64) {
+		t.Helper()
+		m := make(map[uint64]bool)
+		for _, x := range a {
+			m[x] = true
+		}
+		for _, x := range b {
+			m[x] = true
+		}
+		var sa, sb Set
+		sa.AddMulti(a)
+		sb.AddMulti(b)
+		sbOrig := sb.Clone()
+		sa.UnionSmart(&sb)
+		if err := expectEqual(&sa, m); err != nil {
+			t.Fatalf("invalid sa.UnionSmart(sb): %s", err)
+		}
+		if !sb.Equal(sbOrig) {
+			t.Fatalf("sb mustn't change after sa.UnionSmart(sb)")
+		}
+
+		// Verify the updated set remains modifiable and it doesn't share memory with sb.
+		sa.AddMulti([]uint64{0, 1<<64 - 1})
+		sa.DelMulti(b)
+		if !sb.Equal(sbOrig) {
+			t.Fatalf("sb mustn't change after modifying sa")
+		}
+	}
+	f(nil, nil)
+	f([]uint64{1}, nil)
+	f(nil, []uint64{1})
+	f([]uint64{1, 2}, []uint64{2, 3, 4, 5, 6, 7, 8, 9, 10, 11})
+
+	var a, b []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*3))
+	}
+	for i := 0; i < 10; i++ {
+		b = append(b, uint64(i*7), uint64(i)<<32)
+	}
+	f(a, b)
+	f(b, a)
+
+	// Sets with many sparse buckets, so UnionSmart adds the items from the smaller set one-by-one
+	a = a[:0]
+	for i := 0; i < 1e4; i++ {
+		a = append(a, uint64(i)<<16, uint64(i)<<36)
+	}
+	f(a, b)
+	f(b, a)
+
+	// keepSorted mode must be preserved when s items are added to a copy of a
+	var sa, sb Set
+	sa.SetKeepSorted(true)
+	sa.AddMulti(b)
+	sb.AddMulti(a)
+	sa.UnionSmart(&sb)
+	if !sa.opts.keepSorted || !sort.IsSorted(&sa.buckets) {
+		t.Fatalf("UnionSmart must preserve keepSorted mode")
+	}
+}
+
+func TestSetSortNow(t *testing.T) {
+	var s Set
+	m := make(map[uint64]bool)
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 1e4; i++ {
+		x := uint64(rng.Intn(100))<<32 | uint64(rng.Intn(1e7))
+		s.Add(x)
+		m[x] = true
+	}
+	s.SortNow()
+	if !sort.IsSorted(&s.buckets) {
+		t.Fatalf("buckets must be sorted after SortNow")
+	}
+	for i := range s.buckets {
+		for _, b16 := range s.buckets[i].buckets {
+			a := b16.smallPool[:b16.smallPoolLen]
+			if !sort.SliceIsSorted(a, func(i, j int) bool { return a[i] < a[j] }) {
+				t.Fatalf("small pool must be sorted after SortNow; got %v", a)
+			}
+		}
+	}
+	if err := expectEqual(&s, m); err != nil {
+		t.Fatalf("unexpected set after SortNow: %s", err)
+	}
+
+	// Verify the set remains modifiable after SortNow.
+	s.Add(1<<64 - 1)
+	s.Del(1<<64 - 1)
+	if err := expectEqual(&s, m); err != nil {
+		t.Fatalf("unexpected set after modifying sorted set: %s", err)
+	}
+
+	var sNil *Set
+	sNil.SortNow()
+}
+
+func TestSetUnionCountWithSorted(t *testing.T) {
+	f := func(a, b []uint64) {
+		t.Helper()
+		sort.Slice(b, func(i, j int) bool { return b[i] < b[j] })
+		var s, sUnion Set
+		s.AddMulti(a)
+		sUnion.AddMulti(a)
+		sUnion.AddMulti(b)
+		if n := s.UnionCountWithSorted(b); n != sUnion.Len() {
+			t.Fatalf("unexpected UnionCountWithSorted; got %d; want %d", n, sUnion.Len())
+		}
+	}
+	f(nil, nil)
+	f([]uint64{1, 2}, nil)
+	f(nil, []uint64{1, 1, 2, 2, 2})
+	f([]uint64{1, 2}, []uint64{2, 2, 3, 3})
+	f([]uint64{1, 1 << 32}, []uint64{0, 1 << 32, 1 << 32, 1<<64 - 1, 1<<64 - 1})
+
+	rng := rand.New(rand.NewSource(0))
+	var a, b []uint64
+	for i := 0; i < 1e4; i++ {
+		a = append(a, uint64(rng.Intn(1e5)))
+		b = append(b, uint64(rng.Intn(1e5)), uint64(rng.Int63()))
+	}
+	f(a, b)
+}
+
+func TestSetForEachSorted(t *testing.T) {
+	var s Set
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 1e4; i++ {
+		// Add items with descending high bits in order to break the buckets order.
+		s.Add(uint64(1e4-i)<<32 | uint64(rng.Intn(1e6)))
+		s.Add(uint64(rng.Intn(1e6)))
+	}
+	var result []uint64
+	s.ForEachSorted(func(part []uint64) bool {
+		if len(part) > 0 && len(result) > 0 && part[0] <= result[len(result)-1] {
+			t.Fatalf("part must contain items bigger than the previous parts; got %d after %d", part[0], result[len(result)-1])
+		}
+		result = append(result, part...)
+		return true
+	})
+	if err := checkSameItems(result, s.AppendTo(nil)); err != nil {
+		t.Fatalf("unexpected items: %s", err)
+	}
+
+	var sNil *Set
+	sNil.ForEachSorted(func(part []uint64) bool {
+		t.Fatalf("unexpected call for nil set")
+		return true
+	})
+}
+
+func TestSetForEachUnion(t *testing.T) {
+	f := func(a, b []uint64) {
+		t.Helper()
+		var sa, sb Set
+		// Add items in reverse order in order to break the buckets order.
+		for i := len(a) - 1; i >= 0; i-- {
+			sa.Add(a[i])
+		}
+		for i := len(b) - 1; i >= 0; i-- {
+			sb.Add(b[i])
+		}
+		var hisOrig []uint32
+		for i := range sa.buckets {
+			hisOrig = append(hisOrig, sa.buckets[i].hi)
+		}
+		sUnion := sa.Clone()
+		sUnion.Union(&sb)
+		expected := sUnion.AppendTo(nil)
+
+		var result []uint64
+		sa.ForEachUnion(&sb, func(part []uint64) bool {
+			if len(part) > 0 && len(result) > 0 && part[0] <= result[len(result)-1] {
+				t.Fatalf("part must contain items bigger than the previous parts; got %d after %d", part[0], result[len(result)-1])
+			}
+			result = append(result, part...)
+			return true
+		})
+		if err := checkSameItems(result, expected); err != nil {
+			t.Fatalf("unexpected items: %s", err)
+		}
+		for i := range sa.buckets {
+			if sa.buckets[i].hi != hisOrig[i] {
+				t.Fatalf("sa buckets mustn't be reordered by ForEachUnion")
+			}
+		}
+	}
+	f(nil, nil)
+	f([]uint64{1, 2}, nil)
+	f(nil, []uint64{1, 2})
+	f([]uint64{1, 3, 5}, []uint64{2, 3, 4})
+	f([]uint64{1, 1 << 16, 3 << 32}, []uint64{2 << 32, 1 << 16, 1<<16 + 1, 1<<64 - 1})
+
+	// Mix of dense and sparse buckets
+	var a, b []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*2))
+		if i%100 == 0 {
+			b = append(b, uint64(i*3), uint64(i)<<32)
+		}
+	}
+	f(a, b)
+	f(b, a)
+	for i := 0; i < 1e5; i++ {
+		b = append(b, uint64(i*3))
+	}
+	f(a, b)
+
+	rng := rand.New(rand.NewSource(0))
+	a = a[:0]
+	b = b[:0]
+	for i := 0; i < 1e4; i++ {
+		a = append(a, uint64(rng.Intn(1e7)), uint64(rng.Intn(100))<<32)
+		b = append(b, uint64(rng.Intn(1e7)))
+	}
+	f(a, b)
+}
+
+func TestSetTruncate(t *testing.T) {
+	f := func(a []uint64, x uint64) {
+		t.Helper()
+		var sBelow, sAbove Set
+		sBelow.AddMulti(a)
+		sAbove.AddMulti(a)
+		mBelow := make(map[uint64]bool)
+		mAbove := make(map[uint64]bool)
+		for _, v := range a {
+			if v >= x {
+				mBelow[v] = true
+			} else {
+				mAbove[v] = true
+			}
+		}
+		sBelow.TruncateBelow(x)
+		if err := expectEqual(&sBelow, mBelow); err != nil {
+			t.Fatalf("unexpected set after TruncateBelow(%d): %s", x, err)
+		}
+		sAbove.TruncateAbove(x)
+		if err := expectEqual(&sAbove, mAbove); err != nil {
+			t.Fatalf("unexpected set after TruncateAbove(%d): %s", x, err)
+		}
+	}
+	f(nil, 0)
+	f(nil, 10)
+	f([]uint64{0, 1, 2}, 0)
+	f([]uint64{0, 1, 2}, 1)
+	f([]uint64{0, 1, 2}, 3)
+	f([]uint64{0, 1<<64 - 2, 1<<64 - 1}, 1<<64-1)
+	f([]uint64{1, 1 << 16, 1 << 32, 2 << 32, 3<<32 + 5, 1<<64 - 1}, 2<<32)
+	f([]uint64{1, 1 << 16, 1 << 32, 2 << 32, 3<<32 + 5, 1<<64 - 1}, 2<<32+1)
+
+	// Dense buckets spanning multiple bucket32 items
+	var a []uint64
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 1e5; j++ {
+			a = append(a, uint64(i)<<32+uint64(j*3))
+		}
+	}
+	f(a, 0)
+	f(a, 1<<16)
+	f(a, 1<<16+7)
+	f(a, 2<<32)
+	f(a, 2<<32+12345)
+	f(a, 5<<32)
+
+	// StickyDense mode must keep the bits arrays for the emptied buckets
+	var s Set
+	s.SetStickyDense(true)
+	s.AddMulti(a)
+	bucket16sCount := s.bucket16sCount()
+	s.TruncateBelow(3 << 32)
+	if n := s.Len(); n != 1e5 {
+		t.Fatalf("unexpected number of items after TruncateBelow; got %d; want %d", n, int(1e5))
+	}
+	if n := s.bucket16sCount(); n != bucket16sCount {
+		t.Fatalf("unexpected number of bucket16 items after TruncateBelow in stickyDense mode; got %d; want %d", n, bucket16sCount)
+	}
+}
+
+func TestSetApply(t *testing.T) {
+	f := func(initial, adds, dels []uint64) {
+		t.Helper()
+		var s Set
+		s.AddMulti(initial)
+		var sExpected Set
+		sExpected.AddMulti(initial)
+		m := make(map[uint64]bool)
+		for _, x := range initial {
+			m[x] = true
+		}
+		for _, x := range adds {
+			m[x] = true
+		}
+		for _, x := range dels {
+			delete(m, x)
+		}
+
+		s.Apply(adds, dels)
+		if err := expectEqual(&s, m); err != nil {
+			t.Fatalf("unexpected set after Apply: %s", err)
+		}
+		sExpected.AddMulti(adds)
+		sExpected.DelMulti(dels)
+		if !s.Equal(&sExpected) {
+			t.Fatalf("Apply result must be equal to AddMulti followed by DelMulti")
+		}
+	}
+	f(nil, nil, nil)
+	f([]uint64{1, 2}, nil, nil)
+	f(nil, []uint64{1, 2}, nil)
+	f(nil, nil, []uint64{1, 2})
+	f([]uint64{1, 2, 3}, []uint64{4, 5}, []uint64{2, 5})
+
+	// Items in both adds and dels must be missing
+	f(nil, []uint64{1, 1 << 32, 2 << 32}, []uint64{2 << 32, 1 << 32, 1})
+	f(nil, []uint64{2 << 32, 1, 1 << 32}, []uint64{1 << 32, 1, 2 << 32})
+	f([]uint64{3 << 32}, []uint64{1, 1 << 32, 1<<32 + 1, 5 << 32}, []uint64{1<<32 + 1, 3 << 32, 0, 1 << 32})
+
+	// Random items with overlapping adds and dels
+	rng := rand.New(rand.NewSource(0))
+	var initial, adds, dels []uint64
+	for i := 0; i < 1e5; i++ {
+		initial = append(initial, uint64(rng.Intn(1e6))|uint64(rng.Intn(10))<<32)
+		adds = append(adds, uint64(rng.Intn(1e6))|uint64(rng.Intn(10))<<32)
+		dels = append(dels, uint64(rng.Intn(1e6))|uint64(rng.Intn(10))<<32)
+	}
+	dels = append(dels, adds[:1e4]...)
+	f(initial, adds, dels)
+	sort.Slice(adds, func(i, j int) bool { return adds[i] < adds[j] })
+	f(initial, adds, dels)
+	sort.Slice(dels, func(i, j int) bool { return dels[i] < dels[j] })
+	f(initial, adds, dels)
+}
+
+func TestSetDropSparsePrefixes(t *testing.T) {
+	f := func(a []uint64, minCount int) {
+		t.Helper()
+		var s Set
+		s.AddMulti(a)
+		counts := make(map[uint64]int)
+		for _, x := range a {
+			counts[x>>32]++
+		}
+		m := make(map[uint64]bool)
+		droppedExpected := 0
+		for _, x := range a {
+			if counts[x>>32] >= minCount {
+				m[x] = true
+			} else {
+				droppedExpected++
+			}
+		}
+		dropped := s.DropSparsePrefixes(minCount)
+		if dropped != droppedExpected {
+			t.Fatalf("unexpected number of dropped items; got %d; want %d", dropped, droppedExpected)
+		}
+		if err := expectEqual(&s, m); err != nil {
+			t.Fatalf("unexpected set after DropSparsePrefixes(%d): %s", minCount, err)
+		}
+	}
+	f(nil, 0)
+	f(nil, 10)
+	f([]uint64{1, 2, 3}, 0)
+	f([]uint64{1, 2, 3}, 3)
+	f([]uint64{1, 2, 3}, 4)
+	f([]uint64{1, 1 << 32, 2 << 32, 2<<32 + 1, 1<<64 - 1}, 2)
+
+	// Dense prefixes mixed with singleton prefixes
+	var a []uint64
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 1e5; j++ {
+			a = append(a, uint64(i)<<33+uint64(j*3))
+		}
+		a = append(a, uint64(i)<<33+1<<32+uint64(i))
+	}
+	f(a, 1)
+	f(a, 2)
+	f(a, 1e5)
+	f(a, 1e5+1)
+
+	// StickyDense mode must keep the bits arrays for the dropped buckets
+	var s Set
+	s.SetStickyDense(true)
+	s.AddMulti(a)
+	bucket16sCount := s.bucket16sCount()
+	if n := s.DropSparsePrefixes(1e5 + 1); n != len(a) {
+		t.Fatalf("unexpected number of dropped items; got %d; want %d", n, len(a))
+	}
+	if n := s.Len(); n != 0 {
+		t.Fatalf("unexpected number of items after DropSparsePrefixes; got %d; want 0", n)
+	}
+	if n := s.bucket16sCount(); n == 0 || n >= bucket16sCount {
+		t.Fatalf("unexpected number of bucket16 items after DropSparsePrefixes in stickyDense mode; got %d; want in the range (0, %d)", n, bucket16sCount)
+	}
+}
+
+func TestSetSizeBytes(t *testing.T) {
+	f := func(a []uint64, getSizeExpected func(s *Set) uintptr) {
+		t.Helper()
+		var s Set
+		for _, x := range a {
+			s.Add(x)
+		}
+		sizeExpected := getSizeExpected(&s)
+		if n := s.SizeBytes(); n != uint64(sizeExpected) {
+			t.Fatalf("unexpected SizeBytes() for %d items; got %d; want %d", len(a), n, sizeExpected)
+		}
+	}
+	setSize := unsafe.Sizeof(Set{})
+	b32Size := unsafe.Sizeof(bucket32{})
+	b16Size := unsafe.Sizeof(bucket16{})
+	bitsSize := unsafe.Sizeof([wordsPerBucket]uint64{})
+	// Every bucket16 is referenced by an item in bucket32.b16his and by a pointer in bucket32.buckets.
+	b16RefsSize := func(b *bucket32) uintptr {
+		return uintptr(cap(b.b16his))*unsafe.Sizeof(uint16(0)) + uintptr(cap(b.buckets))*unsafe.Sizeof((*bucket16)(nil))
+	}
+
+	f(nil, func(s *Set) uintptr {
+		return setSize
+	})
+
+	// A single bucket32 is stored in Set.scratchBuckets.
+	f([]uint64{1}, func(s *Set) uintptr {
+		return setSize + b16RefsSize(&s.buckets[0]) + b16Size
+	})
+	f([]uint64{1, 2, 3}, func(s *Set) uintptr {
+		return setSize + b16RefsSize(&s.buckets[0]) + b16Size
+	})
+	f([]uint64{1, 1 << 16}, func(s *Set) uintptr {
+		return setSize + b16RefsSize(&s.buckets[0]) + 2*b16Size
+	})
+
+	// Multiple bucket32 items are stored in a separately allocated slice.
+	f([]uint64{1, 1 << 32}, func(s *Set) uintptr {
+		return setSize + uintptr(cap(s.buckets))*b32Size + b16RefsSize(&s.buckets[0]) + b16RefsSize(&s.buckets[1]) + 2*b16Size
+	})
+
+	// Dense bucket16
+	var a []uint64
+	for i := 0; i < 1e4; i++ {
+		a = append(a, uint64(i))
+	}
+	f(a, func(s *Set) uintptr {
+		return setSize + b16RefsSize(&s.buckets[0]) + b16Size + bitsSize
+	})
+}
+
+func TestSetSizeBytesRetainedCapacity(t *testing.T) {
+	var s Set
+	for i := 0; i < 1e3; i++ {
+		s.Add(uint64(i) << 16)
+	}
+	sizeGrown := s.SizeBytes()
+
+	// Deleting bucket16 items leaves the capacity of bucket32.b16his and bucket32.buckets in place.
+	s.TruncateAbove(1 << 16)
+	if n := s.Len(); n != 1 {
+		t.Fatalf("unexpected number of items after deletion; got %d; want 1", n)
+	}
+	b32 := &s.buckets[0]
+	if n := len(b32.buckets); n != 1 {
+		t.Fatalf("unexpected number of bucket16 items after deletion; got %d; want 1", n)
+	}
+	if n := cap(b32.buckets); n < 1e3 {
+		t.Fatalf("unexpected capacity for bucket32.buckets after deletion; got %d; want at least %d", n, int(1e3))
+	}
+	sizeShrunk := s.SizeBytes()
+	sizeRetained := uint64(cap(b32.b16his))*uint64(unsafe.Sizeof(uint16(0))) + uint64(cap(b32.buckets))*uint64(unsafe.Sizeof((*bucket16)(nil)))
+	if sizeShrunk < sizeRetained {
+		t.Fatalf("SizeBytes() must include the retained capacity; got %d; want at least %d", sizeShrunk, sizeRetained)
+	}
+	sizeDeleted := (1e3 - 1) * uint64(unsafe.Sizeof(bucket16{}))
+	if sizeShrunk != sizeGrown-sizeDeleted {
+		t.Fatalf("unexpected SizeBytes() after deletion; got %d; want %d", sizeShrunk, sizeGrown-sizeDeleted)
+	}
+}
+
+func TestSetReadNoAllocs(t *testing.T) {
+	f := func(s *Set) {
+		t.Helper()
+		n := testing.AllocsPerRun(100, func() {
+			_ = s.Len()
+			_ = s.IsEmpty()
+			_ = s.Has(123)
+			_ = s.Has(1<<64 - 1)
+			_ = s.SizeBytes()
+		})
+		if n != 0 {
+			t.Fatalf("unexpected number of allocations; got %v; want 0", n)
+		}
+	}
+	f(nil)
+	f(&Set{})
+	var s Set
+	for i := 0; i < 1e5; i++ {
+		s.Add(uint64(i) * 7)
+	}
+	s.Add(1<<64 - 1)
+	f(&s)
+}
+
+func TestSetCountIf(t *testing.T) {
+	f := func(a []uint64, pred func(x uint64) bool) {
+		t.Helper()
+		var s Set
+		s.AddMulti(a)
+		nExpected := 0
+		for _, x := range s.AppendTo(nil) {
+			if pred(x) {
+				nExpected++
+			}
+		}
+		if n := s.CountIf(pred); n != nExpected {
+			t.Fatalf("unexpected CountIf(); got %d; want %d", n, nExpected)
+		}
+	}
+	isEven := func(x uint64) bool {
+		return x%2 == 0
+	}
+	all := func(x uint64) bool {
+		return true
+	}
+	f(nil, isEven)
+	f([]uint64{1}, isEven)
+	f([]uint64{1, 2, 3, 4, 1 << 32, 1<<64 - 1}, isEven)
+	f([]uint64{1, 2, 3, 4, 1 << 32, 1<<64 - 1}, all)
+
+	var a []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*3))
+	}
+	for i := 0; i < 1e3; i++ {
+		a = append(a, uint64(rand.Int63()))
+	}
+	f(a, isEven)
+	f(a, all)
+	f(a, func(x uint64) bool {
+		return x > 1<<16 && x < 1<<40
+	})
+
+	// nil set
+	var sNil *Set
+	if n := sNil.CountIf(all); n != 0 {
+		t.Fatalf("unexpected CountIf() for nil set; got %d; want 0", n)
+	}
+}
+
+func TestSetForEachMutable(t *testing.T) {
+	var s Set
+	for i := 0; i < 1e4; i++ {
+		s.Add(uint64(i) * 10)
+	}
+	s.Add(1 << 40)
+	sOrig := s.Clone()
+	expected := sOrig.Clone()
+
+	// Expand every item into its neighbors and delete every second item from inside f.
+	var result []uint64
+	s.ForEachMutable(func(x uint64, s *Set) bool {
+		result = append(result, x)
+		s.Add(x + 1)
+		expected.Add(x + 1)
+		if x%20 == 0 {
+			s.Del(x)
+			expected.Del(x)
+			// Delete the next item, which must be still visited.
+			s.Del(x + 10)
+			expected.Del(x + 10)
+		}
+		return true
+	})
+	if err := checkSameItems(result, sOrig.AppendTo(nil)); err != nil {
+		t.Fatalf("unexpected items visited by ForEachMutable: %s", err)
+	}
+	if err := checkSameItems(s.AppendTo(nil), expected.AppendTo(nil)); err != nil {
+		t.Fatalf("unexpected set after ForEachMutable: %s", err)
+	}
+
+	// Stop the iteration
+	n := 0
+	sOrig.ForEachMutable(func(x uint64, s *Set) bool {
+		n++
+		return n < 10
+	})
+	if n != 10 {
+		t.Fatalf("unexpected number of f calls; got %d; want 10", n)
+	}
+
+	// nil set
+	var sNil *Set
+	sNil.ForEachMutable(func(x uint64, s *Set) bool {
+		t.Fatalf("f mustn't be called for nil set")
+		return true
+	})
+}
+
+func TestSetIntersectClone(t *testing.T) {
+	f := func(a, b []uint64) {
+		t.Helper()
+		var sa, sb Set
+		sa.AddMulti(a)
+		sb.AddMulti(b)
+		saOrig := sa.Clone()
+		sbOrig := sb.Clone()
+		expected := sa.Clone()
+		expected.Intersect(&sb)
+		result := sa.IntersectClone(&sb)
+		if !result.Equal(expected) {
+			t.Fatalf("unexpected sa.IntersectClone(sb); got %d items; want %d items", result.Len(), expected.Len())
+		}
+		if err := checkSameItems(result.AppendTo(nil), expected.AppendTo(nil)); err != nil {
+			t.Fatalf("unexpected items in sa.IntersectClone(sb): %s", err)
+		}
+		result = sb.IntersectClone(&sa)
+		if !result.Equal(expected) {
+			t.Fatalf("unexpected sb.IntersectClone(sa); got %d items; want %d items", result.Len(), expected.Len())
+		}
+		if !sa.Equal(saOrig) || !sb.Equal(sbOrig) {
+			t.Fatalf("IntersectClone mustn't modify its operands")
+		}
+
+		// Verify the result can be modified without affecting the operands.
+		result.Add(1<<64 - 1)
+		result.AddMulti(a)
+		if !sa.Equal(saOrig) || !sb.Equal(sbOrig) {
+			t.Fatalf("modifying the result of IntersectClone mustn't modify its operands")
+		}
+	}
+	f(nil, nil)
+	f([]uint64{1, 2}, nil)
+	f([]uint64{1, 2}, []uint64{3, 4})
+	f([]uint64{1, 2}, []uint64{1, 2, 3, 4})
+	f([]uint64{1, 2, 1 << 32}, []uint64{1, 3, 1 << 32, 2 << 32})
+
+	// Dense and sparse buckets
+	var a, b []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*2))
+		b = append(b, uint64(i*3))
+	}
+	f(a, b)
+	f(a, b[:100])
+	f(a[:10], b)
+
+	// Dense buckets with small intersection
+	var c []uint64
+	for i := 0; i < 1e5; i++ {
+		c = append(c, uint64(i*2+1))
+	}
+	c = append(c, 0, 2, 4, 1<<16)
+	f(a, c)
+
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 1000; i++ {
+		a = append(a, uint64(rng.Int63()))
+		b = append(b, uint64(rng.Intn(1e7)))
+	}
+	f(a, b)
+	f(a, a)
+}
+
+func TestSetTakeMin(t *testing.T) {
+	f := func(a []uint64, k int) {
+		t.Helper()
+		var s Set
+		s.AddMulti(a)
+		sOrig := s.Clone()
+		items := s.AppendTo(nil)
+		var itemsExpected []uint64
+		if k > 0 {
+			itemsExpected = items
+			if k < len(items) {
+				itemsExpected = items[:k]
+			}
+		}
+		result := s.TakeMin(k)
+		if n := result.Len(); n != len(itemsExpected) {
+			t.Fatalf("unexpected number of items in TakeMin(%d); got %d; want %d", k, n, len(itemsExpected))
+		}
+		if err := checkSameItems(result.AppendTo(nil), itemsExpected); err != nil {
+			t.Fatalf("unexpected items in TakeMin(%d): %s", k, err)
+		}
+		if !s.Equal(sOrig) {
+			t.Fatalf("s mustn't change after TakeMin(%d)", k)
+		}
+		for i := range result.buckets {
+			for j, b16 := range result.buckets[i].buckets {
+				if b16.bits != nil && b16.getLen() <= smallPoolSize {
+					t.Fatalf("sparse bucket16 #%d in TakeMin(%d) result must be stored in small pool", j, k)
+				}
+			}
+		}
+		// Verify the result can be modified
+		result.Add(1<<64 - 1)
+		if n := result.Len(); n != len(itemsExpected)+1 {
+			t.Fatalf("unexpected number of items after modifying TakeMin(%d) result; got %d; want %d", k, n, len(itemsExpected)+1)
+		}
+		if !s.Equal(sOrig) {
+			t.Fatalf("s mustn't change after modifying TakeMin(%d) result", k)
+		}
+	}
+	f(nil, 0)
+	f(nil, 10)
+	f([]uint64{5, 3, 1}, -1)
+	f([]uint64{5, 3, 1}, 0)
+	f([]uint64{5, 3, 1}, 2)
+	f([]uint64{5, 3, 1}, 3)
+	f([]uint64{5, 3, 1}, 100)
+	f([]uint64{5 << 32, 3 << 32, 1 << 40, 1<<32 + 1<<17, 1<<32 + 5}, 3)
+
+	// Dense buckets
+	var a []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i%7)<<32|uint64(i*5))
+	}
+	for _, k := range []int{1, smallPoolSize, smallPoolSize + 1, 1000, 1<<14 + 7, 5e4, 1e5 - 1} {
+		f(a, k)
+	}
+}
+
+func TestSetDrainMin(t *testing.T) {
+	f := func(a []uint64, k int) {
+		t.Helper()
+		var s Set
+		s.AddMulti(a)
+		itemsExpected := s.AppendTo(nil)
+
+		// Drain s in chunks and verify the chunks reproduce the original sorted items.
+		var items []uint64
+		for s.Len() > 0 {
+			remaining := s.Len()
+			chunk := s.DrainMin(k)
+			n := k
+			if n > remaining {
+				n = remaining
+			}
+			if chunk.Len() != n {
+				t.Fatalf("unexpected number of items in the drained chunk; got %d; want %d", chunk.Len(), n)
+			}
+			if s.Len() != remaining-n {
+				t.Fatalf("unexpected number of items left in s; got %d; want %d", s.Len(), remaining-n)
+			}
+			if m := len(s.AppendTo(nil)); m != s.Len() {
+				t.Fatalf("unexpected number of items returned from s.AppendTo(); got %d; want %d", m, s.Len())
+			}
+			for i := range s.buckets {
+				if len(s.buckets[i].buckets) == 0 {
+					t.Fatalf("empty bucket32 must be removed from s")
+				}
+				for j, b16 := range s.buckets[i].buckets {
+					if b16.isEmpty() {
+						t.Fatalf("empty bucket16 #%d must be removed from s", j)
+					}
+				}
+			}
+			chunkItems := chunk.AppendTo(nil)
+			if len(chunkItems) != chunk.Len() {
+				t.Fatalf("unexpected number of items returned from chunk.AppendTo(); got %d; want %d", len(chunkItems), chunk.Len())
+			}
+			items = append(items, chunkItems...)
+		}
+		if err := checkSameItems(items, itemsExpected); err != nil {
+			t.Fatalf("unexpected items drained with k=%d: %s", k, err)
+		}
+
+		// Verify s is usable after draining all the items.
+		s.Add(123)
+		if s.Len() != 1 || !s.Has(123) {
+			t.Fatalf("unexpected s after adding an item to drained set")
+		}
+	}
+	f([]uint64{5, 3, 1}, 1)
+	f([]uint64{5, 3, 1}, 2)
+	f([]uint64{5, 3, 1}, 3)
+	f([]uint64{5, 3, 1}, 100)
+	f([]uint64{1<<64 - 1, 0, 1 << 32}, 1)
+	f([]uint64{5 << 32, 3 << 32, 1 << 40, 1<<32 + 1<<17, 1<<32 + 5}, 2)
+
+	// Dense buckets
+	var a []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i%7)<<32|uint64(i*5))
+	}
+	for _, k := range []int{smallPoolSize + 1, 999, 1<<14 + 7, 5e4} {
+		f(a, k)
+	}
+
+	// Non-positive k
+	var s Set
+	s.AddMulti([]uint64{1, 2, 3})
+	for _, k := range []int{-1, 0} {
+		if n := s.DrainMin(k).Len(); n != 0 {
+			t.Fatalf("unexpected number of drained items for k=%d; got %d; want 0", k, n)
+		}
+		if n := s.Len(); n != 3 {
+			t.Fatalf("s mustn't change after DrainMin(%d); got %d items; want 3", k, n)
+		}
+	}
+
+	// Empty set
+	var sNil *Set
+	if n := sNil.DrainMin(10).Len(); n != 0 {
+		t.Fatalf("unexpected number of drained items for nil set; got %d; want 0", n)
+	}
+}
+
+func TestSetSubtractCount(t *testing.T) {
+	f := func(a, b []uint64) {
+		t.Helper()
+		var sa, sb Set
+		sa.AddMulti(a)
+		sb.AddMulti(b)
+		saOrig := sa.Clone()
+		sbOrig := sb.Clone()
+		for _, x := range []struct {
+			s, a *Set
+		}{{&sa, &sb}, {&sb, &sa}} {
+			result := x.s.Clone()
+			result.Subtract(x.a)
+			if n := x.s.SubtractCount(x.a); n != result.Len() {
+				t.Fatalf("unexpected SubtractCount(); got %d; want %d", n, result.Len())
+			}
+		}
+		if !sa.Equal(saOrig) || !sb.Equal(sbOrig) {
+			t.Fatalf("SubtractCount mustn't modify its operands")
+		}
+	}
+	f(nil, nil)
+	f([]uint64{1, 2}, nil)
+	f([]uint64{1, 2}, []uint64{3, 4})
+	f([]uint64{1, 2}, []uint64{1, 2, 3, 4})
+	f([]uint64{1, 2, 1 << 32}, []uint64{1, 3, 1 << 32, 2 << 32})
+
+	// Dense and sparse buckets
+	var a, b []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*2))
+		b = append(b, uint64(i*3))
+	}
+	f(a, b)
+	f(a, b[:100])
+	f(a[:10], b)
+
+	// Fully overlapping and disjoint sets
+	f(a, a)
+	f(a, a[:1000])
+	var c []uint64
+	for i := 0; i < 1e5; i++ {
+		c = append(c, uint64(i*2+1))
+	}
+	f(a, c)
+	f(a, []uint64{1 << 40, 2 << 40})
+
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 1000; i++ {
+		a = append(a, uint64(rng.Int63()))
+		b = append(b, uint64(rng.Intn(1e7)))
+	}
+	f(a, b)
+}
+
+func TestSetSharesBucket(t *testing.T) {
+	f := func(a, b []uint64, resultExpected bool) {
+		t.Helper()
+		var sa, sb Set
+		sa.AddMulti(a)
+		sb.AddMulti(b)
+		if result := sa.SharesBucket(&sb); result != resultExpected {
+			t.Fatalf("unexpected sa.SharesBucket(sb); got %v; want %v", result, resultExpected)
+		}
+		if result := sb.SharesBucket(&sa); result != resultExpected {
+			t.Fatalf("unexpected sb.SharesBucket(sa); got %v; want %v", result, resultExpected)
+		}
+		if !resultExpected && sa.intersectCount(&sb) > 0 {
+			t.Fatalf("sets without shared buckets cannot have common items")
+		}
+	}
+	f(nil, nil, false)
+	f([]uint64{1}, nil, false)
+	f([]uint64{1}, []uint64{1}, true)
+	f([]uint64{1, 2 << 32}, []uint64{1 << 32, 3 << 32}, false)
+	f([]uint64{3 << 32, 1, 5 << 32}, []uint64{4 << 32, 2 << 32, 5<<32 + 1}, true)
+
+	// Sets sharing a bucket without common items
+	f([]uint64{1, 2, 3}, []uint64{4, 5, 1 << 20}, true)
+	f([]uint64{7<<32 | 1}, []uint64{7<<32 | 1<<31}, true)
+
+	// Many buckets in unsorted order
+	var a, b []uint64
+	for i := 0; i < 100; i++ {
+		a = append(a, uint64(1000-2*i)<<32)
+		b = append(b, uint64(2*i+1)<<32)
+	}
+	f(a, b, false)
+	f(a, append(b, 900<<32+123), true)
+}
+
+func TestBucket32HintAfterStructuralChanges(t *testing.T) {
+	var s Set
+	for i := 0; i < 10; i++ {
+		s.Add(uint64(i*2) << 16)
+	}
+	b32 := &s.buckets[0]
+	expectHint := func(hi16 uint16) {
+		t.Helper()
+		n := b32.getHint()
+		if n >= uint32(len(b32.b16his)) || b32.b16his[n] != hi16 {
+			t.Fatalf("the hint must point to bucket16 with hi=%d; got hint=%d for b16his=%v", hi16, n, b32.b16his)
+		}
+	}
+
+	// Add sets the hint to the bucket, which has been just created.
+	s.Add(9<<16 | 1)
+	expectHint(9)
+
+	// Adding buckets in front of the hinted bucket must preserve the hint.
+	s.Add(7<<16 | 1)
+	s.Add(1<<16 | 1)
+	s.Add(9<<16 | 2)
+	expectHint(9)
+	b32.getOrCreateBucket16(3)
+	expectHint(9)
+
+	// Removing buckets in front of the hinted bucket must preserve the hint.
+	s.TruncateBelow(4 << 16)
+	expectHint(9)
+	b32.removeBucketAtPos(0)
+	expectHint(9)
+	s.Del(9<<16 | 1)
+	s.Del(9<<16 | 2)
+	b32.compact(false)
+	expectHint(10)
+}
+
+func TestSetForEachBucket16(t *testing.T) {
+	f := func(a []uint64) {
+		t.Helper()
+		var s Set
+		s.AddMulti(a)
+		var result []uint64
+		basePrev := uint64(0)
+		calls := 0
+		s.ForEachBucket16(func(base uint64, part []uint64) bool {
+			if calls > 0 && base <= basePrev {
+				t.Fatalf("base must increase; got %d after %d", base, basePrev)
+			}
+			if len(part) == 0 {
+				t.Fatalf("part mustn't be empty")
+			}
+			for _, x := range part {
+				if x&^(1<<16-1) != base {
+					t.Fatalf("unexpected item %d for base %d", x, base)
+				}
+			}
+			result = append(result, part...)
+			basePrev = base
+			calls++
+			return true
+		})
+		if err := checkSameItems(result, s.AppendTo(nil)); err != nil {
+			t.Fatalf("unexpected items: %s", err)
+		}
+	}
+	f(nil)
+	f([]uint64{0})
+	f([]uint64{5, 3, 1 << 16, 1<<16 + 1, 1 << 32, 7 << 32, 2<<32 + 1<<20, 1<<64 - 1})
+
+	var a []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*3))
+	}
+	for i := 0; i < 1e3; i++ {
+		a = append(a, uint64(rand.Int63()))
+	}
+	f(a)
+
+	// Empty buckets must be skipped
+	var s Set
+	s.Add(1)
+	s.Add(1 << 16)
+	s.Del(1)
+	calls := 0
+	s.ForEachBucket16(func(base uint64, part []uint64) bool {
+		if base != 1<<16 {
+			t.Fatalf("unexpected base; got %d; want %d", base, 1<<16)
+		}
+		calls++
+		return true
+	})
+	if calls != 1 {
+		t.Fatalf("unexpected number of f calls; got %d; want 1", calls)
+	}
+
+	// Stop the iteration
+	calls = 0
+	s.Add(1 << 32)
+	s.ForEachBucket16(func(base uint64, part []uint64) bool {
+		calls++
+		return false
+	})
+	if calls != 1 {
+		t.Fatalf("unexpected number of f calls; got %d; want 1", calls)
+	}
+}
+
+func TestSetSelectInBucket(t *testing.T) {
+	f := func(a []uint64) {
+		t.Helper()
+		var s Set
+		s.AddMulti(a)
+		items := make(map[uint32][]uint64)
+		for _, x := range s.AppendTo(nil) {
+			hi := uint32(x >> 32)
+			items[hi] = append(items[hi], x)
+		}
+		for hi, b := range items {
+			for k, xExpected := range b {
+				x, ok := s.SelectInBucket(hi, k)
+				if !ok {
+					t.Fatalf("cannot find item #%d in the bucket %d", k, hi)
+				}
+				if x != xExpected {
+					t.Fatalf("unexpected item #%d in the bucket %d; got %d; want %d", k, hi, x, xExpected)
+				}
+			}
+			if _, ok := s.SelectInBucket(hi, len(b)); ok {
+				t.Fatalf("unexpected item #%d found in the bucket %d with %d items", len(b), hi, len(b))
+			}
+			if _, ok := s.SelectInBucket(hi, -1); ok {
+				t.Fatalf("unexpected item found for negative k in the bucket %d", hi)
+			}
+		}
+		if _, ok := s.SelectInBucket(12345, 0); ok {
+			t.Fatalf("unexpected item found in missing bucket")
+		}
+	}
+	f(nil)
+	f([]uint64{0})
+	f([]uint64{1<<64 - 1})
+	f([]uint64{5, 3, 1, 1 << 16, 1<<17 + 3, 1<<16 - 1})
+	f([]uint64{1 << 32, 10, 1<<32 + 5, 3<<32 + 1<<20, 3 << 32})
+
+	// Dense buckets
+	var a []uint64
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(r.Intn(3))<<32|uint64(r.Intn(1<<18)))
+	}
+	f(a)
+
+	// Read-only set
+	var sOrig Set
+	sOrig.AddMulti([]uint64{7<<32 + 30, 7<<32 + 10, 7<<32 + 20})
+	data, err := sOrig.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error in MarshalBinary: %s", err)
+	}
+	sr, err := NewReadOnlyFromBytes(newAlignedBytes(data))
+	if err != nil {
+		t.Fatalf("unexpected error in NewReadOnlyFromBytes: %s", err)
+	}
+	if x, ok := sr.SelectInBucket(7, 1); !ok || x != 7<<32+20 {
+		t.Fatalf("unexpected item #1 in read-only set; got %d, %v; want %d, true", x, ok, uint64(7<<32+20))
+	}
+
+	// nil set
+	var sNil *Set
+	if _, ok := sNil.SelectInBucket(0, 0); ok {
+		t.Fatalf("unexpected item found in nil set")
+	}
+}
+
+func TestSetFirstDiff(t *testing.T) {
+	f := func(sa, sb *Set) {
+		t.Helper()
+		ma := make(map[uint64]bool)
+		for _, x := range sa.AppendTo(nil) {
+			ma[x] = true
+		}
+		mb := make(map[uint64]bool)
+		for _, x := range sb.AppendTo(nil) {
+			mb[x] = true
+		}
+		var xExpected uint64
+		inSExpected := false
+		equalExpected := true
+		for _, m := range []map[uint64]bool{ma, mb} {
+			for x := range m {
+				if ma[x] != mb[x] && (equalExpected || x < xExpected) {
+					xExpected = x
+					inSExpected = ma[x]
+					equalExpected = false
+				}
+			}
+		}
+		x, inS, equal := sa.FirstDiff(sb)
+		if equal != equalExpected {
+			t.Fatalf("unexpected equal; got %v; want %v", equal, equalExpected)
+		}
+		if !equal && (x != xExpected || inS != inSExpected) {
+			t.Fatalf("unexpected first diff; got x=%d, inS=%v; want x=%d, inS=%v", x, inS, xExpected, inSExpected)
+		}
+
+		// The result must be symmetric.
+		x, inA, equal := sb.FirstDiff(sa)
+		if equal != equalExpected {
+			t.Fatalf("unexpected equal for swapped args; got %v; want %v", equal, equalExpected)
+		}
+		if !equal && (x != xExpected || inA == inSExpected) {
+			t.Fatalf("unexpected first diff for swapped args; got x=%d, inS=%v; want x=%d, inS=%v", x, inA, xExpected, !inSExpected)
+		}
+	}
+	newSet := func(a []uint64) *Set {
+		var s Set
+		s.AddMulti(a)
+		return &s
+	}
+
+	// nil and empty sets
+	var sNil *Set
+	f(sNil, sNil)
+	f(sNil, &Set{})
+	f(sNil, newSet([]uint64{123}))
+	f(newSet([]uint64{1 << 40}), &Set{})
+
+	// Sparse sets
+	f(newSet([]uint64{1, 2, 3}), newSet([]uint64{3, 2, 1}))
+	f(newSet([]uint64{1, 2, 3}), newSet([]uint64{1, 2, 4}))
+	f(newSet([]uint64{1, 2, 3}), newSet([]uint64{1, 2}))
+	f(newSet([]uint64{5 << 32, 1 << 32}), newSet([]uint64{1 << 32, 3 << 32}))
+	f(newSet([]uint64{1 << 16, 5}), newSet([]uint64{5, 1<<17 + 1}))
+
+	// Dense sets with a mismatch in the middle
+	sa := createRangeSet(1<<32, 2e5)
+	sb := createRangeSet(1<<32, 2e5)
+	f(sa, sb)
+	sb.Del(1<<32 + 123456)
+	f(sa, sb)
+	sa.Del(1<<32 + 123455)
+	f(sa, sb)
+
+	// Dense and sparse buckets with the same items
+	sa = createRangeSet(0, 1e5)
+	sb = createRangeSet(0, 1e5)
+	for i := 0; i < 1e5; i++ {
+		if i%(1<<16) > 10 {
+			sa.Del(uint64(i))
+			sb.Del(uint64(i))
+		}
+	}
+	sb.Optimize()
+	f(sa, sb)
+	sb.Add(1<<16 + 1000)
+	f(sa, sb)
+	sa.Add(1<<16 + 5000)
+	f(sa, sb)
+
+	// Empty buckets must be skipped
+	sa = newSet([]uint64{1, 1 << 32, 2 << 32})
+	sb = newSet([]uint64{1, 2 << 32, 3 << 32})
+	sa.Del(1 << 32)
+	f(sa, sb)
+	sb.Del(3 << 32)
+	f(sa, sb)
+
+	// Random sets
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		var a []uint64
+		for j := 0; j < 1+r.Intn(1000); j++ {
+			a = append(a, uint64(r.Intn(3))<<32|uint64(r.Intn(1<<17)))
+		}
+		sa := newSet(a)
+		sb := sa.Clone()
+		x := a[r.Intn(len(a))]
+		if r.Intn(2) == 0 {
+			sb.Del(x)
+		} else {
+			sb.Add(x + uint64(r.Intn(100)))
+		}
+		f(sa, sb)
+	}
+}
+
+func TestSetRangeStatus(t *testing.T) {
+	f := func(s *Set, lo, hi uint64) {
+		t.Helper()
+		presentExpected := 0
+		for _, x := range s.AppendTo(nil) {
+			if x >= lo && x < hi {
+				presentExpected++
+			}
+		}
+		fullExpected := lo >= hi || uint64(presentExpected) == hi-lo
+		present, full := s.RangeStatus(lo, hi)
+		if present != presentExpected || full != fullExpected {
+			t.Fatalf("unexpected RangeStatus(%d, %d); got %d, %v; want %d, %v", lo, hi, present, full, presentExpected, fullExpected)
+		}
+	}
+	newSet := func(a []uint64) *Set {
+		var s Set
+		s.AddMulti(a)
+		return &s
+	}
+
+	// Empty ranges
+	f(&Set{}, 5, 5)
+	f(&Set{}, 6, 5)
+	f(newSet([]uint64{5}), 5, 5)
+	f(newSet([]uint64{5}), 10, 2)
+
+	// Empty set
+	var sNil *Set
+	f(sNil, 0, 1)
+	f(&Set{}, 0, 1<<64-1)
+
+	// Sparse sets
+	s := newSet([]uint64{1, 2, 3, 5, 1 << 16, 1<<16 + 1, 1 << 32, 1<<64 - 1})
+	f(s, 1, 4)
+	f(s, 1, 5)
+	f(s, 0, 4)
+	f(s, 5, 6)
+	f(s, 1<<16, 1<<16+2)
+	f(s, 1<<16-1, 1<<16+2)
+	f(s, 0, 1<<64-1)
+	f(s, 1<<64-2, 1<<64-1)
+
+	// Full ranges spanning multiple dense buckets
+	s = createRangeSet(1<<32-1e5, 3e5)
+	f(s, 1<<32-1e5, 1<<32+2e5)
+	f(s, 1<<32-1e5, 1<<32+2e5+1)
+	f(s, 1<<32-1e5-1, 1<<32+2e5)
+	f(s, 1<<32-100, 1<<32+1<<17+3)
+	s.Del(1<<32 + 1<<16 + 5)
+	f(s, 1<<32-100, 1<<32+1<<17+3)
+	f(s, 1<<32+1<<16+6, 1<<32+2e5)
+}
+
+func TestSetAbsentCount(t *testing.T) {
+	f := func(s *Set, lo, hi, absentExpected uint64) {
+		t.Helper()
+		if absent := s.AbsentCount(lo, hi); absent != absentExpected {
+			t.Fatalf("unexpected AbsentCount(%d, %d); got %d; want %d", lo, hi, absent, absentExpected)
+		}
+	}
+	newSet := func(a []uint64) *Set {
+		var s Set
+		s.AddMulti(a)
+		return &s
+	}
+
+	// Empty ranges
+	f(&Set{}, 5, 5, 0)
+	f(newSet([]uint64{5}), 10, 2, 0)
+
+	// Empty set
+	var sNil *Set
+	f(sNil, 0, 1, 1)
+	f(&Set{}, 0, 1<<64-1, 1<<64-1)
+	f(&Set{}, 1<<63, 1<<64-1, 1<<63-1)
+
+	// Sparse sets
+	s := newSet([]uint64{1, 2, 3, 5, 1 << 16, 1<<16 + 1, 1 << 32, 1<<64 - 1})
+	f(s, 1, 4, 0)
+	f(s, 0, 6, 2)
+	f(s, 0, 1<<64-1, 1<<64-1-7)
+	f(s, 1<<32, 1<<64-1, 1<<64-1-1<<32-1)
+	f(s, 1<<64-2, 1<<64-1, 1)
+
+	// Dense buckets
+	s = createRangeSet(1<<32-1e5, 3e5)
+	f(s, 1<<32-1e5, 1<<32+2e5, 0)
+	f(s, 1<<32-1e5-1, 1<<32+2e5+1, 2)
+	s.Del(1<<32 + 1<<16 + 5)
+	f(s, 1<<32-100, 1<<32+1<<17+3, 1)
+	f(s, 0, 1<<64-1, 1<<64-1-3e5+1)
+}
+
+func TestSetCountRanges(t *testing.T) {
+	f := func(a, bounds []uint64) {
+		t.Helper()
+		var s Set
+		s.AddMulti(a)
+		counts := s.CountRanges(bounds)
+		if len(bounds) < 2 {
+			if len(counts) != 0 {
+				t.Fatalf("unexpected counts for %d bounds; got %v; want empty", len(bounds), counts)
+			}
+			return
+		}
+		if len(counts) != len(bounds)-1 {
+			t.Fatalf("unexpected number of counts; got %d; want %d", len(counts), len(bounds)-1)
+		}
+		items := s.AppendTo(nil)
+		for i, n := range counts {
+			nExpected := 0
+			for _, x := range items {
+				if x >= bounds[i] && x < bounds[i+1] {
+					nExpected++
+				}
+			}
+			if n != nExpected {
+				t.Fatalf("unexpected count for [%d, %d); got %d; want %d", bounds[i], bounds[i+1], n, nExpected)
+			}
+		}
+	}
+	f(nil, nil)
+	f([]uint64{1, 2}, []uint64{0})
+	f(nil, []uint64{0, 10, 20})
+	f([]uint64{1, 2, 10, 15, 20, 25}, []uint64{0, 10, 20})
+	f([]uint64{1, 2, 10, 15, 20, 25}, []uint64{2, 2, 3, 10, 11, 1 << 40})
+	f([]uint64{1, 1 << 16, 1<<16 + 5, 1 << 32, 3 << 32, 1<<64 - 1}, []uint64{0, 1<<16 + 1, 1 << 33, 1<<64 - 1})
+	f([]uint64{1 << 16, 1 << 32, 3 << 32, 1<<64 - 2}, []uint64{1 << 40, 1 << 50})
+
+	var a []uint64
+	for i := 0; i < 1e5; i++ {
+		a = append(a, uint64(i*3))
+	}
+	for i := 0; i < 1e3; i++ {
+		a = append(a, uint64(rand.Int63()))
+	}
+	var bounds []uint64
+	for i := 0; i < 1000; i++ {
+		bounds = append(bounds, uint64(i)*317)
+	}
+	f(a, bounds)
+	f(a, []uint64{0, 1 << 16, 1 << 17, 1 << 62, 1 << 63})
+	bounds = bounds[:0]
+	for i := 0; i < 100; i++ {
+		bounds = append(bounds, uint64(i)<<57)
+	}
+	f(a, bounds)
+}
+
+func TestPairwiseIntersectCounts(t *testing.T) {
+	f := func(aa [][]uint64) {
+		t.Helper()
+		var sets []*Set
+		var ms []map[uint64]bool
+		for _, a := range aa {
+			var s *Set
+			m := make(map[uint64]bool)
+			if a != nil {
+				s = &Set{}
+				s.AddMulti(a)
+				for _, x := range a {
+					m[x] = true
+				}
+			}
+			sets = append(sets, s)
+			ms = append(ms, m)
+		}
+		var origs []*Set
+		for _, s := range sets {
+			origs = append(origs, s.Clone())
+		}
+		counts := PairwiseIntersectCounts(sets)
+		if len(counts) != len(sets) {
+			t.Fatalf("unexpected number of rows; got %d; want %d", len(counts), len(sets))
+		}
+		for i := range sets {
+			if len(counts[i]) != len(sets) {
+				t.Fatalf("unexpected number of columns in row %d; got %d; want %d", i, len(counts[i]), len(sets))
+			}
+			for j := range sets {
+				n := 0
+				for x := range ms[i] {
+					if ms[j][x] {
+						n++
+					}
+				}
+				if counts[i][j] != n {
+					t.Fatalf("unexpected count at [%d][%d]; got %d; want %d", i, j, counts[i][j], n)
+				}
+			}
+		}
+		for i, s := range sets {
+			if !s.Equal(origs[i]) {
+				t.Fatalf("set #%d has been modified", i)
+			}
+		}
+	}
+	f(nil)
+	f([][]uint64{nil})
+	f([][]uint64{{1, 2, 3}})
+	f([][]uint64{{1, 2, 3}, nil, {2, 3, 4}, {}})
+	f([][]uint64{{1, 1 << 16, 1 << 32}, {1 << 16, 1 << 32, 1 << 40}, {1 << 40, 1<<64 - 1}})
+
+	// Mixed small and dense buckets
+	var aa [][]uint64
+	for i := 0; i < 10; i++ {
+		var a []uint64
+		for j := 0; j < 1e4; j++ {
+			a = append(a, uint64(rand.Intn(1e5)), uint64(rand.Intn(10))<<32|uint64(rand.Intn(1e3)))
+		}
+		aa = append(aa, a)
+	}
+	f(aa)
+
+	// Sets with deleted items
+	var sa, sb Set
+	for i := 0; i < 100; i++ {
+		sa.Add(uint64(i) << 16)
+		sb.Add(uint64(i) << 16)
+	}
+	for i := 0; i < 100; i += 2 {
+		sa.Del(uint64(i) << 16)
+	}
+	counts := PairwiseIntersectCounts([]*Set{&sa, &sb})
+	if counts[0][1] != 50 || counts[1][0] != 50 || counts[0][0] != 50 || counts[1][1] != 100 {
+		t.Fatalf("unexpected counts for sets with deleted items: %v", counts)
+	}
+}
+
+func TestConcatDisjoint(t *testing.T) {
+	f := func(aa [][]uint64) {
+		t.Helper()
+		var sets []*Set
+		m := make(map[uint64]bool)
+		for _, a := range aa {
+			var s Set
+			s.AddMulti(a)
+			sets = append(sets, &s)
+			for _, x := range a {
+				m[x] = true
+			}
+		}
+		var origs []*Set
+		for _, s := range sets {
+			origs = append(origs, s.Clone())
+		}
+		result := ConcatDisjoint(sets...)
+		if err := expectEqual(result, m); err != nil {
+			t.Fatalf("unexpected result: %s", err)
+		}
+		for i, s := range sets {
+			if !s.Equal(origs[i]) {
+				t.Fatalf("ConcatDisjoint mustn't modify set #%d", i)
+			}
+		}
+
+		// Verify the result doesn't share memory with the sets.
+		result.AddMulti([]uint64{0, 1, 1 << 32, 1<<64 - 1})
+		result.Del(1 << 33)
+		for i, s := range sets {
+			if !s.Equal(origs[i]) {
+				t.Fatalf("modifying the result of ConcatDisjoint mustn't modify set #%d", i)
+			}
+		}
+	}
+	f(nil)
+	f([][]uint64{nil, nil})
+	f([][]uint64{{1, 2, 3}})
+	f([][]uint64{{5 << 32, 5<<32 + 1}, nil, {1 << 32}, {3<<32 + 7, 4 << 32}})
+
+	// Sets sharing prefixes
+	f([][]uint64{{1, 2, 3}, {3, 4, 5}, {1 << 33}, {5, 1 << 16, 1<<33 + 1}})
+
+	// Dense buckets
+	var aa [][]uint64
+	for i := 0; i < 10; i++ {
+		var a []uint64
+		for j := 0; j < 1e4; j++ {
+			a = append(a, uint64(10-i)<<32|uint64(j*2))
+		}
+		aa = append(aa, a)
+	}
+	f(aa)
+	f(append(aa, aa[3][:100], aa[5]))
+}
+
+func TestSetShrinkBucket(t *testing.T) {
+	var s Set
+	m := make(map[uint64]bool)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 1e5; j++ {
+			x := uint64(i)<<32 | uint64(j)
+			s.Add(x)
+			m[x] = true
+		}
+	}
+	// Delete the majority of items from the bucket with hi=1.
+	for j := 0; j < 1e5; j++ {
+		if j%4000 != 0 || j >= 9e4 {
+			x := uint64(1)<<32 | uint64(j)
+			s.Del(x)
+			delete(m, x)
+		}
+	}
+	sizeBefore := s.SizeBytes()
+	other := s.buckets[0]
+	if s.buckets[0].hi != 0 {
+		t.Fatalf("unexpected order of buckets")
+	}
+	otherBits := other.buckets[0].bits
+
+	if s.ShrinkBucket(10) {
+		t.Fatalf("ShrinkBucket must return false for missing bucket")
+	}
+	if !s.ShrinkBucket(1) {
+		t.Fatalf("ShrinkBucket must return true for existing bucket")
+	}
+	if err := expectEqual(&s, m); err != nil {
+		t.Fatalf("unexpected set after ShrinkBucket: %s", err)
+	}
+	if n := s.SizeBytes(); n >= sizeBefore {
+		t.Fatalf("ShrinkBucket must reduce SizeBytes(); got %d; want less than %d", n, sizeBefore)
+	}
+	b32 := s.getBucket32(1)
+	for i, b16 := range b32.buckets {
+		if b16.bits != nil {
+			t.Fatalf("bucket16 #%d must be converted to small pool", i)
+		}
+	}
+	if len(b32.buckets) != cap(b32.buckets) || len(b32.b16his) != cap(b32.b16his) {
+		t.Fatalf("the capacity of bucket lists must be trimmed")
+	}
+	if s.buckets[0].buckets[0].bits != otherBits {
+		t.Fatalf("ShrinkBucket mustn't touch other buckets")
+	}
+
+	// Shrink the bucket without items
+	for j := 0; j < 1e5; j++ {
+		x := uint64(2)<<32 | uint64(j)
+		s.Del(x)
+		delete(m, x)
+	}
+	if !s.ShrinkBucket(2) {
+		t.Fatalf("ShrinkBucket must return true for existing bucket")
+	}
+	if s.getBucket32(2) != nil {
+		t.Fatalf("empty bucket must be removed")
+	}
+	if err := expectEqual(&s, m); err != nil {
+		t.Fatalf("unexpected set after ShrinkBucket: %s", err)
+	}
+}
+
+func TestSetAlwaysDense(t *testing.T) {
+	expectDense := func(s *Set) {
+		t.Helper()
+		for i := range s.buckets {
+			for j, b16 := range s.buckets[i].buckets {
+				if b16.bits == nil {
+					t.Fatalf("bucket16 #%d at bucket32 #%d must have bits array in alwaysDense mode", j, i)
+				}
+			}
+		}
+	}
+	var s Set
+	m := make(map[uint64]bool)
+	s.Add(1)
+	s.Add(1 << 32)
+	m[1] = true
+	m[1<<32] = true
+
+	// Existing buckets must be switched to bits arrays.
+	s.SetAlwaysDense(true)
+	expectDense(&s)
+
+	for _, x := range []uint64{2, 1 << 16, 3 << 16, 1<<32 + 5, 2 << 32, 1<<64 - 1} {
+		s.Add(x)
+		m[x] = true
+	}
+	expectDense(&s)
+	var a []uint64
+	for i := 0; i < 1000; i++ {
+		a = append(a, uint64(i)<<20)
+	}
+	s.AddMulti(a)
+	for _, x := range a {
+		m[x] = true
+	}
+	expectDense(&s)
+	if err := expectEqual(&s, m); err != nil {
+		t.Fatalf("unexpected set in alwaysDense mode: %s", err)
+	}
+
+	// The mode must be preserved by Clone.
+	sc := s.Clone()
+	sc.Add(5 << 40)
+	expectDense(sc)
+
+	// Optimize and ShrinkBucket mustn't drop bits arrays.
+	s.Del(1<<32 + 5)
+	delete(m, 1<<32+5)
+	s.ShrinkBucket(1)
+	expectDense(&s)
+	s.Optimize()
+	expectDense(&s)
+	if err := expectEqual(&s, m); err != nil {
+		t.Fatalf("unexpected set after Optimize in alwaysDense mode: %s", err)
+	}
+
+	// Bulk operations must switch new buckets to bits arrays.
+	var sa Set
+	sa.AddMulti([]uint64{3, 10 << 32, 11<<32 + 1, 11<<32 + 1<<16})
+	for _, x := range sa.AppendTo(nil) {
+		m[x] = true
+	}
+	s.Union(&sa)
+	expectDense(&s)
+	s.UnionMayOwn(sa.Clone())
+	expectDense(&s)
+	s.UnionRange(&sa, 11<<32, 12<<32)
+	expectDense(&s)
+	s.ReplaceRange(&sa, 10<<32, 11<<32)
+	expectDense(&s)
+	if err := expectEqual(&s, m); err != nil {
+		t.Fatalf("unexpected set after bulk operations in alwaysDense mode: %s", err)
+	}
+	var sd Set
+	sd.SetAlwaysDense(true)
+	sa.CloneInto(&sd)
+	expectDense(&sd)
+	sd.UnionRange(&sa, 0, 1<<64-1)
+	expectDense(&sd)
+	data, err := sa.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error in MarshalBinary: %s", err)
+	}
+	if err := sd.UnmarshalBinary(data); err != nil {
+		t.Fatalf("unexpected error in UnmarshalBinary: %s", err)
+	}
+	expectDense(&sd)
+	if !sd.Equal(&sa) {
+		t.Fatalf("unexpected set after UnmarshalBinary in alwaysDense mode")
+	}
+
+	// Disable the mode
+	s.SetAlwaysDense(false)
+	s.Add(7 << 32)
+	if b16 := s.getBucket32(7).getBucket16(0); b16.bits != nil {
+		t.Fatalf("bucket16 mustn't have bits array after disabling alwaysDense mode")
+	}
+}
+
+func TestUnionMayOwnN(t *testing.T) {
+	f := func(aa [][]uint64) {
+		t.Helper()
+		var sets []*Set
+		m := make(map[uint64]bool)
+		for _, a := range aa {
+			var s Set
+			s.AddMulti(a)
+			sets = append(sets, &s)
+			for _, x := range a {
+				m[x] = true
+			}
+		}
+		result := UnionMayOwnN(sets...)
+		if err := expectEqual(result, m); err != nil {
+			t.Fatalf("unexpected result: %s", err)
+		}
+		// Verify the result can be modified.
+		result.AddMulti([]uint64{0, 1 << 32, 1<<64 - 1})
+		m[0] = true
+		m[1<<32] = true
+		m[1<<64-1] = true
+		if err := expectEqual(result, m); err != nil {
+			t.Fatalf("unexpected result after the modification: %s", err)
+		}
+	}
+	f(nil)
+	f([][]uint64{nil, nil})
+	f([][]uint64{{1, 2, 3}})
+	f([][]uint64{{5 << 32, 5<<32 + 1}, nil, {1 << 32}, {3<<32 + 7, 4 << 32}})
+	f([][]uint64{{1, 2, 3}, {3, 4, 5}, {1 << 33}, {5, 1 << 16, 1<<33 + 1}})
+
+	// Dense buckets
+	var aa [][]uint64
+	for i := 0; i < 10; i++ {
+		var a []uint64
+		for j := 0; j < 1e4*(i+1); j++ {
+			a = append(a, uint64(i%4)<<32|uint64(j*(i+1)))
+		}
+		aa = append(aa, a)
+	}
+	f(aa)
+
+	// Read-only sets cannot be owned.
+	var s Set
+	for i := 0; i < 1e5; i++ {
+		s.Add(uint64(i) * 3)
+	}
+	s.Add(5 << 32)
+	data, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error in MarshalBinary: %s", err)
+	}
+	sr, err := NewReadOnlyFromBytes(newAlignedBytes(data))
+	if err != nil {
+		t.Fatalf("unexpected error in NewReadOnlyFromBytes: %s", err)
+	}
+	var sb Set
+	sb.Add(7 << 32)
+	result := UnionMayOwnN(sr, &sb)
+	result.Add(1)
+	result.Add(5<<32 + 1)
+	if !sr.Equal(&s) {
+		t.Fatalf("UnionMayOwnN mustn't modify read-only set")
+	}
+	if n := result.Len(); n != s.Len()+3 {
+		t.Fatalf("unexpected number of items in the result; got %d; want %d", n, s.Len()+3)
+	}
+}
+
+func TestSetOptimize(t *testing.T) {
+	f := func(name string, s *Set, mustShrink bool) {
+		t.Helper()
+		m := make(map[uint64]bool)
+		s.ForEach(func(part []uint64) bool {
+			for _, x := range part {
+				m[x] = true
+			}
+			return true
+		})
+		sizeBefore := s.SizeBytes()
+		s.Optimize()
+		if err := expectEqual(s, m); err != nil {
+			t.Fatalf("%s: unexpected set after Optimize: %s", name, err)
+		}
+		sizeAfter := s.SizeBytes()
+		if mustShrink && sizeAfter >= sizeBefore {
+			t.Fatalf("%s: Optimize must reduce SizeBytes(); got %d; want less than %d", name, sizeAfter, sizeBefore)
+		}
+		if !mustShrink && sizeAfter > sizeBefore {
+			t.Fatalf("%s: Optimize mustn't increase SizeBytes(); got %d; want up to %d", name, sizeAfter, sizeBefore)
+		}
+		if len(s.buckets) != cap(s.buckets) {
+			t.Fatalf("%s: the capacity of bucket32 list must be trimmed; len=%d, cap=%d", name, len(s.buckets), cap(s.buckets))
+		}
+		for i := range s.buckets {
+			b32 := &s.buckets[i]
+			if len(b32.buckets) == 0 {
+				t.Fatalf("%s: empty bucket32 must be removed", name)
+			}
+			if len(b32.buckets) != cap(b32.buckets) || len(b32.b16his) != cap(b32.b16his) {
+				t.Fatalf("%s: the capacity of bucket16 lists must be trimmed", name)
+			}
+			for j, b16 := range b32.buckets {
+				if b16.isEmpty() {
+					t.Fatalf("%s: empty bucket16 #%d must be removed", name, j)
+				}
+				if b16.bits != nil && b16.getLen() <= smallPoolSize {
+					t.Fatalf("%s: sparse bucket16 #%d must be converted to small pool", name, j)
+				}
+			}
+		}
+
+		// Optimize must be idempotent.
+		s.Optimize()
+		if n := s.SizeBytes(); n != sizeAfter {
+			t.Fatalf("%s: unexpected SizeBytes() after the second Optimize; got %d; want %d", name, n, sizeAfter)
+		}
+
+		// The set must remain usable after Optimize.
+		x := uint64(1<<64 - 1)
+		s.Add(x)
+		m[x] = true
+		if err := expectEqual(s, m); err != nil {
+			t.Fatalf("%s: unexpected set after adding an item to optimized set: %s", name, err)
+		}
+	}
+
+	// Empty set
+	f("empty", &Set{}, false)
+
+	// Already optimal contiguous range spanning many dense buckets.
+	f("contiguous", createRangeSet(1<<32, 1e6), false)
+
+	// Set with all the items deleted.
+	s := createRangeSet(0, 1e5)
+	s.Union(createRangeSet(5<<32, 1e5))
+	for i := 0; i < 1e5; i++ {
+		s.Del(uint64(i))
+		s.Del(5<<32 | uint64(i))
+	}
+	f("all-deleted", s, true)
+
+	// Dense buckets with a few remaining items.
+	s = createRangeSet(0, 1e6)
+	for i := 0; i < 1e6; i++ {
+		if i%(1<<16) != 0 {
+			s.Del(uint64(i))
+		}
+	}
+	f("sparse-dense", s, true)
+
+	// Many bucket32 items, where only a single bucket32 remains.
+	s = &Set{}
+	for i := 0; i < 100; i++ {
+		s.Add(uint64(i) << 32)
+	}
+	for i := 1; i < 100; i++ {
+		s.Del(uint64(i) << 32)
+	}
+	sc := s.Clone()
+	f("single-remaining-bucket32", s, true)
+	sc.Optimize()
+	if !sc.hasScratchBuckets() {
+		t.Fatalf("the remaining bucket32 must be moved to Set.scratchBuckets")
+	}
+
+	// Sticky dense set keeps empty bits arrays until Optimize is called.
+	s = &Set{}
+	s.SetStickyDense(true)
+	for i := 0; i < 1e5; i++ {
+		s.Add(uint64(i))
+	}
+	for i := 0; i < 1e5; i++ {
+		if i != 12345 {
+			s.Del(uint64(i))
+		}
+	}
+	f("sticky-dense", s, true)
+}
@@ -1,7 +1,11 @@
 package uint64set
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"sort"
 	"testing"
 	"time"
 
@@ -444,6 +448,77 @@ func BenchmarkSetHasMiss(b *testing.B) {
 	}
 }
 
+func BenchmarkSetHasManyPrefixes(b *testing.B) {
+	for _, prefixesCount := range []int{10, 100, 1e3, 50e3} {
+		b.Run(fmt.Sprintf("prefixes_%d", prefixesCount), func(b *testing.B) {
+			// Add items with distinct high 32 bits in random order.
+			var rng fastrand.RNG
+			a := make([]uint64, prefixesCount)
+			for i := range a {
+				a[i] = uint64(i)<<32 | uint64(rng.Uint32())
+			}
+			for i := range a {
+				j := i + int(rng.Uint32n(uint32(len(a)-i)))
+				a[i], a[j] = a[j], a[i]
+			}
+			var s Set
+			for _, x := range a {
+				s.Add(x)
+			}
+
+			b.ResetTimer()
+			b.ReportAllocs()
+			b.SetBytes(int64(len(a)))
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					for _, x := range a {
+						if !s.Has(x) {
+							panic(fmt.Errorf("BUG: missing item %d", x))
+						}
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkSetClusteredPrefixes measures the performance of operations, which are clustered by high 32 bits of items.
+func BenchmarkSetClusteredPrefixes(b *testing.B) {
+	for _, prefixesCount := range []int{1, 8, 64, 1024} {
+		b.Run(fmt.Sprintf("prefixes_%d", prefixesCount), func(b *testing.B) {
+			// Every prefix is visited by a run of items in random order of prefixes.
+			var rng fastrand.RNG
+			a := make([]uint64, 0, 1e5)
+			for len(a) < cap(a) {
+				hi := uint64(rng.Uint32n(uint32(prefixesCount))) << 32
+				for i := 0; i < 100; i++ {
+					a = append(a, hi|uint64(rng.Uint32n(1e4)))
+				}
+			}
+
+			b.ResetTimer()
+			b.ReportAllocs()
+			b.SetBytes(int64(len(a)))
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					var s Set
+					for _, x := range a {
+						s.Add(x)
+					}
+					for _, x := range a {
+						if !s.Has(x) {
+							panic(fmt.Errorf("BUG: missing item %d", x))
+						}
+					}
+					for _, x := range a {
+						s.Del(x)
+					}
+				}
+			})
+		})
+	}
+}
+
 func BenchmarkMapHasMiss(b *testing.B) {
 	for _, itemsCount := range []uint64{1e3, 1e4, 1e5, 1e6, 1e7} {
 		b.Run(fmt.Sprintf("items_%d", itemsCount), func(b *testing.B) {
@@ -474,3 +549,742 @@ func BenchmarkMapHasMiss(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkForEach(b *testing.B) {
+	s := createSparseBucketsSet(1e5)
+	b.ReportAllocs()
+	b.SetBytes(int64(s.Len()))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.ForEach(func(part []uint64) bool {
+				return true
+			})
+		}
+	})
+}
+
+func BenchmarkForEachUnordered(b *testing.B) {
+	s := createSparseBucketsSet(1e5)
+	b.ReportAllocs()
+	b.SetBytes(int64(s.Len()))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.ForEachUnordered(func(part []uint64) bool {
+				return true
+			})
+		}
+	})
+}
+
+func BenchmarkForEachSmallSets(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		n := uint64(0)
+		for pb.Next() {
+			var s Set
+			for i := uint64(0); i < 10; i++ {
+				s.Add(n<<16 | i)
+			}
+			s.ForEach(func(part []uint64) bool {
+				return true
+			})
+			n++
+		}
+	})
+	// Report the memory occupied by a single buffer in partBufPool.
+	xbuf := partBufPool.Get().(*[]uint64)
+	b.ReportMetric(float64(8*cap(*xbuf)), "partBufBytes")
+	partBufPool.Put(xbuf)
+}
+
+// createSparseBucketsSet returns a set with itemsCount items stored in small pools.
+func createSparseBucketsSet(itemsCount int) *Set {
+	var s Set
+	for i := 0; i < itemsCount; i++ {
+		// Put items in reverse order into each bucket16, so they must be sorted by ForEach.
+		n := uint64(i/32)<<16 | uint64(32-i%32)
+		s.Add(n)
+	}
+	return &s
+}
+
+func BenchmarkContainsAll(b *testing.B) {
+	start := uint64(time.Now().UnixNano())
+	sa := createRangeSet(start, 1e7)
+	xs := []uint64{start + 10, start + 1e3, start + 1e5, start + 1e6, start + 5e6}
+	b.Run("ContainsAll", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(xs)))
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if !sa.ContainsAll(xs) {
+					panic("BUG: unexpected result")
+				}
+			}
+		})
+	})
+	b.Run("Intersect", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(xs)))
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				var s Set
+				s.AddMulti(xs)
+				s.Intersect(sa)
+				if s.Len() != len(xs) {
+					panic("BUG: unexpected result")
+				}
+			}
+		})
+	})
+}
+
+func BenchmarkClone(b *testing.B) {
+	start := uint64(time.Now().UnixNano())
+	sa := createRangeSet(start, 1e6)
+	b.Run("Clone", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(sa.Len()))
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				s := sa.Clone()
+				if s.Len() != sa.Len() {
+					panic("BUG: unexpected number of items")
+				}
+			}
+		})
+	})
+	b.Run("CloneInto", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(sa.Len()))
+		b.RunParallel(func(pb *testing.PB) {
+			var s Set
+			for pb.Next() {
+				sa.CloneInto(&s)
+				if s.Len() != sa.Len() {
+					panic("BUG: unexpected number of items")
+				}
+			}
+		})
+	})
+}
+
+// BenchmarkAddManyPrefixes measures the performance of adding items with many distinct high 32 bits
+// with and without keepSorted mode.
+func BenchmarkAddManyPrefixes(b *testing.B) {
+	for _, prefixesCount := range []int{4, 16, 64, 256, 1024} {
+		var rng fastrand.RNG
+		a := make([]uint64, 1e5)
+		for i := range a {
+			a[i] = uint64(rng.Uint32n(uint32(prefixesCount)))<<32 | uint64(rng.Uint32n(1e3))
+		}
+		for _, keepSorted := range []bool{false, true} {
+			b.Run(fmt.Sprintf("prefixes_%d,keepSorted_%v", prefixesCount, keepSorted), func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(a)))
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						var s Set
+						s.SetKeepSorted(keepSorted)
+						for _, x := range a {
+							s.Add(x)
+						}
+						for _, x := range a {
+							if !s.Has(x) {
+								panic(fmt.Errorf("BUG: missing item %d", x))
+							}
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+// BenchmarkAddSparseBuckets measures the performance of adding items to sparse buckets
+// and reports the share of buckets switched to bits array.
+//
+// Run it with -tags=uint64set_smallpool_small or -tags=uint64set_smallpool_large
+// in order to compare the results for distinct smallPoolSize values.
+func BenchmarkAddSparseBuckets(b *testing.B) {
+	for _, itemsPerBucket := range []int{16, 32, 64, 128} {
+		b.Run(fmt.Sprintf("itemsPerBucket_%d", itemsPerBucket), func(b *testing.B) {
+			const bucketsCount = 1e3
+			var rng fastrand.RNG
+			a := make([]uint64, 0, bucketsCount*itemsPerBucket)
+			for i := 0; i < bucketsCount; i++ {
+				for j := 0; j < itemsPerBucket; j++ {
+					a = append(a, uint64(i)<<16|uint64(rng.Uint32n(1<<16)))
+				}
+			}
+			var s Set
+			s.AddMulti(a)
+			denseBuckets := 0
+			for i := range s.buckets {
+				for _, b16 := range s.buckets[i].buckets {
+					if b16.bits != nil {
+						denseBuckets++
+					}
+				}
+			}
+
+			b.ResetTimer()
+			b.ReportAllocs()
+			b.SetBytes(int64(len(a)))
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					var s Set
+					for _, x := range a {
+						s.Add(x)
+					}
+				}
+			})
+			b.ReportMetric(float64(denseBuckets)/bucketsCount, "dense_buckets_share")
+			b.ReportMetric(float64(s.SizeBytes())/float64(s.Len()), "bytes/item")
+		})
+	}
+}
+
+func BenchmarkDelMulti(b *testing.B) {
+	for _, itemsCount := range []int{1e3, 1e4, 1e5, 1e6} {
+		start := uint64(time.Now().UnixNano())
+		sa := createRangeSet(start, itemsCount)
+		a := sa.AppendTo(nil)
+		b.Run(fmt.Sprintf("Del/items_%d", itemsCount), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(a)))
+			b.RunParallel(func(pb *testing.PB) {
+				var s Set
+				for pb.Next() {
+					sa.CloneInto(&s)
+					for _, x := range a {
+						s.Del(x)
+					}
+				}
+			})
+		})
+		b.Run(fmt.Sprintf("DelMulti/items_%d", itemsCount), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(a)))
+			b.RunParallel(func(pb *testing.PB) {
+				var s Set
+				for pb.Next() {
+					sa.CloneInto(&s)
+					s.DelMulti(a)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkStickyDenseChurn(b *testing.B) {
+	start := uint64(time.Now().UnixNano())
+	sa := createRangeSet(start, 1e5)
+	a := sa.AppendTo(nil)
+	lo := a[0]
+	hi := a[len(a)-1] + 1
+	for _, stickyDense := range []bool{false, true} {
+		b.Run(fmt.Sprintf("stickyDense_%v", stickyDense), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(a)))
+			b.RunParallel(func(pb *testing.PB) {
+				var s Set
+				s.SetStickyDense(stickyDense)
+				for pb.Next() {
+					s.AddMulti(a)
+					s.ReplaceRange(nil, lo, hi)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkUnionDenseIntoSparse(b *testing.B) {
+	for _, itemsCount := range []int{1e5, 1e6} {
+		start := uint64(time.Now().UnixNano())
+		sa := createRangeSet(start, itemsCount)
+		var sb Set
+		for x := start; x < start+uint64(itemsCount); x += 1 << 12 {
+			sb.Add(x)
+		}
+		b.Run(fmt.Sprintf("items_%d", itemsCount), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(sa.Len() + sb.Len()))
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					sbCopy := sb.Clone()
+					sbCopy.Union(sa)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkUnionSmart(b *testing.B) {
+	start := uint64(time.Now().UnixNano())
+	var sBig, sSmall Set
+	for i := 0; i < 1e5; i++ {
+		sBig.Add(start + uint64(i)*1e5)
+	}
+	for i := 0; i < 10; i++ {
+		sSmall.Add(start + uint64(i)*1e7)
+	}
+	f := func(name string, sa, sb *Set, union func(s, a *Set)) {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(sa.Len() + sb.Len()))
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					s := sa.Clone()
+					union(s, sb)
+				}
+			})
+		})
+	}
+	f("Union/small_into_big", &sBig, &sSmall, (*Set).Union)
+	f("Union/big_into_small", &sSmall, &sBig, (*Set).Union)
+	f("UnionSmart/small_into_big", &sBig, &sSmall, (*Set).UnionSmart)
+	f("UnionSmart/big_into_small", &sSmall, &sBig, (*Set).UnionSmart)
+}
+
+func BenchmarkUnionManyBuckets(b *testing.B) {
+	var sa Set
+	for i := 0; i < 1e4; i++ {
+		sa.Add(uint64(i) << 32)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(sa.Len()))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			var s Set
+			s.Add(1e4 << 32)
+			s.Union(&sa)
+		}
+	})
+}
+
+func BenchmarkSetBuilder(b *testing.B) {
+	// Mixed density: a dense range followed by sparse items.
+	var a []uint64
+	start := uint64(time.Now().UnixNano())
+	for i := 0; i < 1e6; i++ {
+		a = append(a, start+uint64(i))
+	}
+	for i := 0; i < 1e5; i++ {
+		a = append(a, start+1e6+uint64(i)*1e4)
+	}
+	b.Run("AddMulti", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(a)))
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				var s Set
+				s.AddMulti(a)
+			}
+		})
+	})
+	b.Run("SetBuilder", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(a)))
+		b.RunParallel(func(pb *testing.PB) {
+			var sb SetBuilder
+			for pb.Next() {
+				sb.HintDense(start, start+1e6)
+				sb.AddMulti(a)
+				sb.Build()
+			}
+		})
+	})
+}
+
+func BenchmarkTruncateBelow(b *testing.B) {
+	// Create a set with dense items spread among many bucket32 items.
+	var sa Set
+	for i := 0; i < 64; i++ {
+		sa.AddMulti(createRangeSet(uint64(i)<<32, 1e5).AppendTo(nil))
+	}
+	x := uint64(60)<<32 + 5e4
+	var a []uint64
+	sa.ForEach(func(part []uint64) bool {
+		for _, v := range part {
+			if v < x {
+				a = append(a, v)
+			}
+		}
+		return true
+	})
+	b.Run("DelMulti", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			var s Set
+			for pb.Next() {
+				sa.CloneInto(&s)
+				s.DelMulti(a)
+			}
+		})
+	})
+	b.Run("TruncateBelow", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			var s Set
+			for pb.Next() {
+				sa.CloneInto(&s)
+				s.TruncateBelow(x)
+			}
+		})
+	})
+}
+
+func BenchmarkAddFromChan(b *testing.B) {
+	const itemsCount = 1e5
+	start := uint64(time.Now().UnixNano())
+	a := make([]uint64, itemsCount)
+	for i := range a {
+		a[i] = start + uint64(fastrand.Uint32n(1e7))
+	}
+	// Fill the channel in advance, so the benchmark doesn't depend on goroutine scheduling.
+	ch := make(chan uint64, itemsCount)
+	produce := func() <-chan uint64 {
+		for _, x := range a {
+			ch <- x
+		}
+		close(ch)
+		chResult := ch
+		ch = make(chan uint64, itemsCount)
+		return chResult
+	}
+	b.Run("Add", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(itemsCount)
+		for i := 0; i < b.N; i++ {
+			var s Set
+			for x := range produce() {
+				s.Add(x)
+			}
+		}
+	})
+	b.Run("SliceAddMulti", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(itemsCount)
+		for i := 0; i < b.N; i++ {
+			var s Set
+			var buf []uint64
+			for x := range produce() {
+				buf = append(buf, x)
+			}
+			s.AddMulti(buf)
+		}
+	})
+	b.Run("AddFromChan", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(itemsCount)
+		for i := 0; i < b.N; i++ {
+			var s Set
+			s.AddFromChan(produce())
+		}
+	})
+}
+
+func BenchmarkAddFromReader(b *testing.B) {
+	const itemsCount = 1e6
+	start := uint64(time.Now().UnixNano())
+	var data []byte
+	for i := 0; i < itemsCount; i++ {
+		data = marshalUint64(data, start+uint64(fastrand.Uint32n(1e8)))
+	}
+	b.Run("DecodeAddMulti", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(itemsCount)
+		for i := 0; i < b.N; i++ {
+			var s Set
+			r := bytes.NewReader(data)
+			buf, err := io.ReadAll(r)
+			if err != nil {
+				panic(fmt.Errorf("unexpected error: %w", err))
+			}
+			a := make([]uint64, 0, len(buf)/8)
+			for j := 0; j < len(buf); j += 8 {
+				a = append(a, binary.LittleEndian.Uint64(buf[j:]))
+			}
+			s.AddMulti(a)
+		}
+	})
+	b.Run("AddFromReader", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(itemsCount)
+		for i := 0; i < b.N; i++ {
+			var s Set
+			if _, err := s.AddFromReader(bytes.NewReader(data)); err != nil {
+				panic(fmt.Errorf("unexpected error: %w", err))
+			}
+		}
+	})
+}
+
+func BenchmarkAddSortedSlices(b *testing.B) {
+	const slicesCount = 16
+	const itemsPerSlice = 1e5
+	start := uint64(time.Now().UnixNano())
+	var slices [][]uint64
+	for i := 0; i < slicesCount; i++ {
+		// Interleave items from all the slices.
+		a := make([]uint64, itemsPerSlice)
+		x := start + uint64(i)
+		for j := range a {
+			a[j] = x
+			x += uint64(slicesCount * (1 + fastrand.Uint32n(8)))
+		}
+		slices = append(slices, a)
+	}
+	b.Run("AddMultiPerSlice", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(slicesCount * itemsPerSlice)
+		for i := 0; i < b.N; i++ {
+			var s Set
+			for _, a := range slices {
+				s.AddMulti(a)
+			}
+		}
+	})
+	b.Run("ConcatSortAddMulti", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(slicesCount * itemsPerSlice)
+		for i := 0; i < b.N; i++ {
+			var s Set
+			var a []uint64
+			for _, slice := range slices {
+				a = append(a, slice...)
+			}
+			sort.Slice(a, func(i, j int) bool { return a[i] < a[j] })
+			s.AddMulti(a)
+		}
+	})
+	b.Run("AddSortedSlices", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(slicesCount * itemsPerSlice)
+		for i := 0; i < b.N; i++ {
+			var s Set
+			s.AddSortedSlices(slices...)
+		}
+	})
+}
+
+func BenchmarkGetPutSet(b *testing.B) {
+	a := []uint64{1 << 16, 1 << 20, 1 << 32, 2<<32 + 5}
+	for i := 0; i < 1000; i++ {
+		// Dense bucket
+		a = append(a, uint64(i))
+	}
+	b.Run("NewSet", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				s := &Set{}
+				s.AddMulti(a)
+				if s.Len() != len(a) {
+					panic("BUG: unexpected number of items")
+				}
+			}
+		})
+	})
+	b.Run("GetPutSet", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				s := GetSet()
+				s.AddMulti(a)
+				if s.Len() != len(a) {
+					panic("BUG: unexpected number of items")
+				}
+				PutSet(s)
+			}
+		})
+	})
+}
+
+func BenchmarkAddAfterStructuralChanges(b *testing.B) {
+	start := uint64(time.Now().UnixNano())
+	sa := createRangeSet(start, 1e6)
+	sb := createRangeSet(start+5e5, 1e6)
+	a := createRangeSet(start+8e5, 1e5).AppendTo(nil)
+	b.Run("Intersect", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(a)))
+		b.RunParallel(func(pb *testing.PB) {
+			var s Set
+			for pb.Next() {
+				sa.CloneInto(&s)
+				s.Intersect(sb)
+				for _, x := range a {
+					s.Add(x)
+				}
+			}
+		})
+	})
+	b.Run("TruncateBelow", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(a)))
+		b.RunParallel(func(pb *testing.PB) {
+			var s Set
+			for pb.Next() {
+				sa.CloneInto(&s)
+				s.Add(start + 9e5)
+				s.TruncateBelow(start + 5e5)
+				for _, x := range a {
+					s.Add(x)
+				}
+			}
+		})
+	})
+}
+
+func BenchmarkConcatDisjoint(b *testing.B) {
+	var sets []*Set
+	for i := 0; i < 100; i++ {
+		sets = append(sets, createRangeSet(uint64(i)<<32, 1e4))
+	}
+	b.Run("Union", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				var s Set
+				for _, a := range sets {
+					s.Union(a)
+				}
+			}
+		})
+	})
+	b.Run("ConcatDisjoint", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				ConcatDisjoint(sets...)
+			}
+		})
+	})
+}
+
+func BenchmarkAddAlwaysDense(b *testing.B) {
+	const itemsCount = 1e6
+	start := uint64(time.Now().UnixNano())
+	// Every bucket16 receives 512 items, so it becomes dense.
+	a := make([]uint64, itemsCount)
+	for i := range a {
+		a[i] = start + uint64(i)*128
+	}
+	for _, alwaysDense := range []bool{false, true} {
+		b.Run(fmt.Sprintf("alwaysDense_%v", alwaysDense), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(a)))
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					var s Set
+					s.SetAlwaysDense(alwaysDense)
+					for _, x := range a {
+						s.Add(x)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkPairwiseIntersectCounts(b *testing.B) {
+	var sets []*Set
+	for i := 0; i < 100; i++ {
+		// Sparse sets spread over many prefixes, which are shared only by a few sets.
+		var s Set
+		for j := 0; j < 1000; j++ {
+			s.Add(uint64(fastrand.Uint32n(1e4))<<24 | uint64(fastrand.Uint32n(1<<16)))
+		}
+		sets = append(sets, &s)
+	}
+	b.Run("IntersectCount", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				for i, s := range sets {
+					for j := i + 1; j < len(sets); j++ {
+						s.intersectCount(sets[j])
+					}
+				}
+			}
+		})
+	})
+	b.Run("PairwiseIntersectCounts", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				PairwiseIntersectCounts(sets)
+			}
+		})
+	})
+}
+
+func BenchmarkUnionWithCallback(b *testing.B) {
+	var rng fastrand.RNG
+	var sa, sb Set
+	for i := 0; i < 1e5; i++ {
+		sa.Add(uint64(rng.Uint32n(1e6)))
+		sb.Add(uint64(rng.Uint32n(1e6)))
+	}
+	b.Run("Union", func(b *testing.B) {
+		benchmarkUnionWithCallback(b, &sa, &sb, func(s, a *Set) {
+			s.Union(a)
+		})
+	})
+	b.Run("nilCallbacks", func(b *testing.B) {
+		benchmarkUnionWithCallback(b, &sa, &sb, func(s, a *Set) {
+			s.UnionWithCallback(a, nil, nil)
+		})
+	})
+	b.Run("callbacks", func(b *testing.B) {
+		benchmarkUnionWithCallback(b, &sa, &sb, func(s, a *Set) {
+			n := 0
+			s.UnionWithCallback(a, func(x uint64) { n++ }, func(x uint64) { n-- })
+		})
+	})
+}
+
+func benchmarkUnionWithCallback(b *testing.B, sa, sb *Set, union func(s, a *Set)) {
+	b.ReportAllocs()
+	b.SetBytes(int64(sb.Len()))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			union(sa.Clone(), sb)
+		}
+	})
+}
+
+func BenchmarkUnionMayOwnN(b *testing.B) {
+	var sets []*Set
+	for i := 0; i < 16; i++ {
+		// Every set contains one private bucket32 and one bucket32 shared with all the other sets.
+		s := createRangeSet(uint64(i+1)<<32, 1e5)
+		s.Union(createRangeSet(uint64(i)*1e5, 1e5))
+		sets = append(sets, s)
+	}
+	b.Run("Union", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				var s Set
+				for _, a := range sets {
+					s.Union(a.Clone())
+				}
+			}
+		})
+	})
+	b.Run("UnionMayOwnN", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			owned := make([]*Set, len(sets))
+			for pb.Next() {
+				for i, a := range sets {
+					owned[i] = a.Clone()
+				}
+				UnionMayOwnN(owned...)
+			}
+		})
+	})
+}